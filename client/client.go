@@ -0,0 +1,408 @@
+// Package client is a Go client for kv-server. Reads can be hedged across
+// several server endpoints: if the first endpoint has not answered within
+// the hedge delay the same read is sent to the next one, and whichever
+// answers first wins.
+//
+// Payloads are compressed where it pays. Responses are gzipped by servers
+// that support it and decompressed by net/http, unless the HTTP client's
+// transport sets DisableCompression. Request bodies of at least
+// DefaultCompressMinBytes are gzipped once an endpoint has advertised that
+// it accepts gzip.
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrNotFound is returned when the key does not exist.
+var ErrNotFound = errors.New("key not found")
+
+// ErrExists is returned by Create when the key already exists.
+var ErrExists = errors.New("key already exists")
+
+// errEncodingRefused is returned by do when the server rejects a gzipped
+// body with 415.
+var errEncodingRefused = errors.New("kv-server refused a gzipped body")
+
+// DefaultCompressMinBytes is the smallest request body gzipped unless
+// WithCompression changes it.
+const DefaultCompressMinBytes = 1 << 10
+
+// Client talks to one or more kv-server endpoints serving the same data.
+type Client struct {
+	endpoints  []string
+	http       *http.Client
+	hedgeDelay time.Duration
+	apiKey     string
+	next       atomic.Uint64
+
+	compressMin int
+	// Hosts that have advertised Accept-Encoding: gzip, to true, or refused
+	// a gzipped body, to false
+	gzipHosts sync.Map
+
+	stats struct {
+		reads      atomic.Uint64
+		hedges     atomic.Uint64
+		hedgeWins  atomic.Uint64
+		compressed atomic.Uint64
+		bytesSaved atomic.Uint64
+	}
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithHTTPClient sets the HTTP client used for requests.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		c.http = hc
+	}
+}
+
+// WithHedgeDelay sets how long a read waits before sending a hedged request
+// to another endpoint. Zero disables hedging.
+func WithHedgeDelay(d time.Duration) Option {
+	return func(c *Client) {
+		c.hedgeDelay = d
+	}
+}
+
+// WithAPIKey sends key in the X-API-Key header of every request, for
+// servers with authentication on.
+func WithAPIKey(key string) Option {
+	return func(c *Client) {
+		c.apiKey = key
+	}
+}
+
+// WithCompression sets the smallest request body gzipped for endpoints
+// that accept it. Zero never compresses request bodies.
+func WithCompression(minBytes int) Option {
+	return func(c *Client) {
+		c.compressMin = minBytes
+	}
+}
+
+// New creates a client for the given base URLs, e.g. http://kv-1:8080.
+func New(endpoints []string, opts ...Option) (*Client, error) {
+	if len(endpoints) == 0 {
+		return nil, errors.New("client: at least one endpoint is required")
+	}
+	c := &Client{
+		endpoints:   endpoints,
+		http:        &http.Client{Timeout: 30 * time.Second},
+		compressMin: DefaultCompressMinBytes,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
+}
+
+// Stats counts reads and how often hedging paid off.
+type Stats struct {
+	Reads uint64
+	// Hedges is the number of extra requests sent after an attempt was slow
+	// or failed
+	Hedges uint64
+	// HedgeWins is the number of reads answered by such an extra request
+	HedgeWins uint64
+	// CompressedRequests is the number of request bodies sent gzipped, and
+	// RequestBytesSaved the bytes that kept off the wire
+	CompressedRequests uint64
+	RequestBytesSaved  uint64
+}
+
+// Stats returns the client's read counters.
+func (c *Client) Stats() Stats {
+	return Stats{
+		Reads:     c.stats.reads.Load(),
+		Hedges:    c.stats.hedges.Load(),
+		HedgeWins: c.stats.hedgeWins.Load(),
+
+		CompressedRequests: c.stats.compressed.Load(),
+		RequestBytesSaved:  c.stats.bytesSaved.Load(),
+	}
+}
+
+type response struct {
+	Success bool   `json:"success"`
+	Value   string `json:"value,omitempty"`
+	Error   string `json:"error,omitempty"`
+	// RequestID names the failed request in the server's logs
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// result is one attempt's outcome; hedged reports whether it was a hedge.
+type result struct {
+	value  string
+	err    error
+	hedged bool
+}
+
+// Get reads key. With hedging enabled, up to one request per endpoint is
+// sent, each after a further hedge delay without an answer, and the
+// remaining requests are cancelled once one succeeds or reports not found.
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	c.stats.reads.Add(1)
+
+	attempts := 1
+	if c.hedgeDelay > 0 {
+		attempts = len(c.endpoints)
+	}
+	start := int(c.next.Add(1) % uint64(len(c.endpoints)))
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan result, attempts)
+	launch := func(i int) {
+		endpoint := c.endpoints[(start+i)%len(c.endpoints)]
+		go func() {
+			value, err := c.get(ctx, endpoint, key)
+			results <- result{value: value, err: err, hedged: i > 0}
+		}()
+	}
+
+	launch(0)
+	sent, pending := 1, 1
+	var timer <-chan time.Time
+	if sent < attempts {
+		timer = time.After(c.hedgeDelay)
+	}
+
+	var lastErr error
+	for {
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-timer:
+			c.stats.hedges.Add(1)
+			launch(sent)
+			sent++
+			pending++
+			timer = nil
+			if sent < attempts {
+				timer = time.After(c.hedgeDelay)
+			}
+		case res := <-results:
+			pending--
+			if res.err == nil || errors.Is(res.err, ErrNotFound) {
+				if res.hedged {
+					c.stats.hedgeWins.Add(1)
+				}
+				return res.value, res.err
+			}
+			lastErr = res.err
+			// Fail over right away instead of waiting out the hedge delay
+			if sent < attempts {
+				c.stats.hedges.Add(1)
+				launch(sent)
+				sent++
+				pending++
+				timer = nil
+				if sent < attempts {
+					timer = time.After(c.hedgeDelay)
+				}
+			} else if pending == 0 {
+				return "", lastErr
+			}
+		}
+	}
+}
+
+func (c *Client) get(ctx context.Context, endpoint, key string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, keyURL(endpoint, key), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return "", err
+	}
+	return resp.Value, nil
+}
+
+// Put creates or overwrites key via the first endpoint.
+func (c *Client) Put(ctx context.Context, key, value string) error {
+	body, err := json.Marshal(map[string]string{"value": value})
+	if err != nil {
+		return err
+	}
+	_, err = c.sendJSON(ctx, http.MethodPut, keyURL(c.endpoints[0], key), body)
+	return err
+}
+
+// Create writes key via the first endpoint, failing with ErrExists if it
+// already exists.
+func (c *Client) Create(ctx context.Context, key, value string) error {
+	body, err := json.Marshal(map[string]string{"key": key, "value": value})
+	if err != nil {
+		return err
+	}
+	_, err = c.sendJSON(ctx, http.MethodPost, c.endpoints[0]+"/kv", body)
+	return err
+}
+
+// KeyValue is one pair of a batch write.
+type KeyValue struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	// TTLSeconds expires the key that many seconds after the write; zero
+	// keeps it until deleted
+	TTLSeconds int64 `json:"ttl_seconds,omitempty"`
+}
+
+// PutBatch creates or overwrites every pair via the first endpoint in one
+// transaction, so bulk imports take one round trip per batch. A batch is
+// usually large enough to be sent gzipped. It fails if any pair was
+// rejected; the valid ones are still written.
+func (c *Client) PutBatch(ctx context.Context, pairs []KeyValue) error {
+	body, err := json.Marshal(pairs)
+	if err != nil {
+		return err
+	}
+	_, err = c.sendJSON(ctx, http.MethodPost, c.endpoints[0]+"/kv/batch", body)
+	return err
+}
+
+// sendJSON sends a JSON body, gzipped when the endpoint accepts gzip and
+// the body is large enough and shrinks. If the server refuses the gzipped
+// body, compression is turned off for the endpoint and the body resent as
+// is.
+func (c *Client) sendJSON(ctx context.Context, method, target string, body []byte) (*response, error) {
+	send := func(body []byte, encoding string) (*response, error) {
+		req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if encoding != "" {
+			req.Header.Set("Content-Encoding", encoding)
+		}
+		return c.do(req)
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	gzipped := c.compress(u.Host, body)
+	if gzipped == nil {
+		return send(body, "")
+	}
+	resp, err := send(gzipped, "gzip")
+	if errors.Is(err, errEncodingRefused) {
+		c.gzipHosts.Store(u.Host, false)
+		return send(body, "")
+	}
+	if err == nil {
+		c.stats.compressed.Add(1)
+		c.stats.bytesSaved.Add(uint64(len(body) - len(gzipped)))
+	}
+	return resp, err
+}
+
+// compress returns body gzipped for host, or nil if it should be sent as
+// is.
+func (c *Client) compress(host string, body []byte) []byte {
+	if c.compressMin <= 0 || len(body) < c.compressMin {
+		return nil
+	}
+	if accepts, _ := c.gzipHosts.Load(host); accepts == nil || !accepts.(bool) {
+		return nil
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(body)
+	zw.Close()
+	if buf.Len() >= len(body) {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// Delete removes key via the first endpoint.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, keyURL(c.endpoints[0], key), nil)
+	if err != nil {
+		return err
+	}
+	_, err = c.do(req)
+	return err
+}
+
+func keyURL(endpoint, key string) string {
+	return endpoint + "/kv/" + url.PathEscape(key)
+}
+
+// do sends req and decodes the server's JSON envelope.
+func (c *Client) do(req *http.Request) (*response, error) {
+	if c.apiKey != "" {
+		req.Header.Set("X-API-Key", c.apiKey)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if acceptsGzip(resp.Header.Get("Accept-Encoding")) {
+		// A host that refused a gzipped body stays refused
+		c.gzipHosts.LoadOrStore(req.URL.Host, true)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return nil, ErrNotFound
+	case http.StatusConflict:
+		return nil, ErrExists
+	case http.StatusUnsupportedMediaType:
+		if req.Header.Get("Content-Encoding") != "" {
+			return nil, errEncodingRefused
+		}
+	}
+
+	var r response
+	if err := json.Unmarshal(body, &r); err != nil {
+		return nil, fmt.Errorf("kv-server replied %s: %w", resp.Status, err)
+	}
+	if resp.StatusCode >= 300 || !r.Success {
+		if r.Error == "" {
+			// A partly failed batch reports its errors per item
+			return nil, fmt.Errorf("kv-server replied %s", resp.Status)
+		}
+		if r.RequestID != "" {
+			return nil, fmt.Errorf("kv-server replied %s: %s (request %s)", resp.Status, r.Error, r.RequestID)
+		}
+		return nil, fmt.Errorf("kv-server replied %s: %s", resp.Status, r.Error)
+	}
+	return &r, nil
+}
+
+// acceptsGzip reports whether an Accept-Encoding header names gzip.
+func acceptsGzip(header string) bool {
+	for _, coding := range strings.Split(header, ",") {
+		coding, _, _ = strings.Cut(coding, ";")
+		if strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			return true
+		}
+	}
+	return false
+}
@@ -33,6 +33,7 @@ type LoadGenerator struct {
 	serverURL  string
 	workload   string
 	client     *http.Client
+	apiKey     string
 	stats      *Stats
 	fixedValue string
 }
@@ -51,6 +52,7 @@ func main() {
 	clients := flag.Int("clients", 0, "Number of concurrent clients (0 = auto loop mode)")
 	duration := flag.Int("duration", getEnvAsInt("LOAD_DURATION", 60), "Test duration in seconds")
 	workload := flag.String("workload", config.GetEnv("LOAD_WORKLOAD", "getput"), "Workload type: putall, getall, getpopular, getput")
+	apiKey := flag.String("api-key", config.GetEnv("LOAD_API_KEY", ""), "API key sent in X-API-Key (empty = none)")
 	flag.Parse()
 
 	// fixedValue := makeValue()
@@ -79,16 +81,16 @@ func main() {
 	clientSteps := []int{3, 5, 10, 20, 30, 50}
 	if *clients == 0 {
 		for _, c := range clientSteps {
-			runTest(*serverURL, c, *duration, *workload)
+			runTest(*serverURL, c, *duration, *workload, *apiKey)
 		}
 		return
 	}
 
 	// Single-run mode
-	runTest(*serverURL, *clients, *duration, *workload)
+	runTest(*serverURL, *clients, *duration, *workload, *apiKey)
 }
 
-func runTest(server string, clients int, duration int, workload string) {
+func runTest(server string, clients int, duration int, workload string, apiKey string) {
 	log.Printf("\n\n=== Running Load Test with %d clients ===\n", clients)
 
 	fixedValue := makeValue()
@@ -105,6 +107,7 @@ func runTest(server string, clients int, duration int, workload string) {
 				IdleConnTimeout:     90 * time.Second,
 			},
 		},
+		apiKey:     apiKey,
 		stats:      stats,
 		fixedValue: fixedValue,
 	}
@@ -228,7 +231,13 @@ func (lg *LoadGenerator) createKey(key, value string) error {
 	reqBody := Request{Key: key, Value: value}
 	jsonData, _ := json.Marshal(reqBody)
 
-	resp, err := lg.client.Post(lg.serverURL+"/kv", "application/json", bytes.NewBuffer(jsonData))
+	// Keys repeat, so upsert with PUT; POST would answer 409 for existing keys
+	req, err := lg.newRequest(http.MethodPut, key, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := lg.client.Do(req)
 	if err != nil {
 		return err
 	}
@@ -242,7 +251,11 @@ func (lg *LoadGenerator) createKey(key, value string) error {
 }
 
 func (lg *LoadGenerator) readKey(key string) error {
-	resp, err := lg.client.Get(lg.serverURL + "/kv/" + key)
+	req, err := lg.newRequest(http.MethodGet, key, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := lg.client.Do(req)
 	if err != nil {
 		return err
 	}
@@ -256,7 +269,7 @@ func (lg *LoadGenerator) readKey(key string) error {
 }
 
 func (lg *LoadGenerator) deleteKey(key string) error {
-	req, _ := http.NewRequest(http.MethodDelete, lg.serverURL+"/kv/"+key, nil)
+	req, _ := lg.newRequest(http.MethodDelete, key, nil)
 	resp, err := lg.client.Do(req)
 	if err != nil {
 		return err
@@ -270,6 +283,19 @@ func (lg *LoadGenerator) deleteKey(key string) error {
 	return nil
 }
 
+// newRequest builds a request for /kv/{key}, authenticated if an API key
+// was given.
+func (lg *LoadGenerator) newRequest(method, key string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, lg.serverURL+"/kv/"+key, body)
+	if err != nil {
+		return nil, err
+	}
+	if lg.apiKey != "" {
+		req.Header.Set("X-API-Key", lg.apiKey)
+	}
+	return req, nil
+}
+
 func (lg *LoadGenerator) printResults(elapsed float64) {
 	success := atomic.LoadUint64(&lg.stats.successCount)
 	failed := atomic.LoadUint64(&lg.stats.failCount)
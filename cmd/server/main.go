@@ -1,16 +1,29 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"expvar"
 	"flag"
 	"fmt"
+	"kv-server/internal/cache"
 	"kv-server/internal/config"
 	"kv-server/internal/database"
+	"kv-server/internal/leakcheck"
+	"kv-server/internal/listener"
+	"kv-server/internal/replication"
 	"kv-server/internal/server"
+	"kv-server/internal/watch"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/http/pprof"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -23,39 +36,500 @@ func main() {
 
 	// Command-line flags with env variable defaults
 	port := flag.Int("port", getEnvAsInt("SERVER_PORT", 8080), "Server port")
+	readTimeout := flag.Duration("read-timeout", getEnvAsDuration("READ_TIMEOUT", 10*time.Second), "How long reading a request, body included, may take (0 = no limit)")
+	readHeaderTimeout := flag.Duration("read-header-timeout", getEnvAsDuration("READ_HEADER_TIMEOUT", 0), "How long reading a request's headers may take (0 = -read-timeout)")
+	writeTimeout := flag.Duration("write-timeout", getEnvAsDuration("WRITE_TIMEOUT", 10*time.Second), "How long handling a request and writing its response may take (0 = no limit)")
+	idleTimeout := flag.Duration("idle-timeout", getEnvAsDuration("IDLE_TIMEOUT", 0), "How long a keep-alive connection may wait for its next request (0 = -read-timeout)")
+	http2MaxStreams := flag.Int("http2-max-concurrent-streams", getEnvAsInt("HTTP2_MAX_CONCURRENT_STREAMS", 0), "Requests one HTTP/2 connection may have in flight at once (0 = Go's default of 250)")
+	h2c := flag.Bool("h2c", getEnvAsBool("H2C", false), "Also accept HTTP/2 without TLS (h2c, with prior knowledge) on the server port")
+	fastPort := flag.Int("fast-port", getEnvAsInt("FAST_PORT", 0), "Experimental minimal HTTP/1.1 listener for the /kv hot routes (0 = disabled)")
+	corsOrigins := flag.String("cors-origins", config.GetEnv("CORS_ORIGINS", ""), "Comma-separated origins browser scripts may call the API from, e.g. https://admin.example.com, or * for any (empty = CORS off)")
+	corsMethods := flag.String("cors-methods", config.GetEnv("CORS_METHODS", strings.Join(server.DefaultCORSMethods, ",")), "Comma-separated methods allowed cross-origin")
+	corsHeaders := flag.String("cors-headers", config.GetEnv("CORS_HEADERS", strings.Join(server.DefaultCORSHeaders, ",")), "Comma-separated request headers allowed cross-origin")
+	corsMaxAge := flag.Duration("cors-max-age", getEnvAsDuration("CORS_MAX_AGE", 10*time.Minute), "How long browsers may cache a preflight answer (0 = not at all)")
+	debugPprof := flag.Bool("pprof", getEnvAsBool("PPROF", false), "Serve CPU, heap, goroutine and other profiles under /debug/pprof/ on the debug listener")
+	memcachedPort := flag.Int("memcached-port", getEnvAsInt("MEMCACHED_PORT", 0), "Listener speaking the memcached text protocol, without authentication (0 = disabled)")
+	memcachedNamespace := flag.String("memcached-namespace", config.GetEnv("MEMCACHED_NAMESPACE", ""), "Namespace the memcached listener's keys live in; required with -namespaces")
+	debugAddr := flag.String("debug-addr", config.GetEnv("DEBUG_ADDR", ""), "Address for the debug listener serving /debug/vars and /metrics (empty = disabled)")
+	tlsCert := flag.String("tls-cert", config.GetEnv("TLS_CERT", ""), "PEM certificate file; with -tls-key, serves HTTPS on the server and fast ports")
+	tlsKey := flag.String("tls-key", config.GetEnv("TLS_KEY", ""), "PEM private key file for -tls-cert")
+	tlsClientCA := flag.String("tls-client-ca", config.GetEnv("TLS_CLIENT_CA", ""), "PEM CA bundle; clients must present a certificate it signed (mutual TLS)")
+	compressMinBytes := flag.Int("compress-min-bytes", getEnvAsInt("COMPRESS_MIN_BYTES", server.DefaultCompressMinBytes), "Smallest response body gzipped for clients that accept it (0 = no compression, in either direction)")
+	maxAppendBytes := flag.Int("max-append-bytes", getEnvAsInt("MAX_APPEND_BYTES", server.DefaultMaxAppendBytes), "Largest value POST /kv/{key}/append may build; appends past it get 409")
+	maxBodyBytes := flag.Int64("max-body-bytes", int64(getEnvAsInt("MAX_BODY_BYTES", server.DefaultMaxBodyBytes)), "Largest request body accepted; larger ones get 413, and larger values need an upload")
+	requestTimeout := flag.Duration("request-timeout", getEnvAsDuration("REQUEST_TIMEOUT", server.DefaultRequestTimeout), "How long a request's database calls may take in all before it gets 504 (0 = until the client disconnects)")
+	workers := flag.Int("workers", getEnvAsInt("WORKERS", 0), "Requests processed at once; excess requests queue, then get 503 (0 = unbounded)")
+	workerQueue := flag.Int("worker-queue", getEnvAsInt("WORKER_QUEUE", 1000), "Requests that may wait for a worker; more get 503 at once")
+	workerQueueTimeout := flag.Duration("worker-queue-timeout", getEnvAsDuration("WORKER_QUEUE_TIMEOUT", time.Second), "How long a request waits for a worker before it gets 503")
+	shedInFlight := flag.Int("shed-in-flight", getEnvAsInt("SHED_IN_FLIGHT", 0), "Requests in flight past which new ones get 503 at once (0 = never)")
+	shedQueue := flag.Int("shed-queue", getEnvAsInt("SHED_QUEUE", 0), "Requests waiting for a worker at which new ones get 503 at once (0 = never)")
+	listeners := flag.Int("listeners", getEnvAsInt("SERVER_LISTENERS", 1), "Number of SO_REUSEPORT listening sockets (0 = one per 8 cores)")
 	cacheSize := flag.Int("cache-size", getEnvAsInt("CACHE_SIZE", 1000), "Cache capacity")
+	cacheMaxBytes := flag.Int64("cache-max-bytes", int64(getEnvAsInt("CACHE_MAX_BYTES", 0)), "Upper bound on cached value bytes (0 = bound by entry count only)")
+	cacheHighWatermark := flag.Float64("cache-high-watermark", getEnvAsFloat("CACHE_HIGH_WATERMARK", 0), "Fraction of capacity that triggers background eviction (0 = evict synchronously on Put)")
+	cacheLowWatermark := flag.Float64("cache-low-watermark", getEnvAsFloat("CACHE_LOW_WATERMARK", 0.8), "Fraction of capacity background eviction evicts down to")
+	cachePartitions := flag.String("cache-partitions", config.GetEnv("CACHE_PARTITIONS", ""), "Per-namespace cache shares, e.g. sessions=80,config=20 (namespace = -namespaces namespace, else key prefix before '/')")
+	cachePin := flag.String("cache-pin", config.GetEnv("CACHE_PIN", ""), "Comma-separated keys or key prefixes never evicted for capacity, e.g. config/,feature-flags")
+	cachePinMaxBytes := flag.Int64("cache-pin-max-bytes", int64(getEnvAsInt("CACHE_PIN_MAX_BYTES", 1<<20)), "Upper bound on pinned value bytes; keys beyond it are cached normally")
+	cachePolicy := flag.String("cache-policy", config.GetEnv("CACHE_POLICY", "lru"), "Cache eviction policy: lru, 2q, arc")
+	cacheInvalidation := flag.String("cache-invalidation", config.GetEnv("CACHE_INVALIDATION", "none"), "Cross-instance cache invalidation: none, pg (Postgres LISTEN/NOTIFY)")
+	cacheTTL := flag.Duration("cache-ttl", getEnvAsDuration("CACHE_TTL", 0), "Cache entry TTL (0 = no expiry)")
+	cacheTTLJitter := flag.Float64("cache-ttl-jitter", getEnvAsFloat("CACHE_TTL_JITTER", 0.1), "Random TTL jitter as a fraction of the TTL (0.1 = ±10%)")
+
+	backend := flag.String("backend", config.GetEnv("BACKEND", "postgres"), "Storage backend: postgres, memory")
+	memLatency := flag.String("memory-latency", config.GetEnv("MEMORY_LATENCY", ""), "Artificial memory backend latency: 5ms, 1ms-10ms or exp:5ms")
+	memErrorRate := flag.Float64("memory-error-rate", getEnvAsFloat("MEMORY_ERROR_RATE", 0), "Fraction of memory backend operations that fail")
+	leakCheckInterval := flag.Duration("leak-check-interval", getEnvAsDuration("LEAK_CHECK_INTERVAL", 0), "Soak-test leak detector sampling interval; forces a GC per sample (0 = disabled)")
+	leakCheckWindow := flag.Int("leak-check-window", getEnvAsInt("LEAK_CHECK_WINDOW", 6), "Consecutive increases in goroutines or heap that are flagged as a leak")
+	leakCheckDir := flag.String("leak-check-dir", config.GetEnv("LEAK_CHECK_DIR", ""), "Directory to write a heap profile per leak check sample (empty = don't write)")
+	statsHistoryInterval := flag.Duration("stats-history-interval", getEnvAsDuration("STATS_HISTORY_INTERVAL", time.Minute), "Interval between samples added to the hourly stats table (0 = disabled)")
+	statsHistoryRetention := flag.Duration("stats-history-retention", getEnvAsDuration("STATS_HISTORY_RETENTION", 90*24*time.Hour), "How long hourly stats are kept (0 = forever)")
+	region := flag.String("region", config.GetEnv("REGION", ""), "Name of this deployment's region for experimental active-active replication")
+	replicateTo := flag.String("replicate-to", config.GetEnv("REPLICATE_TO", ""), "Comma-separated base URLs of peer regions to replicate writes to (empty = disabled)")
+	replicationAPIKey := flag.String("replication-api-key", config.GetEnv("REPLICATION_API_KEY", ""), "API key sent with writes replicated to peer regions")
+	responseCacheSize := flag.Int("response-cache-size", getEnvAsInt("RESPONSE_CACHE_SIZE", 1000), "Number of hot keys whose encoded GET response is cached (0 = disabled)")
+	responseCacheMaxBytes := flag.Int64("response-cache-max-bytes", int64(getEnvAsInt("RESPONSE_CACHE_MAX_BYTES", 32<<20)), "Upper bound on cached encoded response bytes")
+	quarantineThreshold := flag.Int("quarantine-threshold", getEnvAsInt("QUARANTINE_THRESHOLD", server.DefaultQuarantineThreshold), "Database failures of one key within -quarantine-window that quarantine it (0 = disabled)")
+	quarantineWindow := flag.Duration("quarantine-window", getEnvAsDuration("QUARANTINE_WINDOW", server.DefaultQuarantineWindow), "Window in which a key's failures are counted")
+	quarantineDuration := flag.Duration("quarantine-duration", getEnvAsDuration("QUARANTINE_DURATION", server.DefaultQuarantineDuration), "How long a quarantined key is turned away")
+	accessLog := flag.Bool("access-log", getEnvAsBool("ACCESS_LOG", false), "Log every request as a JSON line on stdout")
+	accessLogLevel := flag.String("access-log-level", config.GetEnv("ACCESS_LOG_LEVEL", "info"), "Lowest access log level written: debug, info, warn (client errors) or error (server errors)")
+	accessLogBodies := flag.Bool("access-log-bodies", getEnvAsBool("ACCESS_LOG_BODIES", false), "Include the first KiB of each request body in the access log")
+	auditLog := flag.String("audit-log", config.GetEnv("AUDIT_LOG", ""), "Where to write an audit record of every POST, PUT and DELETE: a file path, or \"postgres\" for the kv_audit table (empty = no audit log)")
+	auditLogMaxBytes := flag.Int64("audit-log-max-bytes", int64(getEnvAsInt("AUDIT_LOG_MAX_BYTES", 100<<20)), "Size at which the audit file is rotated (0 = never)")
+	auditLogKeep := flag.Int("audit-log-keep", getEnvAsInt("AUDIT_LOG_KEEP", 10), "Rotated audit files kept (0 = all)")
+	auth := flag.Bool("auth", getEnvAsBool("AUTH", true), "Require an API key in X-API-Key on every request but the health probes (false = open, for local development only)")
+	apiKeys := flag.String("api-keys", config.GetEnv("API_KEYS", ""), "Comma-separated API keys accepted in addition to those in the kv_api_keys table")
+	tenantAPIKeys := flag.String("tenant-api-keys", config.GetEnv("TENANT_API_KEYS", ""), "Comma-separated namespace=key pairs; each key only reaches its namespace (requires -namespaces)")
+	schemaReloadInterval := flag.Duration("schema-reload-interval", getEnvAsDuration("SCHEMA_RELOAD_INTERVAL", server.DefaultSchemaReloadInterval), "Interval between reloads of the value schemas registered through other instances")
+	jwtSecret := flag.String("jwt-secret", config.GetEnv("JWT_SECRET", ""), "Shared secret verifying HS256 bearer tokens in the Authorization header")
+	jwtJWKSURL := flag.String("jwt-jwks-url", config.GetEnv("JWT_JWKS_URL", ""), "Identity provider's JSON Web Key Set, verifying RS256 bearer tokens in the Authorization header")
+	jwtJWKSRefresh := flag.Duration("jwt-jwks-refresh-interval", getEnvAsDuration("JWT_JWKS_REFRESH_INTERVAL", time.Hour), "Interval between fetches of -jwt-jwks-url")
+	jwtIssuer := flag.String("jwt-issuer", config.GetEnv("JWT_ISSUER", ""), "Required iss claim of bearer tokens (empty = any)")
+	jwtAudience := flag.String("jwt-audience", config.GetEnv("JWT_AUDIENCE", ""), "Required aud claim of bearer tokens (empty = any)")
+	jwtNamespaceClaim := flag.String("jwt-namespace-claim", config.GetEnv("JWT_NAMESPACE_CLAIM", ""), "Claim holding the namespace a bearer token is scoped to, * for all (empty = all tokens unscoped; requires -namespaces)")
+	jwtPermissionsClaim := flag.String("jwt-permissions-claim", config.GetEnv("JWT_PERMISSIONS_CLAIM", ""), "Claim listing what a bearer token may do: read, write, admin (empty = everything)")
+	apiKeyReloadInterval := flag.Duration("api-key-reload-interval", getEnvAsDuration("API_KEY_RELOAD_INTERVAL", 30*time.Second), "Interval between reloads of the kv_api_keys table")
+	rateLimit := flag.Float64("rate-limit", getEnvAsFloat("RATE_LIMIT", 0), "Requests per second allowed to each client, by API key or, with -auth=false, by IP (0 = unlimited)")
+	rateLimitBurst := flag.Int("rate-limit-burst", getEnvAsInt("RATE_LIMIT_BURST", 100), "Requests a client may burst above -rate-limit")
+	namespaces := flag.Bool("namespaces", getEnvAsBool("NAMESPACES", false), "Route /kv/{namespace}/{key}, isolating each namespace's keys")
+	watchHistory := flag.Int("watch-history", getEnvAsInt("WATCH_HISTORY", watch.DefaultHistory), "Recent watch events kept for resuming streams (0 = no resume)")
+	uploadMaxBytes := flag.Int64("upload-max-bytes", int64(getEnvAsInt("UPLOAD_MAX_BYTES", server.DefaultMaxUploadBytes)), "Largest value a multi-part upload may assemble")
+	uploadTimeout := flag.Duration("upload-timeout", getEnvAsDuration("UPLOAD_TIMEOUT", server.DefaultUploadTimeout), "How long an upload may go without a part before it is dropped")
+	snapshotTTL := flag.Duration("snapshot-ttl", getEnvAsDuration("SNAPSHOT_TTL", server.DefaultSnapshotTTL), "How long an unreleased snapshot stays open")
+	refreshAheadTop := flag.Int("refresh-ahead-top", getEnvAsInt("REFRESH_AHEAD_TOP", 0), "Refresh this many of the most popular keys before their cache TTL expires (0 = disabled)")
+	namespaceMaxKeys := flag.String("namespace-max-keys", config.GetEnv("NAMESPACE_MAX_KEYS", ""), "Evicting namespaces with their maximum key counts, e.g. thumbnails=10000; the least recently used keys beyond it are deleted (requires -namespaces)")
+	namespaceQuotas := flag.String("namespace-quotas", config.GetEnv("NAMESPACE_QUOTAS", ""), "Namespaces with their maximum key counts and value bytes, e.g. team-a=10000/1073741824 (0 = no bound); writes past them are refused (requires -namespaces)")
+	quotaInterval := flag.Duration("quota-interval", getEnvAsDuration("QUOTA_INTERVAL", 30*time.Second), "Interval between measurements of the usage of namespaces with a quota")
+	namespaceTrimInterval := flag.Duration("namespace-trim-interval", getEnvAsDuration("NAMESPACE_TRIM_INTERVAL", 10*time.Second), "Interval between trims of evicting namespaces")
+	historyVersions := flag.Int("history-versions", getEnvAsInt("HISTORY_VERSIONS", 0), "Versions of each key kept in the history table, deletes included; the expiry sweeper drops older ones (0 = keep all)")
+	softDeleteRetention := flag.Duration("soft-delete-retention", getEnvAsDuration("SOFT_DELETE_RETENTION", 0), "How long deleted keys stay restorable before the expiry sweeper purges them (0 = delete outright)")
+	expirySweepInterval := flag.Duration("expiry-sweep-interval", getEnvAsDuration("EXPIRY_SWEEP_INTERVAL", 10*time.Second), "Interval between deletions of keys past their ttl_seconds (0 = never delete them)")
+	maintenanceWindows := flag.String("maintenance-windows", config.GetEnv("MAINTENANCE_WINDOWS", ""), "Daily windows for background maintenance (expiry sweeps, namespace trims, stats pruning), e.g. 02:00-05:00,22:30-23:30 (empty = any time)")
+	maintenanceTZ := flag.String("maintenance-tz", config.GetEnv("MAINTENANCE_TZ", "UTC"), "Time zone of -maintenance-windows, e.g. Europe/Berlin or Local")
+	maintenanceOutside := flag.String("maintenance-outside", config.GetEnv("MAINTENANCE_OUTSIDE", "throttle"), "Background maintenance outside -maintenance-windows: throttle (one batch per run) or pause")
+	refreshAheadWindow := flag.Duration("refresh-ahead-window", getEnvAsDuration("REFRESH_AHEAD_WINDOW", 5*time.Second), "Refresh popular keys expiring within this window")
+	rehydrateTop := flag.Int("rehydrate-top", getEnvAsInt("REHYDRATE_TOP", 0), "After a cache flush, reload this many of the previously most popular keys (0 = disabled)")
+	rehydrateRate := flag.Float64("rehydrate-rate", getEnvAsFloat("REHYDRATE_RATE", 100), "Keys per second to reload after a cache flush")
 
 	dbHost := flag.String("db-host", config.GetEnv("DB_HOST", "localhost"), "Database host")
 	dbPort := flag.String("db-port", config.GetEnv("DB_PORT", "5432"), "Database port")
 	dbUser := flag.String("db-user", config.GetEnv("DB_USER", "postgres"), "Database user")
 	dbPass := flag.String("db-pass", config.GetEnv("DB_PASSWORD", "postgres"), "Database password")
 	dbName := flag.String("db-name", config.GetEnv("DB_NAME", "kvstore"), "Database name")
+	readOnly := flag.Bool("read-only", getEnvAsBool("READ_ONLY", false), "Start in read-only mode: mutations get 503 until PUT /admin/read-only switches it off")
+	degradeInterval := flag.Duration("degrade-interval", getEnvAsDuration("DEGRADE_INTERVAL", time.Second), "Interval between evaluations of the degradation ladder (0 = disabled)")
+	degradeShedInFlight := flag.Int64("degrade-shed-in-flight", int64(getEnvAsInt("DEGRADE_SHED_IN_FLIGHT", 1000)), "In-flight /kv requests at which scans are shed (0 = never)")
+	degradeDBWaits := flag.Int64("degrade-db-waits", int64(getEnvAsInt("DEGRADE_DB_WAITS", 100)), "Database connection pool waits per evaluation at which reads go cache-only (0 = never)")
+	degradeUnavailableAfter := flag.Duration("degrade-unavailable-after", getEnvAsDuration("DEGRADE_UNAVAILABLE_AFTER", time.Minute), "How long the database may be down, serving read-only, before the server reports unavailable (0 = never)")
+	degradeRecoverAfter := flag.Duration("degrade-recover-after", getEnvAsDuration("DEGRADE_RECOVER_AFTER", 10*time.Second), "How long conditions must stay better before climbing back one degradation level")
+	dbHealthInterval := flag.Duration("db-health-interval", getEnvAsDuration("DB_HEALTH_INTERVAL", 5*time.Second), "Interval between database health pings")
+	dbConnMaxLifetime := flag.Duration("db-conn-max-lifetime", getEnvAsDuration("DB_CONN_MAX_LIFETIME", 30*time.Minute), "Recycle pooled connections older than this (0 = never)")
+	dbConnMaxIdleTime := flag.Duration("db-conn-max-idle-time", getEnvAsDuration("DB_CONN_MAX_IDLE_TIME", 5*time.Minute), "Close pooled connections idle longer than this (0 = never)")
+	slowQueryThreshold := flag.Duration("slow-query-threshold", getEnvAsDuration("SLOW_QUERY_THRESHOLD", 0), "Log database calls slower than this with their request ID (0 = disabled)")
+	waitForDB := flag.Duration("wait-for-db", getEnvAsDuration("WAIT_FOR_DB", 0), "How long to keep retrying the initial database connection (0 = fail immediately)")
 
 	flag.Parse()
 
-	// Connect to database
-	db, err := database.NewPostgresDB(*dbHost, *dbPort, *dbUser, *dbPass, *dbName)
+	policy, err := cache.ParsePolicy(*cachePolicy)
+	if err != nil {
+		log.Fatalf("Invalid cache configuration: %v", err)
+	}
+	partitions, err := cache.ParsePartitions(*cachePartitions)
 	if err != nil {
-		log.Fatalf("Failed to connect to database: %v", err)
+		log.Fatalf("Invalid cache configuration: %v", err)
+	}
+	if *cacheInvalidation != "none" && *cacheInvalidation != "pg" {
+		log.Fatalf("Invalid cache configuration: unknown invalidation mode %q", *cacheInvalidation)
 	}
-	defer db.Close()
 
-	log.Printf("Connected to PostgreSQL database at %s:%s", *dbHost, *dbPort)
+	// Open the storage backend
+	var store database.Store
+	var db *database.PostgresDB
+	switch *backend {
+	case "postgres":
+		db, err = database.WaitForPostgresDB(*dbHost, *dbPort, *dbUser, *dbPass, *dbName, *waitForDB)
+		if err != nil {
+			log.Fatalf("Failed to connect to database: %v", err)
+		}
+		log.Printf("Connected to PostgreSQL database at %s:%s", *dbHost, *dbPort)
+
+		if err := db.Migrate(); err != nil {
+			log.Fatalf("Failed to migrate database schema: %v", err)
+		}
+
+		db.SetConnLifetimes(*dbConnMaxLifetime, *dbConnMaxIdleTime)
+		db.SetSlowQueryThreshold(*slowQueryThreshold)
+		store = db
+	case "memory":
+		latency, err := database.ParseLatency(*memLatency)
+		if err != nil {
+			log.Fatalf("Invalid memory backend configuration: %v", err)
+		}
+		store = database.NewMemoryDB(database.Faults{Latency: latency, ErrorRate: *memErrorRate})
+		log.Printf("Using in-memory backend (latency %s, error rate %.2f%%)", latency, *memErrorRate*100)
+	default:
+		log.Fatalf("Unknown backend %q", *backend)
+	}
+	defer store.Close()
 
 	// Create KV server
-	kvServer := server.NewKVServer(*cacheSize, db)
+	kvServer := server.NewKVServer(*cacheSize, store,
+		cache.WithPolicy(policy),
+		cache.WithPartitions(partitions),
+		cache.WithPins(cache.ParsePins(*cachePin), *cachePinMaxBytes),
+		cache.WithMaxWeight(*cacheMaxBytes),
+		cache.WithWatermarks(*cacheHighWatermark, *cacheLowWatermark),
+		cache.WithTTL(*cacheTTL),
+		cache.WithTTLJitter(*cacheTTLJitter),
+	)
+
+	if *maxBodyBytes <= 0 {
+		log.Fatalf("-max-body-bytes must be positive")
+	}
+	kvServer.SetMaxBodyBytes(*maxBodyBytes)
+	kvServer.SetMaxAppendBytes(*maxAppendBytes)
+	kvServer.SetRequestTimeout(*requestTimeout)
+	kvServer.SetCompression(*compressMinBytes)
+	if *readOnly {
+		kvServer.SetReadOnly(true, "started with -read-only")
+	}
+	if *workers > 0 {
+		kvServer.SetWorkers(*workers, *workerQueue, *workerQueueTimeout)
+		log.Printf("Processing at most %d requests at once (queue %d, wait %s)", *workers, *workerQueue, *workerQueueTimeout)
+	}
+	if *shedInFlight > 0 || *shedQueue > 0 {
+		kvServer.SetLoadShedding(*shedInFlight, *shedQueue)
+		log.Printf("Shedding load at %d requests in flight or %d queued", *shedInFlight, *shedQueue)
+	}
+	if *accessLog {
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(*accessLogLevel)); err != nil {
+			log.Fatalf("Invalid -access-log-level: %v", err)
+		}
+		handler := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level})
+		kvServer.SetAccessLog(slog.New(handler), *accessLogBodies)
+	}
+	stopAudit := func() {}
+	switch *auditLog {
+	case "":
+	case "postgres":
+		auditor, ok := store.(database.Auditor)
+		if !ok {
+			log.Fatalf("-audit-log postgres requires the postgres backend")
+		}
+		stopAudit = kvServer.StartAudit(auditor)
+		defer stopAudit()
+		log.Printf("Writing audit records to kv_audit")
+	default:
+		auditFile, err := server.OpenAuditFile(*auditLog, *auditLogMaxBytes, *auditLogKeep)
+		if err != nil {
+			log.Fatalf("Failed to open audit log: %v", err)
+		}
+		defer auditFile.Close()
+		stopAudit = kvServer.StartAudit(auditFile)
+		defer stopAudit()
+		log.Printf("Writing audit records to %s", *auditLog)
+	}
+	kvServer.SetSnapshotTTL(*snapshotTTL)
+	kvServer.SetUploadLimits(*uploadMaxBytes, *uploadTimeout)
+	kvServer.SetNamespaces(*namespaces)
+	if *memcachedPort != 0 {
+		if err := kvServer.CheckMemcachedNamespace(*memcachedNamespace); err != nil {
+			log.Fatalf("Invalid -memcached-namespace: %v", err)
+		}
+	}
+	kvServer.SetWatchHistory(*watchHistory)
+	kvServer.SetQuarantine(*quarantineThreshold, *quarantineWindow, *quarantineDuration)
+	kvServer.SetSoftDelete(*softDeleteRetention)
+	kvServer.SetHistoryVersions(*historyVersions)
+	kvServer.SetResponseCache(*responseCacheSize, *responseCacheMaxBytes)
+	stopSchemaReload, err := kvServer.StartSchemaReload(*schemaReloadInterval)
+	if err != nil {
+		log.Fatalf("Failed to load value schemas: %v", err)
+	}
+	defer stopSchemaReload()
+	if *corsOrigins != "" {
+		kvServer.SetCORS(splitList(*corsOrigins), splitList(*corsMethods), splitList(*corsHeaders), *corsMaxAge)
+		log.Printf("Allowing cross-origin requests from %s", *corsOrigins)
+	}
+
+	// Require API keys
+	if *auth {
+		keys := make(map[string]string)
+		for _, key := range strings.Split(*apiKeys, ",") {
+			if key = strings.TrimSpace(key); key != "" {
+				keys[key] = ""
+			}
+		}
+		for _, pair := range strings.Split(*tenantAPIKeys, ",") {
+			if pair = strings.TrimSpace(pair); pair == "" {
+				continue
+			}
+			ns, key, ok := strings.Cut(pair, "=")
+			if !ok || ns == "" || key == "" {
+				log.Fatalf("Invalid -tenant-api-keys entry %q, expected namespace=key", pair)
+			}
+			if !*namespaces {
+				log.Fatalf("-tenant-api-keys requires -namespaces")
+			}
+			keys[key] = ns
+		}
+		kvServer.SetAPIKeys(keys)
+		if db != nil {
+			stopReload, err := kvServer.StartAPIKeyReload(db, *apiKeyReloadInterval)
+			if err != nil {
+				log.Fatalf("Failed to load API keys: %v", err)
+			}
+			defer stopReload()
+		}
+		jwtOn := *jwtSecret != "" || *jwtJWKSURL != ""
+		if jwtOn {
+			if *jwtNamespaceClaim != "" && !*namespaces {
+				log.Fatalf("-jwt-namespace-claim requires -namespaces")
+			}
+			stopJWT, err := kvServer.StartJWT(server.JWTConfig{
+				Secret:           []byte(*jwtSecret),
+				JWKSURL:          *jwtJWKSURL,
+				Issuer:           *jwtIssuer,
+				Audience:         *jwtAudience,
+				NamespaceClaim:   *jwtNamespaceClaim,
+				PermissionsClaim: *jwtPermissionsClaim,
+			}, *jwtJWKSRefresh)
+			if err != nil {
+				log.Fatalf("Failed to set up bearer tokens: %v", err)
+			}
+			defer stopJWT()
+		}
+		switch {
+		case jwtOn:
+			log.Printf("Authentication on with %d API keys and bearer tokens", kvServer.APIKeyCount())
+		case kvServer.APIKeyCount() > 0:
+			log.Printf("Authentication on with %d API keys", kvServer.APIKeyCount())
+		case db != nil:
+			// Serving would answer every request with 401
+			log.Fatalf("Authentication is on but no API keys exist: set -api-keys, add one to kv_api_keys, or -auth=false for local development")
+		default:
+			log.Fatalf("Authentication is on but no API keys are configured: set -api-keys, or -auth=false for local development")
+		}
+	} else {
+		if *jwtSecret != "" || *jwtJWKSURL != "" {
+			log.Fatalf("-jwt-secret and -jwt-jwks-url require -auth")
+		}
+		log.Printf("Warning: authentication is off; anyone who can reach the server can read and delete every key")
+	}
+
+	// Keep one client from starving the others
+	if *rateLimit > 0 {
+		if *rateLimitBurst < 1 {
+			log.Fatalf("-rate-limit-burst must be at least 1")
+		}
+		stopRateLimit := kvServer.StartRateLimit(*rateLimit, *rateLimitBurst)
+		defer stopRateLimit()
+		log.Printf("Rate limiting each client to %g requests/s (burst %d)", *rateLimit, *rateLimitBurst)
+	}
+
+	// Replicate writes to peer regions
+	if *replicateTo != "" {
+		if *region == "" {
+			log.Fatalf("-replicate-to requires a -region")
+		}
+		peers := strings.Split(*replicateTo, ",")
+		repl := replication.New(*region, peers)
+		repl.SetAPIKey(*replicationAPIKey)
+		repl.Start()
+		defer repl.Stop()
+		kvServer.SetReplicator(repl)
+		log.Printf("Experimental replication from region %s to %v", *region, peers)
+	}
+
+	// Monitor database availability for readiness
+	if db != nil {
+		monitor := database.NewHealthMonitor(db, *dbHealthInterval)
+		monitor.Start()
+		defer monitor.Stop()
+		kvServer.SetHealthMonitor(monitor)
+	}
+
+	// Degrade predictably under overload and database outages
+	if *degradeInterval > 0 {
+		stopDegradation := kvServer.StartDegradation(server.DegradationConfig{
+			ShedInFlight:     *degradeShedInFlight,
+			DBWaits:          *degradeDBWaits,
+			UnavailableAfter: *degradeUnavailableAfter,
+			RecoverAfter:     *degradeRecoverAfter,
+		}, *degradeInterval)
+		defer stopDegradation()
+	}
+
+	// Refresh popular keys before they expire
+	if *refreshAheadTop > 0 {
+		if *cacheTTL <= 0 {
+			log.Fatalf("-refresh-ahead-top requires a -cache-ttl")
+		}
+		stopRefresh := kvServer.StartRefreshAhead(*refreshAheadTop, *refreshAheadWindow)
+		defer stopRefresh()
+		log.Printf("Refreshing the top %d keys within %s of expiry", *refreshAheadTop, *refreshAheadWindow)
+	}
+
+	// Reload hot keys after a flush at a bounded rate
+	if *rehydrateTop > 0 {
+		if *rehydrateRate <= 0 {
+			log.Fatalf("-rehydrate-rate must be positive")
+		}
+		stopRehydration := kvServer.StartRehydration(*rehydrateTop, *rehydrateRate)
+		defer stopRehydration()
+		log.Printf("Rehydrating the top %d keys at %g/s after a cache flush", *rehydrateTop, *rehydrateRate)
+	}
+
+	// Confine background maintenance to quiet hours
+	windows, err := server.ParseMaintenanceWindows(*maintenanceWindows)
+	if err != nil {
+		log.Fatalf("Invalid -maintenance-windows: %v", err)
+	}
+	if len(windows) > 0 {
+		loc, err := time.LoadLocation(*maintenanceTZ)
+		if err != nil {
+			log.Fatalf("Invalid -maintenance-tz: %v", err)
+		}
+		outside, err := server.ParseMaintenancePolicy(*maintenanceOutside)
+		if err != nil {
+			log.Fatalf("Invalid -maintenance-outside: %v", err)
+		}
+		kvServer.SetMaintenanceWindows(windows, loc, outside)
+		log.Printf("Background maintenance windows %s (%s); outside them maintenance will %s", *maintenanceWindows, loc, outside)
+	}
+
+	// Delete keys past their ttl_seconds
+	if *expirySweepInterval > 0 {
+		stopSweeper := kvServer.StartExpirySweeper(*expirySweepInterval)
+		defer stopSweeper()
+	}
+
+	// Bound evicting namespaces
+	namespaceLimits, err := server.ParseNamespaceLimits(*namespaceMaxKeys)
+	if err != nil {
+		log.Fatalf("Invalid -namespace-max-keys: %v", err)
+	}
+	if len(namespaceLimits) > 0 {
+		if !*namespaces {
+			log.Fatalf("-namespace-max-keys requires -namespaces")
+		}
+		stopTrimmer, err := kvServer.StartNamespaceTrimmer(namespaceLimits, *namespaceTrimInterval)
+		if err != nil {
+			log.Fatalf("Failed to start namespace trimmer: %v", err)
+		}
+		defer stopTrimmer()
+		log.Printf("Trimming %d evicting namespace(s) every %s", len(namespaceLimits), *namespaceTrimInterval)
+	}
+
+	// Enforce namespace quotas
+	quotas, err := server.ParseQuotas(*namespaceQuotas)
+	if err != nil {
+		log.Fatalf("Invalid -namespace-quotas: %v", err)
+	}
+	if len(quotas) > 0 {
+		if !*namespaces {
+			log.Fatalf("-namespace-quotas requires -namespaces")
+		}
+		stopQuotas, err := kvServer.StartQuotas(quotas, *quotaInterval)
+		if err != nil {
+			log.Fatalf("Failed to start quotas: %v", err)
+		}
+		defer stopQuotas()
+		log.Printf("Enforcing quotas on %d namespace(s), measured every %s", len(quotas), *quotaInterval)
+	}
+
+	// Keep hourly stats for capacity planning
+	if *statsHistoryInterval > 0 {
+		statsStore, ok := store.(database.StatsStore)
+		if !ok {
+			log.Fatalf("Storage backend %q cannot keep stats history", *backend)
+		}
+		stopStatsHistory := kvServer.StartStatsHistory(statsStore, *statsHistoryInterval, *statsHistoryRetention)
+		defer stopStatsHistory()
+	}
+
+	// Serve expvar counters and Prometheus metrics on a separate debug listener
+	if *debugPprof && *debugAddr == "" {
+		log.Fatalf("-pprof requires -debug-addr")
+	}
+	if *debugAddr != "" {
+		kvServer.PublishExpvars()
+		debugMux := http.NewServeMux()
+		debugMux.Handle("/debug/vars", expvar.Handler())
+		debugMux.Handle("/metrics", kvServer.MetricsHandler())
+		if *debugPprof {
+			// Registered by hand: the package's init only fills DefaultServeMux
+			debugMux.HandleFunc("/debug/pprof/", pprof.Index)
+			debugMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+			debugMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+			debugMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+			debugMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		}
+		go func() {
+			log.Printf("Debug listener on %s", *debugAddr)
+			if err := http.ListenAndServe(*debugAddr, debugMux); err != nil {
+				log.Printf("Debug listener failed: %v", err)
+			}
+		}()
+	}
+
+	// Evict keys written by other instances sharing the database
+	if *cacheInvalidation == "pg" {
+		if db == nil {
+			log.Fatalf("Cache invalidation via Postgres requires -backend=postgres")
+		}
+		db.EnableInvalidation()
+		invalidations, err := db.ListenInvalidations(kvServer.InvalidateCached, kvServer.ClearCache)
+		if err != nil {
+			log.Fatalf("Failed to listen for cache invalidations: %v", err)
+		}
+		defer invalidations.Close()
+		log.Println("Cache invalidation via Postgres LISTEN/NOTIFY enabled")
+	}
 
 	// Configure HTTP server with thread pool
 	httpServer := &http.Server{
-		Addr:           fmt.Sprintf("0.0.0.0:%d", *port),
-		Handler:        kvServer,
-		ReadTimeout:    10 * time.Second,
-		WriteTimeout:   10 * time.Second,
-		MaxHeaderBytes: 1 << 20,
+		Addr:              fmt.Sprintf("0.0.0.0:%d", *port),
+		Handler:           kvServer,
+		ReadTimeout:       *readTimeout,
+		ReadHeaderTimeout: *readHeaderTimeout,
+		WriteTimeout:      *writeTimeout,
+		IdleTimeout:       *idleTimeout,
+		MaxHeaderBytes:    1 << 20,
+	}
+	if *http2MaxStreams > 0 {
+		httpServer.HTTP2 = &http.HTTP2Config{MaxConcurrentStreams: *http2MaxStreams}
 	}
 
-	// Start stats printer
-	// go printStats(kvServer)
+	// Watch for leaks during soak tests
+	if *leakCheckInterval > 0 {
+		detector := leakcheck.New(*leakCheckInterval, *leakCheckWindow, *leakCheckDir)
+		detector.Start()
+		defer detector.Stop()
+		log.Printf("Leak detector sampling every %s", *leakCheckInterval)
+	}
 
 	// Handle graceful shutdown
 	go func() {
@@ -63,29 +537,127 @@ func main() {
 		signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 		<-sigChan
 		log.Println("\nShutting down server...")
+		// Exiting skips the deferred calls; the audit log must not lose
+		// what is queued
+		stopAudit()
 		os.Exit(0)
 	}()
 
-	log.Printf("Server starting on port %d with cache size %d", *port, *cacheSize)
-	if err := httpServer.ListenAndServe(); err != nil {
+	// Serve TLS when a certificate is configured
+	tlsConfig, err := loadTLSConfig(*tlsCert, *tlsKey, *tlsClientCA)
+	if err != nil {
+		log.Fatalf("Failed to load TLS configuration: %v", err)
+	}
+	httpServer.TLSConfig = tlsConfig
+	if *h2c {
+		if tlsConfig != nil {
+			log.Fatalf("-h2c is for plain HTTP; HTTPS already negotiates HTTP/2")
+		}
+		httpServer.Protocols = new(http.Protocols)
+		httpServer.Protocols.SetHTTP1(true)
+		httpServer.Protocols.SetUnencryptedHTTP2(true)
+		kvServer.SetUnencryptedHTTP2(true)
+	}
+
+	listenerCount := *listeners
+	if listenerCount == 0 {
+		listenerCount = listener.AutoCount()
+	}
+	lns, err := listener.Listen(httpServer.Addr, listenerCount)
+	if err != nil {
+		log.Fatalf("Failed to listen: %v", err)
+	}
+
+	if *fastPort != 0 {
+		fastLn, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", *fastPort))
+		if err != nil {
+			log.Fatalf("Failed to listen on fast port: %v", err)
+		}
+		if tlsConfig != nil {
+			fastLn = tls.NewListener(fastLn, tlsConfig)
+		}
+		log.Printf("Experimental fast path serving /kv on port %d", *fastPort)
+		go func() {
+			log.Fatalf("Fast path failed: %v", kvServer.ServeFast(fastLn))
+		}()
+	}
+
+	if *memcachedPort != 0 {
+		mcLn, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", *memcachedPort))
+		if err != nil {
+			log.Fatalf("Failed to listen on memcached port: %v", err)
+		}
+		log.Printf("Memcached protocol served on port %d", *memcachedPort)
+		if *auth {
+			log.Printf("Warning: the memcached port has no authentication; anyone who can reach it can read and delete its keys")
+		}
+		go func() {
+			log.Fatalf("Memcached listener failed: %v", kvServer.ServeMemcached(mcLn, *memcachedNamespace))
+		}()
+	}
+
+	scheme := "HTTP"
+	switch {
+	case tlsConfig != nil && tlsConfig.ClientCAs != nil:
+		scheme = "HTTPS with client certificates"
+	case tlsConfig != nil:
+		scheme = "HTTPS"
+	case *h2c:
+		scheme = "HTTP and h2c"
+	}
+	log.Printf("Server starting on port %d (%d listener(s), %s) with cache size %d (%s)", *port, len(lns), scheme, *cacheSize, policy)
+	errChan := make(chan error, len(lns))
+	for _, ln := range lns {
+		go func(ln net.Listener) {
+			if tlsConfig != nil {
+				// The certificate is already in TLSConfig
+				errChan <- httpServer.ServeTLS(ln, "", "")
+				return
+			}
+			errChan <- httpServer.Serve(ln)
+		}(ln)
+	}
+	if err := <-errChan; err != nil {
 		log.Fatalf("Server failed: %v", err)
 	}
 }
 
-// func printStats(kvServer *server.KVServer) {
-// 	ticker := time.NewTicker(30 * time.Second)
-// 	defer ticker.Stop()
-
-// 	for range ticker.C {
-// 		hits, misses := kvServer.GetCacheStats()
-// 		total := hits + misses
-// 		hitRate := float64(0)
-// 		if total > 0 {
-// 			hitRate = float64(hits) / float64(total) * 100
-// 		}
-// 		log.Printf("Cache Stats - Hits: %d, Misses: %d, Hit Rate: %.2f%%", hits, misses, hitRate)
-// 	}
-// }
+// loadTLSConfig returns the server's TLS configuration, or nil to serve
+// plain HTTP when no certificate is given. A client CA bundle turns on
+// mutual TLS: every connection must present a certificate it signed.
+func loadTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" {
+		if clientCAFile != "" {
+			return nil, errors.New("-tls-client-ca requires -tls-cert and -tls-key")
+		}
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("-tls-cert and -tls-key must be given together")
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAFile != "" {
+		pem, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", clientCAFile)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
 
 func getEnvAsInt(key string, defaultValue int) int {
 	valueStr := os.Getenv(key)
@@ -98,3 +670,51 @@ func getEnvAsInt(key string, defaultValue int) int {
 	}
 	return value
 }
+
+func getEnvAsBool(key string, defaultValue bool) bool {
+	valueStr := os.Getenv(key)
+	if valueStr == "" {
+		return defaultValue
+	}
+	value, err := strconv.ParseBool(valueStr)
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+func getEnvAsDuration(key string, defaultValue time.Duration) time.Duration {
+	valueStr := os.Getenv(key)
+	if valueStr == "" {
+		return defaultValue
+	}
+	value, err := time.ParseDuration(valueStr)
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+func getEnvAsFloat(key string, defaultValue float64) float64 {
+	valueStr := os.Getenv(key)
+	if valueStr == "" {
+		return defaultValue
+	}
+	value, err := strconv.ParseFloat(valueStr, 64)
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+// splitList splits a comma-separated flag value, dropping blanks around
+// and between items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
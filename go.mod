@@ -1,5 +1,5 @@
 module kv-server
 
-go 1.23.4
+go 1.24.0
 
 require github.com/lib/pq v1.10.9
@@ -0,0 +1,116 @@
+package cache
+
+import "container/list"
+
+const (
+	queueT1 uint8 = iota
+	queueT2
+)
+
+// arcPolicy implements the Adaptive Replacement Cache (Megiddo & Modha).
+// T1 holds keys seen once recently and T2 keys seen at least twice; B1 and B2
+// remember keys recently evicted from each. A miss that hits a ghost list
+// shifts the target size p of T1 towards whichever side would have kept the
+// key, so the cache self-tunes between scan-heavy and hot-set workloads.
+//
+// Eviction runs before the new key is admitted, so p adapts on admission
+// rather than ahead of the eviction it would have influenced; the skew is
+// at most one entry.
+type arcPolicy[K comparable, V any] struct {
+	capacity int
+	p        int
+
+	t1, t2 *list.List
+	b1, b2 *list.List
+	ghost  map[K]*list.Element
+}
+
+// ghostEntry is a non-resident key remembered in B1 or B2.
+type ghostEntry[K comparable] struct {
+	key  K
+	inB2 bool
+}
+
+func newARCPolicy[K comparable, V any](capacity int) *arcPolicy[K, V] {
+	return &arcPolicy[K, V]{
+		capacity: capacity,
+		t1:       list.New(),
+		t2:       list.New(),
+		b1:       list.New(),
+		b2:       list.New(),
+		ghost:    make(map[K]*list.Element),
+	}
+}
+
+func (p *arcPolicy[K, V]) add(e *entry[K, V]) {
+	if g, ok := p.ghost[e.key]; ok {
+		// Ghost hit: adapt the target size of T1 and admit as frequent
+		if g.Value.(*ghostEntry[K]).inB2 {
+			p.p = max(0, p.p-max(p.b1.Len()/max(p.b2.Len(), 1), 1))
+			p.b2.Remove(g)
+		} else {
+			p.p = min(p.capacity, p.p+max(p.b2.Len()/max(p.b1.Len(), 1), 1))
+			p.b1.Remove(g)
+		}
+		delete(p.ghost, e.key)
+		e.queue = queueT2
+		e.elem = p.t2.PushFront(e)
+		return
+	}
+
+	e.queue = queueT1
+	e.elem = p.t1.PushFront(e)
+	p.trimGhosts()
+}
+
+func (p *arcPolicy[K, V]) touch(e *entry[K, V]) {
+	// Any second reference makes an entry frequent
+	if e.queue == queueT1 {
+		p.t1.Remove(e.elem)
+		e.queue = queueT2
+		e.elem = p.t2.PushFront(e)
+		return
+	}
+	p.t2.MoveToFront(e.elem)
+}
+
+func (p *arcPolicy[K, V]) remove(e *entry[K, V]) {
+	if e.queue == queueT2 {
+		p.t2.Remove(e.elem)
+	} else {
+		p.t1.Remove(e.elem)
+	}
+}
+
+func (p *arcPolicy[K, V]) evict() *entry[K, V] {
+	var victim *entry[K, V]
+	if p.t1.Len() > 0 && (p.t1.Len() > p.p || p.t2.Len() == 0) {
+		oldest := p.t1.Back()
+		p.t1.Remove(oldest)
+		victim = oldest.Value.(*entry[K, V])
+		p.ghost[victim.key] = p.b1.PushFront(&ghostEntry[K]{key: victim.key})
+	} else if p.t2.Len() > 0 {
+		oldest := p.t2.Back()
+		p.t2.Remove(oldest)
+		victim = oldest.Value.(*entry[K, V])
+		p.ghost[victim.key] = p.b2.PushFront(&ghostEntry[K]{key: victim.key, inB2: true})
+	}
+	p.trimGhosts()
+	return victim
+}
+
+// trimGhosts keeps |T1|+|B1| <= c and the whole directory within 2c.
+func (p *arcPolicy[K, V]) trimGhosts() {
+	for p.b1.Len() > 0 && p.t1.Len()+p.b1.Len() > p.capacity {
+		p.dropGhost(p.b1)
+	}
+	for p.b2.Len() > 0 && p.t1.Len()+p.t2.Len()+p.b1.Len()+p.b2.Len() > 2*p.capacity {
+		p.dropGhost(p.b2)
+	}
+}
+
+func (p *arcPolicy[K, V]) dropGhost(l *list.List) {
+	oldest := l.Back()
+	l.Remove(oldest)
+	delete(p.ghost, oldest.Value.(*ghostEntry[K]).key)
+}
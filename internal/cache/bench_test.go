@@ -0,0 +1,163 @@
+package cache
+
+import (
+	"container/list"
+	"flag"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// The workload of BenchmarkPolicies, e.g.
+//
+//	go test ./internal/cache -run '^$' -bench Policies -zipf 1.2 -goroutines 1,8,32
+var (
+	benchKeys       = flag.Int("keys", 100000, "BenchmarkPolicies: size of the key space")
+	benchCapacity   = flag.Int("capacity", 10000, "BenchmarkPolicies: cache capacity in entries")
+	benchZipf       = flag.Float64("zipf", 1.1, "BenchmarkPolicies: Zipf skew s of key popularity (must be > 1; 0 = uniform)")
+	benchReadRatio  = flag.Float64("read-ratio", 0.9, "BenchmarkPolicies: fraction of ops that are reads")
+	benchGoroutines = flag.String("goroutines", "1,4,16", "BenchmarkPolicies: comma-separated goroutine counts")
+	benchImpls      = flag.String("impls", "locked-lru,lru,2q,arc", "BenchmarkPolicies: implementations to compare (locked-lru or a cache policy)")
+)
+
+// benchCache is the surface BenchmarkPolicies exercises.
+type benchCache interface {
+	Get(key string) (string, bool)
+	Put(key, value string)
+}
+
+// BenchmarkPolicies compares every implementation at every goroutine count.
+// Each op is a read, filling the cache on a miss as the server does, or,
+// with probability 1-read-ratio, a write. It reports the read hit rate.
+func BenchmarkPolicies(b *testing.B) {
+	var counts []int
+	for _, s := range strings.Split(*benchGoroutines, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || n < 1 {
+			b.Fatalf("invalid goroutine count %q", s)
+		}
+		counts = append(counts, n)
+	}
+	keys := make([]string, *benchKeys)
+	for i := range keys {
+		keys[i] = "key-" + strconv.Itoa(i)
+	}
+
+	for _, name := range strings.Split(*benchImpls, ",") {
+		name = strings.TrimSpace(name)
+		for _, g := range counts {
+			b.Run(fmt.Sprintf("%s/goroutines=%d", name, g), func(b *testing.B) {
+				c := newBenchCache(b, name, *benchCapacity)
+				if closer, ok := c.(interface{ Close() }); ok {
+					defer closer.Close()
+				}
+				benchmarkCache(b, c, keys, g)
+			})
+		}
+	}
+}
+
+func newBenchCache(b *testing.B, name string, capacity int) benchCache {
+	if name == "locked-lru" {
+		return newLockedLRU(capacity)
+	}
+	policy, err := ParsePolicy(name)
+	if err != nil {
+		b.Fatalf("unknown implementation %q (want locked-lru or a cache policy)", name)
+	}
+	return NewShardedCache(capacity, WithPolicy(policy))
+}
+
+func benchmarkCache(b *testing.B, c benchCache, keys []string, goroutines int) {
+	var hits, reads atomic.Uint64
+	var wg sync.WaitGroup
+	perWorker := b.N/goroutines + 1
+	b.ResetTimer()
+	for w := 0; w < goroutines; w++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(seed))
+			next := keyPicker(rng, len(keys))
+			var h, r uint64
+			for i := 0; i < perWorker; i++ {
+				key := keys[next()]
+				if rng.Float64() < *benchReadRatio {
+					r++
+					if _, ok := c.Get(key); ok {
+						h++
+						continue
+					}
+				}
+				c.Put(key, key)
+			}
+			hits.Add(h)
+			reads.Add(r)
+		}(int64(w))
+	}
+	wg.Wait()
+
+	if r := reads.Load(); r > 0 {
+		b.ReportMetric(100*float64(hits.Load())/float64(r), "hit%")
+	}
+}
+
+// keyPicker returns a generator of key indexes with the configured skew.
+func keyPicker(rng *rand.Rand, n int) func() int {
+	if *benchZipf > 1 {
+		z := rand.NewZipf(rng, *benchZipf, 1, uint64(n-1))
+		return func() int { return int(z.Uint64()) }
+	}
+	return func() int { return rng.Intn(n) }
+}
+
+// lockedLRU is an unsharded LRU behind a single mutex, the baseline the
+// sharded cache is measured against.
+type lockedLRU struct {
+	mu       sync.Mutex
+	capacity int
+	items    map[string]*list.Element
+	order    *list.List
+}
+
+type lruItem struct {
+	key, value string
+}
+
+func newLockedLRU(capacity int) *lockedLRU {
+	return &lockedLRU{
+		capacity: capacity,
+		items:    make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+func (l *lockedLRU) Get(key string) (string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if elem, ok := l.items[key]; ok {
+		l.order.MoveToFront(elem)
+		return elem.Value.(*lruItem).value, true
+	}
+	return "", false
+}
+
+func (l *lockedLRU) Put(key, value string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if elem, ok := l.items[key]; ok {
+		elem.Value.(*lruItem).value = value
+		l.order.MoveToFront(elem)
+		return
+	}
+	if l.order.Len() >= l.capacity {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		delete(l.items, oldest.Value.(*lruItem).key)
+	}
+	l.items[key] = l.order.PushFront(&lruItem{key: key, value: value})
+}
@@ -2,128 +2,817 @@ package cache
 
 import (
 	"container/list"
+	"fmt"
+	"kv-server/internal/fasthash"
+	"kv-server/internal/hashring"
+	"math/rand"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
 )
 
 const SHARD_COUNT = 32
 
-type entry struct {
-	key   string
-	value string
+type entry[K comparable, V any] struct {
+	key         K
+	value       V
+	weight      int
+	insertedAt  time.Time
+	lastAccess  time.Time
+	hits        uint64
+	expiresAt   time.Time
+	version     uint64
+	revision    uint64
+	contentType string
+	pinned      bool
+
+	// Bookkeeping owned by the shard's eviction policy
+	elem  *list.Element
+	queue uint8
+}
+
+// EntryInfo describes a resident cache entry for diagnostics.
+type EntryInfo[V any] struct {
+	Shard      int
+	Value      V
+	Weight     int
+	InsertedAt time.Time
+	LastAccess time.Time
+	Hits       uint64
+	ExpiresAt  time.Time
+	Version    uint64
+	Revision   uint64
+}
+
+// Versioned is a cached value together with the version and time of the
+// write that stored it. Revision is the caller-supplied revision of the
+// value in its backing store, zero if none was given. ExpiresAt is when the
+// value stops being served, zero for never; a caller-supplied ExpiresAt caps
+// the cache's own TTL. ContentType is an opaque media type the caller
+// stores alongside the value, empty if none.
+type Versioned[V any] struct {
+	Value       V
+	Version     uint64
+	Revision    uint64
+	UpdatedAt   time.Time
+	ExpiresAt   time.Time
+	ContentType string
+}
+
+// expired reports whether the entry has a TTL that has elapsed.
+func (e *entry[K, V]) expired(now time.Time) bool {
+	return !e.expiresAt.IsZero() && now.After(e.expiresAt)
+}
+
+type cacheShard[K comparable, V any] struct {
+	capacity  int
+	maxWeight int64
+	weight    int64
+	entries   map[K]*entry[K, V]
+	policy    policy[K, V]
+	mu        sync.Mutex
+	hits      uint64
+	misses    uint64
+	evictions uint64
+	loads     map[K]*call[V]
+
+	// Pinned entries are resident but outside the policy and the limits
+	pins         *pinBudget
+	pinnedCount  int
+	pinnedWeight int64
+
+	// Soft limits for background eviction; zero when disabled
+	highCount, lowCount   int
+	highWeight, lowWeight int64
+	evictQueued           bool
+}
+
+// remove drops e from the shard. Callers must hold the shard lock.
+func (shard *cacheShard[K, V]) remove(e *entry[K, V]) {
+	if e.pinned {
+		shard.unpin(e)
+	} else {
+		shard.policy.remove(e)
+	}
+	delete(shard.entries, e.key)
+	shard.weight -= int64(e.weight)
+}
+
+// overBudget reports whether adding extra weight (and count) would exceed the
+// shard's limits. Callers must hold the shard lock.
+func (shard *cacheShard[K, V]) overBudget(extraCount int, extraWeight int64) bool {
+	count, weight := shard.evictable()
+	if count+extraCount > shard.capacity {
+		return true
+	}
+	return shard.maxWeight > 0 && weight+extraWeight > shard.maxWeight
+}
+
+// evictable returns the count and weight of entries subject to eviction,
+// i.e. excluding pinned ones. Callers must hold the shard lock.
+func (shard *cacheShard[K, V]) evictable() (int, int64) {
+	return len(shard.entries) - shard.pinnedCount, shard.weight - shard.pinnedWeight
+}
+
+// evictUntilFits evicts victims until the extra count and weight fit.
+// Callers must hold the shard lock.
+func (shard *cacheShard[K, V]) evictUntilFits(extraCount int, extraWeight int64) {
+	for shard.overBudget(extraCount, extraWeight) {
+		victim := shard.policy.evict()
+		if victim == nil {
+			return
+		}
+		delete(shard.entries, victim.key)
+		shard.weight -= int64(victim.weight)
+		shard.evictions++
+	}
+}
+
+// aboveHigh reports whether the shard crossed its high watermark.
+// Callers must hold the shard lock.
+func (shard *cacheShard[K, V]) aboveHigh() bool {
+	if shard.highCount == 0 {
+		return false
+	}
+	count, weight := shard.evictable()
+	if count > shard.highCount {
+		return true
+	}
+	return shard.highWeight > 0 && weight > shard.highWeight
+}
+
+// aboveLow reports whether the shard is still above its low watermark.
+// Callers must hold the shard lock.
+func (shard *cacheShard[K, V]) aboveLow() bool {
+	count, weight := shard.evictable()
+	if count > shard.lowCount {
+		return true
+	}
+	return shard.lowWeight > 0 && weight > shard.lowWeight
+}
+
+// call is an in-flight GetOrLoad shared by concurrent callers of the same key.
+type call[V any] struct {
+	wg    sync.WaitGroup
+	value Versioned[V]
+	err   error
+
+	// Set by a Put, Delete or Clear of the key while the loader runs, whose
+	// result is then older than the cache and is not stored
+	stale atomic.Bool
+}
+
+// invalidateLoad marks the in-flight load of key, if any, stale. Callers
+// must hold the shard lock.
+func (shard *cacheShard[K, V]) invalidateLoad(key K) {
+	if cl, ok := shard.loads[key]; ok {
+		cl.stale.Store(true)
+	}
+}
+
+// Cache is a sharded, in-memory cache with pluggable eviction and optional
+// weight-based (e.g. byte) capacity accounting.
+type Cache[K comparable, V any] struct {
+	shards  []*cacheShard[K, V]
+	hash    func(K) uint64
+	weigher func(V) int
+	ttl     time.Duration
+	jitter  float64
+
+	// Partition i owns shards[i*SHARD_COUNT:(i+1)*SHARD_COUNT]; partition 0
+	// is the default one. partitionIndex is nil when unpartitioned.
+	partitions     []partition
+	partitionIndex map[string]int
+
+	// Nil unless WithPins configured prefixes
+	pins *pinBudget
+
+	// Picks a key's shard within its partition; see Rebalance
+	ring      atomic.Pointer[hashring.Ring]
+	rebalance rebalanceState
+
+	// Source of entry versions; a key deleted and written again never gets
+	// a version it had before
+	version atomic.Uint64
+
+	// Background eviction, only running when watermarks are configured
+	evictCh chan int
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// ShardedCache is the string cache used by the KV server.
+type ShardedCache = Cache[string, string]
+
+type options struct {
+	ttl       time.Duration
+	jitter    float64
+	policy    Policy
+	weigher   any
+	maxWeight int64
+	high, low float64
+
+	partitions []Partition
+
+	pins         []string
+	pinMaxWeight int64
+}
+
+// Option configures optional Cache behaviour.
+type Option func(*options)
+
+// WithPolicy selects the eviction policy used by every shard. LRU is the default.
+func WithPolicy(p Policy) Option {
+	return func(o *options) {
+		o.policy = p
+	}
+}
+
+// WithTTL sets the default time-to-live applied by Put. Zero disables expiry.
+func WithTTL(ttl time.Duration) Option {
+	return func(o *options) {
+		o.ttl = ttl
+	}
+}
+
+// WithTTLJitter randomizes each expiration by up to ±fraction of its TTL so
+// entries loaded together don't all expire (and reload from the DB) together.
+func WithTTLJitter(fraction float64) Option {
+	return func(o *options) {
+		if fraction < 0 {
+			fraction = 0
+		}
+		if fraction > 1 {
+			fraction = 1
+		}
+		o.jitter = fraction
+	}
+}
+
+// WithWeigher sets the function computing an entry's weight. Without one
+// every entry weighs 1. The value type must match the cache's V.
+func WithWeigher[V any](weigher func(V) int) Option {
+	return func(o *options) {
+		o.weigher = weigher
+	}
 }
 
-type lruShard struct {
-	capacity int
-	cache    map[string]*list.Element
-	lru      *list.List
-	mu       sync.Mutex 
-	hits     uint64
-	misses   uint64
+// WithMaxWeight bounds the total weight of resident entries, split evenly
+// across shards. Zero leaves only the entry count bound.
+func WithMaxWeight(maxWeight int64) Option {
+	return func(o *options) {
+		o.maxWeight = maxWeight
+	}
 }
 
-// ShardedCache is the wrapper that manages the 8 internal shards.
-type ShardedCache struct {
-	shards [SHARD_COUNT]*lruShard
+// WithWatermarks enables background eviction. Once a shard grows past high
+// (a fraction of its capacity) a background goroutine evicts it down to low,
+// taking eviction off the write path. The capacity itself stays a hard limit
+// that Put enforces synchronously if the background evictor falls behind.
+func WithWatermarks(high, low float64) Option {
+	return func(o *options) {
+		o.high = high
+		o.low = low
+	}
 }
 
-// NewShardedCache creates 8 distinct LRU caches, dividing capacity among them.
-func NewShardedCache(totalCapacity int) *ShardedCache {
-	sc := &ShardedCache{}
+// New creates a cache of SHARD_COUNT shards per partition, dividing capacity
+// among them.
+func New[K comparable, V any](totalCapacity int, opts ...Option) *Cache[K, V] {
+	o := options{policy: PolicyLRU}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	c := &Cache[K, V]{
+		hash:   keyHasher[K](),
+		ttl:    o.ttl,
+		jitter: o.jitter,
+	}
+	c.ring.Store(hashring.NewUniform(SHARD_COUNT, hashring.DefaultReplicas))
+	if o.weigher != nil {
+		weigher, ok := o.weigher.(func(V) int)
+		if !ok {
+			panic(fmt.Sprintf("cache: weigher %T does not match value type", o.weigher))
+		}
+		c.weigher = weigher
+	}
+	if len(o.pins) > 0 && o.pinMaxWeight > 0 {
+		c.pins = &pinBudget{prefixes: o.pins, max: o.pinMaxWeight}
+	}
 
-	
-	shardCap := totalCapacity / SHARD_COUNT
-	if shardCap < 1 {
-		shardCap = 1
+	// The default partition gets whatever share is not reserved
+	shares := []Partition{{Name: defaultPartition, Percent: 100}}
+	if len(o.partitions) > 0 {
+		c.partitionIndex = make(map[string]int)
+		for _, p := range o.partitions {
+			shares[0].Percent -= p.Percent
+			c.partitionIndex[p.Name] = len(shares)
+			shares = append(shares, p)
+		}
 	}
 
-	// Initialize each shard
-	for i := 0; i < SHARD_COUNT; i++ {
-		sc.shards[i] = &lruShard{
-			capacity: shardCap,
-			cache:    make(map[string]*list.Element),
-			lru:      list.New(),
+	watermarks := o.high > 0 && o.low > 0 && o.low < o.high && o.high <= 1
+
+	for _, p := range shares {
+		capacity := int(float64(totalCapacity) * p.Percent / 100)
+		c.partitions = append(c.partitions, partition{name: p.Name, capacity: capacity})
+
+		shardCap := capacity / SHARD_COUNT
+		if shardCap < 1 {
+			shardCap = 1
+		}
+		maxWeight := int64(float64(o.maxWeight) * p.Percent / 100)
+		shardWeight := maxWeight / SHARD_COUNT
+		if o.maxWeight > 0 && shardWeight < 1 {
+			shardWeight = 1
+		}
+
+		// Initialize each shard
+		for i := 0; i < SHARD_COUNT; i++ {
+			shard := &cacheShard[K, V]{
+				capacity:  shardCap,
+				maxWeight: shardWeight,
+				entries:   make(map[K]*entry[K, V]),
+				policy:    newPolicy[K, V](o.policy, shardCap),
+				loads:     make(map[K]*call[V]),
+				pins:      c.pins,
+			}
+			if watermarks {
+				shard.highCount = int(float64(shardCap) * o.high)
+				shard.lowCount = int(float64(shardCap) * o.low)
+				shard.highWeight = int64(float64(shardWeight) * o.high)
+				shard.lowWeight = int64(float64(shardWeight) * o.low)
+			}
+			c.shards = append(c.shards, shard)
+		}
+	}
+
+	if watermarks {
+		c.evictCh = make(chan int, len(c.shards))
+		c.stop = make(chan struct{})
+		c.done = make(chan struct{})
+		go c.evictLoop()
+	}
+
+	return c
+}
+
+// evictBatch bounds how long the background evictor holds a shard lock.
+const evictBatch = 64
+
+func (c *Cache[K, V]) evictLoop() {
+	defer close(c.done)
+	for {
+		select {
+		case <-c.stop:
+			return
+		case idx := <-c.evictCh:
+			c.evictToLow(c.shards[idx])
+		}
+	}
+}
+
+// evictToLow evicts a shard down to its low watermark in small batches so
+// readers and writers can interleave.
+func (c *Cache[K, V]) evictToLow(shard *cacheShard[K, V]) {
+	for {
+		shard.mu.Lock()
+		for i := 0; i < evictBatch && shard.aboveLow(); i++ {
+			victim := shard.policy.evict()
+			if victim == nil {
+				break
+			}
+			delete(shard.entries, victim.key)
+			shard.weight -= int64(victim.weight)
+			shard.evictions++
+		}
+		more := shard.aboveLow() && len(shard.entries) > shard.pinnedCount
+		if !more {
+			shard.evictQueued = false
+		}
+		shard.mu.Unlock()
+
+		if !more {
+			return
 		}
 	}
+}
+
+// queueEviction hands a shard over its high watermark to the background
+// evictor. Callers must hold the shard lock.
+func (c *Cache[K, V]) queueEviction(idx int, shard *cacheShard[K, V]) {
+	if c.evictCh == nil || shard.evictQueued || !shard.aboveHigh() {
+		return
+	}
+	select {
+	case c.evictCh <- idx:
+		shard.evictQueued = true
+	default:
+	}
+}
 
-	return sc
+// Close stops the background evictor, if any.
+func (c *Cache[K, V]) Close() {
+	if c.stop == nil {
+		return
+	}
+	close(c.stop)
+	<-c.done
 }
 
+// NewShardedCache creates a string cache whose entries weigh their value
+// length in bytes, so WithMaxWeight bounds memory.
+func NewShardedCache(totalCapacity int, opts ...Option) *ShardedCache {
+	opts = append([]Option{WithWeigher(func(v string) int { return len(v) })}, opts...)
+	return New[string, string](totalCapacity, opts...)
+}
 
-func hash(key string) uint64 {
-	var h uint64 = 14695981039346656037
-	for i := 0; i < len(key); i++ {
-		h ^= uint64(key[i])
-		h *= 1099511628211
+// keyHasher returns the hash that places keys of type K on the ring. It
+// runs on every operation, so it is fasthash's hardware-accelerated hash
+// rather than the ring's own; shard placement need not survive a restart.
+func keyHasher[K comparable]() func(K) uint64 {
+	var zero K
+	if _, ok := any(zero).(string); ok {
+		return func(key K) uint64 {
+			return fasthash.String(any(key).(string))
+		}
+	}
+	return func(key K) uint64 {
+		return fasthash.String(fmt.Sprint(key))
 	}
-	return h
 }
 
-// getShard determines which shard owns the key
-func (sc *ShardedCache) getShard(key string) *lruShard {
-	h := hash(key)
-	// Fast bitwise modulo: h % 8 == h & 7
-	return sc.shards[h&(SHARD_COUNT-1)]
+// expiry returns the jittered absolute expiration for ttl, or the zero time
+// when ttl is not positive.
+func (c *Cache[K, V]) expiry(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	if c.jitter > 0 {
+		// Scale by a uniform factor in [1-jitter, 1+jitter)
+		ttl = time.Duration(float64(ttl) * (1 + c.jitter*(2*rand.Float64()-1)))
+	}
+	return time.Now().Add(ttl)
+}
+
+func (c *Cache[K, V]) weigh(value V) int {
+	if c.weigher == nil {
+		return 1
+	}
+	return c.weigher(value)
+}
+
+// shardIndex determines which shard owns the key: the key's partition picks
+// a group of shards and the hash ring picks one within it.
+func (c *Cache[K, V]) shardIndex(key K) int {
+	return c.partitionOf(key)*SHARD_COUNT + c.ring.Load().LocateHash(c.hash(key))
+}
+
+func (c *Cache[K, V]) getShard(key K) *cacheShard[K, V] {
+	return c.shards[c.shardIndex(key)]
 }
 
 // --- Public API ---
 
-func (sc *ShardedCache) Get(key string) (string, bool) {
-	shard := sc.getShard(key)
+func (c *Cache[K, V]) Get(key K) (V, bool) {
+	v, ok := c.GetVersioned(key)
+	return v.Value, ok
+}
 
+// GetVersioned is Get that also returns the entry's version and update time,
+// so callers can answer conditional requests without reloading the value.
+// Versions grow monotonically across the whole cache with every write.
+func (c *Cache[K, V]) GetVersioned(key K) (Versioned[V], bool) {
+	shard := c.getShard(key)
+	prev := c.previousShard(key, shard)
+	if v, ok := shard.get(key, prev == nil); ok || prev == nil {
+		return v, ok
+	}
+	// While rebalancing, the key may not have moved yet
+	return prev.get(key, true)
+}
+
+// get looks key up in the shard, counting a hit or, if countMiss, a miss.
+func (shard *cacheShard[K, V]) get(key K, countMiss bool) (Versioned[V], bool) {
 	shard.mu.Lock()
 	defer shard.mu.Unlock()
 
-	if elem, ok := shard.cache[key]; ok {
-		shard.lru.MoveToFront(elem)
+	if e, ok := shard.entries[key]; ok {
+		now := time.Now()
+		if e.expired(now) {
+			shard.remove(e)
+			shard.misses++
+			return Versioned[V]{}, false
+		}
+		if !e.pinned {
+			shard.policy.touch(e)
+		}
 		shard.hits++
-		return elem.Value.(*entry).value, true
+		e.hits++
+		e.lastAccess = now
+		return Versioned[V]{
+			Value:       e.value,
+			Version:     e.version,
+			Revision:    e.revision,
+			UpdatedAt:   e.insertedAt,
+			ExpiresAt:   e.expiresAt,
+			ContentType: e.contentType,
+		}, true
+	}
+	if countMiss {
+		shard.misses++
+	}
+	return Versioned[V]{}, false
+}
+
+// GetOrLoad returns the cached value for key or, on a miss, calls loader and
+// caches its result. Concurrent misses for the same key share a single loader
+// call. Loader errors are returned to every waiter and nothing is cached; a
+// loader that panics returns an error. A Put, Delete or Clear of the key
+// while loader runs wins: loader's result is returned but not cached.
+func (c *Cache[K, V]) GetOrLoad(key K, loader func() (V, error)) (V, error) {
+	if v, ok := c.Get(key); ok {
+		return v, nil
 	}
-	shard.misses++
-	return "", false
+	v, err := c.load(key, func() (Versioned[V], error) {
+		value, err := loader()
+		return Versioned[V]{Value: value}, err
+	})
+	return v.Value, err
 }
 
-func (sc *ShardedCache) Put(key, value string) {
-	shard := sc.getShard(key)
+// GetOrLoadVersioned is GetOrLoad returning the entry's version on a hit.
+// loader's value is cached with its Revision and ExpiresAt, as by
+// PutVersioned. Values produced by loader report version 0.
+func (c *Cache[K, V]) GetOrLoadVersioned(key K, loader func() (Versioned[V], error)) (Versioned[V], error) {
+	if v, ok := c.GetVersioned(key); ok {
+		return v, nil
+	}
+	return c.load(key, loader)
+}
+
+// load runs loader for a key that missed, sharing the call with concurrent
+// loads of the same key.
+func (c *Cache[K, V]) load(key K, loader func() (Versioned[V], error)) (Versioned[V], error) {
+	shard := c.getShard(key)
+
+	shard.mu.Lock()
+	if cl, ok := shard.loads[key]; ok {
+		shard.mu.Unlock()
+		cl.wg.Wait()
+		return cl.value, cl.err
+	}
+	cl := &call[V]{}
+	cl.wg.Add(1)
+	shard.loads[key] = cl
+	shard.mu.Unlock()
+
+	// Waiters must not block forever on a loader that panicked
+	defer func() {
+		shard.mu.Lock()
+		delete(shard.loads, key)
+		shard.mu.Unlock()
+		cl.wg.Done()
+	}()
+
+	cl.run(loader)
+	cl.value.Version = 0
+	if cl.err == nil {
+		c.putUnless(key, cl.value, c.deadline(cl.value.ExpiresAt), &cl.stale)
+	}
+	return cl.value, cl.err
+}
+
+// run calls loader, turning a panic into the call's error.
+func (cl *call[V]) run(loader func() (Versioned[V], error)) {
+	defer func() {
+		if r := recover(); r != nil {
+			cl.err = fmt.Errorf("cache: loader panicked: %v", r)
+		}
+	}()
+	cl.value, cl.err = loader()
+}
+
+func (c *Cache[K, V]) Put(key K, value V) {
+	c.put(key, Versioned[V]{Value: value}, c.expiry(c.ttl))
+}
+
+// PutVersioned is Put recording v's Revision and ContentType, which
+// GetVersioned reports back. A non-zero v.ExpiresAt expires the entry no
+// later than that.
+func (c *Cache[K, V]) PutVersioned(key K, v Versioned[V]) {
+	c.put(key, v, c.deadline(v.ExpiresAt))
+}
+
+// PutWithTTL stores the value with an explicit time-to-live, overriding the
+// cache default. The configured jitter is still applied. Values heavier than
+// a whole shard's weight budget are not cached.
+func (c *Cache[K, V]) PutWithTTL(key K, value V, ttl time.Duration) {
+	c.put(key, Versioned[V]{Value: value}, c.expiry(ttl))
+}
+
+// deadline is the expiry of an entry that must not outlive expiresAt.
+func (c *Cache[K, V]) deadline(expiresAt time.Time) time.Time {
+	ttlExpiry := c.expiry(c.ttl)
+	if expiresAt.IsZero() || (!ttlExpiry.IsZero() && ttlExpiry.Before(expiresAt)) {
+		return ttlExpiry
+	}
+	return expiresAt
+}
+
+// put stores v's value, revision and content type, expiring at expiresAt.
+func (c *Cache[K, V]) put(key K, v Versioned[V], expiresAt time.Time) {
+	c.putUnless(key, v, expiresAt, nil)
+}
+
+// putUnless is put, skipped if stale is set by the time the shard is
+// locked.
+func (c *Cache[K, V]) putUnless(key K, v Versioned[V], expiresAt time.Time, stale *atomic.Bool) {
+	idx := c.shardIndex(key)
+	shard := c.shards[idx]
+
+	// While rebalancing, drop the copy that has not moved yet so it cannot
+	// be served after this write
+	if prev := c.previousShard(key, shard); prev != nil {
+		prev.delete(key)
+	}
+
+	value := v.Value
+	weight := c.weigh(value)
 
 	shard.mu.Lock()
 	defer shard.mu.Unlock()
 
-	// Check for update
-	if elem, ok := shard.cache[key]; ok {
-		shard.lru.MoveToFront(elem)
-		elem.Value.(*entry).value = value
+	if stale != nil && stale.Load() {
 		return
 	}
+	shard.invalidateLoad(key)
+
+	oversized := shard.maxWeight > 0 && int64(weight) > shard.maxWeight
 
-	// Check for eviction
-	if shard.lru.Len() >= shard.capacity {
-		oldest := shard.lru.Back()
-		if oldest != nil {
-			shard.lru.Remove(oldest)
-			delete(shard.cache, oldest.Value.(*entry).key)
+	// Check for update
+	if e, ok := shard.entries[key]; ok {
+		if oversized && !e.pinned {
+			shard.remove(e)
+			return
+		}
+		if !e.pinned {
+			shard.policy.touch(e)
 		}
+		shard.reweigh(e, weight)
+		e.value = value
+		e.insertedAt = time.Now()
+		e.expiresAt = expiresAt
+		e.version = c.version.Add(1)
+		e.revision = v.Revision
+		e.contentType = v.ContentType
+		shard.evictUntilFits(0, 0)
+		c.queueEviction(idx, shard)
+		return
 	}
 
 	// Add new
-	elem := shard.lru.PushFront(&entry{key: key, value: value})
-	shard.cache[key] = elem
+	c.adopt(shard, &entry[K, V]{
+		key:         key,
+		value:       value,
+		weight:      weight,
+		insertedAt:  time.Now(),
+		expiresAt:   expiresAt,
+		version:     c.version.Add(1),
+		revision:    v.Revision,
+		contentType: v.ContentType,
+	})
+	c.queueEviction(idx, shard)
+}
+
+// adopt makes e, which is not resident anywhere, resident in the shard,
+// pinning it if its key is pinned and the pin budget allows. An unpinned
+// entry heavier than the whole shard is dropped. Callers must hold the
+// shard lock.
+func (c *Cache[K, V]) adopt(shard *cacheShard[K, V], e *entry[K, V]) {
+	weight := int64(e.weight)
+	e.pinned = c.pins.matches(keyString(e.key)) && c.pins.reserve(weight)
+	if e.pinned {
+		shard.pinnedCount++
+		shard.pinnedWeight += weight
+	} else {
+		if shard.maxWeight > 0 && weight > shard.maxWeight {
+			return
+		}
+		// Check for eviction
+		shard.evictUntilFits(1, weight)
+		shard.policy.add(e)
+	}
+	shard.entries[e.key] = e
+	shard.weight += weight
+}
+
+func (c *Cache[K, V]) Delete(key K) {
+	shard := c.getShard(key)
+
+	// The old copy goes first, so a move cannot slip in between and bring
+	// the key back
+	if prev := c.previousShard(key, shard); prev != nil {
+		prev.delete(key)
+	}
+	shard.delete(key)
+}
+
+func (shard *cacheShard[K, V]) delete(key K) {
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	shard.invalidateLoad(key)
+	if e, ok := shard.entries[key]; ok {
+		shard.remove(e)
+	}
+}
+
+// Clear removes every entry, keeping hit/miss stats.
+func (c *Cache[K, V]) Clear() {
+	for _, shard := range c.shards {
+		shard.mu.Lock()
+		for _, e := range shard.entries {
+			shard.remove(e)
+		}
+		for key := range shard.loads {
+			shard.invalidateLoad(key)
+		}
+		shard.mu.Unlock()
+	}
+}
+
+// Keys returns up to limit resident keys whose string form starts with
+// prefix (limit <= 0 means no limit). Shards are visited one at a time, so
+// each shard's keys are a consistent snapshot but writes to other shards may
+// interleave; the full cache is never locked at once.
+func (c *Cache[K, V]) Keys(prefix string, limit int) []K {
+	var keys []K
+	now := time.Now()
+
+	for _, shard := range c.shards {
+		shard.mu.Lock()
+		for key, e := range shard.entries {
+			if limit > 0 && len(keys) >= limit {
+				break
+			}
+			if e.expired(now) || !strings.HasPrefix(keyString(key), prefix) {
+				continue
+			}
+			keys = append(keys, key)
+		}
+		shard.mu.Unlock()
+
+		if limit > 0 && len(keys) >= limit {
+			break
+		}
+	}
+	return keys
 }
 
-func (sc *ShardedCache) Delete(key string) {
-	shard := sc.getShard(key)
+func keyString[K comparable](key K) string {
+	if s, ok := any(key).(string); ok {
+		return s
+	}
+	return fmt.Sprint(key)
+}
+
+// Inspect returns metadata (insert time, last access, hit count) for a
+// resident, unexpired entry without affecting recency or hit/miss stats.
+func (c *Cache[K, V]) Inspect(key K) (EntryInfo[V], bool) {
+	idx := c.shardIndex(key)
+	shard := c.shards[idx]
 
 	shard.mu.Lock()
 	defer shard.mu.Unlock()
 
-	if elem, ok := shard.cache[key]; ok {
-		shard.lru.Remove(elem)
-		delete(shard.cache, key)
+	e, ok := shard.entries[key]
+	if !ok {
+		return EntryInfo[V]{Shard: idx}, false
+	}
+	if e.expired(time.Now()) {
+		return EntryInfo[V]{Shard: idx}, false
 	}
+	return EntryInfo[V]{
+		Shard:      idx,
+		Value:      e.value,
+		Weight:     e.weight,
+		InsertedAt: e.insertedAt,
+		LastAccess: e.lastAccess,
+		Hits:       e.hits,
+		ExpiresAt:  e.expiresAt,
+		Version:    e.version,
+		Revision:   e.revision,
+	}, true
 }
 
-func (sc *ShardedCache) GetStats() (totalHits, totalMisses uint64) {
+func (c *Cache[K, V]) GetStats() (totalHits, totalMisses uint64) {
 	// Aggregate stats from all shards
-	for _, shard := range sc.shards {
+	for _, shard := range c.shards {
 		shard.mu.Lock()
 		totalHits += shard.hits
 		totalMisses += shard.misses
@@ -131,3 +820,170 @@ func (sc *ShardedCache) GetStats() (totalHits, totalMisses uint64) {
 	}
 	return
 }
+
+// Evictions returns the number of entries evicted for capacity.
+func (c *Cache[K, V]) Evictions() uint64 {
+	var total uint64
+	for _, shard := range c.shards {
+		shard.mu.Lock()
+		total += shard.evictions
+		shard.mu.Unlock()
+	}
+	return total
+}
+
+// ExpiringEntry identifies a resident entry that is about to expire.
+type ExpiringEntry[K comparable] struct {
+	Key        K
+	Hits       uint64
+	InsertedAt time.Time
+	ExpiresAt  time.Time
+}
+
+// HotExpiring returns up to limit entries expiring within the given window,
+// most frequently hit first, as candidates for refresh-ahead.
+func (c *Cache[K, V]) HotExpiring(within time.Duration, limit int) []ExpiringEntry[K] {
+	now := time.Now()
+	deadline := now.Add(within)
+
+	var candidates []ExpiringEntry[K]
+	for _, shard := range c.shards {
+		shard.mu.Lock()
+		for key, e := range shard.entries {
+			if e.expiresAt.IsZero() || e.expired(now) || e.expiresAt.After(deadline) || e.hits == 0 {
+				continue
+			}
+			candidates = append(candidates, ExpiringEntry[K]{
+				Key:        key,
+				Hits:       e.hits,
+				InsertedAt: e.insertedAt,
+				ExpiresAt:  e.expiresAt,
+			})
+		}
+		shard.mu.Unlock()
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Hits > candidates[j].Hits
+	})
+	if limit > 0 && len(candidates) > limit {
+		candidates = candidates[:limit]
+	}
+	return candidates
+}
+
+// HotKeys returns up to limit resident keys that have been hit, most
+// frequently hit first, e.g. to reload them after the cache is cleared.
+func (c *Cache[K, V]) HotKeys(limit int) []K {
+	type hot struct {
+		key  K
+		hits uint64
+	}
+	now := time.Now()
+
+	var candidates []hot
+	for _, shard := range c.shards {
+		shard.mu.Lock()
+		for key, e := range shard.entries {
+			if e.hits > 0 && !e.expired(now) {
+				candidates = append(candidates, hot{key, e.hits})
+			}
+		}
+		shard.mu.Unlock()
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].hits > candidates[j].hits
+	})
+	if limit > 0 && len(candidates) > limit {
+		candidates = candidates[:limit]
+	}
+	keys := make([]K, len(candidates))
+	for i, candidate := range candidates {
+		keys[i] = candidate.key
+	}
+	return keys
+}
+
+// Warm loads key with loader unless it is already resident, sharing the call
+// with concurrent misses as GetOrLoadVersioned does but without counting a
+// hit or miss. It reports whether the key was loaded.
+func (c *Cache[K, V]) Warm(key K, loader func() (Versioned[V], error)) (bool, error) {
+	if _, ok := c.Inspect(key); ok {
+		return false, nil
+	}
+	_, err := c.load(key, loader)
+	return err == nil, err
+}
+
+// Refresh replaces the value of a resident entry and restarts its TTL, but
+// only if it has not been rewritten since insertedAt; a concurrent Put always
+// wins over a background refresh. v's Revision, ExpiresAt and ContentType
+// are applied as by PutVersioned. It reports whether the entry was updated.
+func (c *Cache[K, V]) Refresh(key K, v Versioned[V], insertedAt time.Time) bool {
+	expiresAt := c.deadline(v.ExpiresAt)
+	value := v.Value
+	weight := c.weigh(value)
+	shard := c.getShard(key)
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	e, ok := shard.entries[key]
+	if !ok || !e.insertedAt.Equal(insertedAt) {
+		return false
+	}
+	shard.reweigh(e, weight)
+	e.value = value
+	e.insertedAt = time.Now()
+	e.expiresAt = expiresAt
+	e.version = c.version.Add(1)
+	e.revision = v.Revision
+	e.contentType = v.ContentType
+	shard.evictUntilFits(0, 0)
+	return true
+}
+
+// Len returns the number of resident entries, including expired ones not yet
+// removed.
+func (c *Cache[K, V]) Len() int {
+	total := 0
+	for _, shard := range c.shards {
+		shard.mu.Lock()
+		total += len(shard.entries)
+		shard.mu.Unlock()
+	}
+	return total
+}
+
+// Weight returns the summed weight of all resident entries.
+func (c *Cache[K, V]) Weight() int64 {
+	var total int64
+	for _, shard := range c.shards {
+		shard.mu.Lock()
+		total += shard.weight
+		shard.mu.Unlock()
+	}
+	return total
+}
+
+// MemoryUsage approximates the memory held by resident entries: key bytes,
+// value weight (bytes for a ShardedCache) and the per-entry bookkeeping of
+// the entry struct, its policy list element and its map slot. It walks every
+// shard, so it is meant for periodic reporting rather than the hot path.
+func (c *Cache[K, V]) MemoryUsage() int64 {
+	var zero entry[K, V]
+	overhead := int64(unsafe.Sizeof(zero) + unsafe.Sizeof(list.Element{}) +
+		unsafe.Sizeof(zero.key) + unsafe.Sizeof(&zero))
+
+	var total int64
+	for _, shard := range c.shards {
+		shard.mu.Lock()
+		for key := range shard.entries {
+			total += int64(len(keyString(key))) + overhead
+		}
+		total += shard.weight
+		shard.mu.Unlock()
+	}
+	return total
+}
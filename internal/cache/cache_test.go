@@ -0,0 +1,289 @@
+package cache
+
+import (
+	"container/list"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lruModel is a reference LRU for a single shard.
+type lruModel struct {
+	capacity int
+	order    *list.List
+	items    map[string]*list.Element
+	values   map[string]string
+}
+
+func newLRUModel(capacity int) *lruModel {
+	return &lruModel{capacity: capacity, order: list.New(), items: map[string]*list.Element{}, values: map[string]string{}}
+}
+
+func (m *lruModel) put(key, value string) {
+	if elem, ok := m.items[key]; ok {
+		m.order.MoveToFront(elem)
+		m.values[key] = value
+		return
+	}
+	if m.order.Len() >= m.capacity {
+		oldest := m.order.Back()
+		m.order.Remove(oldest)
+		delete(m.items, oldest.Value.(string))
+		delete(m.values, oldest.Value.(string))
+	}
+	m.items[key] = m.order.PushFront(key)
+	m.values[key] = value
+}
+
+func (m *lruModel) get(key string) (string, bool) {
+	elem, ok := m.items[key]
+	if !ok {
+		return "", false
+	}
+	m.order.MoveToFront(elem)
+	return m.values[key], true
+}
+
+func (m *lruModel) remove(key string) {
+	if elem, ok := m.items[key]; ok {
+		m.order.Remove(elem)
+		delete(m.items, key)
+		delete(m.values, key)
+	}
+}
+
+// lruCheck drives an LRU cache and a reference model per shard with the
+// same operations, failing on the first observable difference.
+type lruCheck struct {
+	c      *ShardedCache
+	models map[int]*lruModel
+}
+
+const modelShardCapacity = 4
+
+func newLRUCheck() *lruCheck {
+	return &lruCheck{
+		c:      NewShardedCache(modelShardCapacity*SHARD_COUNT, WithPolicy(PolicyLRU)),
+		models: make(map[int]*lruModel),
+	}
+}
+
+func (lc *lruCheck) model(key string) *lruModel {
+	shard := lc.c.shardIndex(key)
+	m, ok := lc.models[shard]
+	if !ok {
+		m = newLRUModel(modelShardCapacity)
+		lc.models[shard] = m
+	}
+	return m
+}
+
+// step applies op to key, op < 5 being a Get, < 9 a Put and the rest a
+// Delete.
+func (lc *lruCheck) step(t testing.TB, i, op int, key string) {
+	m := lc.model(key)
+	switch {
+	case op < 5:
+		got, gotOK := lc.c.Get(key)
+		want, wantOK := m.get(key)
+		if got != want || gotOK != wantOK {
+			t.Fatalf("op %d: Get(%q) = %q, %v; model says %q, %v", i, key, got, gotOK, want, wantOK)
+		}
+	case op < 9:
+		value := fmt.Sprintf("v%d", i)
+		lc.c.Put(key, value)
+		m.put(key, value)
+	default:
+		lc.c.Delete(key)
+		m.remove(key)
+	}
+}
+
+func (lc *lruCheck) finish(t testing.TB) {
+	total := 0
+	for _, m := range lc.models {
+		total += m.order.Len()
+	}
+	if n := lc.c.Len(); n != total {
+		t.Fatalf("cache holds %d entries, model holds %d", n, total)
+	}
+}
+
+func TestLRUMatchesModel(t *testing.T) {
+	for seed := int64(1); seed <= 5; seed++ {
+		t.Run(fmt.Sprintf("seed=%d", seed), func(t *testing.T) {
+			rng := rand.New(rand.NewSource(seed))
+			lc := newLRUCheck()
+			keySpace := modelShardCapacity * SHARD_COUNT * 3
+			for i := 0; i < 20000; i++ {
+				lc.step(t, i, rng.Intn(10), fmt.Sprintf("key_%d", rng.Intn(keySpace)))
+			}
+			lc.finish(t)
+		})
+	}
+}
+
+// FuzzLRU reads ops as pairs of bytes, an operation and a key, and checks
+// the LRU cache against the model.
+func FuzzLRU(f *testing.F) {
+	f.Add([]byte{0, 1, 5, 1, 0, 1, 9, 1, 0, 1})
+	f.Add([]byte{5, 0, 5, 1, 5, 2, 5, 3, 5, 4, 0, 0})
+	f.Fuzz(func(t *testing.T, ops []byte) {
+		lc := newLRUCheck()
+		for i := 0; i+1 < len(ops); i += 2 {
+			lc.step(t, i/2, int(ops[i]%10), fmt.Sprintf("key_%d", ops[i+1]))
+		}
+		lc.finish(t)
+	})
+}
+
+// checkAccounting requires c to be within its bounds and its weight to be
+// the sum of its entries' weights.
+func checkAccounting(t testing.TB, c *ShardedCache, capacity int, maxWeight int64) {
+	if n := c.Len(); n > capacity {
+		t.Fatalf("%d entries exceed capacity %d", n, capacity)
+	}
+	if w := c.Weight(); w > maxWeight {
+		t.Fatalf("weight %d exceeds max %d", w, maxWeight)
+	}
+	var sum int64
+	for _, key := range c.Keys("", 0) {
+		if info, ok := c.Inspect(key); ok {
+			sum += int64(info.Weight)
+		}
+	}
+	if sum != c.Weight() {
+		t.Fatalf("entry weights sum to %d but cache reports %d", sum, c.Weight())
+	}
+}
+
+func TestPoliciesKeepAccounting(t *testing.T) {
+	const capacity = 64 * SHARD_COUNT
+	const maxWeight = 4096 * SHARD_COUNT
+	const workers, ops = 8, 20000
+
+	for _, policy := range []Policy{PolicyLRU, Policy2Q, PolicyARC} {
+		t.Run(string(policy), func(t *testing.T) {
+			c := NewShardedCache(capacity, WithPolicy(policy), WithMaxWeight(maxWeight))
+			defer c.Close()
+
+			var wg sync.WaitGroup
+			for w := 0; w < workers; w++ {
+				wg.Add(1)
+				go func(seed int64) {
+					defer wg.Done()
+					rng := rand.New(rand.NewSource(seed))
+					for i := 0; i < ops/workers; i++ {
+						key := fmt.Sprintf("key_%d", rng.Intn(capacity*4))
+						switch rng.Intn(4) {
+						case 0, 1:
+							c.Get(key)
+						case 2:
+							c.Put(key, strings.Repeat("x", rng.Intn(256)))
+						default:
+							c.Delete(key)
+						}
+					}
+				}(int64(w))
+			}
+			wg.Wait()
+			checkAccounting(t, c, capacity, maxWeight)
+		})
+	}
+}
+
+// FuzzPolicies interleaves Put, Get and Delete on every policy from the
+// fuzzed bytes: an operation, a key and a value length per triple.
+func FuzzPolicies(f *testing.F) {
+	f.Add([]byte{0, 1, 10, 1, 1, 0, 2, 1, 0})
+	f.Add([]byte{0, 7, 255, 0, 7, 0, 2, 7, 0, 1, 7, 0})
+	f.Fuzz(func(t *testing.T, ops []byte) {
+		const capacity = 2 * SHARD_COUNT
+		const maxWeight = 512 * SHARD_COUNT
+		for _, policy := range []Policy{PolicyLRU, Policy2Q, PolicyARC} {
+			c := NewShardedCache(capacity, WithPolicy(policy), WithMaxWeight(maxWeight))
+			for i := 0; i+2 < len(ops); i += 3 {
+				key := fmt.Sprintf("key_%d", ops[i+1])
+				switch ops[i] % 3 {
+				case 0:
+					value := strings.Repeat("x", int(ops[i+2]))
+					c.Put(key, value)
+					if got, ok := c.Get(key); ok && got != value {
+						t.Fatalf("%s: Get(%q) after Put = %q", policy, key, got)
+					}
+				case 1:
+					c.Get(key)
+				default:
+					c.Delete(key)
+					if _, ok := c.Get(key); ok {
+						t.Fatalf("%s: %q still cached after Delete", policy, key)
+					}
+				}
+			}
+			checkAccounting(t, c, capacity, maxWeight)
+			c.Close()
+		}
+	})
+}
+
+func TestGetOrLoadSurvivesPanic(t *testing.T) {
+	c := NewShardedCache(100)
+	_, err := c.GetOrLoad("k", func() (string, error) { panic("boom") })
+	if err == nil {
+		t.Fatal("GetOrLoad with a panicking loader returned no error")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if v, err := c.GetOrLoad("k", func() (string, error) { return "v", nil }); v != "v" || err != nil {
+			t.Errorf("GetOrLoad after a panic = %q, %v", v, err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("GetOrLoad after a panic blocked")
+	}
+}
+
+func TestWriteDuringLoadWins(t *testing.T) {
+	for name, write := range map[string]func(c *ShardedCache){
+		"delete": func(c *ShardedCache) { c.Delete("k") },
+		"put":    func(c *ShardedCache) { c.Put("k", "new") },
+		"clear":  func(c *ShardedCache) { c.Clear() },
+	} {
+		t.Run(name, func(t *testing.T) {
+			c := NewShardedCache(100)
+			v, err := c.GetOrLoad("k", func() (string, error) {
+				// The loader read the old value before the write landed
+				write(c)
+				return "old", nil
+			})
+			if v != "old" || err != nil {
+				t.Fatalf("GetOrLoad = %q, %v; want the loaded value", v, err)
+			}
+			got, ok := c.Get("k")
+			if name == "put" {
+				if got != "new" {
+					t.Errorf("Get after a Put during the load = %q, %v; want the Put's value", got, ok)
+				}
+			} else if ok {
+				t.Errorf("Get after a %s during the load = %q; want a miss", name, got)
+			}
+		})
+	}
+}
+
+func TestLoadIsCached(t *testing.T) {
+	c := NewShardedCache(100)
+	if _, err := c.GetOrLoad("k", func() (string, error) { return "v", nil }); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := c.Get("k"); got != "v" || !ok {
+		t.Errorf("Get after GetOrLoad = %q, %v", got, ok)
+	}
+}
@@ -0,0 +1,114 @@
+package cache
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// NamespaceSeparator splits a key's namespace from the rest of the key; the
+// namespace selects the key's cache partition.
+const NamespaceSeparator = "/"
+
+// qualifiedSeparator ends the namespace of keys qualified by the database
+// package. It takes precedence over NamespaceSeparator, so with namespaced
+// routing a partition is a whole namespace.
+const qualifiedSeparator = "\x00"
+
+// defaultPartition holds keys whose namespace has no partition of its own.
+const defaultPartition = ""
+
+// Partition reserves a percentage of the cache for one namespace so churn in
+// other namespaces can't evict its entries.
+type Partition struct {
+	Name    string
+	Percent float64
+}
+
+// PartitionStats describes one partition's occupancy.
+type PartitionStats struct {
+	Name     string `json:"name"`
+	Entries  int    `json:"entries"`
+	Weight   int64  `json:"weight"`
+	Capacity int    `json:"capacity"`
+}
+
+// ParsePartitions parses a spec such as "sessions=80,config=20". Unlisted
+// namespaces share whatever percentage is left over.
+func ParsePartitions(spec string) ([]Partition, error) {
+	if strings.TrimSpace(spec) == "" {
+		return nil, nil
+	}
+
+	var parts []Partition
+	seen := make(map[string]bool)
+	total := 0.0
+	for _, item := range strings.Split(spec, ",") {
+		name, pct, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid partition %q, expected name=percent", item)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate partition %q", name)
+		}
+		percent, err := strconv.ParseFloat(pct, 64)
+		if err != nil || percent <= 0 {
+			return nil, fmt.Errorf("invalid percentage for partition %q", name)
+		}
+		seen[name] = true
+		total += percent
+		parts = append(parts, Partition{Name: name, Percent: percent})
+	}
+	if total > 100 {
+		return nil, fmt.Errorf("partition percentages add up to %.0f%%, more than 100%%", total)
+	}
+	return parts, nil
+}
+
+// WithPartitions splits the cache into independently sized partitions keyed
+// by namespace (the part of the key before NamespaceSeparator).
+func WithPartitions(parts []Partition) Option {
+	return func(o *options) {
+		o.partitions = parts
+	}
+}
+
+// partition is a contiguous group of SHARD_COUNT shards in Cache.shards.
+type partition struct {
+	name     string
+	capacity int
+}
+
+// partitionOf returns the index of the partition owning key.
+func (c *Cache[K, V]) partitionOf(key K) int {
+	if c.partitionIndex == nil {
+		return 0
+	}
+	ns, _, ok := strings.Cut(keyString(key), qualifiedSeparator)
+	if !ok {
+		ns, _, ok = strings.Cut(keyString(key), NamespaceSeparator)
+	}
+	if !ok {
+		return 0
+	}
+	if idx, ok := c.partitionIndex[ns]; ok {
+		return idx
+	}
+	return 0
+}
+
+// Partitions reports per-partition occupancy; the unnamed partition holds
+// namespaces without a dedicated share.
+func (c *Cache[K, V]) Partitions() []PartitionStats {
+	stats := make([]PartitionStats, len(c.partitions))
+	for i, p := range c.partitions {
+		stats[i] = PartitionStats{Name: p.name, Capacity: p.capacity}
+		for _, shard := range c.shards[i*SHARD_COUNT : (i+1)*SHARD_COUNT] {
+			shard.mu.Lock()
+			stats[i].Entries += len(shard.entries)
+			stats[i].Weight += shard.weight
+			shard.mu.Unlock()
+		}
+	}
+	return stats
+}
@@ -0,0 +1,95 @@
+package cache
+
+import (
+	"strings"
+	"sync/atomic"
+)
+
+// pinBudget tracks pinned entries across all shards. Pinned entries are kept
+// out of the eviction policy, so capacity pressure never evicts them; only
+// Delete, Clear and TTL expiry remove them.
+type pinBudget struct {
+	prefixes []string
+	max      int64
+	used     atomic.Int64
+}
+
+// ParsePins parses a comma-separated list of keys or key prefixes to pin.
+func ParsePins(spec string) []string {
+	var prefixes []string
+	for _, p := range strings.Split(spec, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			prefixes = append(prefixes, p)
+		}
+	}
+	return prefixes
+}
+
+// WithPins pins entries whose key starts with any of prefixes, up to
+// maxWeight of pinned weight in total. Whether an entry is pinned is decided
+// when it is inserted; entries that don't fit the budget, or outgrow it when
+// updated, are cached and evicted like any other.
+func WithPins(prefixes []string, maxWeight int64) Option {
+	return func(o *options) {
+		o.pins = prefixes
+		o.pinMaxWeight = maxWeight
+	}
+}
+
+// matches reports whether key should be pinned; a nil budget pins nothing.
+func (b *pinBudget) matches(key string) bool {
+	if b == nil {
+		return false
+	}
+	for _, p := range b.prefixes {
+		if strings.HasPrefix(key, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// reserve claims delta weight from the budget, failing if it would overflow.
+func (b *pinBudget) reserve(delta int64) bool {
+	for {
+		used := b.used.Load()
+		if delta > 0 && used+delta > b.max {
+			return false
+		}
+		if b.used.CompareAndSwap(used, used+delta) {
+			return true
+		}
+	}
+}
+
+// unpin hands a pinned entry's weight back to the budget. Callers must hold
+// the shard lock and add e to the policy if it stays resident.
+func (shard *cacheShard[K, V]) unpin(e *entry[K, V]) {
+	shard.pins.used.Add(-int64(e.weight))
+	shard.pinnedCount--
+	shard.pinnedWeight -= int64(e.weight)
+	e.pinned = false
+}
+
+// reweigh changes a resident entry's weight, demoting a pinned entry that no
+// longer fits the pin budget. Callers must hold the shard lock.
+func (shard *cacheShard[K, V]) reweigh(e *entry[K, V], weight int) {
+	delta := int64(weight - e.weight)
+	if e.pinned && !shard.pins.reserve(delta) {
+		shard.unpin(e)
+		shard.policy.add(e)
+	}
+	if e.pinned {
+		shard.pinnedWeight += delta
+	}
+	shard.weight += delta
+	e.weight = weight
+}
+
+// PinnedWeight returns the total weight of pinned entries.
+func (c *Cache[K, V]) PinnedWeight() int64 {
+	if c.pins == nil {
+		return 0
+	}
+	return c.pins.used.Load()
+}
@@ -0,0 +1,74 @@
+package cache
+
+import (
+	"container/list"
+	"fmt"
+)
+
+// Policy names an eviction policy.
+type Policy string
+
+const (
+	PolicyLRU Policy = "lru"
+	Policy2Q  Policy = "2q"
+	PolicyARC Policy = "arc"
+)
+
+// ParsePolicy validates a policy name from flags or config.
+func ParsePolicy(name string) (Policy, error) {
+	switch p := Policy(name); p {
+	case PolicyLRU, Policy2Q, PolicyARC:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown cache policy %q", name)
+}
+
+// policy orders the entries of a single shard for eviction. All methods are
+// called with the shard lock held.
+type policy[K comparable, V any] interface {
+	// add registers a newly inserted entry.
+	add(e *entry[K, V])
+	// touch records an access to a resident entry.
+	touch(e *entry[K, V])
+	// remove forgets an entry that was deleted or expired.
+	remove(e *entry[K, V])
+	// evict detaches and returns the next victim, or nil when empty.
+	evict() *entry[K, V]
+}
+
+func newPolicy[K comparable, V any](p Policy, capacity int) policy[K, V] {
+	switch p {
+	case Policy2Q:
+		return newTwoQueuePolicy[K, V](capacity)
+	case PolicyARC:
+		return newARCPolicy[K, V](capacity)
+	default:
+		return &lruPolicy[K, V]{lru: list.New()}
+	}
+}
+
+// lruPolicy evicts the least recently used entry.
+type lruPolicy[K comparable, V any] struct {
+	lru *list.List
+}
+
+func (p *lruPolicy[K, V]) add(e *entry[K, V]) {
+	e.elem = p.lru.PushFront(e)
+}
+
+func (p *lruPolicy[K, V]) touch(e *entry[K, V]) {
+	p.lru.MoveToFront(e.elem)
+}
+
+func (p *lruPolicy[K, V]) remove(e *entry[K, V]) {
+	p.lru.Remove(e.elem)
+}
+
+func (p *lruPolicy[K, V]) evict() *entry[K, V] {
+	oldest := p.lru.Back()
+	if oldest == nil {
+		return nil
+	}
+	p.lru.Remove(oldest)
+	return oldest.Value.(*entry[K, V])
+}
@@ -0,0 +1,244 @@
+package cache
+
+import (
+	"errors"
+	"kv-server/internal/hashring"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrRebalancing is returned by Rebalance while an earlier one is running.
+var ErrRebalancing = errors.New("cache: a rebalance is already running")
+
+// Bounds on a shard's ring weight, relative to the initial uniform weight,
+// so one rebalance cannot starve a shard or hand it most of the keys.
+const (
+	minRingWeight = hashring.DefaultReplicas / 8
+	maxRingWeight = hashring.DefaultReplicas * 8
+)
+
+// ShardStats describes one shard's occupancy.
+type ShardStats struct {
+	Shard     int    `json:"shard"`
+	Partition string `json:"partition,omitempty"`
+	Entries   int    `json:"entries"`
+	Weight    int64  `json:"weight"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	// RingWeight is the number of virtual nodes the shard owns on the hash
+	// ring; it starts at hashring.DefaultReplicas
+	RingWeight int `json:"ring_weight"`
+}
+
+// RebalanceStatus reports the last rebalance.
+type RebalanceStatus struct {
+	Running bool   `json:"running"`
+	Moved   uint64 `json:"moved"`
+	// Nil before the first rebalance and while one runs, respectively
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+type rebalanceState struct {
+	mu         sync.Mutex
+	weights    []int
+	running    bool
+	startedAt  time.Time
+	finishedAt time.Time
+	moved      atomic.Uint64
+
+	// The ring keys are moving off; nil outside a rebalance
+	prev atomic.Pointer[hashring.Ring]
+}
+
+// Shards reports per-shard occupancy, in shard order.
+func (c *Cache[K, V]) Shards() []ShardStats {
+	weights := c.ringWeights()
+	stats := make([]ShardStats, len(c.shards))
+	for i, shard := range c.shards {
+		shard.mu.Lock()
+		stats[i] = ShardStats{
+			Shard:      i,
+			Partition:  c.partitions[i/SHARD_COUNT].name,
+			Entries:    len(shard.entries),
+			Weight:     shard.weight,
+			Hits:       shard.hits,
+			Misses:     shard.misses,
+			RingWeight: weights[i%SHARD_COUNT],
+		}
+		shard.mu.Unlock()
+	}
+	return stats
+}
+
+// Rebalance evens out skewed shards online. It rebuilds the hash ring so
+// each shard's share of the key space shrinks or grows in proportion to how
+// far its occupancy (weight, or entries for an unweighted cache) is above
+// or below the mean, then moves the entries whose shard changed in the
+// background. Until the move finishes, a lookup that misses its new shard
+// also tries the old one, and writes and deletes clear the old copy, so no
+// entry is lost or served stale. It fails with ErrRebalancing if a
+// rebalance is already running.
+func (c *Cache[K, V]) Rebalance() error {
+	rb := &c.rebalance
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	if rb.running {
+		return ErrRebalancing
+	}
+
+	rb.weights = c.targetWeights()
+	rb.prev.Store(c.ring.Load())
+	c.ring.Store(hashring.New(rb.weights, 1))
+	rb.running = true
+	rb.startedAt = time.Now()
+	rb.finishedAt = time.Time{}
+	rb.moved.Store(0)
+
+	go c.migrate()
+	return nil
+}
+
+// Rebalancing reports the progress of the last rebalance.
+func (c *Cache[K, V]) Rebalancing() RebalanceStatus {
+	rb := &c.rebalance
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	status := RebalanceStatus{Running: rb.running, Moved: rb.moved.Load()}
+	if started := rb.startedAt; !started.IsZero() {
+		status.StartedAt = &started
+	}
+	if finished := rb.finishedAt; !finished.IsZero() {
+		status.FinishedAt = &finished
+	}
+	return status
+}
+
+// ringWeights returns the ring weight of each shard within a partition.
+func (c *Cache[K, V]) ringWeights() []int {
+	c.rebalance.mu.Lock()
+	defer c.rebalance.mu.Unlock()
+	weights := make([]int, SHARD_COUNT)
+	for i := range weights {
+		weights[i] = hashring.DefaultReplicas
+		if c.rebalance.weights != nil {
+			weights[i] = c.rebalance.weights[i]
+		}
+	}
+	return weights
+}
+
+// targetWeights scales each shard's current ring weight by mean occupancy
+// over its own, summed across partitions since they share the ring. The
+// caller holds c.rebalance.mu.
+func (c *Cache[K, V]) targetWeights() []int {
+	var entries, weight [SHARD_COUNT]float64
+	for i, shard := range c.shards {
+		shard.mu.Lock()
+		entries[i%SHARD_COUNT] += float64(len(shard.entries))
+		weight[i%SHARD_COUNT] += float64(shard.weight)
+		shard.mu.Unlock()
+	}
+	occupancy := weight[:]
+	if c.weigher == nil {
+		occupancy = entries[:]
+	}
+
+	var total float64
+	for _, o := range occupancy {
+		total += o
+	}
+	mean := total / SHARD_COUNT
+
+	weights := make([]int, SHARD_COUNT)
+	for i, o := range occupancy {
+		current := float64(hashring.DefaultReplicas)
+		if c.rebalance.weights != nil {
+			current = float64(c.rebalance.weights[i])
+		}
+		target := maxRingWeight
+		if o > 0 {
+			target = int(math.Round(current * mean / o))
+		} else if total == 0 {
+			target = int(current)
+		}
+		weights[i] = min(max(target, minRingWeight), maxRingWeight)
+	}
+	return weights
+}
+
+// migrate moves every entry that the new ring places in another shard, one
+// entry at a time so readers and writers interleave, then ends the
+// dual-lookup window. Writes since the ring changed go to the new shards,
+// so the second pass only catches writes that were already placed when it
+// changed.
+func (c *Cache[K, V]) migrate() {
+	for pass := 0; pass < 2; pass++ {
+		for idx, src := range c.shards {
+			src.mu.Lock()
+			var moving []K
+			for key := range src.entries {
+				if c.shardIndex(key) != idx {
+					moving = append(moving, key)
+				}
+			}
+			src.mu.Unlock()
+
+			for _, key := range moving {
+				if c.move(key, idx, c.shardIndex(key)) {
+					c.rebalance.moved.Add(1)
+				}
+			}
+		}
+	}
+
+	rb := &c.rebalance
+	rb.mu.Lock()
+	rb.prev.Store(nil)
+	rb.running = false
+	rb.finishedAt = time.Now()
+	rb.mu.Unlock()
+}
+
+// move transfers key's entry from shard from to shard to, unless it is gone
+// or has already been written to its new shard. Both shards are locked, in
+// index order, so a concurrent write or delete sees the key in one place.
+func (c *Cache[K, V]) move(key K, from, to int) bool {
+	src, dst := c.shards[from], c.shards[to]
+	first, second := src, dst
+	if to < from {
+		first, second = dst, src
+	}
+	first.mu.Lock()
+	second.mu.Lock()
+	defer first.mu.Unlock()
+	defer second.mu.Unlock()
+
+	e, ok := src.entries[key]
+	if !ok {
+		return false
+	}
+	src.remove(e)
+	if _, ok := dst.entries[key]; ok || e.expired(time.Now()) {
+		return false
+	}
+	c.adopt(dst, e)
+	c.queueEviction(to, dst)
+	return true
+}
+
+// previousShard returns the shard that owned key before a running
+// rebalance, or nil if there is none or it is current.
+func (c *Cache[K, V]) previousShard(key K, current *cacheShard[K, V]) *cacheShard[K, V] {
+	prev := c.rebalance.prev.Load()
+	if prev == nil {
+		return nil
+	}
+	shard := c.shards[c.partitionOf(key)*SHARD_COUNT+prev.LocateHash(c.hash(key))]
+	if shard == current {
+		return nil
+	}
+	return shard
+}
@@ -0,0 +1,99 @@
+package cache
+
+import "container/list"
+
+const (
+	queueA1in uint8 = iota
+	queueAm
+)
+
+// twoQueuePolicy implements the full 2Q algorithm (Johnson & Shasha). New
+// entries land in the A1in FIFO; keys evicted from A1in are remembered in the
+// A1out ghost queue, and a key that comes back while still remembered is
+// promoted to the Am LRU. One-off scans therefore churn A1in without pushing
+// the frequently used set out of Am.
+type twoQueuePolicy[K comparable, V any] struct {
+	kin  int
+	kout int
+
+	a1in  *list.List
+	am    *list.List
+	a1out *list.List
+	ghost map[K]*list.Element
+}
+
+func newTwoQueuePolicy[K comparable, V any](capacity int) *twoQueuePolicy[K, V] {
+	// Sizes recommended by the paper: A1in 25%, A1out 50% of capacity
+	kin := capacity / 4
+	if kin < 1 {
+		kin = 1
+	}
+	kout := capacity / 2
+	if kout < 1 {
+		kout = 1
+	}
+	return &twoQueuePolicy[K, V]{
+		kin:   kin,
+		kout:  kout,
+		a1in:  list.New(),
+		am:    list.New(),
+		a1out: list.New(),
+		ghost: make(map[K]*list.Element),
+	}
+}
+
+func (p *twoQueuePolicy[K, V]) add(e *entry[K, V]) {
+	if g, ok := p.ghost[e.key]; ok {
+		// Seen recently enough to be remembered: treat as hot
+		p.a1out.Remove(g)
+		delete(p.ghost, e.key)
+		e.queue = queueAm
+		e.elem = p.am.PushFront(e)
+		return
+	}
+	e.queue = queueA1in
+	e.elem = p.a1in.PushFront(e)
+}
+
+func (p *twoQueuePolicy[K, V]) touch(e *entry[K, V]) {
+	// Hits in A1in are deliberately ignored; correlated references shortly
+	// after insertion should not promote an entry.
+	if e.queue == queueAm {
+		p.am.MoveToFront(e.elem)
+	}
+}
+
+func (p *twoQueuePolicy[K, V]) remove(e *entry[K, V]) {
+	if e.queue == queueAm {
+		p.am.Remove(e.elem)
+	} else {
+		p.a1in.Remove(e.elem)
+	}
+}
+
+func (p *twoQueuePolicy[K, V]) evict() *entry[K, V] {
+	if p.a1in.Len() > p.kin || p.am.Len() == 0 {
+		oldest := p.a1in.Back()
+		if oldest == nil {
+			return nil
+		}
+		p.a1in.Remove(oldest)
+		e := oldest.Value.(*entry[K, V])
+		p.remember(e.key)
+		return e
+	}
+
+	oldest := p.am.Back()
+	p.am.Remove(oldest)
+	return oldest.Value.(*entry[K, V])
+}
+
+// remember records an evicted A1in key in the bounded A1out ghost queue.
+func (p *twoQueuePolicy[K, V]) remember(key K) {
+	p.ghost[key] = p.a1out.PushFront(key)
+	if p.a1out.Len() > p.kout {
+		oldest := p.a1out.Back()
+		p.a1out.Remove(oldest)
+		delete(p.ghost, oldest.Value.(K))
+	}
+}
@@ -0,0 +1,239 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// IndexAdvisor is implemented by stores that can recommend indexes for the
+// observed query workload.
+type IndexAdvisor interface {
+	IndexAdvice() (*IndexReport, error)
+	CreateAdvisedIndex(name string) error
+}
+
+var _ IndexAdvisor = (*PostgresDB)(nil)
+
+// maxAdviceStatements bounds the statements listed in a report.
+const maxAdviceStatements = 20
+
+// indexRule recommends an index when kv_store statements match pattern and
+// no existing index satisfies it. Rules requiring a column are skipped
+// until a migration adds it.
+type indexRule struct {
+	name    string
+	column  string
+	pattern string
+	// satisfied reports whether an existing index definition already covers
+	// the rule
+	satisfied func(indexDef string) bool
+	create    string
+	reason    string
+}
+
+var indexRules = []indexRule{
+	{
+		name:    "kv_store_key_prefix_idx",
+		column:  "key",
+		pattern: " like ",
+		satisfied: func(def string) bool {
+			return strings.Contains(def, "text_pattern_ops") || strings.Contains(def, `COLLATE "C"`)
+		},
+		create: `CREATE INDEX CONCURRENTLY IF NOT EXISTS kv_store_key_prefix_idx ON kv_store (namespace, key text_pattern_ops)`,
+		reason: "prefix scans (LIKE 'p%') cannot use the primary key index under a non-C collation",
+	},
+	{
+		name:    "kv_store_updated_at_idx",
+		column:  "updated_at",
+		pattern: "updated_at",
+		satisfied: func(def string) bool {
+			return strings.Contains(def, "(updated_at")
+		},
+		create: `CREATE INDEX CONCURRENTLY IF NOT EXISTS kv_store_updated_at_idx ON kv_store (updated_at)`,
+		reason: "statements filter or sort on updated_at",
+	},
+	{
+		name:    "kv_store_namespace_idx",
+		column:  "namespace",
+		pattern: "namespace",
+		satisfied: func(def string) bool {
+			return strings.Contains(def, "(namespace")
+		},
+		create: `CREATE INDEX CONCURRENTLY IF NOT EXISTS kv_store_namespace_idx ON kv_store (namespace, key)`,
+		reason: "statements filter on namespace",
+	},
+}
+
+// StatementStat is one normalized kv_store statement from pg_stat_statements.
+type StatementStat struct {
+	Query       string  `json:"query"`
+	Calls       int64   `json:"calls"`
+	TotalTimeMs float64 `json:"total_time_ms"`
+	MeanTimeMs  float64 `json:"mean_time_ms"`
+	Rows        int64   `json:"rows"`
+}
+
+// Recommendation is a missing index worth creating.
+type Recommendation struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+	SQL    string `json:"sql"`
+	// Calls and TotalTimeMs sum the statements that would benefit
+	Calls       int64   `json:"calls"`
+	TotalTimeMs float64 `json:"total_time_ms"`
+}
+
+// IndexReport describes the kv_store workload and the indexes it lacks.
+type IndexReport struct {
+	StatementsAvailable bool             `json:"statements_available"`
+	StatementsError     string           `json:"statements_error,omitempty"`
+	Statements          []StatementStat  `json:"statements"`
+	Indexes             []string         `json:"indexes"`
+	SeqScans            int64            `json:"seq_scans"`
+	IndexScans          int64            `json:"index_scans"`
+	Recommendations     []Recommendation `json:"recommendations"`
+}
+
+// IndexAdvice inspects pg_stat_statements (if the extension is installed)
+// and the existing kv_store indexes, and recommends indexes for the
+// statements actually being run.
+func (p *PostgresDB) IndexAdvice() (*IndexReport, error) {
+	report := &IndexReport{Statements: []StatementStat{}, Recommendations: []Recommendation{}}
+
+	indexes, err := p.kvIndexes()
+	if err != nil {
+		return nil, err
+	}
+	report.Indexes = indexes
+
+	columns, err := p.kvColumns()
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.db.QueryRow(`SELECT coalesce(seq_scan, 0), coalesce(idx_scan, 0)
+			  FROM pg_stat_user_tables WHERE relname = 'kv_store'`).Scan(&report.SeqScans, &report.IndexScans)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	var installed bool
+	err = p.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'pg_stat_statements')`).Scan(&installed)
+	if err != nil {
+		return nil, err
+	}
+	if !installed {
+		report.StatementsError = "pg_stat_statements is not installed; add it to shared_preload_libraries and CREATE EXTENSION pg_stat_statements"
+		return report, nil
+	}
+
+	statements, err := p.kvStatements()
+	if err != nil {
+		// Usually a missing shared_preload_libraries entry or an old version
+		report.StatementsError = err.Error()
+		return report, nil
+	}
+	report.StatementsAvailable = true
+	report.Statements = statements
+	if len(report.Statements) > maxAdviceStatements {
+		report.Statements = report.Statements[:maxAdviceStatements]
+	}
+
+	for _, rule := range indexRules {
+		if !columns[rule.column] || ruleSatisfied(rule, indexes) {
+			continue
+		}
+		rec := Recommendation{Name: rule.name, Reason: rule.reason, SQL: rule.create}
+		for _, st := range statements {
+			if strings.Contains(strings.ToLower(st.Query), rule.pattern) {
+				rec.Calls += st.Calls
+				rec.TotalTimeMs += st.TotalTimeMs
+			}
+		}
+		if rec.Calls > 0 {
+			report.Recommendations = append(report.Recommendations, rec)
+		}
+	}
+	return report, nil
+}
+
+// CreateAdvisedIndex creates one of the indexes IndexAdvice can recommend,
+// without blocking writes. Only known index names are accepted.
+func (p *PostgresDB) CreateAdvisedIndex(name string) error {
+	for _, rule := range indexRules {
+		if rule.name == name {
+			_, err := p.db.Exec(rule.create)
+			return err
+		}
+	}
+	return fmt.Errorf("unknown index %q", name)
+}
+
+func ruleSatisfied(rule indexRule, indexes []string) bool {
+	for _, def := range indexes {
+		if rule.satisfied(def) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *PostgresDB) kvIndexes() ([]string, error) {
+	rows, err := p.db.Query(`SELECT indexdef FROM pg_indexes WHERE tablename = 'kv_store' ORDER BY indexname`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	indexes := []string{}
+	for rows.Next() {
+		var def string
+		if err := rows.Scan(&def); err != nil {
+			return nil, err
+		}
+		indexes = append(indexes, def)
+	}
+	return indexes, rows.Err()
+}
+
+func (p *PostgresDB) kvColumns() (map[string]bool, error) {
+	rows, err := p.db.Query(`SELECT column_name FROM information_schema.columns WHERE table_name = 'kv_store'`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		columns[name] = true
+	}
+	return columns, rows.Err()
+}
+
+// kvStatements returns kv_store statements, most expensive first. It needs
+// Postgres 13+ column names.
+func (p *PostgresDB) kvStatements() ([]StatementStat, error) {
+	rows, err := p.db.Query(`SELECT query, calls, total_exec_time, mean_exec_time, rows
+			  FROM pg_stat_statements
+			  WHERE query ILIKE '%kv_store%' AND dbid = (SELECT oid FROM pg_database WHERE datname = current_database())
+			  ORDER BY total_exec_time DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stats []StatementStat
+	for rows.Next() {
+		var st StatementStat
+		if err := rows.Scan(&st.Query, &st.Calls, &st.TotalTimeMs, &st.MeanTimeMs, &st.Rows); err != nil {
+			return nil, err
+		}
+		stats = append(stats, st)
+	}
+	return stats, rows.Err()
+}
@@ -0,0 +1,38 @@
+package database
+
+import "database/sql"
+
+// APIKey is a stored API key: the hex-encoded SHA-256 hash of the key and
+// the namespace it is scoped to, empty for all of them.
+type APIKey struct {
+	Hash      string
+	Namespace string
+}
+
+// APIKeyStore is implemented by stores that hold API keys. Only hashes are
+// stored, so a database dump does not leak usable keys.
+type APIKeyStore interface {
+	APIKeys() ([]APIKey, error)
+}
+
+var _ APIKeyStore = (*PostgresDB)(nil)
+
+func (p *PostgresDB) APIKeys() ([]APIKey, error) {
+	rows, err := p.db.Query(`SELECT key_hash, namespace FROM kv_api_keys`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []APIKey
+	for rows.Next() {
+		var key APIKey
+		var ns sql.NullString
+		if err := rows.Scan(&key.Hash, &ns); err != nil {
+			return nil, err
+		}
+		key.Namespace = ns.String
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
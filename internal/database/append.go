@@ -0,0 +1,85 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ErrTooLarge is returned by Append when the value would grow past the
+// limit.
+var ErrTooLarge = errors.New("value too large")
+
+// Appender is implemented by stores that can grow a value in place, so
+// concurrent appends never lose one another.
+type Appender interface {
+	// Append atomically adds data to the end of the value stored at key and
+	// returns the new record. A missing or expired key is created holding
+	// data, with contentType; an existing one keeps its expiry and content
+	// type. It fails with ErrTooLarge if the value would be longer than
+	// maxBytes.
+	Append(ctx context.Context, key, data, contentType string, maxBytes int) (Record, error)
+}
+
+var (
+	_ Appender = (*PostgresDB)(nil)
+	_ Appender = (*MemoryDB)(nil)
+)
+
+// Append concatenates in the upsert itself; the size check is its WHERE,
+// so a value at the limit is left untouched.
+func (p *PostgresDB) Append(ctx context.Context, key, data, contentType string, maxBytes int) (Record, error) {
+	defer p.observe(ctx, "append", time.Now())
+	if len(data) > maxBytes {
+		return Record{}, ErrTooLarge
+	}
+	var rec Record
+	var value []byte
+	var expiresAt sql.NullTime
+	var stored sql.NullString
+	ns, k := SplitKey(key)
+	query := `INSERT INTO kv_store (namespace, key, value, content_type) VALUES ($1, $2, $3, $4)
+			  ON CONFLICT (namespace, key) DO UPDATE
+			  SET value = CASE WHEN kv_store.expires_at <= now() THEN $3
+			                   ELSE kv_store.value || $3 END,
+			      expires_at = CASE WHEN kv_store.expires_at <= now() THEN NULL
+			                        ELSE kv_store.expires_at END,
+			      content_type = CASE WHEN kv_store.expires_at <= now() THEN $4
+			                          ELSE kv_store.content_type END,
+			      revision = nextval('kv_revision_seq')
+			  WHERE kv_store.expires_at <= now() OR octet_length(kv_store.value) + octet_length($3) <= $5
+			  RETURNING value, revision, expires_at, content_type`
+	err := p.db.QueryRowContext(ctx, query, ns, k, []byte(data), nullString(contentType), maxBytes).
+		Scan(&value, &rec.Revision, &expiresAt, &stored)
+	if err == sql.ErrNoRows {
+		return Record{}, ErrTooLarge
+	}
+	if err != nil {
+		return Record{}, err
+	}
+	rec.Value = string(value)
+	rec.ExpiresAt = expiresAt.Time
+	rec.ContentType = stored.String
+	p.notifyInvalidation(key)
+	return rec, nil
+}
+
+func (m *MemoryDB) Append(ctx context.Context, key, data, contentType string, maxBytes int) (Record, error) {
+	if err := m.faults.inject(ctx); err != nil {
+		return Record{}, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	v, ok := m.lookup(key)
+	if !ok {
+		v = memoryValue{contentType: contentType}
+	}
+	if len(v.value)+len(data) > maxBytes {
+		return Record{}, ErrTooLarge
+	}
+	value := v.value + data
+	revision := m.set(key, value, v.contentType, v.expiresAt)
+	return Record{Value: value, Revision: revision, ExpiresAt: v.expiresAt, ContentType: v.contentType}, nil
+}
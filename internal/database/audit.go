@@ -0,0 +1,59 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// AuditRecord is one mutating request, as the audit log keeps it.
+type AuditRecord struct {
+	Time time.Time `json:"time"`
+	// APIKey identifies the client's API key by the first 16 hex digits of
+	// its SHA-256 hash, a prefix of its kv_api_keys key_hash; empty without
+	// authentication
+	APIKey string `json:"api_key"`
+	// Operation is what the request did, e.g. "write" or "DELETE /admin/cache"
+	Operation string `json:"operation"`
+	// Key is the key the request names, {namespace}/{key} outside the
+	// default namespace; empty for requests naming several
+	Key       string `json:"key"`
+	ValueSize int64  `json:"value_size"`
+	Status    int    `json:"status"`
+	RequestID string `json:"request_id"`
+}
+
+// Auditor is implemented by stores that keep an append-only audit log.
+type Auditor interface {
+	// AppendAudit writes records, all or none.
+	AppendAudit(ctx context.Context, records []AuditRecord) error
+}
+
+var _ Auditor = (*PostgresDB)(nil)
+
+// AppendAudit inserts the records in one statement.
+func (p *PostgresDB) AppendAudit(ctx context.Context, records []AuditRecord) error {
+	defer p.observe(ctx, "append audit", time.Now())
+	times := make([]string, len(records))
+	apiKeys := make([]string, len(records))
+	operations := make([]string, len(records))
+	keys := make([]string, len(records))
+	sizes := make([]int64, len(records))
+	statuses := make([]int64, len(records))
+	requestIDs := make([]string, len(records))
+	for i, rec := range records {
+		times[i] = rec.Time.Format(time.RFC3339Nano)
+		apiKeys[i] = rec.APIKey
+		operations[i] = rec.Operation
+		keys[i] = rec.Key
+		sizes[i] = rec.ValueSize
+		statuses[i] = int64(rec.Status)
+		requestIDs[i] = rec.RequestID
+	}
+	query := `INSERT INTO kv_audit (at, api_key, operation, key, value_size, status, request_id)
+			  SELECT * FROM unnest($1::timestamptz[], $2::text[], $3::text[], $4::text[], $5::bigint[], $6::int[], $7::text[])`
+	_, err := p.db.ExecContext(ctx, query, pq.Array(times), pq.Array(apiKeys), pq.Array(operations), pq.Array(keys),
+		pq.Array(sizes), pq.Array(statuses), pq.Array(requestIDs))
+	return err
+}
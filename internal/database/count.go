@@ -0,0 +1,75 @@
+package database
+
+import (
+	"context"
+	"time"
+)
+
+// Counter is implemented by stores that can count keys without listing
+// them.
+type Counter interface {
+	// CountPrefix returns the number of live keys starting with prefix in
+	// its namespace.
+	CountPrefix(ctx context.Context, prefix string) (int64, error)
+	// EstimateKeys returns an estimate of the keys in every namespace,
+	// expired ones included, from table statistics, and false if there
+	// are none yet.
+	EstimateKeys(ctx context.Context) (int64, bool, error)
+}
+
+var (
+	_ Counter = (*PostgresDB)(nil)
+	_ Counter = (*MemoryDB)(nil)
+)
+
+// CountPrefix scans kv_store like CountKeys, within the namespace.
+func (p *PostgresDB) CountPrefix(ctx context.Context, prefix string) (int64, error) {
+	defer p.observe(ctx, "count", time.Now())
+	var n int64
+	ns, prefix := SplitKey(prefix)
+	query := `SELECT count(*) FROM kv_store WHERE namespace = $1 AND key LIKE $2 ESCAPE '\' AND ` + liveRow
+	err := p.db.QueryRowContext(ctx, query, ns, likePrefix(prefix)).Scan(&n)
+	return n, err
+}
+
+// EstimateKeys reads the row count the planner keeps in pg_class, as of the
+// last VACUUM or ANALYZE; a table never analyzed has none.
+func (p *PostgresDB) EstimateKeys(ctx context.Context) (int64, bool, error) {
+	defer p.observe(ctx, "estimate keys", time.Now())
+	var n float64
+	err := p.db.QueryRowContext(ctx, `SELECT reltuples FROM pg_class WHERE oid = 'kv_store'::regclass`).Scan(&n)
+	if err != nil {
+		return 0, false, err
+	}
+	if n < 0 {
+		return 0, false, nil
+	}
+	return int64(n), true, nil
+}
+
+func (m *MemoryDB) CountPrefix(ctx context.Context, prefix string) (int64, error) {
+	if err := m.faults.inject(ctx); err != nil {
+		return 0, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	now := time.Now()
+	var n int64
+	for key, v := range m.data {
+		if hasKeyPrefix(key, prefix) && v.live(now) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// EstimateKeys is exact but for expired keys not yet swept.
+func (m *MemoryDB) EstimateKeys(ctx context.Context) (int64, bool, error) {
+	if err := m.faults.inject(ctx); err != nil {
+		return 0, false, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return int64(len(m.data)), true, nil
+}
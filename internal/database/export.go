@@ -0,0 +1,142 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// exportFetch is how many rows an export fetches from its cursor at a time,
+// which bounds the rows it holds in memory.
+const exportFetch = 500
+
+// ExportScope selects the keys an export covers.
+type ExportScope struct {
+	// Prefix is qualified with its namespace as for List. With
+	// AllNamespaces set, its namespace is ignored and it matches keys in
+	// every namespace.
+	Prefix        string
+	AllNamespaces bool
+}
+
+// Exporter is implemented by stores that can stream their live keys for a
+// backup.
+type Exporter interface {
+	// Export calls fn with every live key in scope, qualified, in order of
+	// namespace and then key, stopping at the first error fn returns. The
+	// keys come from one consistent view of the store.
+	Export(ctx context.Context, scope ExportScope, fn func(KeyValue) error) error
+}
+
+var (
+	_ Exporter = (*PostgresDB)(nil)
+	_ Exporter = (*MemoryDB)(nil)
+)
+
+// Export reads through a cursor in a read-only REPEATABLE READ transaction,
+// so a large keyspace streams in batches from one MVCC snapshot. The
+// transaction holds a pooled connection until the export ends.
+func (p *PostgresDB) Export(ctx context.Context, scope ExportScope, fn func(KeyValue) error) error {
+	defer p.observe(ctx, "export", time.Now())
+	tx, err := p.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	ns, prefix := SplitKey(scope.Prefix)
+	query := `DECLARE kv_export NO SCROLL CURSOR FOR
+			  SELECT namespace, key, value, revision, expires_at, content_type FROM kv_store
+			  WHERE ($1 OR namespace = $2) AND key LIKE $3 ESCAPE '\' AND ` + liveRow + `
+			  ORDER BY namespace, key`
+	if _, err := tx.ExecContext(ctx, query, scope.AllNamespaces, ns, likePrefix(prefix)); err != nil {
+		return err
+	}
+
+	for {
+		n, err := p.fetchExport(ctx, tx, fn)
+		if err != nil {
+			return err
+		}
+		if n < exportFetch {
+			return tx.Commit()
+		}
+	}
+}
+
+// fetchExport passes the next batch of the export cursor to fn and returns
+// how many rows it had.
+func (p *PostgresDB) fetchExport(ctx context.Context, tx *sql.Tx, fn func(KeyValue) error) (int, error) {
+	rows, err := tx.QueryContext(ctx, `FETCH `+strconv.Itoa(exportFetch)+` FROM kv_export`)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	n := 0
+	for rows.Next() {
+		var ns string
+		var kv KeyValue
+		var expiresAt sql.NullTime
+		var contentType sql.NullString
+		if err := rows.Scan(&ns, &kv.Key, &kv.Value, &kv.Revision, &expiresAt, &contentType); err != nil {
+			return n, err
+		}
+		kv.Key = QualifyKey(ns, kv.Key)
+		kv.ExpiresAt = expiresAt.Time
+		kv.ContentType = contentType.String
+		if err := fn(kv); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, rows.Err()
+}
+
+// Export copies the matching keys first, so it is consistent but holds the
+// whole export in memory; MemoryDB is small anyway.
+func (m *MemoryDB) Export(ctx context.Context, scope ExportScope, fn func(KeyValue) error) error {
+	if err := m.faults.inject(ctx); err != nil {
+		return err
+	}
+	_, prefix := SplitKey(scope.Prefix)
+
+	m.mu.RLock()
+	now := time.Now()
+	var items []KeyValue
+	for key, v := range m.data {
+		if !v.live(now) {
+			continue
+		}
+		if scope.AllNamespaces {
+			if _, k := SplitKey(key); !strings.HasPrefix(k, prefix) {
+				continue
+			}
+		} else if !hasKeyPrefix(key, scope.Prefix) {
+			continue
+		}
+		items = append(items, KeyValue{Key: key, Value: v.value, ContentType: v.contentType, ExpiresAt: v.expiresAt, Revision: v.revision})
+	}
+	m.mu.RUnlock()
+
+	sort.Slice(items, func(i, j int) bool {
+		ni, ki := SplitKey(items[i].Key)
+		nj, kj := SplitKey(items[j].Key)
+		if ni != nj {
+			return ni < nj
+		}
+		return ki < kj
+	})
+	for _, kv := range items {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(kv); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// ErrInjected is returned by operations failed on purpose by fault injection.
+var ErrInjected = errors.New("injected failure")
+
+// LatencyDist samples artificial operation latencies.
+type LatencyDist struct {
+	kind     string
+	min, max time.Duration
+	mean     time.Duration
+}
+
+// ParseLatency parses a latency distribution:
+//
+//	""  or "0"     no added latency
+//	"5ms"          fixed
+//	"1ms-10ms"     uniform between the bounds
+//	"exp:5ms"      exponential with the given mean (long tail)
+func ParseLatency(spec string) (LatencyDist, error) {
+	spec = strings.TrimSpace(spec)
+	switch {
+	case spec == "" || spec == "0":
+		return LatencyDist{}, nil
+
+	case strings.HasPrefix(spec, "exp:"):
+		mean, err := time.ParseDuration(strings.TrimPrefix(spec, "exp:"))
+		if err != nil || mean <= 0 {
+			return LatencyDist{}, fmt.Errorf("invalid exponential latency %q", spec)
+		}
+		return LatencyDist{kind: "exp", mean: mean}, nil
+
+	case strings.Contains(spec, "-"):
+		lo, hi, _ := strings.Cut(spec, "-")
+		min, err1 := time.ParseDuration(lo)
+		max, err2 := time.ParseDuration(hi)
+		if err1 != nil || err2 != nil || min < 0 || max < min {
+			return LatencyDist{}, fmt.Errorf("invalid uniform latency %q", spec)
+		}
+		return LatencyDist{kind: "uniform", min: min, max: max}, nil
+	}
+
+	fixed, err := time.ParseDuration(spec)
+	if err != nil || fixed < 0 {
+		return LatencyDist{}, fmt.Errorf("invalid latency %q", spec)
+	}
+	return LatencyDist{kind: "fixed", min: fixed}, nil
+}
+
+// Sample draws one latency from the distribution.
+func (d LatencyDist) Sample() time.Duration {
+	switch d.kind {
+	case "fixed":
+		return d.min
+	case "uniform":
+		return d.min + time.Duration(rand.Int63n(int64(d.max-d.min)+1))
+	case "exp":
+		return time.Duration(rand.ExpFloat64() * float64(d.mean))
+	}
+	return 0
+}
+
+func (d LatencyDist) String() string {
+	switch d.kind {
+	case "fixed":
+		return d.min.String()
+	case "uniform":
+		return d.min.String() + "-" + d.max.String()
+	case "exp":
+		return "exp:" + d.mean.String()
+	}
+	return "none"
+}
+
+// Faults configures artificial latency and failures for MemoryDB.
+type Faults struct {
+	Latency   LatencyDist
+	ErrorRate float64
+}
+
+// inject sleeps for a sampled latency and then fails with probability
+// ErrorRate. Like a query, the sleep ends early with ctx's error.
+func (f Faults) inject(ctx context.Context) error {
+	if d := f.Latency.Sample(); d > 0 {
+		t := time.NewTimer(d)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+	}
+	if f.ErrorRate > 0 && rand.Float64() < f.ErrorRate {
+		return ErrInjected
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ErrStaleToken is returned by CreateFenced when a write of the key has
+// already carried a higher fencing token.
+var ErrStaleToken = errors.New("stale fencing token")
+
+// Fencer is implemented by stores that can reject writes from a writer that
+// has been superseded. Each key remembers the highest fencing token a write
+// of it has carried; a write carrying a lower one fails.
+type Fencer interface {
+	// CreateFenced is Create that first checks token against the key's
+	// fence and raises the fence to it, atomically with the write. It fails
+	// with ErrStaleToken if the fence is already higher.
+	CreateFenced(ctx context.Context, key, value, contentType string, expiresAt time.Time, token uint64) (uint64, error)
+}
+
+var (
+	_ Fencer = (*PostgresDB)(nil)
+	_ Fencer = (*MemoryDB)(nil)
+)
+
+// CreateFenced raises the fence and upserts in one statement. The fence row
+// stays locked until it commits, so concurrent fenced writes of a key are
+// ordered and the lower token sees the raised fence.
+func (p *PostgresDB) CreateFenced(ctx context.Context, key, value, contentType string, expiresAt time.Time, token uint64) (uint64, error) {
+	defer p.observe(ctx, "create fenced", time.Now())
+	var revision uint64
+	ns, k := SplitKey(key)
+	query := `WITH fence AS (
+				  INSERT INTO kv_fences (namespace, key, token) VALUES ($1, $2, $6)
+				  ON CONFLICT (namespace, key) DO UPDATE SET token = EXCLUDED.token
+				  WHERE kv_fences.token <= EXCLUDED.token
+				  RETURNING token
+			  )
+			  INSERT INTO kv_store (namespace, key, value, content_type, expires_at)
+			  SELECT $1, $2, $3, $4, $5 FROM fence
+			  ON CONFLICT (namespace, key) DO UPDATE
+			  SET value = $3, content_type = $4, expires_at = $5, revision = nextval('kv_revision_seq')
+			  RETURNING revision`
+	err := p.db.QueryRowContext(ctx, query, ns, k, []byte(value), nullString(contentType), nullTime(expiresAt), int64(token)).Scan(&revision)
+	if err == sql.ErrNoRows {
+		return 0, ErrStaleToken
+	}
+	if err != nil {
+		return 0, err
+	}
+	p.notifyInvalidation(key)
+	return revision, nil
+}
+
+func (m *MemoryDB) CreateFenced(ctx context.Context, key, value, contentType string, expiresAt time.Time, token uint64) (uint64, error) {
+	if err := m.faults.inject(ctx); err != nil {
+		return 0, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if token < m.fences[key] {
+		return 0, ErrStaleToken
+	}
+	if m.fences == nil {
+		m.fences = make(map[string]uint64)
+	}
+	m.fences[key] = token
+	return m.set(key, value, contentType, expiresAt), nil
+}
@@ -0,0 +1,208 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// maxMemoryHistory bounds the revisions MemoryDB keeps per key.
+const maxMemoryHistory = 64
+
+// HistoryReader is implemented by stores that keep every revision of a key,
+// so past values can be read back.
+type HistoryReader interface {
+	// ReadAtRevision returns the value key had at revision, with the
+	// revision that wrote it. ErrNotFound means the key did not exist then.
+	ReadAtRevision(key string, revision uint64) (string, uint64, error)
+	// ReadAtTime is ReadAtRevision as of a point in time.
+	ReadAtTime(key string, at time.Time) (string, uint64, error)
+	// History returns up to limit of key's revisions, newest first,
+	// deletes included.
+	History(key string, limit int) ([]Version, error)
+}
+
+// HistoryPruner is implemented by stores whose history can be bounded.
+type HistoryPruner interface {
+	// PruneHistory drops up to limit revisions that are not among the
+	// newest keep of their key, and returns how many it dropped.
+	PruneHistory(ctx context.Context, keep, limit int) (int, error)
+}
+
+// Version is one revision in a key's history. A delete has no value.
+type Version struct {
+	Revision  uint64
+	Value     string
+	Deleted   bool
+	UpdatedAt time.Time
+}
+
+var (
+	_ HistoryReader = (*PostgresDB)(nil)
+	_ HistoryReader = (*MemoryDB)(nil)
+	_ HistoryPruner = (*PostgresDB)(nil)
+	_ HistoryPruner = (*MemoryDB)(nil)
+)
+
+func (p *PostgresDB) ReadAtRevision(key string, revision uint64) (string, uint64, error) {
+	ns, k := SplitKey(key)
+	query := `SELECT value, revision FROM kv_history
+			  WHERE namespace = $1 AND key = $2 AND revision <= $3
+			  ORDER BY revision DESC LIMIT 1`
+	return scanHistory(p.db.QueryRow(query, ns, k, revision))
+}
+
+func (p *PostgresDB) ReadAtTime(key string, at time.Time) (string, uint64, error) {
+	ns, k := SplitKey(key)
+	query := `SELECT value, revision FROM kv_history
+			  WHERE namespace = $1 AND key = $2 AND updated_at <= $3
+			  ORDER BY updated_at DESC, revision DESC LIMIT 1`
+	return scanHistory(p.db.QueryRow(query, ns, k, at))
+}
+
+func (p *PostgresDB) History(key string, limit int) ([]Version, error) {
+	ns, k := SplitKey(key)
+	query := `SELECT revision, value, updated_at FROM kv_history
+			  WHERE namespace = $1 AND key = $2
+			  ORDER BY revision DESC LIMIT $3`
+	rows, err := p.db.Query(query, ns, k, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var versions []Version
+	for rows.Next() {
+		var v Version
+		var value sql.NullString
+		if err := rows.Scan(&v.Revision, &value, &v.UpdatedAt); err != nil {
+			return nil, err
+		}
+		v.Value, v.Deleted = value.String, !value.Valid
+		versions = append(versions, v)
+	}
+	return versions, rows.Err()
+}
+
+// PruneHistory ranks every key's revisions, so it reads the whole of
+// kv_history; the primary key serves the ranking.
+func (p *PostgresDB) PruneHistory(ctx context.Context, keep, limit int) (int, error) {
+	defer p.observe(ctx, "prune history", time.Now())
+	query := `DELETE FROM kv_history WHERE (namespace, key, revision) IN (
+				SELECT namespace, key, revision FROM (
+					SELECT namespace, key, revision,
+					       row_number() OVER (PARTITION BY namespace, key ORDER BY revision DESC) AS n
+					FROM kv_history) ranked
+				WHERE n > $1 LIMIT $2)`
+	res, err := p.db.ExecContext(ctx, query, keep, limit)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// scanHistory reads one kv_history row, where a NULL value is a delete.
+func scanHistory(row *sql.Row) (string, uint64, error) {
+	var value sql.NullString
+	var revision uint64
+	err := row.Scan(&value, &revision)
+	if err == sql.ErrNoRows || (err == nil && !value.Valid) {
+		return "", 0, ErrNotFound
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	return value.String, revision, nil
+}
+
+// memoryRevision is one entry of a key's history in MemoryDB.
+type memoryRevision struct {
+	memoryValue
+	deleted bool
+	at      time.Time
+}
+
+// record appends a revision to key's history. The caller holds m.mu.
+func (m *MemoryDB) record(key string, rev memoryRevision) {
+	if m.history == nil {
+		m.history = make(map[string][]memoryRevision)
+	}
+	revs := append(m.history[key], rev)
+	if len(revs) > maxMemoryHistory {
+		revs = revs[len(revs)-maxMemoryHistory:]
+	}
+	m.history[key] = revs
+}
+
+func (m *MemoryDB) ReadAtRevision(key string, revision uint64) (string, uint64, error) {
+	return m.readHistory(key, func(rev memoryRevision) bool { return rev.revision <= revision })
+}
+
+func (m *MemoryDB) ReadAtTime(key string, at time.Time) (string, uint64, error) {
+	return m.readHistory(key, func(rev memoryRevision) bool { return !rev.at.After(at) })
+}
+
+func (m *MemoryDB) History(key string, limit int) ([]Version, error) {
+	if err := m.faults.inject(context.Background()); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	revs := m.history[key]
+	versions := make([]Version, 0, min(len(revs), limit))
+	for i := len(revs) - 1; i >= 0 && len(versions) < limit; i-- {
+		versions = append(versions, Version{
+			Revision:  revs[i].revision,
+			Value:     revs[i].value,
+			Deleted:   revs[i].deleted,
+			UpdatedAt: revs[i].at,
+		})
+	}
+	return versions, nil
+}
+
+// PruneHistory drops the oldest revisions beyond keep; MemoryDB never
+// keeps more than maxMemoryHistory anyway.
+func (m *MemoryDB) PruneHistory(ctx context.Context, keep, limit int) (int, error) {
+	if err := m.faults.inject(ctx); err != nil {
+		return 0, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n := 0
+	for key, revs := range m.history {
+		if len(revs) <= keep {
+			continue
+		}
+		drop := min(len(revs)-keep, limit-n)
+		m.history[key] = revs[drop:]
+		if n += drop; n == limit {
+			break
+		}
+	}
+	return n, nil
+}
+
+// readHistory returns the newest revision of key that matches.
+func (m *MemoryDB) readHistory(key string, match func(memoryRevision) bool) (string, uint64, error) {
+	if err := m.faults.inject(context.Background()); err != nil {
+		return "", 0, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	revs := m.history[key]
+	for i := len(revs) - 1; i >= 0; i-- {
+		if !match(revs[i]) {
+			continue
+		}
+		if revs[i].deleted {
+			return "", 0, ErrNotFound
+		}
+		return revs[i].value, revs[i].revision, nil
+	}
+	return "", 0, ErrNotFound
+}
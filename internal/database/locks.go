@@ -0,0 +1,206 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var (
+	// ErrLockHeld is returned by Acquire while another holder's lease on
+	// the lock has not expired.
+	ErrLockHeld = errors.New("lock is held")
+	// ErrLockNotHeld is returned by Renew and Release when the token does
+	// not hold the lock, because its lease expired or it never did.
+	ErrLockNotHeld = errors.New("lock not held")
+)
+
+// Lock is a lease on a named lock. Token is a fencing token: it is taken
+// from the revision sequence, so every acquisition of any lock gets a
+// higher one than all before it, and writes carrying it can be fenced
+// (see Fencer).
+type Lock struct {
+	Name      string
+	Owner     string
+	Token     uint64
+	ExpiresAt time.Time
+}
+
+// Locker is implemented by stores that provide named locks with leases.
+// A lock whose lease has expired is free, whether or not its row is gone.
+type Locker interface {
+	// Acquire takes the lock for ttl on behalf of owner, a free-form label
+	// for whoever asks who holds it. It fails with ErrLockHeld, and the
+	// current holder's lease, if the lock is held.
+	Acquire(ctx context.Context, name, owner string, ttl time.Duration) (Lock, error)
+	// Renew extends the lease of the holder with token to ttl from now.
+	Renew(ctx context.Context, name string, token uint64, ttl time.Duration) (Lock, error)
+	// Release frees the lock if token holds it.
+	Release(ctx context.Context, name string, token uint64) error
+	// Holder returns the lock's current lease, or ErrNotFound if it is
+	// free.
+	Holder(ctx context.Context, name string) (Lock, error)
+	// DeleteExpiredLocks deletes the rows of expired leases and returns how
+	// many there were.
+	DeleteExpiredLocks(ctx context.Context) (int, error)
+}
+
+var (
+	_ Locker = (*PostgresDB)(nil)
+	_ Locker = (*MemoryDB)(nil)
+)
+
+// Acquire takes the lock in one conditional upsert, so of concurrent
+// acquirers exactly one gets it.
+func (p *PostgresDB) Acquire(ctx context.Context, name, owner string, ttl time.Duration) (Lock, error) {
+	defer p.observe(ctx, "acquire lock", time.Now())
+	lock := Lock{Name: name, Owner: owner}
+	query := `INSERT INTO kv_locks (name, owner, token, expires_at)
+			  VALUES ($1, $2, nextval('kv_revision_seq'), now() + $3 * interval '1 millisecond')
+			  ON CONFLICT (name) DO UPDATE
+			  SET owner = EXCLUDED.owner, token = EXCLUDED.token, expires_at = EXCLUDED.expires_at
+			  WHERE kv_locks.expires_at <= now()
+			  RETURNING token, expires_at`
+	err := p.db.QueryRowContext(ctx, query, name, owner, ttl.Milliseconds()).Scan(&lock.Token, &lock.ExpiresAt)
+	if err == sql.ErrNoRows {
+		holder, err := p.Holder(ctx, name)
+		if errors.Is(err, ErrNotFound) {
+			// The lease ran out in between; the caller may simply retry
+			return Lock{}, ErrLockHeld
+		}
+		if err != nil {
+			return Lock{}, err
+		}
+		return holder, ErrLockHeld
+	}
+	return lock, err
+}
+
+func (p *PostgresDB) Renew(ctx context.Context, name string, token uint64, ttl time.Duration) (Lock, error) {
+	defer p.observe(ctx, "renew lock", time.Now())
+	lock := Lock{Name: name, Token: token}
+	query := `UPDATE kv_locks SET expires_at = now() + $3 * interval '1 millisecond'
+			  WHERE name = $1 AND token = $2 AND expires_at > now()
+			  RETURNING owner, expires_at`
+	err := p.db.QueryRowContext(ctx, query, name, int64(token), ttl.Milliseconds()).Scan(&lock.Owner, &lock.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return Lock{}, ErrLockNotHeld
+	}
+	return lock, err
+}
+
+func (p *PostgresDB) Release(ctx context.Context, name string, token uint64) error {
+	defer p.observe(ctx, "release lock", time.Now())
+	res, err := p.db.ExecContext(ctx, `DELETE FROM kv_locks WHERE name = $1 AND token = $2 AND expires_at > now()`, name, int64(token))
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return ErrLockNotHeld
+	}
+	return nil
+}
+
+func (p *PostgresDB) Holder(ctx context.Context, name string) (Lock, error) {
+	lock := Lock{Name: name}
+	query := `SELECT owner, token, expires_at FROM kv_locks WHERE name = $1 AND expires_at > now()`
+	err := p.db.QueryRowContext(ctx, query, name).Scan(&lock.Owner, &lock.Token, &lock.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return Lock{}, ErrNotFound
+	}
+	return lock, err
+}
+
+func (p *PostgresDB) DeleteExpiredLocks(ctx context.Context) (int, error) {
+	res, err := p.db.ExecContext(ctx, `DELETE FROM kv_locks WHERE expires_at <= now()`)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func (m *MemoryDB) Acquire(ctx context.Context, name, owner string, ttl time.Duration) (Lock, error) {
+	if err := m.faults.inject(ctx); err != nil {
+		return Lock{}, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if held, ok := m.locks[name]; ok && now.Before(held.ExpiresAt) {
+		return held, ErrLockHeld
+	}
+	m.revision++
+	lock := Lock{Name: name, Owner: owner, Token: m.revision, ExpiresAt: now.Add(ttl)}
+	if m.locks == nil {
+		m.locks = make(map[string]Lock)
+	}
+	m.locks[name] = lock
+	return lock, nil
+}
+
+func (m *MemoryDB) Renew(ctx context.Context, name string, token uint64, ttl time.Duration) (Lock, error) {
+	if err := m.faults.inject(ctx); err != nil {
+		return Lock{}, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	lock, ok := m.locks[name]
+	if !ok || lock.Token != token || !now.Before(lock.ExpiresAt) {
+		return Lock{}, ErrLockNotHeld
+	}
+	lock.ExpiresAt = now.Add(ttl)
+	m.locks[name] = lock
+	return lock, nil
+}
+
+func (m *MemoryDB) Release(ctx context.Context, name string, token uint64) error {
+	if err := m.faults.inject(ctx); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	lock, ok := m.locks[name]
+	if !ok || lock.Token != token || !time.Now().Before(lock.ExpiresAt) {
+		return ErrLockNotHeld
+	}
+	delete(m.locks, name)
+	return nil
+}
+
+func (m *MemoryDB) Holder(ctx context.Context, name string) (Lock, error) {
+	if err := m.faults.inject(ctx); err != nil {
+		return Lock{}, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	lock, ok := m.locks[name]
+	if !ok || !time.Now().Before(lock.ExpiresAt) {
+		return Lock{}, ErrNotFound
+	}
+	return lock, nil
+}
+
+func (m *MemoryDB) DeleteExpiredLocks(ctx context.Context) (int, error) {
+	if err := m.faults.inject(ctx); err != nil {
+		return 0, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	n := 0
+	for name, lock := range m.locks {
+		if !now.Before(lock.ExpiresAt) {
+			delete(m.locks, name)
+			n++
+		}
+	}
+	return n, nil
+}
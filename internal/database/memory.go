@@ -0,0 +1,256 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MemoryDB is a non-persistent Store with optional latency and failure
+// injection, so handler-level performance and chaos tests run without
+// Postgres.
+type MemoryDB struct {
+	mu         sync.RWMutex
+	data       map[string]memoryValue
+	revision   uint64
+	history    map[string][]memoryRevision
+	tombstones map[string]memoryTombstone
+	used       map[string]time.Time
+	stats      map[time.Time]*StatsHour
+	fences     map[string]uint64
+	locks      map[string]Lock
+	schemas    map[string]string
+	faults     Faults
+}
+
+type memoryValue struct {
+	value       string
+	contentType string
+	revision    uint64
+	expiresAt   time.Time
+}
+
+func (v memoryValue) live(now time.Time) bool {
+	return v.expiresAt.IsZero() || now.Before(v.expiresAt)
+}
+
+func NewMemoryDB(faults Faults) *MemoryDB {
+	return &MemoryDB{
+		data:   make(map[string]memoryValue),
+		faults: faults,
+	}
+}
+
+// set stores value under the next revision. The caller holds m.mu.
+func (m *MemoryDB) set(key, value, contentType string, expiresAt time.Time) uint64 {
+	m.revision++
+	v := memoryValue{value: value, contentType: contentType, revision: m.revision, expiresAt: expiresAt}
+	m.data[key] = v
+	m.record(key, memoryRevision{memoryValue: v, at: time.Now()})
+	return m.revision
+}
+
+// lookup returns key's value unless it is missing or expired. The caller
+// holds m.mu.
+func (m *MemoryDB) lookup(key string) (memoryValue, bool) {
+	v, ok := m.data[key]
+	if !ok || !v.live(time.Now()) {
+		return memoryValue{}, false
+	}
+	return v, true
+}
+
+func (m *MemoryDB) Create(ctx context.Context, key, value, contentType string, expiresAt time.Time) (uint64, error) {
+	if err := m.faults.inject(ctx); err != nil {
+		return 0, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.set(key, value, contentType, expiresAt), nil
+}
+
+func (m *MemoryDB) Insert(ctx context.Context, key, value, contentType string, expiresAt time.Time) (uint64, error) {
+	if err := m.faults.inject(ctx); err != nil {
+		return 0, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.lookup(key); ok {
+		return 0, ErrExists
+	}
+	return m.set(key, value, contentType, expiresAt), nil
+}
+
+func (m *MemoryDB) Update(ctx context.Context, key, value, contentType string, expiresAt time.Time, revision uint64) (uint64, error) {
+	if err := m.faults.inject(ctx); err != nil {
+		return 0, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	current, ok := m.lookup(key)
+	if !ok {
+		return 0, ErrNotFound
+	}
+	if current.revision != revision {
+		return 0, ErrRevisionMismatch
+	}
+	return m.set(key, value, contentType, expiresAt), nil
+}
+
+func (m *MemoryDB) Increment(ctx context.Context, key string, delta int64) (Record, error) {
+	if err := m.faults.inject(ctx); err != nil {
+		return Record{}, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var current int64
+	v, ok := m.lookup(key)
+	if ok {
+		n, err := strconv.ParseInt(v.value, 10, 64)
+		if errors.Is(err, strconv.ErrRange) {
+			return Record{}, ErrOverflow
+		}
+		if err != nil {
+			return Record{}, ErrNotInteger
+		}
+		current = n
+	}
+	sum := current + delta
+	if (delta > 0 && sum < current) || (delta < 0 && sum > current) {
+		return Record{}, ErrOverflow
+	}
+	value := strconv.FormatInt(sum, 10)
+	revision := m.set(key, value, v.contentType, v.expiresAt)
+	return Record{Value: value, Revision: revision, ExpiresAt: v.expiresAt, ContentType: v.contentType}, nil
+}
+
+func (m *MemoryDB) CreateBatch(ctx context.Context, pairs []KeyValue) error {
+	if err := m.faults.inject(ctx); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	for i := range pairs {
+		kv := &pairs[i]
+		kv.Revision = m.set(kv.Key, kv.Value, kv.ContentType, kv.ExpiresAt)
+	}
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *MemoryDB) Read(ctx context.Context, key string) (string, error) {
+	rec, err := m.ReadRecord(ctx, key)
+	return rec.Value, err
+}
+
+func (m *MemoryDB) ReadRecord(ctx context.Context, key string) (Record, error) {
+	if err := m.faults.inject(ctx); err != nil {
+		return Record{}, err
+	}
+	m.mu.RLock()
+	v, ok := m.lookup(key)
+	m.mu.RUnlock()
+	if !ok {
+		return Record{}, ErrNotFound
+	}
+	return Record{Value: v.value, Revision: v.revision, ExpiresAt: v.expiresAt, ContentType: v.contentType}, nil
+}
+
+func (m *MemoryDB) ReadBatch(ctx context.Context, keys []string) (map[string]string, error) {
+	if err := m.faults.inject(ctx); err != nil {
+		return nil, err
+	}
+	values := make(map[string]string, len(keys))
+	m.mu.RLock()
+	for _, key := range keys {
+		if v, ok := m.lookup(key); ok {
+			values[key] = v.value
+		}
+	}
+	m.mu.RUnlock()
+	return values, nil
+}
+
+func (m *MemoryDB) Delete(ctx context.Context, key string) error {
+	if err := m.faults.inject(ctx); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.data[key]; !ok {
+		return ErrNotFound
+	}
+	_, live := m.lookup(key)
+	m.remove(key)
+	if !live {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// remove deletes key and records the delete. The caller holds m.mu.
+func (m *MemoryDB) remove(key string) {
+	delete(m.data, key)
+	delete(m.used, key)
+	m.revision++
+	m.record(key, memoryRevision{memoryValue: memoryValue{revision: m.revision}, deleted: true, at: time.Now()})
+}
+
+func (m *MemoryDB) DeleteExpired(ctx context.Context, limit int) ([]string, error) {
+	if err := m.faults.inject(ctx); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	var keys []string
+	for key, v := range m.data {
+		if len(keys) == limit {
+			break
+		}
+		if !v.live(now) {
+			keys = append(keys, key)
+		}
+	}
+	for _, key := range keys {
+		m.remove(key)
+	}
+	return keys, nil
+}
+
+func (m *MemoryDB) List(ctx context.Context, prefix, after string, limit int, withValues bool) ([]KeyValue, error) {
+	if err := m.faults.inject(ctx); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	now := time.Now()
+	var keys []string
+	for key, v := range m.data {
+		if hasKeyPrefix(key, prefix) && key > after && v.live(now) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	if len(keys) > limit {
+		keys = keys[:limit]
+	}
+
+	items := make([]KeyValue, len(keys))
+	for i, key := range keys {
+		items[i].Key = key
+		if withValues {
+			items[i].Value = m.data[key].value
+		}
+	}
+	return items, nil
+}
+
+func (m *MemoryDB) Close() error {
+	return nil
+}
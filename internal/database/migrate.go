@@ -0,0 +1,189 @@
+package database
+
+import "fmt"
+
+// migrations bring an existing database up to the schema this version
+// expects. Migration i is recorded as version i+1 in kv_schema_migrations
+// and applied once; append new ones, never edit applied ones.
+var migrations = []string{
+	`CREATE TABLE IF NOT EXISTS kv_store (
+		key VARCHAR(255) PRIMARY KEY,
+		value TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`,
+
+	// Revisions come from one sequence, so they order writes across all keys
+	`CREATE SEQUENCE IF NOT EXISTS kv_revision_seq;
+	ALTER TABLE kv_store ADD COLUMN IF NOT EXISTS revision BIGINT NOT NULL DEFAULT nextval('kv_revision_seq')`,
+
+	// Every write and delete is appended to kv_history by trigger, so no
+	// writer can skip it. A NULL value marks a delete.
+	`CREATE TABLE IF NOT EXISTS kv_history (
+		key VARCHAR(255) NOT NULL,
+		revision BIGINT NOT NULL,
+		value TEXT,
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (key, revision)
+	);
+	CREATE INDEX IF NOT EXISTS kv_history_key_time ON kv_history (key, updated_at);
+	CREATE OR REPLACE FUNCTION kv_record_history() RETURNS trigger AS $$
+	BEGIN
+		IF TG_OP = 'DELETE' THEN
+			INSERT INTO kv_history (key, revision, value) VALUES (OLD.key, nextval('kv_revision_seq'), NULL);
+			RETURN OLD;
+		END IF;
+		INSERT INTO kv_history (key, revision, value) VALUES (NEW.key, NEW.revision, NEW.value);
+		RETURN NEW;
+	END;
+	$$ LANGUAGE plpgsql;
+	DROP TRIGGER IF EXISTS kv_store_history ON kv_store;
+	CREATE TRIGGER kv_store_history AFTER INSERT OR UPDATE OR DELETE ON kv_store
+		FOR EACH ROW EXECUTE FUNCTION kv_record_history();
+	INSERT INTO kv_history (key, revision, value, updated_at)
+		SELECT key, revision, value, COALESCE(created_at, now()) FROM kv_store
+		ON CONFLICT DO NOTHING`,
+
+	// Per-key expiry; the partial index serves the sweeper
+	`ALTER TABLE kv_store ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ;
+	CREATE INDEX IF NOT EXISTS kv_store_expires_at ON kv_store (expires_at) WHERE expires_at IS NOT NULL`,
+
+	// Values are bytes, not text, so arbitrary binary data round-trips
+	`ALTER TABLE kv_store ALTER COLUMN value TYPE BYTEA USING convert_to(value, 'UTF8');
+	ALTER TABLE kv_store ADD COLUMN IF NOT EXISTS content_type TEXT;
+	ALTER TABLE kv_history ALTER COLUMN value TYPE BYTEA USING convert_to(value, 'UTF8')`,
+
+	// Namespaces isolate applications sharing a deployment; existing keys
+	// land in the default namespace ''
+	`ALTER TABLE kv_store ADD COLUMN IF NOT EXISTS namespace VARCHAR(64) NOT NULL DEFAULT '';
+	ALTER TABLE kv_store DROP CONSTRAINT IF EXISTS kv_store_pkey;
+	ALTER TABLE kv_store ADD PRIMARY KEY (namespace, key);
+	ALTER TABLE kv_history ADD COLUMN IF NOT EXISTS namespace VARCHAR(64) NOT NULL DEFAULT '';
+	ALTER TABLE kv_history DROP CONSTRAINT IF EXISTS kv_history_pkey;
+	ALTER TABLE kv_history ADD PRIMARY KEY (namespace, key, revision);
+	DROP INDEX IF EXISTS kv_history_key_time;
+	CREATE INDEX kv_history_key_time ON kv_history (namespace, key, updated_at);
+	CREATE OR REPLACE FUNCTION kv_record_history() RETURNS trigger AS $$
+	BEGIN
+		IF TG_OP = 'DELETE' THEN
+			INSERT INTO kv_history (namespace, key, revision, value)
+				VALUES (OLD.namespace, OLD.key, nextval('kv_revision_seq'), NULL);
+			RETURN OLD;
+		END IF;
+		INSERT INTO kv_history (namespace, key, revision, value) VALUES (NEW.namespace, NEW.key, NEW.revision, NEW.value);
+		RETURN NEW;
+	END;
+	$$ LANGUAGE plpgsql`,
+
+	// API keys, by hex SHA-256 hash: encode(sha256('key'), 'hex')
+	`CREATE TABLE IF NOT EXISTS kv_api_keys (
+		key_hash CHAR(64) PRIMARY KEY,
+		name TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+
+	// Tenant keys only reach their own namespace; NULL reaches all of them
+	`ALTER TABLE kv_api_keys ADD COLUMN IF NOT EXISTS namespace VARCHAR(64)`,
+
+	// When keys were last read or written, for trimming evicting namespaces.
+	// It is kept apart from kv_store so a read does not write history.
+	`CREATE TABLE IF NOT EXISTS kv_recency (
+		namespace VARCHAR(64) NOT NULL,
+		key VARCHAR(255) NOT NULL,
+		used_at TIMESTAMPTZ NOT NULL,
+		PRIMARY KEY (namespace, key)
+	);
+	CREATE INDEX IF NOT EXISTS kv_recency_used_at ON kv_recency (namespace, used_at)`,
+
+	// Hourly server statistics; every instance adds its samples to the row
+	`CREATE TABLE IF NOT EXISTS kv_stats_hourly (
+		hour TIMESTAMPTZ PRIMARY KEY,
+		requests BIGINT NOT NULL DEFAULT 0,
+		cache_hits BIGINT NOT NULL DEFAULT 0,
+		cache_misses BIGINT NOT NULL DEFAULT 0,
+		latency_sum_us BIGINT NOT NULL DEFAULT 0,
+		latency_max_us BIGINT NOT NULL DEFAULT 0,
+		keys BIGINT
+	)`,
+
+	// The highest fencing token a write of each key has carried. Rows
+	// outlive their key, so a stale writer cannot recreate it either.
+	`CREATE TABLE IF NOT EXISTS kv_fences (
+		namespace VARCHAR(64) NOT NULL,
+		key VARCHAR(255) NOT NULL,
+		token BIGINT NOT NULL,
+		PRIMARY KEY (namespace, key)
+	)`,
+
+	// Named locks. A row whose lease has expired is a free lock; the
+	// expiry sweeper deletes it eventually.
+	`CREATE TABLE IF NOT EXISTS kv_locks (
+		name VARCHAR(255) PRIMARY KEY,
+		owner TEXT NOT NULL,
+		token BIGINT NOT NULL,
+		expires_at TIMESTAMPTZ NOT NULL
+	)`,
+
+	// Soft-deleted keys, restorable until the purge drops them
+	`CREATE TABLE IF NOT EXISTS kv_tombstones (
+		namespace VARCHAR(64) NOT NULL,
+		key VARCHAR(255) NOT NULL,
+		value BYTEA NOT NULL,
+		content_type TEXT,
+		expires_at TIMESTAMPTZ,
+		deleted_at TIMESTAMPTZ NOT NULL,
+		PRIMARY KEY (namespace, key)
+	);
+	CREATE INDEX IF NOT EXISTS kv_tombstones_deleted_at ON kv_tombstones (deleted_at)`,
+	`CREATE TABLE IF NOT EXISTS kv_audit (
+		id BIGSERIAL PRIMARY KEY,
+		at TIMESTAMPTZ NOT NULL,
+		api_key TEXT NOT NULL,
+		operation TEXT NOT NULL,
+		key TEXT NOT NULL,
+		value_size BIGINT NOT NULL,
+		status INT NOT NULL,
+		request_id TEXT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS kv_audit_at ON kv_audit (at)`,
+
+	// The JSON Schema values in each namespace must match
+	`CREATE TABLE IF NOT EXISTS kv_schemas (
+		namespace VARCHAR(64) PRIMARY KEY,
+		schema TEXT NOT NULL,
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+}
+
+// Migrate applies the migrations not yet recorded as applied. Concurrent
+// instances are serialized with an advisory lock held for the duration.
+func (p *PostgresDB) Migrate() error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext('kv_store_migrate'))`); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`CREATE TABLE IF NOT EXISTS kv_schema_migrations (
+		version INT PRIMARY KEY,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`); err != nil {
+		return err
+	}
+
+	var applied int
+	if err := tx.QueryRow(`SELECT COALESCE(max(version), 0) FROM kv_schema_migrations`).Scan(&applied); err != nil {
+		return err
+	}
+	for i := applied; i < len(migrations); i++ {
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO kv_schema_migrations (version) VALUES ($1)`, i+1); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
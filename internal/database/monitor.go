@@ -0,0 +1,156 @@
+package database
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const maxHealthEvents = 20
+
+// HealthEvent records a single availability transition.
+type HealthEvent struct {
+	Time    time.Time `json:"time"`
+	Healthy bool      `json:"healthy"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// HealthStatus is a point-in-time view of the monitor.
+type HealthStatus struct {
+	Healthy           bool          `json:"healthy"`
+	Since             time.Time     `json:"since"`
+	Transitions       uint64        `json:"transitions"`
+	FailedPings       uint64        `json:"failed_pings"`
+	OpenConnections   int           `json:"open_connections"`
+	InUse             int           `json:"in_use"`
+	Idle              int           `json:"idle"`
+	MaxOpen           int           `json:"max_open"`
+	WaitCount         int64         `json:"wait_count"`
+	WaitDuration      time.Duration `json:"wait_duration"`
+	MaxLifetimeClosed int64         `json:"max_lifetime_closed"`
+	MaxIdleTimeClosed int64         `json:"max_idle_time_closed"`
+	RecentEvents      []HealthEvent `json:"recent_events"`
+}
+
+// HealthMonitor periodically pings the database and tracks availability
+// transitions so readiness reflects brief DB outages.
+type HealthMonitor struct {
+	db       *PostgresDB
+	interval time.Duration
+
+	healthy     atomic.Bool
+	transitions atomic.Uint64
+	failedPings atomic.Uint64
+
+	mu     sync.Mutex
+	since  time.Time
+	events []HealthEvent
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewHealthMonitor creates a monitor that assumes the database starts healthy,
+// since it is only constructed after a successful connection.
+func NewHealthMonitor(db *PostgresDB, interval time.Duration) *HealthMonitor {
+	m := &HealthMonitor{
+		db:       db,
+		interval: interval,
+		since:    time.Now(),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	m.healthy.Store(true)
+	return m
+}
+
+// Start launches the background ping loop.
+func (m *HealthMonitor) Start() {
+	go m.run()
+}
+
+// Stop terminates the ping loop and waits for it to exit.
+func (m *HealthMonitor) Stop() {
+	close(m.stop)
+	<-m.done
+}
+
+func (m *HealthMonitor) run() {
+	defer close(m.done)
+
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			m.check()
+		}
+	}
+}
+
+func (m *HealthMonitor) check() {
+	ctx, cancel := context.WithTimeout(context.Background(), m.interval)
+	defer cancel()
+
+	err := m.db.db.PingContext(ctx)
+	if err != nil {
+		m.failedPings.Add(1)
+	}
+
+	healthy := err == nil
+	if m.healthy.Swap(healthy) == healthy {
+		return
+	}
+
+	// Availability changed
+	m.transitions.Add(1)
+	event := HealthEvent{Time: time.Now(), Healthy: healthy}
+	if err != nil {
+		event.Error = err.Error()
+		log.Printf("Database became unavailable: %v", err)
+	} else {
+		log.Println("Database available again")
+	}
+
+	m.mu.Lock()
+	m.since = event.Time
+	m.events = append(m.events, event)
+	if len(m.events) > maxHealthEvents {
+		m.events = m.events[len(m.events)-maxHealthEvents:]
+	}
+	m.mu.Unlock()
+}
+
+// Healthy reports whether the last ping succeeded.
+func (m *HealthMonitor) Healthy() bool {
+	return m.healthy.Load()
+}
+
+// Status returns the current availability, transition counters and pool stats.
+func (m *HealthMonitor) Status() HealthStatus {
+	stats := m.db.db.Stats()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return HealthStatus{
+		Healthy:           m.healthy.Load(),
+		Since:             m.since,
+		Transitions:       m.transitions.Load(),
+		FailedPings:       m.failedPings.Load(),
+		OpenConnections:   stats.OpenConnections,
+		InUse:             stats.InUse,
+		Idle:              stats.Idle,
+		MaxOpen:           stats.MaxOpenConnections,
+		WaitCount:         stats.WaitCount,
+		WaitDuration:      stats.WaitDuration,
+		MaxLifetimeClosed: stats.MaxLifetimeClosed,
+		MaxIdleTimeClosed: stats.MaxIdleTimeClosed,
+		RecentEvents:      append([]HealthEvent(nil), m.events...),
+	}
+}
@@ -0,0 +1,44 @@
+package database
+
+import "strings"
+
+// Keys passed to a Store are qualified with their namespace, as built by
+// QualifyKey. An unqualified key is in the default namespace "", where every
+// key lived before namespaces existed. Postgres cannot store NUL in text, so
+// the separator never occurs inside a namespace or key.
+const namespaceSep = "\x00"
+
+// notifySep replaces namespaceSep in NOTIFY payloads, which are text too.
+const notifySep = "\x1f"
+
+// QualifyKey returns the Store key of key in namespace ns.
+func QualifyKey(ns, key string) string {
+	if ns == "" {
+		return key
+	}
+	return ns + namespaceSep + key
+}
+
+// SplitKey splits a Store key into its namespace and key.
+func SplitKey(qualified string) (ns, key string) {
+	if ns, key, ok := strings.Cut(qualified, namespaceSep); ok {
+		return ns, key
+	}
+	return "", qualified
+}
+
+// hasKeyPrefix reports whether the qualified key is in the namespace of the
+// qualified prefix and starts with it there.
+func hasKeyPrefix(qualified, prefix string) bool {
+	ns, key := SplitKey(qualified)
+	pns, prefix := SplitKey(prefix)
+	return ns == pns && strings.HasPrefix(key, prefix)
+}
+
+func wireKey(qualified string) string {
+	return strings.Replace(qualified, namespaceSep, notifySep, 1)
+}
+
+func unwireKey(wire string) string {
+	return strings.Replace(wire, notifySep, namespaceSep, 1)
+}
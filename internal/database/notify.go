@@ -0,0 +1,87 @@
+package database
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// InvalidationChannel is the Postgres NOTIFY channel carrying mutated keys.
+const InvalidationChannel = "kv_invalidate"
+
+// EnableInvalidation makes every mutation publish the affected key on
+// InvalidationChannel so other instances sharing the database can evict it.
+func (p *PostgresDB) EnableInvalidation() {
+	p.instanceID = newInstanceID()
+}
+
+// notifyInvalidation publishes key tagged with this instance's ID. Failures
+// are logged rather than returned: the write itself already succeeded.
+func (p *PostgresDB) notifyInvalidation(key string) {
+	if p.instanceID == "" {
+		return
+	}
+	if _, err := p.db.Exec(`SELECT pg_notify($1, $2)`, InvalidationChannel, p.instanceID+":"+wireKey(key)); err != nil {
+		log.Printf("Failed to publish cache invalidation for %q: %v", key, err)
+	}
+}
+
+// InvalidationListener receives keys mutated by other instances.
+type InvalidationListener struct {
+	listener *pq.Listener
+	done     chan struct{}
+}
+
+// ListenInvalidations subscribes to InvalidationChannel on a dedicated
+// connection. onKey is called for each key changed by another instance;
+// onReset is called after the connection is re-established, since any
+// notifications sent while disconnected were lost.
+func (p *PostgresDB) ListenInvalidations(onKey func(key string), onReset func()) (*InvalidationListener, error) {
+	listener := pq.NewListener(p.connStr, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		switch ev {
+		case pq.ListenerEventDisconnected:
+			log.Printf("Cache invalidation listener disconnected: %v", err)
+		case pq.ListenerEventReconnected:
+			log.Println("Cache invalidation listener reconnected")
+		}
+	})
+	if err := listener.Listen(InvalidationChannel); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	l := &InvalidationListener{listener: listener, done: make(chan struct{})}
+	go func() {
+		defer close(l.done)
+		for n := range listener.Notify {
+			// A nil notification signals a reconnect
+			if n == nil {
+				onReset()
+				continue
+			}
+			instance, key, ok := strings.Cut(n.Extra, ":")
+			if !ok || instance == p.instanceID {
+				continue
+			}
+			onKey(unwireKey(key))
+		}
+	}()
+	return l, nil
+}
+
+// Close stops listening and waits for the dispatch goroutine to exit.
+func (l *InvalidationListener) Close() error {
+	err := l.listener.Close()
+	<-l.done
+	return err
+}
+
+func newInstanceID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -1,14 +1,49 @@
 package database
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"log"
+	"strings"
+	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
+// batchChunk bounds rows per INSERT statement, keeping well under
+// Postgres's 65535 bind parameter limit.
+const batchChunk = 1000
+
+// liveRow filters out kv_store rows past their expiry.
+const liveRow = `(expires_at IS NULL OR expires_at > now())`
+
+// ErrNotFound is returned when the requested key does not exist.
+var ErrNotFound = errors.New("key not found")
+
+// ErrExists is returned by Insert when the key is already present.
+var ErrExists = errors.New("key already exists")
+
+// ErrRevisionMismatch is returned by Update when the key has been written
+// since the revision the caller expected.
+var ErrRevisionMismatch = errors.New("revision mismatch")
+
+// ErrNotInteger is returned by Increment when the value is not an integer.
+var ErrNotInteger = errors.New("value is not an integer")
+
+// ErrOverflow is returned by Increment when the result does not fit in 64 bits.
+var ErrOverflow = errors.New("integer overflow")
+
 type PostgresDB struct {
-	db *sql.DB
+	db      *sql.DB
+	connStr string
+
+	// instanceID tags invalidation notifications; empty disables them
+	instanceID string
+
+	// Store calls slower than this are logged; zero disables the log
+	slowQuery time.Duration
 }
 
 func NewPostgresDB(host, port, user, password, dbname string) (*PostgresDB, error) {
@@ -26,45 +61,395 @@ func NewPostgresDB(host, port, user, password, dbname string) (*PostgresDB, erro
 
 	// Test connection
 	if err := db.Ping(); err != nil {
+		db.Close()
 		return nil, err
 	}
 
-	return &PostgresDB{db: db}, nil
+	return &PostgresDB{db: db, connStr: connStr}, nil
+}
+
+// WaitForPostgresDB keeps retrying NewPostgresDB with exponential backoff
+// until it succeeds or wait has elapsed. A zero wait makes a single attempt.
+func WaitForPostgresDB(host, port, user, password, dbname string, wait time.Duration) (*PostgresDB, error) {
+	deadline := time.Now().Add(wait)
+	backoff := 500 * time.Millisecond
+
+	for attempt := 1; ; attempt++ {
+		db, err := NewPostgresDB(host, port, user, password, dbname)
+		if err == nil {
+			return db, nil
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, fmt.Errorf("database not reachable after %d attempt(s): %w", attempt, err)
+		}
+		if backoff > remaining {
+			backoff = remaining
+		}
+
+		log.Printf("Database not ready (attempt %d): %v; retrying in %s", attempt, err, backoff)
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if backoff > 10*time.Second {
+			backoff = 10 * time.Second
+		}
+	}
+}
+
+// SetConnLifetimes recycles pooled connections once they exceed maxLifetime
+// or sit idle longer than maxIdleTime. Zero leaves the limit disabled.
+func (p *PostgresDB) SetConnLifetimes(maxLifetime, maxIdleTime time.Duration) {
+	p.db.SetConnMaxLifetime(maxLifetime)
+	p.db.SetConnMaxIdleTime(maxIdleTime)
 }
 
-func (p *PostgresDB) Create(key, value string) error {
-	query := `INSERT INTO kv_store (key, value) VALUES ($1, $2)
-			  ON CONFLICT (key) DO UPDATE SET value = $2`
-	_, err := p.db.Exec(query, key, value)
-	return err
+// SetSlowQueryThreshold logs every Store call that takes longer than d,
+// with the ID of the request it served, so a slow query can be matched to
+// the client request and access log line behind it. Zero disables the log.
+// Call it before serving.
+func (p *PostgresDB) SetSlowQueryThreshold(d time.Duration) {
+	p.slowQuery = d
 }
 
-func (p *PostgresDB) Read(key string) (string, error) {
-	var value string
-	query := `SELECT value FROM kv_store WHERE key = $1`
-	err := p.db.QueryRow(query, key).Scan(&value)
+// observe logs the Store call op, started at start, if it was slow.
+func (p *PostgresDB) observe(ctx context.Context, op string, start time.Time) {
+	if p.slowQuery <= 0 {
+		return
+	}
+	elapsed := time.Since(start)
+	if elapsed < p.slowQuery {
+		return
+	}
+	id := RequestID(ctx)
+	if id == "" {
+		id = "-"
+	}
+	log.Printf("Slow query: %s took %s (request %s)", op, elapsed.Round(time.Microsecond), id)
+}
+
+// Create passes the value as []byte, as every write does, so the driver
+// sends it as bytea rather than as text that Postgres would parse for
+// escape sequences.
+func (p *PostgresDB) Create(ctx context.Context, key, value, contentType string, expiresAt time.Time) (uint64, error) {
+	defer p.observe(ctx, "create", time.Now())
+	var revision uint64
+	ns, k := SplitKey(key)
+	query := `INSERT INTO kv_store (namespace, key, value, content_type, expires_at) VALUES ($1, $2, $3, $4, $5)
+			  ON CONFLICT (namespace, key) DO UPDATE
+			  SET value = $3, content_type = $4, expires_at = $5, revision = nextval('kv_revision_seq')
+			  RETURNING revision`
+	err := p.db.QueryRowContext(ctx, query, ns, k, []byte(value), nullString(contentType), nullTime(expiresAt)).Scan(&revision)
+	if err != nil {
+		return 0, err
+	}
+	p.notifyInvalidation(key)
+	return revision, nil
+}
+
+// Insert treats an expired row as absent and overwrites it.
+func (p *PostgresDB) Insert(ctx context.Context, key, value, contentType string, expiresAt time.Time) (uint64, error) {
+	defer p.observe(ctx, "insert", time.Now())
+	var revision uint64
+	ns, k := SplitKey(key)
+	query := `INSERT INTO kv_store (namespace, key, value, content_type, expires_at) VALUES ($1, $2, $3, $4, $5)
+			  ON CONFLICT (namespace, key) DO UPDATE
+			  SET value = $3, content_type = $4, expires_at = $5, revision = nextval('kv_revision_seq')
+			  WHERE kv_store.expires_at <= now()
+			  RETURNING revision`
+	err := p.db.QueryRowContext(ctx, query, ns, k, []byte(value), nullString(contentType), nullTime(expiresAt)).Scan(&revision)
+	if err == sql.ErrNoRows {
+		return 0, ErrExists
+	}
+	if err != nil {
+		return 0, err
+	}
+	p.notifyInvalidation(key)
+	return revision, nil
+}
+
+func (p *PostgresDB) Update(ctx context.Context, key, value, contentType string, expiresAt time.Time, revision uint64) (uint64, error) {
+	defer p.observe(ctx, "update", time.Now())
+	var next uint64
+	ns, k := SplitKey(key)
+	query := `UPDATE kv_store SET value = $3, content_type = $4, expires_at = $5, revision = nextval('kv_revision_seq')
+			  WHERE namespace = $1 AND key = $2 AND revision = $6 AND ` + liveRow + `
+			  RETURNING revision`
+	err := p.db.QueryRowContext(ctx, query, ns, k, []byte(value), nullString(contentType), nullTime(expiresAt), revision).Scan(&next)
 	if err == sql.ErrNoRows {
-		return "", fmt.Errorf("key not found")
+		// Tell a stale revision apart from a missing key
+		var exists bool
+		query := `SELECT EXISTS (SELECT 1 FROM kv_store WHERE namespace = $1 AND key = $2 AND ` + liveRow + `)`
+		if err := p.db.QueryRowContext(ctx, query, ns, k).Scan(&exists); err != nil {
+			return 0, err
+		}
+		if !exists {
+			return 0, ErrNotFound
+		}
+		return 0, ErrRevisionMismatch
 	}
-	return value, err
+	if err != nil {
+		return 0, err
+	}
+	p.notifyInvalidation(key)
+	return next, nil
 }
 
-func (p *PostgresDB) Delete(key string) error {
-	query := `DELETE FROM kv_store WHERE key = $1`
-	result, err := p.db.Exec(query, key)
+// Increment restarts an expired counter from zero, without an expiry or
+// content type.
+func (p *PostgresDB) Increment(ctx context.Context, key string, delta int64) (Record, error) {
+	defer p.observe(ctx, "increment", time.Now())
+	var rec Record
+	var expiresAt sql.NullTime
+	var contentType sql.NullString
+	ns, k := SplitKey(key)
+	query := `INSERT INTO kv_store (namespace, key, value) VALUES ($1, $2, convert_to($3::bigint::text, 'UTF8'))
+			  ON CONFLICT (namespace, key) DO UPDATE
+			  SET value = convert_to((CASE WHEN kv_store.expires_at <= now() THEN $3
+			                               ELSE convert_from(kv_store.value, 'UTF8')::bigint + $3 END)::text, 'UTF8'),
+			      expires_at = CASE WHEN kv_store.expires_at <= now() THEN NULL
+			                        ELSE kv_store.expires_at END,
+			      content_type = CASE WHEN kv_store.expires_at <= now() THEN NULL
+			                          ELSE kv_store.content_type END,
+			      revision = nextval('kv_revision_seq')
+			  RETURNING value, revision, expires_at, content_type`
+	err := p.db.QueryRowContext(ctx, query, ns, k, delta).Scan(&rec.Value, &rec.Revision, &expiresAt, &contentType)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case "22P02", "22021": // invalid_text_representation, character_not_in_repertoire
+			return Record{}, ErrNotInteger
+		case "22003": // numeric_value_out_of_range
+			return Record{}, ErrOverflow
+		}
+	}
 	if err != nil {
+		return Record{}, err
+	}
+	rec.ExpiresAt = expiresAt.Time
+	rec.ContentType = contentType.String
+	p.notifyInvalidation(key)
+	return rec, nil
+}
+
+// CreateBatch upserts pairs in one transaction using multi-row INSERTs.
+// Keys must be unique within a batch: Postgres refuses to update the same
+// row twice in one statement. Invalidations are sent inside the transaction
+// so they are delivered only if it commits.
+func (p *PostgresDB) CreateBatch(ctx context.Context, pairs []KeyValue) error {
+	defer p.observe(ctx, "create batch", time.Now())
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	revisions := make(map[string]uint64, len(pairs))
+	for start := 0; start < len(pairs); start += batchChunk {
+		chunk := pairs[start:min(start+batchChunk, len(pairs))]
+
+		var query strings.Builder
+		query.WriteString(`INSERT INTO kv_store (namespace, key, value, content_type, expires_at) VALUES `)
+		args := make([]any, 0, 5*len(chunk))
+		for i, kv := range chunk {
+			if i > 0 {
+				query.WriteString(", ")
+			}
+			fmt.Fprintf(&query, "($%d, $%d, $%d, $%d, $%d)", 5*i+1, 5*i+2, 5*i+3, 5*i+4, 5*i+5)
+			ns, k := SplitKey(kv.Key)
+			args = append(args, ns, k, []byte(kv.Value), nullString(kv.ContentType), nullTime(kv.ExpiresAt))
+		}
+		query.WriteString(` ON CONFLICT (namespace, key) DO UPDATE
+			SET value = EXCLUDED.value, content_type = EXCLUDED.content_type,
+			    expires_at = EXCLUDED.expires_at, revision = EXCLUDED.revision
+			RETURNING namespace, key, revision`)
+
+		rows, err := tx.QueryContext(ctx, query.String(), args...)
+		if err != nil {
+			return err
+		}
+		if err := scanRevisions(rows, revisions); err != nil {
+			return err
+		}
+	}
+
+	if p.instanceID != "" {
+		keys := make([]string, len(pairs))
+		for i, kv := range pairs {
+			keys[i] = wireKey(kv.Key)
+		}
+		query := `SELECT pg_notify($1, $2 || ':' || k) FROM unnest($3::text[]) AS k`
+		if _, err := tx.ExecContext(ctx, query, InvalidationChannel, p.instanceID, pq.Array(keys)); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
 		return err
 	}
-	rows, err := result.RowsAffected()
+	for i := range pairs {
+		pairs[i].Revision = revisions[pairs[i].Key]
+	}
+	return nil
+}
+
+// scanRevisions collects the namespace, key and revision columns of rows
+// into revisions, by qualified key.
+func scanRevisions(rows *sql.Rows, revisions map[string]uint64) error {
+	defer rows.Close()
+	for rows.Next() {
+		var ns, key string
+		var revision uint64
+		if err := rows.Scan(&ns, &key, &revision); err != nil {
+			return err
+		}
+		revisions[QualifyKey(ns, key)] = revision
+	}
+	return rows.Err()
+}
+
+func (p *PostgresDB) Read(ctx context.Context, key string) (string, error) {
+	rec, err := p.ReadRecord(ctx, key)
+	return rec.Value, err
+}
+
+func (p *PostgresDB) ReadRecord(ctx context.Context, key string) (Record, error) {
+	defer p.observe(ctx, "read", time.Now())
+	var rec Record
+	var expiresAt sql.NullTime
+	var contentType sql.NullString
+	ns, k := SplitKey(key)
+	query := `SELECT value, revision, expires_at, content_type FROM kv_store
+			  WHERE namespace = $1 AND key = $2 AND ` + liveRow
+	err := p.db.QueryRowContext(ctx, query, ns, k).Scan(&rec.Value, &rec.Revision, &expiresAt, &contentType)
+	if err == sql.ErrNoRows {
+		return Record{}, ErrNotFound
+	}
+	rec.ExpiresAt = expiresAt.Time
+	rec.ContentType = contentType.String
+	return rec, err
+}
+
+func (p *PostgresDB) ReadBatch(ctx context.Context, keys []string) (map[string]string, error) {
+	defer p.observe(ctx, "read batch", time.Now())
+	namespaces := make([]string, len(keys))
+	names := make([]string, len(keys))
+	for i, key := range keys {
+		namespaces[i], names[i] = SplitKey(key)
+	}
+	query := `SELECT namespace, key, value FROM kv_store
+			  WHERE (namespace, key) IN (SELECT * FROM unnest($1::text[], $2::text[])) AND ` + liveRow
+	rows, err := p.db.QueryContext(ctx, query, pq.Array(namespaces), pq.Array(names))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := make(map[string]string, len(keys))
+	for rows.Next() {
+		var ns, key, value string
+		if err := rows.Scan(&ns, &key, &value); err != nil {
+			return nil, err
+		}
+		values[QualifyKey(ns, key)] = value
+	}
+	return values, rows.Err()
+}
+
+// Delete removes an expired row too, but reports it as not found.
+func (p *PostgresDB) Delete(ctx context.Context, key string) error {
+	defer p.observe(ctx, "delete", time.Now())
+	var live bool
+	ns, k := SplitKey(key)
+	query := `DELETE FROM kv_store WHERE namespace = $1 AND key = $2 RETURNING ` + liveRow
+	err := p.db.QueryRowContext(ctx, query, ns, k).Scan(&live)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
 	if err != nil {
 		return err
 	}
-	if rows == 0 {
-		return fmt.Errorf("key not found")
+	p.notifyInvalidation(key)
+	if !live {
+		return ErrNotFound
 	}
 	return nil
 }
 
+// DeleteExpired skips rows locked by concurrent writers, and sweepers on
+// other instances, instead of waiting for them.
+func (p *PostgresDB) DeleteExpired(ctx context.Context, limit int) ([]string, error) {
+	defer p.observe(ctx, "delete expired", time.Now())
+	query := `DELETE FROM kv_store WHERE (namespace, key) IN (
+				SELECT namespace, key FROM kv_store WHERE expires_at <= now()
+				ORDER BY expires_at LIMIT $1 FOR UPDATE SKIP LOCKED)
+			  RETURNING namespace, key`
+	rows, err := p.db.QueryContext(ctx, query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var ns, key string
+		if err := rows.Scan(&ns, &key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, QualifyKey(ns, key))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		p.notifyInvalidation(key)
+	}
+	return keys, nil
+}
+
+// List pages through keys with keyset pagination, so each page costs the
+// same however deep into the listing it is. The namespace of prefix is the
+// one listed.
+func (p *PostgresDB) List(ctx context.Context, prefix, after string, limit int, withValues bool) ([]KeyValue, error) {
+	defer p.observe(ctx, "list", time.Now())
+	columns := "key, ''"
+	if withValues {
+		columns = "key, value"
+	}
+	ns, prefix := SplitKey(prefix)
+	_, after = SplitKey(after)
+	query := `SELECT ` + columns + ` FROM kv_store
+			  WHERE namespace = $1 AND key LIKE $2 ESCAPE '\' AND key > $3 AND ` + liveRow + `
+			  ORDER BY key LIMIT $4`
+	rows, err := p.db.QueryContext(ctx, query, ns, likePrefix(prefix), after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []KeyValue
+	for rows.Next() {
+		var kv KeyValue
+		if err := rows.Scan(&kv.Key, &kv.Value); err != nil {
+			return nil, err
+		}
+		kv.Key = QualifyKey(ns, kv.Key)
+		items = append(items, kv)
+	}
+	return items, rows.Err()
+}
+
+// nullTime maps a zero time to NULL.
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+// nullString maps an empty string to NULL.
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
 func (p *PostgresDB) Close() error {
 	return p.db.Close()
 }
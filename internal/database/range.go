@@ -0,0 +1,90 @@
+package database
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// RangeReader is implemented by stores that can read the keys between two
+// bounds in key order.
+type RangeReader interface {
+	// Range returns up to limit live keys from start, inclusive, to end,
+	// exclusive, in key order, with their values unless keysOnly. The
+	// namespace of start is the one read, and end is qualified with it too;
+	// an empty end leaves the range open above.
+	Range(ctx context.Context, start, end string, limit int, keysOnly bool) ([]KeyValue, error)
+}
+
+var (
+	_ RangeReader = (*PostgresDB)(nil)
+	_ RangeReader = (*MemoryDB)(nil)
+)
+
+// Range is a scan of the primary key between the bounds.
+func (p *PostgresDB) Range(ctx context.Context, start, end string, limit int, keysOnly bool) ([]KeyValue, error) {
+	defer p.observe(ctx, "range", time.Now())
+	columns := "key, value"
+	if keysOnly {
+		columns = "key, ''"
+	}
+	ns, start := SplitKey(start)
+	_, end = SplitKey(end)
+	args := []any{ns, start, limit}
+	bound := ""
+	if end != "" {
+		bound = " AND key < $4"
+		args = append(args, end)
+	}
+	query := `SELECT ` + columns + ` FROM kv_store
+			  WHERE namespace = $1 AND key >= $2` + bound + ` AND ` + liveRow + `
+			  ORDER BY key LIMIT $3`
+	rows, err := p.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []KeyValue
+	for rows.Next() {
+		var kv KeyValue
+		if err := rows.Scan(&kv.Key, &kv.Value); err != nil {
+			return nil, err
+		}
+		kv.Key = QualifyKey(ns, kv.Key)
+		items = append(items, kv)
+	}
+	return items, rows.Err()
+}
+
+func (m *MemoryDB) Range(ctx context.Context, start, end string, limit int, keysOnly bool) ([]KeyValue, error) {
+	if err := m.faults.inject(ctx); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	ns, from := SplitKey(start)
+	_, to := SplitKey(end)
+	now := time.Now()
+	var keys []string
+	for key, v := range m.data {
+		kns, name := SplitKey(key)
+		if kns == ns && name >= from && (to == "" || name < to) && v.live(now) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	if len(keys) > limit {
+		keys = keys[:limit]
+	}
+
+	items := make([]KeyValue, len(keys))
+	for i, key := range keys {
+		items[i].Key = key
+		if !keysOnly {
+			items[i].Value = m.data[key].value
+		}
+	}
+	return items, nil
+}
@@ -0,0 +1,20 @@
+package database
+
+import "context"
+
+// RequestIDKey is the context key a request's ID is stored under. A context
+// may also answer it lazily from its Value method, so an ID is only made
+// when something asks for it.
+type RequestIDKey struct{}
+
+// WithRequestID returns a copy of ctx carrying id.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, RequestIDKey{}, id)
+}
+
+// RequestID returns the ID ctx carries, or "" if there is none, as for
+// background work.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(RequestIDKey{}).(string)
+	return id
+}
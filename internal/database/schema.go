@@ -0,0 +1,101 @@
+package database
+
+import (
+	"context"
+	"time"
+)
+
+// SchemaStore is implemented by stores that hold a JSON Schema per
+// namespace for values written there to match. The store keeps the schema
+// text; compiling and enforcing it is up to the server.
+type SchemaStore interface {
+	// Schemas returns every schema by namespace, "" being the default one.
+	Schemas(ctx context.Context) (map[string]string, error)
+	PutSchema(ctx context.Context, namespace, schema string) error
+	// DeleteSchema fails with ErrNotFound if namespace has no schema.
+	DeleteSchema(ctx context.Context, namespace string) error
+}
+
+var (
+	_ SchemaStore = (*PostgresDB)(nil)
+	_ SchemaStore = (*MemoryDB)(nil)
+)
+
+func (p *PostgresDB) Schemas(ctx context.Context) (map[string]string, error) {
+	defer p.observe(ctx, "schemas", time.Now())
+	rows, err := p.db.QueryContext(ctx, `SELECT namespace, schema FROM kv_schemas`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	schemas := make(map[string]string)
+	for rows.Next() {
+		var ns, schema string
+		if err := rows.Scan(&ns, &schema); err != nil {
+			return nil, err
+		}
+		schemas[ns] = schema
+	}
+	return schemas, rows.Err()
+}
+
+func (p *PostgresDB) PutSchema(ctx context.Context, namespace, schema string) error {
+	defer p.observe(ctx, "put schema", time.Now())
+	query := `INSERT INTO kv_schemas (namespace, schema) VALUES ($1, $2)
+			  ON CONFLICT (namespace) DO UPDATE SET schema = $2, updated_at = now()`
+	_, err := p.db.ExecContext(ctx, query, namespace, schema)
+	return err
+}
+
+func (p *PostgresDB) DeleteSchema(ctx context.Context, namespace string) error {
+	defer p.observe(ctx, "delete schema", time.Now())
+	res, err := p.db.ExecContext(ctx, `DELETE FROM kv_schemas WHERE namespace = $1`, namespace)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (m *MemoryDB) Schemas(ctx context.Context) (map[string]string, error) {
+	if err := m.faults.inject(ctx); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	schemas := make(map[string]string, len(m.schemas))
+	for ns, schema := range m.schemas {
+		schemas[ns] = schema
+	}
+	return schemas, nil
+}
+
+func (m *MemoryDB) PutSchema(ctx context.Context, namespace, schema string) error {
+	if err := m.faults.inject(ctx); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.schemas == nil {
+		m.schemas = make(map[string]string)
+	}
+	m.schemas[namespace] = schema
+	return nil
+}
+
+func (m *MemoryDB) DeleteSchema(ctx context.Context, namespace string) error {
+	if err := m.faults.inject(ctx); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.schemas[namespace]; !ok {
+		return ErrNotFound
+	}
+	delete(m.schemas, namespace)
+	return nil
+}
@@ -0,0 +1,175 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Snapshot is a consistent, read-only view of the keys under a prefix as of
+// the moment it was taken. Writes made afterwards are not visible to it.
+type Snapshot interface {
+	// Read returns the value of a key under the snapshot's prefix.
+	Read(key string) (string, error)
+	// Scan calls fn for every key under the prefix in key order, stopping at
+	// the first error fn returns.
+	Scan(fn func(key, value string) error) error
+	// Count returns the number of keys in the snapshot.
+	Count() int
+	// Close releases the snapshot's resources.
+	Close() error
+}
+
+// Snapshotter is implemented by stores that can take snapshots.
+type Snapshotter interface {
+	Snapshot(prefix string) (Snapshot, error)
+}
+
+var (
+	_ Snapshotter = (*PostgresDB)(nil)
+	_ Snapshotter = (*MemoryDB)(nil)
+)
+
+// Snapshot opens a read-only REPEATABLE READ transaction, which pins one
+// MVCC snapshot for its lifetime. Each snapshot holds a pooled connection
+// until closed.
+func (p *PostgresDB) Snapshot(prefix string) (Snapshot, error) {
+	tx, err := p.db.BeginTx(context.Background(), &sql.TxOptions{
+		Isolation: sql.LevelRepeatableRead,
+		ReadOnly:  true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The snapshot is taken by the first statement, not by BEGIN
+	snap := &pgSnapshot{tx: tx}
+	snap.namespace, snap.prefix = SplitKey(prefix)
+	query := `SELECT count(*) FROM kv_store WHERE namespace = $1 AND key LIKE $2 ESCAPE '\' AND ` + liveRow
+	if err := tx.QueryRow(query, snap.namespace, likePrefix(snap.prefix)).Scan(&snap.count); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return snap, nil
+}
+
+// pgSnapshot serializes access because a transaction is bound to a single
+// connection, which can only run one statement at a time.
+type pgSnapshot struct {
+	mu        sync.Mutex
+	tx        *sql.Tx
+	namespace string
+	prefix    string
+	count     int
+}
+
+func (s *pgSnapshot) Read(key string) (string, error) {
+	ns, key := SplitKey(key)
+	if ns != s.namespace || !strings.HasPrefix(key, s.prefix) {
+		return "", ErrNotFound
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var value string
+	query := `SELECT value FROM kv_store WHERE namespace = $1 AND key = $2 AND ` + liveRow
+	err := s.tx.QueryRow(query, ns, key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", ErrNotFound
+	}
+	return value, err
+}
+
+func (s *pgSnapshot) Scan(fn func(key, value string) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	query := `SELECT key, value FROM kv_store
+			  WHERE namespace = $1 AND key LIKE $2 ESCAPE '\' AND ` + liveRow + ` ORDER BY key`
+	rows, err := s.tx.Query(query, s.namespace, likePrefix(s.prefix))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return err
+		}
+		if err := fn(QualifyKey(s.namespace, key), value); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *pgSnapshot) Count() int {
+	return s.count
+}
+
+func (s *pgSnapshot) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tx.Rollback()
+}
+
+// likePrefix builds a LIKE pattern matching keys that start with prefix.
+func likePrefix(prefix string) string {
+	r := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return r.Replace(prefix) + "%"
+}
+
+// Snapshot copies the matching keys, so it is consistent but not free for
+// large prefixes.
+func (m *MemoryDB) Snapshot(prefix string) (Snapshot, error) {
+	if err := m.faults.inject(context.Background()); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	snap := &memorySnapshot{data: make(map[string]string)}
+	now := time.Now()
+	for key, v := range m.data {
+		if hasKeyPrefix(key, prefix) && v.live(now) {
+			snap.data[key] = v.value
+			snap.keys = append(snap.keys, key)
+		}
+	}
+	sort.Strings(snap.keys)
+	return snap, nil
+}
+
+type memorySnapshot struct {
+	data map[string]string
+	keys []string
+}
+
+func (s *memorySnapshot) Read(key string) (string, error) {
+	value, ok := s.data[key]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return value, nil
+}
+
+func (s *memorySnapshot) Scan(fn func(key, value string) error) error {
+	for _, key := range s.keys {
+		if err := fn(key, s.data[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memorySnapshot) Count() int {
+	return len(s.keys)
+}
+
+func (s *memorySnapshot) Close() error {
+	return nil
+}
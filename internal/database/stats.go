@@ -0,0 +1,177 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"time"
+)
+
+// StatsSample is what one instance served since its previous sample. All
+// instances' samples for an hour add up in the same row.
+type StatsSample struct {
+	Hour        time.Time
+	Requests    uint64
+	CacheHits   uint64
+	CacheMisses uint64
+	// LatencySum adds up the latency of Requests; LatencyMax is the slowest
+	LatencySum time.Duration
+	LatencyMax time.Duration
+	// Keys is the number of live keys, negative if not counted this time
+	Keys int64
+}
+
+// StatsHour is the sum of an hour's samples. Keys is the last count taken
+// in the hour, negative if none was.
+type StatsHour struct {
+	Hour        time.Time
+	Requests    uint64
+	CacheHits   uint64
+	CacheMisses uint64
+	LatencySum  time.Duration
+	LatencyMax  time.Duration
+	Keys        int64
+}
+
+// StatsStore is implemented by stores that keep hourly server statistics.
+type StatsStore interface {
+	// RecordStats adds sample to its hour.
+	RecordStats(sample StatsSample) error
+	// StatsHistory returns the hours from since on, oldest first.
+	StatsHistory(since time.Time) ([]StatsHour, error)
+	// PruneStats deletes the hours before before.
+	PruneStats(before time.Time) error
+	// CountKeys returns the number of live keys in every namespace.
+	CountKeys() (int64, error)
+}
+
+var (
+	_ StatsStore = (*PostgresDB)(nil)
+	_ StatsStore = (*MemoryDB)(nil)
+)
+
+func (p *PostgresDB) RecordStats(sample StatsSample) error {
+	query := `INSERT INTO kv_stats_hourly
+				(hour, requests, cache_hits, cache_misses, latency_sum_us, latency_max_us, keys)
+			  VALUES ($1, $2, $3, $4, $5, $6, $7)
+			  ON CONFLICT (hour) DO UPDATE SET
+				requests = kv_stats_hourly.requests + EXCLUDED.requests,
+				cache_hits = kv_stats_hourly.cache_hits + EXCLUDED.cache_hits,
+				cache_misses = kv_stats_hourly.cache_misses + EXCLUDED.cache_misses,
+				latency_sum_us = kv_stats_hourly.latency_sum_us + EXCLUDED.latency_sum_us,
+				latency_max_us = GREATEST(kv_stats_hourly.latency_max_us, EXCLUDED.latency_max_us),
+				keys = COALESCE(EXCLUDED.keys, kv_stats_hourly.keys)`
+	keys := sql.NullInt64{Int64: sample.Keys, Valid: sample.Keys >= 0}
+	_, err := p.db.Exec(query, sample.Hour, int64(sample.Requests), int64(sample.CacheHits), int64(sample.CacheMisses),
+		sample.LatencySum.Microseconds(), sample.LatencyMax.Microseconds(), keys)
+	return err
+}
+
+func (p *PostgresDB) StatsHistory(since time.Time) ([]StatsHour, error) {
+	query := `SELECT hour, requests, cache_hits, cache_misses, latency_sum_us, latency_max_us, keys
+			  FROM kv_stats_hourly WHERE hour >= $1 ORDER BY hour`
+	rows, err := p.db.Query(query, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hours []StatsHour
+	for rows.Next() {
+		var h StatsHour
+		var requests, hits, misses, latencySum, latencyMax int64
+		var keys sql.NullInt64
+		if err := rows.Scan(&h.Hour, &requests, &hits, &misses, &latencySum, &latencyMax, &keys); err != nil {
+			return nil, err
+		}
+		h.Requests, h.CacheHits, h.CacheMisses = uint64(requests), uint64(hits), uint64(misses)
+		h.LatencySum = time.Duration(latencySum) * time.Microsecond
+		h.LatencyMax = time.Duration(latencyMax) * time.Microsecond
+		h.Keys = -1
+		if keys.Valid {
+			h.Keys = keys.Int64
+		}
+		hours = append(hours, h)
+	}
+	return hours, rows.Err()
+}
+
+func (p *PostgresDB) PruneStats(before time.Time) error {
+	_, err := p.db.Exec(`DELETE FROM kv_stats_hourly WHERE hour < $1`, before)
+	return err
+}
+
+// CountKeys scans kv_store, so it is meant to run about once an hour.
+func (p *PostgresDB) CountKeys() (int64, error) {
+	var n int64
+	err := p.db.QueryRow(`SELECT count(*) FROM kv_store WHERE ` + liveRow).Scan(&n)
+	return n, err
+}
+
+func (m *MemoryDB) RecordStats(sample StatsSample) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.stats == nil {
+		m.stats = make(map[time.Time]*StatsHour)
+	}
+	h, ok := m.stats[sample.Hour]
+	if !ok {
+		h = &StatsHour{Hour: sample.Hour, Keys: -1}
+		m.stats[sample.Hour] = h
+	}
+	h.Requests += sample.Requests
+	h.CacheHits += sample.CacheHits
+	h.CacheMisses += sample.CacheMisses
+	h.LatencySum += sample.LatencySum
+	h.LatencyMax = max(h.LatencyMax, sample.LatencyMax)
+	if sample.Keys >= 0 {
+		h.Keys = sample.Keys
+	}
+	return nil
+}
+
+func (m *MemoryDB) StatsHistory(since time.Time) ([]StatsHour, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var hours []StatsHour
+	for hour, h := range m.stats {
+		if !hour.Before(since) {
+			hours = append(hours, *h)
+		}
+	}
+	sort.Slice(hours, func(i, j int) bool {
+		return hours[i].Hour.Before(hours[j].Hour)
+	})
+	return hours, nil
+}
+
+func (m *MemoryDB) PruneStats(before time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for hour := range m.stats {
+		if hour.Before(before) {
+			delete(m.stats, hour)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryDB) CountKeys() (int64, error) {
+	if err := m.faults.inject(context.Background()); err != nil {
+		return 0, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var n int64
+	now := time.Now()
+	for _, v := range m.data {
+		if v.live(now) {
+			n++
+		}
+	}
+	return n, nil
+}
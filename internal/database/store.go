@@ -0,0 +1,79 @@
+package database
+
+import (
+	"context"
+	"time"
+)
+
+// Store is the persistence layer behind the cache. PostgresDB is the
+// production implementation; MemoryDB backs hermetic tests and benchmarks.
+//
+// Every write stamps the key with a new revision. Revisions increase across
+// the whole store, so a key never gets back a revision it had before.
+//
+// Writes take an expiry time, zero for none, and replace any earlier one. A
+// key past its expiry reads as missing until the sweeper deletes it.
+//
+// Values are arbitrary bytes. Writes also take the value's media type, empty
+// if the client gave none, which is stored as is and read back with it.
+//
+// Keys are qualified with their namespace (see QualifyKey). Keys in different
+// namespaces never collide, and List and Snapshot prefixes only match keys in
+// their own namespace.
+//
+// Every method but Close takes the context of the request it serves, which
+// carries the request's ID (see RequestID) for logging.
+type Store interface {
+	// Create upserts key and returns its new revision.
+	Create(ctx context.Context, key, value, contentType string, expiresAt time.Time) (uint64, error)
+	// Insert writes a new key, failing with ErrExists if it is present.
+	Insert(ctx context.Context, key, value, contentType string, expiresAt time.Time) (uint64, error)
+	// Update overwrites key only while it is still at revision, failing with
+	// ErrRevisionMismatch otherwise and ErrNotFound if it does not exist.
+	Update(ctx context.Context, key, value, contentType string, expiresAt time.Time, revision uint64) (uint64, error)
+	// Increment atomically adds delta to the integer stored at key, treating
+	// a missing key as 0, and returns the new record. The key keeps its
+	// expiry and content type. It fails with ErrNotInteger or ErrOverflow
+	// when the value cannot be incremented.
+	Increment(ctx context.Context, key string, delta int64) (Record, error)
+	// CreateBatch upserts every pair atomically: all are written or none.
+	// The new revisions are filled into pairs.
+	CreateBatch(ctx context.Context, pairs []KeyValue) error
+	Read(ctx context.Context, key string) (string, error)
+	// ReadRecord is Read that also returns the key's revision, expiry and
+	// content type.
+	ReadRecord(ctx context.Context, key string) (Record, error)
+	// ReadBatch returns the values of the keys that exist, in one round trip.
+	ReadBatch(ctx context.Context, keys []string) (map[string]string, error)
+	Delete(ctx context.Context, key string) error
+	// DeleteExpired deletes up to limit keys past their expiry and returns
+	// them.
+	DeleteExpired(ctx context.Context, limit int) ([]string, error)
+	// List returns up to limit keys starting with prefix that sort after
+	// after, in key order. Values are only filled in when withValues is set.
+	List(ctx context.Context, prefix, after string, limit int, withValues bool) ([]KeyValue, error)
+	Close() error
+}
+
+// Record is a stored value with its revision, expiry (zero if none) and
+// content type (empty if none).
+type Record struct {
+	Value       string
+	Revision    uint64
+	ExpiresAt   time.Time
+	ContentType string
+}
+
+// KeyValue is one pair in a batch write.
+type KeyValue struct {
+	Key         string
+	Value       string
+	ContentType string
+	ExpiresAt   time.Time
+	Revision    uint64
+}
+
+var (
+	_ Store = (*PostgresDB)(nil)
+	_ Store = (*MemoryDB)(nil)
+)
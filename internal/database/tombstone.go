@@ -0,0 +1,193 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// SoftDeleter is implemented by stores that can keep deleted keys as
+// tombstones, so an accidental delete can be undone until the tombstone is
+// purged.
+type SoftDeleter interface {
+	// SoftDelete is Delete that keeps the key's value, content type and
+	// expiry in a tombstone stamped with the time of the delete. A key
+	// deleted again replaces its tombstone.
+	SoftDelete(ctx context.Context, key string) error
+	// Restore writes key's tombstone back under a new revision and drops
+	// it. It fails with ErrNotFound if there is none, or its expiry has
+	// passed, and with ErrExists if the key has been written since.
+	Restore(ctx context.Context, key string) (Record, error)
+	// PurgeTombstones drops up to limit tombstones of keys deleted before
+	// before, or whose expiry has passed, and returns how many it dropped.
+	PurgeTombstones(ctx context.Context, before time.Time, limit int) (int, error)
+}
+
+var (
+	_ SoftDeleter = (*PostgresDB)(nil)
+	_ SoftDeleter = (*MemoryDB)(nil)
+)
+
+// SoftDelete moves the row to kv_tombstones in one statement. An expired
+// row is deleted without a tombstone, and reported as not found.
+func (p *PostgresDB) SoftDelete(ctx context.Context, key string) error {
+	defer p.observe(ctx, "soft delete", time.Now())
+	var live bool
+	ns, k := SplitKey(key)
+	query := `WITH gone AS (
+				  DELETE FROM kv_store WHERE namespace = $1 AND key = $2
+				  RETURNING namespace, key, value, content_type, expires_at, ` + liveRow + ` AS live
+			  ), kept AS (
+				  INSERT INTO kv_tombstones (namespace, key, value, content_type, expires_at, deleted_at)
+				  SELECT namespace, key, value, content_type, expires_at, now() FROM gone WHERE live
+				  ON CONFLICT (namespace, key) DO UPDATE
+				  SET value = EXCLUDED.value, content_type = EXCLUDED.content_type,
+				      expires_at = EXCLUDED.expires_at, deleted_at = EXCLUDED.deleted_at
+			  )
+			  SELECT live FROM gone`
+	err := p.db.QueryRowContext(ctx, query, ns, k).Scan(&live)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	p.notifyInvalidation(key)
+	if !live {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Restore locks the tombstone while it writes the key back, so two
+// restores of a key cannot both succeed.
+func (p *PostgresDB) Restore(ctx context.Context, key string) (Record, error) {
+	defer p.observe(ctx, "restore", time.Now())
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Record{}, err
+	}
+	defer tx.Rollback()
+
+	var rec Record
+	var value []byte
+	var expiresAt sql.NullTime
+	var contentType sql.NullString
+	ns, k := SplitKey(key)
+	query := `SELECT value, content_type, expires_at FROM kv_tombstones
+			  WHERE namespace = $1 AND key = $2 AND ` + liveRow + ` FOR UPDATE`
+	err = tx.QueryRowContext(ctx, query, ns, k).Scan(&value, &contentType, &expiresAt)
+	if err == sql.ErrNoRows {
+		return Record{}, ErrNotFound
+	}
+	if err != nil {
+		return Record{}, err
+	}
+
+	// As Insert: an expired row is absent
+	query = `INSERT INTO kv_store (namespace, key, value, content_type, expires_at) VALUES ($1, $2, $3, $4, $5)
+			 ON CONFLICT (namespace, key) DO UPDATE
+			 SET value = $3, content_type = $4, expires_at = $5, revision = nextval('kv_revision_seq')
+			 WHERE kv_store.expires_at <= now()
+			 RETURNING revision`
+	err = tx.QueryRowContext(ctx, query, ns, k, value, contentType, expiresAt).Scan(&rec.Revision)
+	if err == sql.ErrNoRows {
+		return Record{}, ErrExists
+	}
+	if err != nil {
+		return Record{}, err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM kv_tombstones WHERE namespace = $1 AND key = $2`, ns, k); err != nil {
+		return Record{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Record{}, err
+	}
+
+	p.notifyInvalidation(key)
+	rec.Value = string(value)
+	rec.ContentType = contentType.String
+	rec.ExpiresAt = expiresAt.Time
+	return rec, nil
+}
+
+// PurgeTombstones skips tombstones being restored, and purges on other
+// instances, instead of waiting for them.
+func (p *PostgresDB) PurgeTombstones(ctx context.Context, before time.Time, limit int) (int, error) {
+	defer p.observe(ctx, "purge tombstones", time.Now())
+	query := `DELETE FROM kv_tombstones WHERE (namespace, key) IN (
+				SELECT namespace, key FROM kv_tombstones WHERE deleted_at < $1 OR expires_at <= now()
+				LIMIT $2 FOR UPDATE SKIP LOCKED)`
+	res, err := p.db.ExecContext(ctx, query, before, limit)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// memoryTombstone is a soft-deleted key in MemoryDB.
+type memoryTombstone struct {
+	memoryValue
+	deletedAt time.Time
+}
+
+func (m *MemoryDB) SoftDelete(ctx context.Context, key string) error {
+	if err := m.faults.inject(ctx); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.data[key]; !ok {
+		return ErrNotFound
+	}
+	v, live := m.lookup(key)
+	m.remove(key)
+	if !live {
+		return ErrNotFound
+	}
+	if m.tombstones == nil {
+		m.tombstones = make(map[string]memoryTombstone)
+	}
+	m.tombstones[key] = memoryTombstone{memoryValue: v, deletedAt: time.Now()}
+	return nil
+}
+
+func (m *MemoryDB) Restore(ctx context.Context, key string) (Record, error) {
+	if err := m.faults.inject(ctx); err != nil {
+		return Record{}, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.tombstones[key]
+	if !ok || !t.live(time.Now()) {
+		return Record{}, ErrNotFound
+	}
+	if _, ok := m.lookup(key); ok {
+		return Record{}, ErrExists
+	}
+	delete(m.tombstones, key)
+	revision := m.set(key, t.value, t.contentType, t.expiresAt)
+	return Record{Value: t.value, Revision: revision, ExpiresAt: t.expiresAt, ContentType: t.contentType}, nil
+}
+
+func (m *MemoryDB) PurgeTombstones(ctx context.Context, before time.Time, limit int) (int, error) {
+	if err := m.faults.inject(ctx); err != nil {
+		return 0, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	n := 0
+	for key, t := range m.tombstones {
+		if n == limit {
+			break
+		}
+		if t.deletedAt.Before(before) || !t.live(now) {
+			delete(m.tombstones, key)
+			n++
+		}
+	}
+	return n, nil
+}
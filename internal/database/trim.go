@@ -0,0 +1,130 @@
+package database
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Trimmer is implemented by stores that can bound the number of keys in a
+// namespace, deleting the least recently used ones beyond the bound.
+type Trimmer interface {
+	// Touch records when keys were last read or written. An older time than
+	// the one recorded is ignored. Keys never touched count as the least
+	// recently used.
+	Touch(used map[string]time.Time) error
+	// TrimNamespace deletes up to limit of the least recently used keys of
+	// namespace ns beyond the newest max, and returns them.
+	TrimNamespace(ns string, max, limit int) ([]string, error)
+}
+
+var (
+	_ Trimmer = (*PostgresDB)(nil)
+	_ Trimmer = (*MemoryDB)(nil)
+)
+
+// Touch keeps recency in kv_recency rather than kv_store, so that touching a
+// key neither bumps its revision nor writes history.
+func (p *PostgresDB) Touch(used map[string]time.Time) error {
+	namespaces := make([]string, 0, len(used))
+	names := make([]string, 0, len(used))
+	times := make([]string, 0, len(used))
+	for key, at := range used {
+		ns, name := SplitKey(key)
+		namespaces = append(namespaces, ns)
+		names = append(names, name)
+		times = append(times, at.Format(time.RFC3339Nano))
+	}
+	query := `INSERT INTO kv_recency (namespace, key, used_at)
+			  SELECT * FROM unnest($1::text[], $2::text[], $3::timestamptz[])
+			  ON CONFLICT (namespace, key) DO UPDATE
+			  SET used_at = GREATEST(kv_recency.used_at, EXCLUDED.used_at)`
+	_, err := p.db.Exec(query, pq.Array(namespaces), pq.Array(names), pq.Array(times))
+	return err
+}
+
+// TrimNamespace also drops the recency of keys deleted by other means.
+func (p *PostgresDB) TrimNamespace(ns string, max, limit int) ([]string, error) {
+	query := `DELETE FROM kv_store WHERE namespace = $1 AND key IN (
+				SELECT s.key FROM kv_store s
+				LEFT JOIN kv_recency r ON r.namespace = s.namespace AND r.key = s.key
+				WHERE s.namespace = $1
+				ORDER BY r.used_at DESC NULLS LAST, s.key OFFSET $2 LIMIT $3)
+			  RETURNING key`
+	rows, err := p.db.Query(query, ns, max, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, QualifyKey(ns, key))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		p.notifyInvalidation(key)
+	}
+
+	_, err = p.db.Exec(`DELETE FROM kv_recency r WHERE r.namespace = $1 AND NOT EXISTS (
+						  SELECT 1 FROM kv_store s WHERE s.namespace = r.namespace AND s.key = r.key)`, ns)
+	return keys, err
+}
+
+func (m *MemoryDB) Touch(used map[string]time.Time) error {
+	if err := m.faults.inject(context.Background()); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.used == nil {
+		m.used = make(map[string]time.Time)
+	}
+	for key, at := range used {
+		if _, ok := m.data[key]; ok && at.After(m.used[key]) {
+			m.used[key] = at
+		}
+	}
+	return nil
+}
+
+func (m *MemoryDB) TrimNamespace(ns string, max, limit int) ([]string, error) {
+	if err := m.faults.inject(context.Background()); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var keys []string
+	for key := range m.data {
+		if keyNamespace, _ := SplitKey(key); keyNamespace == ns {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) <= max {
+		return nil, nil
+	}
+
+	// Least recently used first, as Postgres orders them
+	sort.Slice(keys, func(i, j int) bool {
+		ui, uj := m.used[keys[i]], m.used[keys[j]]
+		if !ui.Equal(uj) {
+			return ui.Before(uj)
+		}
+		return keys[i] > keys[j]
+	})
+	keys = keys[:min(len(keys)-max, limit)]
+	for _, key := range keys {
+		m.remove(key)
+	}
+	return keys, nil
+}
@@ -0,0 +1,220 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// txnAttempts bounds how often a transaction that lost a race with a
+// concurrent write is retried.
+const txnAttempts = 3
+
+// ErrCompareFailed is returned by Txn when a compare does not hold.
+var ErrCompareFailed = errors.New("compare failed")
+
+// CompareTarget is what a compare checks of a key.
+type CompareTarget int
+
+const (
+	// CompareVersion checks the key's revision. A missing key has revision
+	// 0, so "= 0" checks that it does not exist.
+	CompareVersion CompareTarget = iota
+	// CompareValue checks the key's value. A missing key fails every value
+	// compare.
+	CompareValue
+)
+
+// CompareOp is how a compare relates the key's state to its operand.
+type CompareOp int
+
+const (
+	CompareEqual CompareOp = iota
+	CompareNotEqual
+	CompareLess
+	CompareGreater
+)
+
+// Compare is a condition a transaction checks before writing.
+type Compare struct {
+	Key     string
+	Target  CompareTarget
+	Op      CompareOp
+	Version uint64
+	Value   string
+}
+
+// holds reports whether the compare holds for the key's current record,
+// ok false if it is missing.
+func (c Compare) holds(rec Record, ok bool) bool {
+	if c.Target == CompareValue {
+		return ok && compareOrdered(rec.Value, c.Value, c.Op)
+	}
+	return compareOrdered(rec.Revision, c.Version, c.Op)
+}
+
+func compareOrdered[T uint64 | string](a, b T, op CompareOp) bool {
+	switch op {
+	case CompareNotEqual:
+		return a != b
+	case CompareLess:
+		return a < b
+	case CompareGreater:
+		return a > b
+	}
+	return a == b
+}
+
+// TxnOp is a write in a transaction: a put, or a delete if Delete is set.
+type TxnOp struct {
+	Delete      bool
+	Key         string
+	Value       string
+	ContentType string
+	ExpiresAt   time.Time
+	// Revision is filled in with the key's new revision by a put
+	Revision uint64
+}
+
+// Transactor is implemented by stores that can apply several writes
+// atomically under conditions, like etcd's Txn.
+type Transactor interface {
+	// Txn checks every compare against the keys' current state and, if
+	// all hold, applies ops in order, all or none. Otherwise it writes
+	// nothing and returns the index of the first compare that failed with
+	// ErrCompareFailed. Deleting a missing key is not an error.
+	Txn(ctx context.Context, compares []Compare, ops []TxnOp) (int, error)
+}
+
+var (
+	_ Transactor = (*PostgresDB)(nil)
+	_ Transactor = (*MemoryDB)(nil)
+)
+
+// Txn runs in a REPEATABLE READ transaction that locks the rows it
+// compares and writes. A concurrent write to them makes Postgres fail the
+// transaction rather than let the compares go stale, and it is retried.
+// Invalidations are sent inside the transaction, as for CreateBatch.
+func (p *PostgresDB) Txn(ctx context.Context, compares []Compare, ops []TxnOp) (int, error) {
+	defer p.observe(ctx, "txn", time.Now())
+	for attempt := 1; ; attempt++ {
+		failed, err := p.txn(ctx, compares, ops)
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "40001" && attempt < txnAttempts { // serialization_failure
+			continue
+		}
+		return failed, err
+	}
+}
+
+func (p *PostgresDB) txn(ctx context.Context, compares []Compare, ops []TxnOp) (int, error) {
+	tx, err := p.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead})
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	seen := make(map[string]bool)
+	var namespaces, names []string
+	addKey := func(key string) {
+		if !seen[key] {
+			seen[key] = true
+			ns, k := SplitKey(key)
+			namespaces, names = append(namespaces, ns), append(names, k)
+		}
+	}
+	for _, c := range compares {
+		addKey(c.Key)
+	}
+	for _, op := range ops {
+		addKey(op.Key)
+	}
+
+	// Locking in key order keeps concurrent transactions from deadlocking
+	query := `SELECT namespace, key, value, revision FROM kv_store
+			  WHERE (namespace, key) IN (SELECT * FROM unnest($1::text[], $2::text[])) AND ` + liveRow + `
+			  ORDER BY namespace, key FOR UPDATE`
+	rows, err := tx.QueryContext(ctx, query, pq.Array(namespaces), pq.Array(names))
+	if err != nil {
+		return 0, err
+	}
+	current := make(map[string]Record)
+	for rows.Next() {
+		var ns, key string
+		var rec Record
+		if err := rows.Scan(&ns, &key, &rec.Value, &rec.Revision); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		current[QualifyKey(ns, key)] = rec
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for i, c := range compares {
+		rec, ok := current[c.Key]
+		if !c.holds(rec, ok) {
+			return i, ErrCompareFailed
+		}
+	}
+
+	for i, op := range ops {
+		ns, k := SplitKey(op.Key)
+		if op.Delete {
+			if _, err := tx.ExecContext(ctx, `DELETE FROM kv_store WHERE namespace = $1 AND key = $2`, ns, k); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		query := `INSERT INTO kv_store (namespace, key, value, content_type, expires_at) VALUES ($1, $2, $3, $4, $5)
+				  ON CONFLICT (namespace, key) DO UPDATE
+				  SET value = $3, content_type = $4, expires_at = $5, revision = nextval('kv_revision_seq')
+				  RETURNING revision`
+		err := tx.QueryRowContext(ctx, query, ns, k, []byte(op.Value), nullString(op.ContentType), nullTime(op.ExpiresAt)).Scan(&ops[i].Revision)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if p.instanceID != "" {
+		keys := make([]string, len(ops))
+		for i, op := range ops {
+			keys[i] = wireKey(op.Key)
+		}
+		query := `SELECT pg_notify($1, $2 || ':' || k) FROM unnest($3::text[]) AS k`
+		if _, err := tx.ExecContext(ctx, query, InvalidationChannel, p.instanceID, pq.Array(keys)); err != nil {
+			return 0, err
+		}
+	}
+	return 0, tx.Commit()
+}
+
+func (m *MemoryDB) Txn(ctx context.Context, compares []Compare, ops []TxnOp) (int, error) {
+	if err := m.faults.inject(ctx); err != nil {
+		return 0, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, c := range compares {
+		v, ok := m.lookup(c.Key)
+		if !c.holds(Record{Value: v.value, Revision: v.revision}, ok) {
+			return i, ErrCompareFailed
+		}
+	}
+	for i, op := range ops {
+		if op.Delete {
+			if _, ok := m.data[op.Key]; ok {
+				m.remove(op.Key)
+			}
+			continue
+		}
+		ops[i].Revision = m.set(op.Key, op.Value, op.ContentType, op.ExpiresAt)
+	}
+	return 0, nil
+}
@@ -0,0 +1,45 @@
+package database
+
+import (
+	"context"
+	"time"
+)
+
+// UsageReader is implemented by stores that can measure what a namespace
+// holds, for enforcing quotas.
+type UsageReader interface {
+	// NamespaceUsage returns the live keys in namespace ns and the total
+	// bytes of their values.
+	NamespaceUsage(ctx context.Context, ns string) (keys, bytes int64, err error)
+}
+
+var (
+	_ UsageReader = (*PostgresDB)(nil)
+	_ UsageReader = (*MemoryDB)(nil)
+)
+
+// NamespaceUsage scans the namespace's part of the primary key, reading
+// every value's size.
+func (p *PostgresDB) NamespaceUsage(ctx context.Context, ns string) (keys, bytes int64, err error) {
+	defer p.observe(ctx, "namespace usage", time.Now())
+	query := `SELECT count(*), coalesce(sum(octet_length(value)), 0) FROM kv_store WHERE namespace = $1 AND ` + liveRow
+	err = p.db.QueryRowContext(ctx, query, ns).Scan(&keys, &bytes)
+	return keys, bytes, err
+}
+
+func (m *MemoryDB) NamespaceUsage(ctx context.Context, ns string) (keys, bytes int64, err error) {
+	if err := m.faults.inject(ctx); err != nil {
+		return 0, 0, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	now := time.Now()
+	for key, v := range m.data {
+		if kns, _ := SplitKey(key); kns == ns && v.live(now) {
+			keys++
+			bytes += int64(len(v.value))
+		}
+	}
+	return keys, bytes, nil
+}
@@ -0,0 +1,34 @@
+// Package fasthash provides the hashes computed on every request: a key
+// hash that places keys in cache shards, and a CRC-32C checksum of values.
+//
+// Both pick the fastest instructions the CPU has at run time, so a default
+// build gets them without GOAMD64 or GOARM64 settings. The key hash is the
+// runtime's map hash, which uses AES rounds (AES-NI on amd64, the ARMv8
+// crypto extension on arm64) and falls back to wyhash elsewhere. The
+// checksum uses the CRC32 instructions (SSE4.2 on amd64, ARMv8 CRC on
+// arm64) and falls back to slicing-by-8 tables.
+package fasthash
+
+import (
+	"hash/crc32"
+	"hash/maphash"
+	"unsafe"
+)
+
+// seed is fixed for the life of the process. Key hashes are therefore not
+// stable across restarts and must never be persisted or sent to a peer;
+// hashring.Hash is the stable hash.
+var seed = maphash.MakeSeed()
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// String returns the 64-bit hash of s.
+func String(s string) uint64 {
+	return maphash.String(seed, s)
+}
+
+// Checksum returns the CRC-32C (Castagnoli) checksum of s.
+func Checksum(s string) uint32 {
+	// crc32 only takes a []byte; s is never written through it
+	return crc32.Update(0, castagnoli, unsafe.Slice(unsafe.StringData(s), len(s)))
+}
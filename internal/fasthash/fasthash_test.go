@@ -0,0 +1,72 @@
+package fasthash
+
+import (
+	"fmt"
+	"hash/crc32"
+	"kv-server/internal/hashring"
+	"strings"
+	"testing"
+)
+
+// X-Checksum carries Checksum to clients, which compute it with their own
+// CRC-32C, so it must be the standard Castagnoli checksum.
+func TestChecksumIsCRC32C(t *testing.T) {
+	table := crc32.MakeTable(crc32.Castagnoli)
+	for _, s := range []string{"", "a", "123456789", "hello, world", strings.Repeat("v", 10<<10), "é世\x00\xff"} {
+		if got, want := Checksum(s), crc32.Checksum([]byte(s), table); got != want {
+			t.Errorf("Checksum(%.20q) = %08x, want %08x", s, got, want)
+		}
+	}
+	// The check value of CRC-32C
+	if got := Checksum("123456789"); got != 0xe3069283 {
+		t.Errorf("Checksum(\"123456789\") = %08x, want e3069283", got)
+	}
+}
+
+func TestStringIsStable(t *testing.T) {
+	if String("key") != String("key") {
+		t.Error("String hashes the same key differently")
+	}
+	if String("key_1") == String("key_2") {
+		t.Error("String hashes key_1 and key_2 alike")
+	}
+}
+
+// BenchmarkKeyHash compares the key hash with the FNV-1a hash the ring
+// still uses for its own nodes.
+func BenchmarkKeyHash(b *testing.B) {
+	for _, n := range []int{8, 32, 128} {
+		key := strings.Repeat("k", n)
+		b.Run(fmt.Sprintf("fnv-1a/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				hashring.Hash(key)
+			}
+		})
+		b.Run(fmt.Sprintf("aeshash/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				String(key)
+			}
+		})
+	}
+}
+
+// BenchmarkChecksum compares the checksum with CRC-32 over a lookup table;
+// the Koopman polynomial has no hardware path, so it measures table-driven
+// code.
+func BenchmarkChecksum(b *testing.B) {
+	value := strings.Repeat("v", 10<<10)
+	valueBytes := []byte(value)
+	koopman := crc32.MakeTable(crc32.Koopman)
+	b.Run("crc32-koopman", func(b *testing.B) {
+		b.SetBytes(int64(len(value)))
+		for i := 0; i < b.N; i++ {
+			crc32.Checksum(valueBytes, koopman)
+		}
+	})
+	b.Run("crc32c", func(b *testing.B) {
+		b.SetBytes(int64(len(value)))
+		for i := 0; i < b.N; i++ {
+			Checksum(value)
+		}
+	})
+}
@@ -0,0 +1,111 @@
+// Package hashring implements consistent hashing with virtual nodes. Nodes
+// may carry a weight so that larger members own a proportionally larger
+// share of the key space.
+package hashring
+
+import (
+	"sort"
+	"strconv"
+)
+
+// DefaultReplicas is the number of virtual nodes placed per unit of weight.
+const DefaultReplicas = 160
+
+// Hash is the 64-bit FNV-1a hash of key. It is exported so callers that need
+// a stable key hash (e.g. for logging) agree with the ring.
+func Hash(key string) uint64 {
+	var h uint64 = 14695981039346656037
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= 1099511628211
+	}
+	return mix(h)
+}
+
+// mix is the murmur3 finalizer; FNV alone clusters badly on keys that only
+// differ in a numeric suffix such as "key_1", "key_2".
+func mix(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+type vnode struct {
+	hash uint64
+	node int
+}
+
+// Ring maps keys to node indexes. A Ring is immutable once built and safe
+// for concurrent use.
+type Ring struct {
+	vnodes []vnode
+	nodes  int
+}
+
+// New builds a ring over nodes 0..len(weights)-1 where node i receives
+// weights[i]*replicas virtual nodes. A node with weight 0 owns no keys.
+func New(weights []int, replicas int) *Ring {
+	if replicas <= 0 {
+		replicas = DefaultReplicas
+	}
+
+	r := &Ring{nodes: len(weights)}
+	for node, weight := range weights {
+		for i := 0; i < weight*replicas; i++ {
+			label := strconv.Itoa(node) + "#" + strconv.Itoa(i)
+			r.vnodes = append(r.vnodes, vnode{hash: Hash(label), node: node})
+		}
+	}
+	sort.Slice(r.vnodes, func(i, j int) bool {
+		return r.vnodes[i].hash < r.vnodes[j].hash
+	})
+	return r
+}
+
+// NewUniform builds a ring of n equally weighted nodes.
+func NewUniform(n, replicas int) *Ring {
+	weights := make([]int, n)
+	for i := range weights {
+		weights[i] = 1
+	}
+	return New(weights, replicas)
+}
+
+// Nodes returns the number of nodes the ring was built with.
+func (r *Ring) Nodes() int {
+	return r.nodes
+}
+
+// Locate returns the node owning key, or -1 if the ring has no virtual nodes.
+func (r *Ring) Locate(key string) int {
+	return r.LocateHash(Hash(key))
+}
+
+// LocateHash returns the node owning a precomputed hash.
+func (r *Ring) LocateHash(h uint64) int {
+	if len(r.vnodes) == 0 {
+		return -1
+	}
+	i := sort.Search(len(r.vnodes), func(i int) bool {
+		return r.vnodes[i].hash >= h
+	})
+	if i == len(r.vnodes) {
+		i = 0
+	}
+	return r.vnodes[i].node
+}
+
+// Distribution counts how many of keys land on each node, which is handy for
+// checking balance against a realistic key sample.
+func (r *Ring) Distribution(keys []string) []int {
+	counts := make([]int, r.nodes)
+	for _, key := range keys {
+		if node := r.Locate(key); node >= 0 {
+			counts[node]++
+		}
+	}
+	return counts
+}
@@ -0,0 +1,136 @@
+package hashring
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// keyPatterns are key shapes seen in practice: sequential IDs, which FNV
+// alone clusters, prefixed IDs, nested paths and random tokens.
+var keyPatterns = map[string]func(i int, rng *rand.Rand) string{
+	"sequential": func(i int, _ *rand.Rand) string { return fmt.Sprintf("key_%d", i) },
+	"user":       func(i int, _ *rand.Rand) string { return fmt.Sprintf("user:%d:profile", i) },
+	"path": func(i int, _ *rand.Rand) string {
+		return fmt.Sprintf("tenant-%d/orders/%d", i%50, i)
+	},
+	"token": func(_ int, rng *rand.Rand) string {
+		return fmt.Sprintf("session/%016x%016x", rng.Uint64(), rng.Uint64())
+	},
+}
+
+func sampleKeys(pattern func(int, *rand.Rand) string, n int) []string {
+	rng := rand.New(rand.NewSource(1))
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = pattern(i, rng)
+	}
+	return keys
+}
+
+func TestDistributionUniform(t *testing.T) {
+	const nodes, keys = 16, 100000
+	r := NewUniform(nodes, DefaultReplicas)
+
+	for name, pattern := range keyPatterns {
+		t.Run(name, func(t *testing.T) {
+			counts := r.Distribution(sampleKeys(pattern, keys))
+			mean := float64(keys) / nodes
+			for node, n := range counts {
+				if dev := (float64(n) - mean) / mean; dev > 0.2 || dev < -0.2 {
+					t.Errorf("node %d holds %d keys, %.0f%% off the mean of %.0f", node, n, dev*100, mean)
+				}
+			}
+		})
+	}
+}
+
+func TestDistributionWeighted(t *testing.T) {
+	const keys = 100000
+	weights := []int{1, 2, 3, 2}
+	r := New(weights, DefaultReplicas)
+
+	total := 0
+	for _, w := range weights {
+		total += w
+	}
+	counts := r.Distribution(sampleKeys(keyPatterns["user"], keys))
+	for node, n := range counts {
+		want := float64(keys) * float64(weights[node]) / float64(total)
+		if dev := (float64(n) - want) / want; dev > 0.2 || dev < -0.2 {
+			t.Errorf("node %d of weight %d holds %d keys, want about %.0f", node, weights[node], n, want)
+		}
+	}
+}
+
+func TestZeroWeightOwnsNothing(t *testing.T) {
+	r := New([]int{1, 0, 1}, DefaultReplicas)
+	if counts := r.Distribution(sampleKeys(keyPatterns["sequential"], 10000)); counts[1] != 0 {
+		t.Errorf("node of weight 0 holds %d keys", counts[1])
+	}
+}
+
+func TestEmptyRing(t *testing.T) {
+	if node := New(nil, 0).Locate("key"); node != -1 {
+		t.Errorf("Locate on an empty ring = %d, want -1", node)
+	}
+}
+
+func TestAddNodeMovesOnlyItsShare(t *testing.T) {
+	const nodes, keys = 8, 50000
+	before := NewUniform(nodes, DefaultReplicas)
+	after := NewUniform(nodes+1, DefaultReplicas)
+
+	moved := 0
+	for _, key := range sampleKeys(keyPatterns["token"], keys) {
+		from, to := before.Locate(key), after.Locate(key)
+		if from == to {
+			continue
+		}
+		moved++
+		if to != nodes {
+			t.Fatalf("key %q moved from node %d to old node %d", key, from, to)
+		}
+	}
+
+	// Ideally 1/(nodes+1) of the keys move, all to the new node
+	ideal := float64(keys) / (nodes + 1)
+	if float64(moved) > 1.3*ideal || float64(moved) < 0.7*ideal {
+		t.Errorf("adding a node moved %d keys, want about %.0f", moved, ideal)
+	}
+}
+
+func TestRemoveNodeMovesOnlyItsKeys(t *testing.T) {
+	const nodes, keys, removed = 8, 50000, 3
+	before := NewUniform(nodes, DefaultReplicas)
+	weights := make([]int, nodes)
+	for i := range weights {
+		weights[i] = 1
+	}
+	weights[removed] = 0
+	after := New(weights, DefaultReplicas)
+
+	moved := make([]int, nodes)
+	for _, key := range sampleKeys(keyPatterns["path"], keys) {
+		from, to := before.Locate(key), after.Locate(key)
+		if from == to {
+			continue
+		}
+		if from != removed {
+			t.Fatalf("key %q moved from remaining node %d to %d", key, from, to)
+		}
+		moved[to]++
+	}
+
+	// The removed node's keys spread over the others rather than piling
+	// onto its neighbour
+	share := float64(keys) / nodes / (nodes - 1)
+	for node, n := range moved {
+		if node == removed {
+			continue
+		}
+		if float64(n) > 2*share {
+			t.Errorf("node %d took %d of the removed node's keys, want about %.0f", node, n, share)
+		}
+	}
+}
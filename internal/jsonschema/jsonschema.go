@@ -0,0 +1,579 @@
+// Package jsonschema validates JSON documents against the subset of JSON
+// Schema (draft 2020-12) that describes the shape of a value: type, enum,
+// const, properties, required, additionalProperties, items, the length,
+// size and range bounds, multipleOf, pattern, uniqueItems, allOf, anyOf,
+// oneOf and not. Annotations such as title, description, default and
+// format are accepted and ignored. Any other keyword, notably $ref, is
+// refused when the schema is compiled rather than silently skipped.
+//
+// Patterns are Go regular expressions (RE2), which differ from ECMA 262 in
+// a few rarely used features such as lookaround.
+package jsonschema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Schema is a compiled schema.
+type Schema struct {
+	// Set for the boolean schemas true and false
+	boolean *bool
+
+	types    []string
+	enum     []any
+	constant any
+	hasConst bool
+
+	properties map[string]*Schema
+	required   []string
+	// nil allows any additional property
+	additional *Schema
+	items      *Schema
+
+	minItems, maxItems           int
+	uniqueItems                  bool
+	minLength, maxLength         int
+	minProperties, maxProperties int
+	pattern                      *regexp.Regexp
+
+	minimum, maximum                   *float64
+	exclusiveMinimum, exclusiveMaximum *float64
+	multipleOf                         float64
+
+	allOf, anyOf, oneOf []*Schema
+	not                 *Schema
+}
+
+// annotations are the keywords accepted and ignored.
+var annotations = map[string]bool{
+	"$schema": true, "$id": true, "$comment": true, "title": true, "description": true,
+	"default": true, "examples": true, "format": true, "deprecated": true, "readOnly": true, "writeOnly": true,
+}
+
+var typeNames = map[string]bool{
+	"null": true, "boolean": true, "object": true, "array": true, "number": true, "integer": true, "string": true,
+}
+
+// Compile parses and checks a schema.
+func Compile(data []byte) (*Schema, error) {
+	doc, err := decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("schema is not valid JSON: %w", err)
+	}
+	return compile(doc, "")
+}
+
+// Error is a document's first failure to match a schema.
+type Error struct {
+	// Path is the JSON Pointer of the failing value, empty for the whole
+	// document
+	Path string
+	// Keyword is the schema keyword the value fails
+	Keyword string
+	// Message says how
+	Message string
+	// Got is the failing value as JSON, shortened if long
+	Got string
+}
+
+func (e *Error) Error() string {
+	if e.Path == "" {
+		return e.Message
+	}
+	return e.Path + ": " + e.Message
+}
+
+// Validate checks the JSON document data against the schema. It returns an
+// *Error if the document does not match, or the decoding error if data is
+// not JSON.
+func (s *Schema) Validate(data []byte) error {
+	doc, err := decode(data)
+	if err != nil {
+		return err
+	}
+	if verr := s.validate(doc, ""); verr != nil {
+		return verr
+	}
+	return nil
+}
+
+// maxGot bounds Error.Got.
+const maxGot = 64
+
+func decode(data []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("unexpected data after the JSON document")
+	}
+	return doc, nil
+}
+
+func compile(v any, at string) (*Schema, error) {
+	if b, ok := v.(bool); ok {
+		return &Schema{boolean: &b}, nil
+	}
+	obj, ok := v.(map[string]any)
+	if !ok {
+		return nil, schemaError(at, "a schema must be an object or a boolean")
+	}
+
+	s := &Schema{minItems: -1, maxItems: -1, minLength: -1, maxLength: -1, minProperties: -1, maxProperties: -1}
+	keywords := make([]string, 0, len(obj))
+	for k := range obj {
+		keywords = append(keywords, k)
+	}
+	sort.Strings(keywords)
+	for _, k := range keywords {
+		if err := s.compileKeyword(k, obj[k], at+"/"+k); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *Schema) compileKeyword(k string, v any, at string) error {
+	var err error
+	switch k {
+	case "type":
+		switch t := v.(type) {
+		case string:
+			s.types = []string{t}
+		case []any:
+			for _, e := range t {
+				name, ok := e.(string)
+				if !ok {
+					return schemaError(at, "must be a type name or an array of them")
+				}
+				s.types = append(s.types, name)
+			}
+		default:
+			return schemaError(at, "must be a type name or an array of them")
+		}
+		for _, t := range s.types {
+			if !typeNames[t] {
+				return schemaError(at, "unknown type "+strconv.Quote(t))
+			}
+		}
+	case "enum":
+		values, ok := v.([]any)
+		if !ok {
+			return schemaError(at, "must be an array")
+		}
+		s.enum = values
+	case "const":
+		s.constant, s.hasConst = v, true
+	case "properties":
+		props, ok := v.(map[string]any)
+		if !ok {
+			return schemaError(at, "must be an object")
+		}
+		s.properties = make(map[string]*Schema, len(props))
+		for name, sub := range props {
+			if s.properties[name], err = compile(sub, at+"/"+escape(name)); err != nil {
+				return err
+			}
+		}
+	case "required":
+		names, ok := v.([]any)
+		if !ok {
+			return schemaError(at, "must be an array of property names")
+		}
+		for _, n := range names {
+			name, ok := n.(string)
+			if !ok {
+				return schemaError(at, "must be an array of property names")
+			}
+			s.required = append(s.required, name)
+		}
+	case "additionalProperties":
+		s.additional, err = compile(v, at)
+	case "items":
+		s.items, err = compile(v, at)
+	case "not":
+		s.not, err = compile(v, at)
+	case "allOf", "anyOf", "oneOf":
+		subs, ok := v.([]any)
+		if !ok || len(subs) == 0 {
+			return schemaError(at, "must be a non-empty array of schemas")
+		}
+		list := make([]*Schema, len(subs))
+		for i, sub := range subs {
+			if list[i], err = compile(sub, at+"/"+strconv.Itoa(i)); err != nil {
+				return err
+			}
+		}
+		switch k {
+		case "allOf":
+			s.allOf = list
+		case "anyOf":
+			s.anyOf = list
+		default:
+			s.oneOf = list
+		}
+	case "minItems":
+		s.minItems, err = count(v, at)
+	case "maxItems":
+		s.maxItems, err = count(v, at)
+	case "minLength":
+		s.minLength, err = count(v, at)
+	case "maxLength":
+		s.maxLength, err = count(v, at)
+	case "minProperties":
+		s.minProperties, err = count(v, at)
+	case "maxProperties":
+		s.maxProperties, err = count(v, at)
+	case "uniqueItems":
+		b, ok := v.(bool)
+		if !ok {
+			return schemaError(at, "must be a boolean")
+		}
+		s.uniqueItems = b
+	case "pattern":
+		expr, ok := v.(string)
+		if !ok {
+			return schemaError(at, "must be a string")
+		}
+		if s.pattern, err = regexp.Compile(expr); err != nil {
+			return schemaError(at, err.Error())
+		}
+	case "minimum":
+		s.minimum, err = bound(v, at)
+	case "maximum":
+		s.maximum, err = bound(v, at)
+	case "exclusiveMinimum":
+		s.exclusiveMinimum, err = bound(v, at)
+	case "exclusiveMaximum":
+		s.exclusiveMaximum, err = bound(v, at)
+	case "multipleOf":
+		f, ok := number(v)
+		if !ok || f <= 0 {
+			return schemaError(at, "must be a number greater than 0")
+		}
+		s.multipleOf = f
+	default:
+		if !annotations[k] {
+			return schemaError(at, "unsupported keyword")
+		}
+	}
+	return err
+}
+
+func schemaError(at, msg string) error {
+	if at == "" {
+		return fmt.Errorf("invalid schema: %s", msg)
+	}
+	return fmt.Errorf("invalid schema at %s: %s", at, msg)
+}
+
+func count(v any, at string) (int, error) {
+	f, ok := number(v)
+	if !ok || f < 0 || f != math.Trunc(f) || f > math.MaxInt32 {
+		return 0, schemaError(at, "must be a non-negative integer")
+	}
+	return int(f), nil
+}
+
+func bound(v any, at string) (*float64, error) {
+	f, ok := number(v)
+	if !ok {
+		return nil, schemaError(at, "must be a number")
+	}
+	return &f, nil
+}
+
+func number(v any) (float64, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, false
+	}
+	f, err := n.Float64()
+	return f, err == nil
+}
+
+// validate checks v, found at JSON Pointer at, against the schema.
+func (s *Schema) validate(v any, at string) *Error {
+	err := s.check(v, at)
+	// The innermost failure fills in Got, with the value it was checking
+	if err != nil && err.Got == "" {
+		err.Got = literal(v)
+		if len(err.Got) > maxGot {
+			err.Got = err.Got[:maxGot] + "..."
+		}
+	}
+	return err
+}
+
+func (s *Schema) check(v any, at string) *Error {
+	if s.boolean != nil {
+		if !*s.boolean {
+			return &Error{Path: at, Keyword: "false", Message: "no value is allowed here"}
+		}
+		return nil
+	}
+
+	if len(s.types) > 0 && !s.hasType(v) {
+		return &Error{Path: at, Keyword: "type", Message: "must be " + strings.Join(s.types, " or ") + ", not " + typeOf(v)}
+	}
+	if s.hasConst && !equal(v, s.constant) {
+		return &Error{Path: at, Keyword: "const", Message: "must be " + literal(s.constant)}
+	}
+	if s.enum != nil {
+		found := false
+		for _, e := range s.enum {
+			if equal(v, e) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return &Error{Path: at, Keyword: "enum", Message: "must be one of " + literal(s.enum)}
+		}
+	}
+
+	var err *Error
+	switch v := v.(type) {
+	case map[string]any:
+		err = s.validateObject(v, at)
+	case []any:
+		err = s.validateArray(v, at)
+	case string:
+		err = s.validateString(v, at)
+	case json.Number:
+		err = s.validateNumber(v, at)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, sub := range s.allOf {
+		if err := sub.validate(v, at); err != nil {
+			return err
+		}
+	}
+	if s.anyOf != nil {
+		matched := false
+		for _, sub := range s.anyOf {
+			if sub.validate(v, at) == nil {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return &Error{Path: at, Keyword: "anyOf", Message: "must match at least one schema of anyOf"}
+		}
+	}
+	if s.oneOf != nil {
+		matched := 0
+		for _, sub := range s.oneOf {
+			if sub.validate(v, at) == nil {
+				matched++
+			}
+		}
+		if matched != 1 {
+			return &Error{Path: at, Keyword: "oneOf", Message: fmt.Sprintf("must match exactly one schema of oneOf, not %d", matched)}
+		}
+	}
+	if s.not != nil && s.not.validate(v, at) == nil {
+		return &Error{Path: at, Keyword: "not", Message: "must not match the schema of not"}
+	}
+	return nil
+}
+
+func (s *Schema) validateObject(obj map[string]any, at string) *Error {
+	for _, name := range s.required {
+		if _, ok := obj[name]; !ok {
+			return &Error{Path: at, Keyword: "required", Message: "missing required property " + strconv.Quote(name)}
+		}
+	}
+	if s.minProperties >= 0 && len(obj) < s.minProperties {
+		return &Error{Path: at, Keyword: "minProperties", Message: fmt.Sprintf("must have at least %d properties", s.minProperties)}
+	}
+	if s.maxProperties >= 0 && len(obj) > s.maxProperties {
+		return &Error{Path: at, Keyword: "maxProperties", Message: fmt.Sprintf("must have at most %d properties", s.maxProperties)}
+	}
+
+	names := make([]string, 0, len(obj))
+	for name := range obj {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		sub, ok := s.properties[name]
+		if !ok {
+			sub = s.additional
+		}
+		if sub == nil {
+			continue
+		}
+		if err := sub.validate(obj[name], at+"/"+escape(name)); err != nil {
+			if !ok && err.Keyword == "false" {
+				err.Path, err.Keyword, err.Message, err.Got = at, "additionalProperties", "unknown property "+strconv.Quote(name), strconv.Quote(name)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Schema) validateArray(arr []any, at string) *Error {
+	if s.minItems >= 0 && len(arr) < s.minItems {
+		return &Error{Path: at, Keyword: "minItems", Message: fmt.Sprintf("must have at least %d items", s.minItems)}
+	}
+	if s.maxItems >= 0 && len(arr) > s.maxItems {
+		return &Error{Path: at, Keyword: "maxItems", Message: fmt.Sprintf("must have at most %d items", s.maxItems)}
+	}
+	if s.uniqueItems {
+		for i := range arr {
+			for j := i + 1; j < len(arr); j++ {
+				if equal(arr[i], arr[j]) {
+					return &Error{Path: at, Keyword: "uniqueItems", Message: fmt.Sprintf("items %d and %d are equal", i, j)}
+				}
+			}
+		}
+	}
+	if s.items != nil {
+		for i, item := range arr {
+			if err := s.items.validate(item, at+"/"+strconv.Itoa(i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Schema) validateString(str, at string) *Error {
+	n := utf8.RuneCountInString(str)
+	if s.minLength >= 0 && n < s.minLength {
+		return &Error{Path: at, Keyword: "minLength", Message: fmt.Sprintf("must be at least %d characters long", s.minLength)}
+	}
+	if s.maxLength >= 0 && n > s.maxLength {
+		return &Error{Path: at, Keyword: "maxLength", Message: fmt.Sprintf("must be at most %d characters long", s.maxLength)}
+	}
+	if s.pattern != nil && !s.pattern.MatchString(str) {
+		return &Error{Path: at, Keyword: "pattern", Message: "must match " + strconv.Quote(s.pattern.String())}
+	}
+	return nil
+}
+
+func (s *Schema) validateNumber(n json.Number, at string) *Error {
+	f, _ := number(n)
+	bounds := []struct {
+		limit  *float64
+		fails  bool
+		name   string
+		phrase string
+	}{
+		{s.minimum, s.minimum != nil && f < *s.minimum, "minimum", ">="},
+		{s.maximum, s.maximum != nil && f > *s.maximum, "maximum", "<="},
+		{s.exclusiveMinimum, s.exclusiveMinimum != nil && f <= *s.exclusiveMinimum, "exclusiveMinimum", ">"},
+		{s.exclusiveMaximum, s.exclusiveMaximum != nil && f >= *s.exclusiveMaximum, "exclusiveMaximum", "<"},
+	}
+	for _, b := range bounds {
+		if b.fails {
+			return &Error{Path: at, Keyword: b.name, Message: "must be " + b.phrase + " " + strconv.FormatFloat(*b.limit, 'g', -1, 64)}
+		}
+	}
+	if s.multipleOf > 0 {
+		q := f / s.multipleOf
+		if math.Abs(q-math.Round(q)) > 1e-9 {
+			return &Error{Path: at, Keyword: "multipleOf", Message: "must be a multiple of " + strconv.FormatFloat(s.multipleOf, 'g', -1, 64)}
+		}
+	}
+	return nil
+}
+
+func (s *Schema) hasType(v any) bool {
+	for _, t := range s.types {
+		if t == typeOf(v) || t == "number" && typeOf(v) == "integer" {
+			return true
+		}
+	}
+	return false
+}
+
+// typeOf names v's JSON type; numbers without a fractional part are
+// integers.
+func typeOf(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case map[string]any:
+		return "object"
+	case []any:
+		return "array"
+	case string:
+		return "string"
+	case json.Number:
+		if f, ok := number(v); ok && f == math.Trunc(f) && !math.IsInf(f, 0) {
+			return "integer"
+		}
+		return "number"
+	}
+	return "unknown"
+}
+
+// equal reports whether two decoded JSON values are equal, comparing
+// numbers by value.
+func equal(a, b any) bool {
+	switch a := a.(type) {
+	case json.Number:
+		bn, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		fa, _ := number(a)
+		fb, _ := number(bn)
+		return fa == fb
+	case map[string]any:
+		bm, ok := b.(map[string]any)
+		if !ok || len(a) != len(bm) {
+			return false
+		}
+		for k, v := range a {
+			if w, ok := bm[k]; !ok || !equal(v, w) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		ba, ok := b.([]any)
+		if !ok || len(a) != len(ba) {
+			return false
+		}
+		for i := range a {
+			if !equal(a[i], ba[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return a == b
+}
+
+func literal(v any) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
+
+// escape escapes a property name for a JSON Pointer.
+func escape(name string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(name)
+}
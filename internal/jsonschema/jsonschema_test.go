@@ -0,0 +1,159 @@
+package jsonschema
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema string
+		doc    string
+		// keyword and path of the failure; empty keyword for a match
+		keyword string
+		path    string
+	}{
+		{"type match", `{"type":"string"}`, `"a"`, "", ""},
+		{"type mismatch", `{"type":"string"}`, `1`, "type", ""},
+		{"type list", `{"type":["string","null"]}`, `null`, "", ""},
+		{"integer is a number", `{"type":"number"}`, `3`, "", ""},
+		{"fraction is not an integer", `{"type":"integer"}`, `3.5`, "type", ""},
+		{"integer with zero fraction", `{"type":"integer"}`, `3.0`, "", ""},
+
+		{"required present", `{"required":["id"]}`, `{"id":1}`, "", ""},
+		{"required missing", `{"required":["id","name"]}`, `{"id":1}`, "required", ""},
+		{"required ignores non-objects", `{"required":["id"]}`, `[]`, "", ""},
+
+		{"property matches", `{"properties":{"age":{"type":"integer"}}}`, `{"age":3}`, "", ""},
+		{"property fails", `{"properties":{"age":{"type":"integer"}}}`, `{"age":"3"}`, "type", "/age"},
+		{"nested property fails", `{"properties":{"a":{"properties":{"b/c":{"type":"string"}}}}}`, `{"a":{"b/c":1}}`, "type", "/a/b~1c"},
+		{"additional allowed by default", `{"properties":{"a":{}}}`, `{"a":1,"b":2}`, "", ""},
+		{"additional forbidden", `{"properties":{"a":{}},"additionalProperties":false}`, `{"a":1,"b":2}`, "additionalProperties", ""},
+		{"additional schema", `{"properties":{"a":{}},"additionalProperties":{"type":"string"}}`, `{"a":1,"b":2}`, "type", "/b"},
+
+		{"enum match", `{"enum":["red","green"]}`, `"green"`, "", ""},
+		{"enum mismatch", `{"enum":["red","green"]}`, `"blue"`, "enum", ""},
+		{"enum compares numbers by value", `{"enum":[1,2]}`, `2.0`, "", ""},
+		{"enum compares objects", `{"enum":[{"a":[1]}]}`, `{"a":[1]}`, "", ""},
+		{"const mismatch", `{"const":"x"}`, `"y"`, "const", ""},
+
+		{"minimum inclusive", `{"minimum":1}`, `1`, "", ""},
+		{"below minimum", `{"minimum":1}`, `0.5`, "minimum", ""},
+		{"above maximum", `{"maximum":10}`, `11`, "maximum", ""},
+		{"exclusive minimum", `{"exclusiveMinimum":1}`, `1`, "exclusiveMinimum", ""},
+		{"exclusive maximum", `{"exclusiveMaximum":1}`, `0.9`, "", ""},
+		{"multipleOf", `{"multipleOf":0.5}`, `1.5`, "", ""},
+		{"not a multiple", `{"multipleOf":2}`, `3`, "multipleOf", ""},
+		{"bounds ignore strings", `{"minimum":1}`, `"0"`, "", ""},
+
+		{"minLength counts characters", `{"minLength":2}`, `"é世"`, "", ""},
+		{"too short", `{"minLength":2}`, `"a"`, "minLength", ""},
+		{"too long", `{"maxLength":2}`, `"abc"`, "maxLength", ""},
+		{"pattern match", `{"pattern":"^[a-z]+$"}`, `"abc"`, "", ""},
+		{"pattern mismatch", `{"pattern":"^[a-z]+$"}`, `"ab1"`, "pattern", ""},
+		{"pattern is unanchored", `{"pattern":"[0-9]"}`, `"ab1"`, "", ""},
+
+		{"items match", `{"items":{"type":"integer"}}`, `[1,2,3]`, "", ""},
+		{"item fails", `{"items":{"type":"integer"}}`, `[1,"2"]`, "type", "/1"},
+		{"too few items", `{"minItems":2}`, `[1]`, "minItems", ""},
+		{"too many items", `{"maxItems":1}`, `[1,2]`, "maxItems", ""},
+		{"unique items", `{"uniqueItems":true}`, `[1,1.0]`, "uniqueItems", ""},
+		{"too few properties", `{"minProperties":1}`, `{}`, "minProperties", ""},
+
+		{"allOf", `{"allOf":[{"type":"integer"},{"minimum":5}]}`, `4`, "minimum", ""},
+		{"anyOf", `{"anyOf":[{"type":"string"},{"type":"integer"}]}`, `true`, "anyOf", ""},
+		{"oneOf both", `{"oneOf":[{"type":"number"},{"type":"integer"}]}`, `1`, "oneOf", ""},
+		{"not", `{"not":{"type":"null"}}`, `null`, "not", ""},
+		{"false schema", `false`, `1`, "false", ""},
+		{"true schema", `true`, `1`, "", ""},
+		{"annotations ignored", `{"title":"t","description":"d","format":"email","type":"string"}`, `"x"`, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := Compile([]byte(tt.schema))
+			if err != nil {
+				t.Fatalf("Compile(%s): %v", tt.schema, err)
+			}
+			err = s.Validate([]byte(tt.doc))
+			if tt.keyword == "" {
+				if err != nil {
+					t.Fatalf("Validate(%s) = %v, want a match", tt.doc, err)
+				}
+				return
+			}
+			var verr *Error
+			if !errors.As(err, &verr) {
+				t.Fatalf("Validate(%s) = %v, want an *Error for %s", tt.doc, err, tt.keyword)
+			}
+			if verr.Keyword != tt.keyword || verr.Path != tt.path {
+				t.Errorf("Validate(%s) failed %s at %q, want %s at %q: %v", tt.doc, verr.Keyword, verr.Path, tt.keyword, tt.path, verr)
+			}
+			if verr.Got == "" {
+				t.Errorf("Validate(%s): Got is empty", tt.doc)
+			}
+		})
+	}
+}
+
+func TestValidateRejectsInvalidJSON(t *testing.T) {
+	s, err := Compile([]byte(`{"type":"object"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, doc := range []string{``, `{`, `{} {}`, `nope`} {
+		err := s.Validate([]byte(doc))
+		var verr *Error
+		if err == nil || errors.As(err, &verr) {
+			t.Errorf("Validate(%q) = %v, want a decoding error", doc, err)
+		}
+	}
+}
+
+func TestErrorGotIsShortened(t *testing.T) {
+	s, err := Compile([]byte(`{"maxLength":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var verr *Error
+	if !errors.As(s.Validate([]byte(`"`+strings.Repeat("x", 200)+`"`)), &verr) {
+		t.Fatal("Validate of a long string passed maxLength 1")
+	}
+	if len(verr.Got) > maxGot+len("...") || !strings.HasSuffix(verr.Got, "...") {
+		t.Errorf("Got = %q, want at most %d bytes and an ellipsis", verr.Got, maxGot)
+	}
+}
+
+func TestCompileRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema string
+		want   string
+	}{
+		{"ref", `{"$ref":"#/defs/a"}`, "unsupported keyword"},
+		{"unknown keyword", `{"type":"string","minimumLength":1}`, "unsupported keyword"},
+		{"nested unknown keyword", `{"properties":{"a":{"if":{}}}}`, "/properties/a/if"},
+		{"not JSON", `{`, "not valid JSON"},
+		{"not a schema", `"string"`, "object or a boolean"},
+		{"unknown type", `{"type":"text"}`, "unknown type"},
+		{"bad type", `{"type":1}`, "type name"},
+		{"enum not array", `{"enum":"a"}`, "must be an array"},
+		{"required not names", `{"required":[1]}`, "property names"},
+		{"negative count", `{"minLength":-1}`, "non-negative integer"},
+		{"fractional count", `{"maxItems":1.5}`, "non-negative integer"},
+		{"bad pattern", `{"pattern":"("}`, "/pattern"},
+		{"bad bound", `{"minimum":"1"}`, "must be a number"},
+		{"zero multipleOf", `{"multipleOf":0}`, "greater than 0"},
+		{"empty anyOf", `{"anyOf":[]}`, "non-empty array"},
+		{"bad uniqueItems", `{"uniqueItems":"yes"}`, "boolean"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Compile([]byte(tt.schema))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Compile(%s) = %v, want an error containing %q", tt.schema, err, tt.want)
+			}
+		})
+	}
+}
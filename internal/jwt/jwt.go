@@ -0,0 +1,300 @@
+// Package jwt verifies JSON Web Tokens (RFC 7519) in compact form, signed
+// with HS256 against a shared secret or with RS256 against the RSA keys of
+// a JSON Web Key Set fetched from an identity provider. Tokens with any
+// other algorithm, including "none", are refused, as are tokens with
+// critical header parameters.
+//
+// A verified token must carry an exp claim in the future, and nbf, if
+// present, in the past; both allow ClockSkew. The iss and aud claims are
+// checked when the Verifier asks for them.
+package jwt
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ClockSkew is how far exp and nbf may be off and still pass.
+const ClockSkew = 30 * time.Second
+
+// Claims is a verified token's payload.
+type Claims map[string]any
+
+// String returns claim name if it is a string, else "".
+func (c Claims) String(name string) string {
+	s, _ := c[name].(string)
+	return s
+}
+
+// Strings returns claim name as a list: the elements of an array of
+// strings, or the words of a space-separated string as in the OAuth scope
+// claim.
+func (c Claims) Strings(name string) []string {
+	switch v := c[name].(type) {
+	case string:
+		return strings.Fields(v)
+	case []any:
+		list := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+// Verifier checks tokens. At least one of Secret and Keys must be set.
+type Verifier struct {
+	// Secret verifies HS256 tokens; nil refuses them
+	Secret []byte
+	// Keys verifies RS256 tokens; nil refuses them
+	Keys *KeySet
+	// Issuer, if set, must equal the iss claim
+	Issuer string
+	// Audience, if set, must be the aud claim or one of its elements
+	Audience string
+}
+
+var (
+	ErrMalformed = errors.New("malformed token")
+	ErrAlgorithm = errors.New("unsupported signing algorithm")
+	ErrSignature = errors.New("invalid signature")
+	ErrExpired   = errors.New("token expired")
+	ErrNotYet    = errors.New("token not valid yet")
+	ErrIssuer    = errors.New("unexpected issuer")
+	ErrAudience  = errors.New("unexpected audience")
+)
+
+type header struct {
+	Alg  string   `json:"alg"`
+	Kid  string   `json:"kid"`
+	Crit []string `json:"crit"`
+}
+
+// Verify checks token's signature and claims at now and returns its
+// claims. ctx bounds a fetch of the key set for a key ID it has not seen.
+func (v *Verifier) Verify(ctx context.Context, token string, now time.Time) (Claims, error) {
+	head, rest, ok := strings.Cut(token, ".")
+	payload, sig, ok2 := strings.Cut(rest, ".")
+	if !ok || !ok2 || strings.Contains(sig, ".") {
+		return nil, ErrMalformed
+	}
+	var h header
+	if err := decodeSegment(head, &h); err != nil {
+		return nil, err
+	}
+	if len(h.Crit) > 0 {
+		return nil, fmt.Errorf("%w: critical header %q", ErrMalformed, h.Crit[0])
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	signed := token[:len(head)+1+len(payload)]
+	digest := sha256.Sum256([]byte(signed))
+
+	switch {
+	case h.Alg == "HS256" && v.Secret != nil:
+		mac := hmac.New(sha256.New, v.Secret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return nil, ErrSignature
+		}
+	case h.Alg == "RS256" && v.Keys != nil:
+		key, err := v.Keys.key(ctx, h.Kid)
+		if err != nil {
+			return nil, err
+		}
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) != nil {
+			return nil, ErrSignature
+		}
+	default:
+		return nil, fmt.Errorf("%w %q", ErrAlgorithm, h.Alg)
+	}
+
+	var claims Claims
+	if err := decodeSegment(payload, &claims); err != nil {
+		return nil, err
+	}
+	return claims, v.checkClaims(claims, now)
+}
+
+func (v *Verifier) checkClaims(claims Claims, now time.Time) error {
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return fmt.Errorf("%w: no exp claim", ErrMalformed)
+	}
+	if now.Add(-ClockSkew).After(unixTime(exp)) {
+		return ErrExpired
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(ClockSkew).Before(unixTime(nbf)) {
+		return ErrNotYet
+	}
+	if v.Issuer != "" && claims.String("iss") != v.Issuer {
+		return ErrIssuer
+	}
+	if v.Audience != "" {
+		found := false
+		for _, aud := range claims.Strings("aud") {
+			found = found || aud == v.Audience
+		}
+		if !found {
+			return ErrAudience
+		}
+	}
+	return nil
+}
+
+func unixTime(seconds float64) time.Time {
+	whole, frac := math.Modf(seconds)
+	return time.Unix(int64(whole), int64(frac*1e9))
+}
+
+func decodeSegment(segment string, v any) error {
+	raw, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return ErrMalformed
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	if err := dec.Decode(v); err != nil {
+		return ErrMalformed
+	}
+	return nil
+}
+
+// minRefetch is how often a token with an unknown key ID may make a KeySet
+// fetch again, so made-up key IDs cannot hammer the identity provider.
+const minRefetch = time.Minute
+
+// KeySet is the RSA signing keys of a JSON Web Key Set, by key ID.
+type KeySet struct {
+	url    string
+	client *http.Client
+
+	mu   sync.RWMutex
+	keys map[string]*rsa.PublicKey
+	// When the last fetch started, failed or not
+	attempted time.Time
+	// Serializes fetches
+	fetching sync.Mutex
+}
+
+// NewKeySet returns the key set served at url, which Refresh fetches.
+func NewKeySet(url string) *KeySet {
+	return &KeySet{url: url, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Len returns the number of keys last fetched.
+func (k *KeySet) Len() int {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return len(k.keys)
+}
+
+// Refresh fetches the key set, keeping the RSA keys meant for signatures.
+// The keys last fetched stay in use if it fails.
+func (k *KeySet) Refresh(ctx context.Context) error {
+	k.fetching.Lock()
+	defer k.fetching.Unlock()
+	return k.fetch(ctx)
+}
+
+type jwks struct {
+	Keys []struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Use string `json:"use"`
+		Alg string `json:"alg"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+	} `json:"keys"`
+}
+
+func (k *KeySet) fetch(ctx context.Context) error {
+	k.mu.Lock()
+	k.attempted = time.Now()
+	k.mu.Unlock()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, k.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching %s: %s", k.url, resp.Status)
+	}
+	var set jwks
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return fmt.Errorf("decoding %s: %w", k.url, err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Kty != "RSA" || (jwk.Use != "" && jwk.Use != "sig") || (jwk.Alg != "" && jwk.Alg != "RS256") {
+			continue
+		}
+		n, err1 := base64.RawURLEncoding.DecodeString(jwk.N)
+		e, err2 := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err1 != nil || err2 != nil || len(e) == 0 || len(e) > 4 {
+			continue
+		}
+		exp := new(big.Int).SetBytes(e)
+		keys[jwk.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exp.Int64())}
+	}
+	k.mu.Lock()
+	k.keys = keys
+	k.mu.Unlock()
+	return nil
+}
+
+// key returns the key with ID kid, fetching the set again if it has none
+// and no fetch started within minRefetch, as after a key rotation.
+func (k *KeySet) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	k.mu.RLock()
+	key, attempted := k.keys[kid], k.attempted
+	k.mu.RUnlock()
+	if key != nil {
+		return key, nil
+	}
+	if time.Since(attempted) >= minRefetch {
+		k.fetching.Lock()
+		// Another request may have fetched it meanwhile
+		k.mu.RLock()
+		attempted = k.attempted
+		k.mu.RUnlock()
+		if time.Since(attempted) >= minRefetch {
+			if err := k.fetch(ctx); err != nil {
+				k.fetching.Unlock()
+				return nil, fmt.Errorf("%w: fetching keys: %v", ErrSignature, err)
+			}
+		}
+		k.fetching.Unlock()
+		k.mu.RLock()
+		key = k.keys[kid]
+		k.mu.RUnlock()
+	}
+	if key == nil {
+		return nil, fmt.Errorf("%w: unknown key ID %q", ErrSignature, kid)
+	}
+	return key, nil
+}
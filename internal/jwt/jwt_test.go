@@ -0,0 +1,252 @@
+package jwt
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var (
+	testSecret = []byte("test-secret")
+
+	rsaOnce sync.Once
+	rsaKey  *rsa.PrivateKey
+)
+
+func testRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	rsaOnce.Do(func() {
+		var err error
+		if rsaKey, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+			panic(err)
+		}
+	})
+	return rsaKey
+}
+
+func segment(t *testing.T, v any) string {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// hs256 signs claims with secret under header h.
+func hs256(t *testing.T, h map[string]any, claims map[string]any, secret []byte) string {
+	t.Helper()
+	signed := segment(t, h) + "." + segment(t, claims)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// rs256 signs claims with key, naming kid.
+func rs256(t *testing.T, kid string, claims map[string]any, key *rsa.PrivateKey) string {
+	t.Helper()
+	signed := segment(t, map[string]any{"alg": "RS256", "kid": kid}) + "." + segment(t, claims)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// jwksServer serves a key set holding key under each of kids, counting
+// the fetches.
+type jwksServer struct {
+	*httptest.Server
+	fetches atomic.Int32
+
+	mu   sync.Mutex
+	kids []string
+}
+
+func newJWKSServer(t *testing.T, key *rsa.PublicKey, kids ...string) *jwksServer {
+	t.Helper()
+	js := &jwksServer{kids: kids}
+	js.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		js.fetches.Add(1)
+		js.mu.Lock()
+		defer js.mu.Unlock()
+		set := map[string][]map[string]string{"keys": {}}
+		for _, kid := range js.kids {
+			set["keys"] = append(set["keys"], map[string]string{
+				"kty": "RSA", "kid": kid, "use": "sig", "alg": "RS256",
+				"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			})
+		}
+		json.NewEncoder(w).Encode(set)
+	}))
+	t.Cleanup(js.Close)
+	return js
+}
+
+func (js *jwksServer) rotate(kids ...string) {
+	js.mu.Lock()
+	js.kids = kids
+	js.mu.Unlock()
+}
+
+func TestVerify(t *testing.T) {
+	key := testRSAKey(t)
+	js := newJWKSServer(t, &key.PublicKey, "k1")
+	keys := NewKeySet(js.URL)
+	if err := keys.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1_700_000_000, 0)
+	exp := float64(now.Add(time.Hour).Unix())
+	valid := map[string]any{"exp": exp, "iss": "idp", "aud": []string{"kv", "other"}}
+	with := func(k string, v any) map[string]any {
+		claims := map[string]any{}
+		for name, value := range valid {
+			claims[name] = value
+		}
+		if v == nil {
+			delete(claims, k)
+		} else {
+			claims[k] = v
+		}
+		return claims
+	}
+	hs := map[string]any{"alg": "HS256"}
+	publicDER, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hsOnly := &Verifier{Secret: testSecret, Issuer: "idp", Audience: "kv"}
+	rsOnly := &Verifier{Keys: keys, Issuer: "idp", Audience: "kv"}
+	skew := ClockSkew.Seconds()
+
+	tests := []struct {
+		name     string
+		verifier *Verifier
+		token    string
+		want     error
+	}{
+		{"hs256", hsOnly, hs256(t, hs, valid, testSecret), nil},
+		{"rs256", rsOnly, rs256(t, "k1", valid, key), nil},
+		{"alg none", hsOnly, segment(t, map[string]any{"alg": "none"}) + "." + segment(t, valid) + ".", ErrAlgorithm},
+		{"alg none with signature", hsOnly, segment(t, map[string]any{"alg": "none"}) + "." + segment(t, valid) + ".c2ln", ErrAlgorithm},
+		{"lowercase alg", hsOnly, hs256(t, map[string]any{"alg": "hs256"}, valid, testSecret), ErrAlgorithm},
+		{"hs256 signed with the public key", rsOnly, hs256(t, hs, valid, publicDER), ErrAlgorithm},
+		{"rs256 without a key set", hsOnly, rs256(t, "k1", valid, key), ErrAlgorithm},
+		{"wrong secret", hsOnly, hs256(t, hs, valid, []byte("other-secret")), ErrSignature},
+		{"tampered payload", hsOnly, tamper(hs256(t, hs, valid, testSecret), segment(t, with("iss", "idp2"))), ErrSignature},
+		{"tampered rs256 payload", rsOnly, tamper(rs256(t, "k1", valid, key), segment(t, with("aud", "kv"))), ErrSignature},
+		{"critical header", hsOnly, hs256(t, map[string]any{"alg": "HS256", "crit": []string{"b64"}}, valid, testSecret), ErrMalformed},
+		{"two segments", hsOnly, "a.b", ErrMalformed},
+		{"four segments", hsOnly, hs256(t, hs, valid, testSecret) + ".x", ErrMalformed},
+		{"no exp", hsOnly, hs256(t, hs, with("exp", nil), testSecret), ErrMalformed},
+		{"expired", hsOnly, hs256(t, hs, with("exp", float64(now.Unix())-skew-1), testSecret), ErrExpired},
+		{"expired within skew", hsOnly, hs256(t, hs, with("exp", float64(now.Unix())-skew), testSecret), nil},
+		{"not yet valid", hsOnly, hs256(t, hs, with("nbf", float64(now.Unix())+skew+1), testSecret), ErrNotYet},
+		{"not yet valid within skew", hsOnly, hs256(t, hs, with("nbf", float64(now.Unix())+skew), testSecret), nil},
+		{"wrong issuer", hsOnly, hs256(t, hs, with("iss", "evil"), testSecret), ErrIssuer},
+		{"no issuer", hsOnly, hs256(t, hs, with("iss", nil), testSecret), ErrIssuer},
+		{"wrong audience", hsOnly, hs256(t, hs, with("aud", "billing"), testSecret), ErrAudience},
+		{"audience string", hsOnly, hs256(t, hs, with("aud", "kv"), testSecret), nil},
+		{"no audience", hsOnly, hs256(t, hs, with("aud", nil), testSecret), ErrAudience},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.verifier.Verify(context.Background(), tt.token, now)
+			if tt.want == nil && err != nil {
+				t.Fatalf("Verify = %v, want success", err)
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Fatalf("Verify = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+// tamper replaces token's payload, keeping its header and signature.
+func tamper(token, payload string) string {
+	parts := strings.Split(token, ".")
+	return parts[0] + "." + payload + "." + parts[2]
+}
+
+func TestUnknownKeyIDRefetches(t *testing.T) {
+	key := testRSAKey(t)
+	js := newJWKSServer(t, &key.PublicKey, "k1")
+	keys := NewKeySet(js.URL)
+	if err := keys.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	v := &Verifier{Keys: keys}
+	now := time.Now()
+	claims := map[string]any{"exp": float64(now.Add(time.Hour).Unix())}
+
+	// The provider rotates to k2; the last fetch is old enough to repeat
+	js.rotate("k1", "k2")
+	keys.mu.Lock()
+	keys.attempted = time.Now().Add(-minRefetch)
+	keys.mu.Unlock()
+	if _, err := v.Verify(context.Background(), rs256(t, "k2", claims, key), now); err != nil {
+		t.Fatalf("Verify with a rotated-in key = %v", err)
+	}
+	if n := js.fetches.Load(); n != 2 {
+		t.Fatalf("%d fetches, want 2: the first and one for k2", n)
+	}
+
+	// Made-up key IDs within minRefetch of that fetch do not fetch again
+	for _, kid := range []string{"k3", "k4", "k5"} {
+		if _, err := v.Verify(context.Background(), rs256(t, kid, claims, key), now); !errors.Is(err, ErrSignature) {
+			t.Fatalf("Verify with unknown key %q = %v, want %v", kid, err, ErrSignature)
+		}
+	}
+	if n := js.fetches.Load(); n != 2 {
+		t.Errorf("%d fetches after unknown key IDs, want still 2", n)
+	}
+
+	// Known keys never fetch
+	if _, err := v.Verify(context.Background(), rs256(t, "k1", claims, key), now); err != nil {
+		t.Fatalf("Verify with a known key = %v", err)
+	}
+	if n := js.fetches.Load(); n != 2 {
+		t.Errorf("%d fetches after a known key, want still 2", n)
+	}
+}
+
+func TestKeySetSkipsUnusableKeys(t *testing.T) {
+	key := testRSAKey(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := base64.RawURLEncoding.EncodeToString(key.N.Bytes())
+		w.Write([]byte(`{"keys":[
+			{"kty":"EC","kid":"ec"},
+			{"kty":"RSA","kid":"enc","use":"enc","n":"` + n + `","e":"AQAB"},
+			{"kty":"RSA","kid":"ps","alg":"PS256","n":"` + n + `","e":"AQAB"},
+			{"kty":"RSA","kid":"bad","n":"!","e":"AQAB"},
+			{"kty":"RSA","kid":"ok","n":"` + n + `","e":"AQAB"}]}`))
+	}))
+	defer srv.Close()
+
+	keys := NewKeySet(srv.URL)
+	if err := keys.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := keys.Len(); n != 1 {
+		t.Errorf("key set holds %d keys, want only the RSA signing key", n)
+	}
+}
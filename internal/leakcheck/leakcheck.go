@@ -0,0 +1,224 @@
+// Package leakcheck watches a long-running process for memory and goroutine
+// leaks. It is a debug aid for soak tests, not something to leave enabled in
+// production: every sample forces a garbage collection.
+package leakcheck
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"time"
+)
+
+// topSites is how many growing allocation sites are logged per sample.
+const topSites = 5
+
+// profileRate samples allocations more densely than the runtime default
+// (512 KiB) so slow growth shows up in the site diffs.
+const profileRate = 64 * 1024
+
+// Sample is one observation of the process.
+type Sample struct {
+	Time       time.Time
+	Goroutines int
+	HeapInuse  uint64
+	HeapObjs   uint64
+}
+
+// Detector samples heap and goroutine counts at a fixed interval, logs the
+// allocation sites whose in-use bytes grew since the previous sample, and
+// warns when a metric has grown at every one of the last window samples.
+type Detector struct {
+	interval time.Duration
+	window   int
+	dir      string
+
+	samples []Sample
+	sites   map[[32]uintptr]int64
+	seq     int
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// New creates a detector. window is the number of consecutive increases
+// treated as monotonic growth (minimum 2). If dir is non-empty a heap profile
+// is written there on every sample, for offline `go tool pprof -diff_base`.
+// New raises the heap profiling rate, so it should be called early.
+func New(interval time.Duration, window int, dir string) *Detector {
+	if window < 2 {
+		window = 2
+	}
+	runtime.MemProfileRate = profileRate
+	return &Detector{
+		interval: interval,
+		window:   window,
+		dir:      dir,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start launches the sampling loop.
+func (d *Detector) Start() {
+	go d.run()
+}
+
+// Stop terminates the sampling loop and waits for it to exit.
+func (d *Detector) Stop() {
+	close(d.stop)
+	<-d.done
+}
+
+func (d *Detector) run() {
+	defer close(d.done)
+
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	d.sample()
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+			d.sample()
+		}
+	}
+}
+
+func (d *Detector) sample() {
+	// The heap profile only reflects frees up to the last completed GC
+	runtime.GC()
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	s := Sample{
+		Time:       time.Now(),
+		Goroutines: runtime.NumGoroutine(),
+		HeapInuse:  ms.HeapInuse,
+		HeapObjs:   ms.HeapObjects,
+	}
+
+	d.samples = append(d.samples, s)
+	if len(d.samples) > d.window+1 {
+		d.samples = d.samples[len(d.samples)-d.window-1:]
+	}
+
+	log.Printf("Leak check - Goroutines: %d, Heap In Use: %.2f MiB, Heap Objects: %d",
+		s.Goroutines, float64(s.HeapInuse)/(1<<20), s.HeapObjs)
+
+	d.diffSites()
+	d.writeProfile()
+
+	if d.growing(func(s Sample) uint64 { return uint64(s.Goroutines) }) {
+		log.Printf("Leak check WARNING: goroutine count grew over the last %d samples (%d -> %d)",
+			d.window, d.samples[0].Goroutines, s.Goroutines)
+	}
+	if d.growing(func(s Sample) uint64 { return s.HeapInuse }) {
+		log.Printf("Leak check WARNING: heap in use grew over the last %d samples (%.2f -> %.2f MiB)",
+			d.window, float64(d.samples[0].HeapInuse)/(1<<20), float64(s.HeapInuse)/(1<<20))
+	}
+}
+
+// growing reports whether metric increased at each of the last window steps.
+func (d *Detector) growing(metric func(Sample) uint64) bool {
+	if len(d.samples) <= d.window {
+		return false
+	}
+	for i := 1; i < len(d.samples); i++ {
+		if metric(d.samples[i]) <= metric(d.samples[i-1]) {
+			return false
+		}
+	}
+	return true
+}
+
+// diffSites logs the allocation sites whose in-use bytes grew the most since
+// the previous sample.
+func (d *Detector) diffSites() {
+	records := make([]runtime.MemProfileRecord, 256)
+	for {
+		n, ok := runtime.MemProfile(records, false)
+		if ok {
+			records = records[:n]
+			break
+		}
+		records = make([]runtime.MemProfileRecord, n+64)
+	}
+
+	sites := make(map[[32]uintptr]int64, len(records))
+	for _, r := range records {
+		sites[r.Stack0] += r.InUseBytes()
+	}
+
+	if d.sites != nil {
+		type growth struct {
+			stack [32]uintptr
+			delta int64
+		}
+		var grown []growth
+		for stack, bytes := range sites {
+			if delta := bytes - d.sites[stack]; delta > 0 {
+				grown = append(grown, growth{stack, delta})
+			}
+		}
+		sort.Slice(grown, func(i, j int) bool { return grown[i].delta > grown[j].delta })
+		for i := 0; i < len(grown) && i < topSites; i++ {
+			log.Printf("Leak check -   +%d B at %s", grown[i].delta, site(grown[i].stack))
+		}
+	}
+	d.sites = sites
+}
+
+// site names the innermost frame of an allocation stack outside the runtime.
+func site(stack [32]uintptr) string {
+	var pcs []uintptr
+	for _, pc := range stack {
+		if pc == 0 {
+			break
+		}
+		pcs = append(pcs, pc)
+	}
+	frames := runtime.CallersFrames(pcs)
+	first := ""
+	for {
+		frame, more := frames.Next()
+		name := fmt.Sprintf("%s (%s:%d)", frame.Function, filepath.Base(frame.File), frame.Line)
+		if first == "" {
+			first = name
+		}
+		if !isRuntime(frame.Function) {
+			return name
+		}
+		if !more {
+			return first
+		}
+	}
+}
+
+func isRuntime(function string) bool {
+	return len(function) >= 8 && function[:8] == "runtime."
+}
+
+// writeProfile saves the current heap profile to dir, if configured.
+func (d *Detector) writeProfile() {
+	if d.dir == "" {
+		return
+	}
+	d.seq++
+	path := filepath.Join(d.dir, fmt.Sprintf("heap-%04d.pprof", d.seq))
+	f, err := os.Create(path)
+	if err != nil {
+		log.Printf("Leak check: failed to write heap profile: %v", err)
+		return
+	}
+	defer f.Close()
+	if err := pprof.Lookup("heap").WriteTo(f, 0); err != nil {
+		log.Printf("Leak check: failed to write heap profile: %v", err)
+	}
+}
@@ -0,0 +1,53 @@
+// Package listener opens the server's TCP listening sockets, optionally
+// several bound to the same address with SO_REUSEPORT so the kernel spreads
+// incoming connections across independent accept queues.
+package listener
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"runtime"
+)
+
+// CoresPerListener is how many CPUs share one socket when the count is auto.
+const CoresPerListener = 8
+
+// AutoCount returns one listener per CoresPerListener CPUs, at least one.
+func AutoCount() int {
+	n := runtime.NumCPU() / CoresPerListener
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// Listen opens count TCP listeners on addr. A count above one requires
+// SO_REUSEPORT support from the platform.
+func Listen(addr string, count int) ([]net.Listener, error) {
+	if count <= 1 {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{ln}, nil
+	}
+
+	if !reusePortSupported {
+		return nil, fmt.Errorf("multiple listeners require SO_REUSEPORT, which is not supported on %s", runtime.GOOS)
+	}
+
+	lc := net.ListenConfig{Control: setReusePort}
+	listeners := make([]net.Listener, 0, count)
+	for i := 0; i < count; i++ {
+		ln, err := lc.Listen(context.Background(), "tcp", addr)
+		if err != nil {
+			for _, opened := range listeners {
+				opened.Close()
+			}
+			return nil, fmt.Errorf("listener %d: %w", i, err)
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
@@ -0,0 +1,21 @@
+//go:build linux
+
+package listener
+
+import "syscall"
+
+const reusePortSupported = true
+
+// soReusePort is SO_REUSEPORT, which the syscall package does not export.
+const soReusePort = 0xf
+
+func setReusePort(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,62 @@
+package replication
+
+// VectorClock counts the writes to one key made in each region.
+type VectorClock map[string]uint64
+
+// Ordering is the causal relationship between two vector clocks.
+type Ordering int
+
+const (
+	Equal Ordering = iota
+	Before
+	After
+	Concurrent
+)
+
+// Compare reports how v relates to other: Before means other has seen every
+// write v has, Concurrent means each has writes the other has not seen.
+func (v VectorClock) Compare(other VectorClock) Ordering {
+	less, greater := false, false
+	for region, n := range v {
+		if m := other[region]; n < m {
+			less = true
+		} else if n > m {
+			greater = true
+		}
+	}
+	for region, m := range other {
+		if _, ok := v[region]; !ok && m > 0 {
+			less = true
+		}
+	}
+	switch {
+	case less && greater:
+		return Concurrent
+	case less:
+		return Before
+	case greater:
+		return After
+	}
+	return Equal
+}
+
+// Merge returns the pointwise maximum of v and other.
+func (v VectorClock) Merge(other VectorClock) VectorClock {
+	merged := make(VectorClock, len(v)+len(other))
+	for region, n := range v {
+		merged[region] = n
+	}
+	for region, n := range other {
+		if n > merged[region] {
+			merged[region] = n
+		}
+	}
+	return merged
+}
+
+// Tick returns a copy of v with region's counter incremented.
+func (v VectorClock) Tick(region string) VectorClock {
+	next := v.Merge(nil)
+	next[region]++
+	return next
+}
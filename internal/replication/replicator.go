@@ -0,0 +1,418 @@
+// Package replication is an experimental asynchronous active-active mode:
+// independent deployments forward their writes to each other and converge
+// with per-key last-writer-wins registers. Vector clocks tell causally
+// ordered writes apart from concurrent ones; only the latter are conflicts,
+// resolved by wall-clock timestamp with the region name as tie-breaker.
+//
+// Register metadata lives in memory only, so after a restart the first
+// remote write to each key is accepted unconditionally.
+package replication
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"kv-server/internal/fasthash"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// queueSize bounds the writes buffered per peer; beyond it writes are
+	// dropped and counted, and the peer diverges until the key is rewritten.
+	queueSize = 10000
+
+	// maxBatch bounds the writes shipped per request.
+	maxBatch = 500
+
+	// flushInterval is how long a partial batch waits for more writes.
+	flushInterval = 50 * time.Millisecond
+
+	maxConflicts = 100
+	lockStripes  = 64
+)
+
+// Op is one replicated write or delete.
+type Op struct {
+	Key     string      `json:"key"`
+	Value   string      `json:"value,omitempty"`
+	Deleted bool        `json:"deleted,omitempty"`
+	Clock   VectorClock `json:"clock"`
+	Time    int64       `json:"time"`
+	Region  string      `json:"region"`
+}
+
+// wins reports whether op beats other under last-writer-wins.
+func (op Op) wins(other register) bool {
+	if op.Time != other.time {
+		return op.Time > other.time
+	}
+	return op.Region > other.region
+}
+
+// Batch is the body of a replication request between peers.
+type Batch struct {
+	Region string `json:"region"`
+	Ops    []Op   `json:"ops"`
+}
+
+// Conflict records two concurrent writes to a key and which one won.
+type Conflict struct {
+	Key          string    `json:"key"`
+	DetectedAt   time.Time `json:"detected_at"`
+	LocalRegion  string    `json:"local_region"`
+	LocalTime    time.Time `json:"local_time"`
+	RemoteRegion string    `json:"remote_region"`
+	RemoteTime   time.Time `json:"remote_time"`
+	Winner       string    `json:"winner"`
+}
+
+// register is the LWW metadata of the last write applied to a key.
+type register struct {
+	clock  VectorClock
+	time   int64
+	region string
+}
+
+// Applier writes a remote op to local storage.
+type Applier func(op Op) error
+
+// Replicator stamps local writes, ships them to peers and resolves incoming
+// ones.
+type Replicator struct {
+	region string
+	client *http.Client
+	apiKey string
+	peers  []*peer
+
+	stripes [lockStripes]sync.Mutex
+
+	mu        sync.Mutex
+	registers map[string]register
+	conflicts []Conflict
+
+	applied       atomic.Uint64
+	superseded    atomic.Uint64
+	conflictCount atomic.Uint64
+}
+
+// New creates a replicator for region shipping writes to the given peer base
+// URLs (e.g. http://eu-kv:8080).
+func New(region string, peerURLs []string) *Replicator {
+	r := &Replicator{
+		region:    region,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		registers: make(map[string]register),
+	}
+	for _, url := range peerURLs {
+		r.peers = append(r.peers, &peer{
+			url:   url,
+			queue: make(chan Op, queueSize),
+			stop:  make(chan struct{}),
+			done:  make(chan struct{}),
+		})
+	}
+	return r
+}
+
+// SetAPIKey authenticates the batches sent to peers, which must accept key.
+// Call it before Start.
+func (r *Replicator) SetAPIKey(key string) {
+	r.apiKey = key
+}
+
+// Region returns the local region name.
+func (r *Replicator) Region() string {
+	return r.region
+}
+
+// Start launches one sender per peer.
+func (r *Replicator) Start() {
+	for _, p := range r.peers {
+		go r.send(p)
+	}
+}
+
+// Stop terminates the senders, abandoning unsent writes.
+func (r *Replicator) Stop() {
+	for _, p := range r.peers {
+		close(p.stop)
+		<-p.done
+	}
+}
+
+// Lock serializes writes to keys against replicated writes to the same keys
+// and returns the unlock function. Local writes must hold it from before
+// their database write until after Local.
+func (r *Replicator) Lock(keys ...string) func() {
+	idx := make([]int, 0, len(keys))
+	seen := make(map[int]bool, len(keys))
+	for _, key := range keys {
+		if i := stripe(key); !seen[i] {
+			seen[i] = true
+			idx = append(idx, i)
+		}
+	}
+	// A fixed order keeps multi-key locks deadlock-free
+	sort.Ints(idx)
+	for _, i := range idx {
+		r.stripes[i].Lock()
+	}
+	return func() {
+		for _, i := range idx {
+			r.stripes[i].Unlock()
+		}
+	}
+}
+
+func stripe(key string) int {
+	return int(fasthash.String(key) % lockStripes)
+}
+
+// Local records a committed local write and queues it for every peer.
+// Callers must hold Lock(key).
+func (r *Replicator) Local(key, value string, deleted bool) {
+	r.mu.Lock()
+	prev := r.registers[key]
+	// Keep per-key timestamps increasing even if the wall clock steps back
+	now := max(time.Now().UnixNano(), prev.time+1)
+	op := Op{
+		Key:     key,
+		Value:   value,
+		Deleted: deleted,
+		Clock:   prev.clock.Tick(r.region),
+		Time:    now,
+		Region:  r.region,
+	}
+	r.registers[key] = register{clock: op.Clock, time: op.Time, region: op.Region}
+	r.mu.Unlock()
+
+	for _, p := range r.peers {
+		select {
+		case p.queue <- op:
+		default:
+			p.dropped.Add(1)
+		}
+	}
+}
+
+// Receive resolves ops from a peer against local registers and applies the
+// winners. It stops at the first apply error so the peer retries the batch;
+// ops already applied are recognized as duplicates on retry.
+func (r *Replicator) Receive(ops []Op, apply Applier) error {
+	for _, op := range ops {
+		if err := r.receive(op, apply); err != nil {
+			return fmt.Errorf("applying %q: %w", op.Key, err)
+		}
+	}
+	return nil
+}
+
+func (r *Replicator) receive(op Op, apply Applier) error {
+	unlock := r.Lock(op.Key)
+	defer unlock()
+
+	r.mu.Lock()
+	local, known := r.registers[op.Key]
+	r.mu.Unlock()
+
+	order := Before
+	if known {
+		order = local.clock.Compare(op.Clock)
+	}
+
+	switch order {
+	case Equal, After:
+		// Already applied, or superseded by a write that saw it
+		r.superseded.Add(1)
+		return nil
+	case Concurrent:
+		remoteWins := op.wins(local)
+		r.recordConflict(op, local, remoteWins)
+		if !remoteWins {
+			// Keep our value but remember we have now seen the remote write
+			r.mu.Lock()
+			local.clock = local.clock.Merge(op.Clock)
+			r.registers[op.Key] = local
+			r.mu.Unlock()
+			r.superseded.Add(1)
+			return nil
+		}
+		op.Clock = op.Clock.Merge(local.clock)
+	}
+
+	if err := apply(op); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.registers[op.Key] = register{clock: op.Clock, time: op.Time, region: op.Region}
+	r.mu.Unlock()
+	r.applied.Add(1)
+	return nil
+}
+
+func (r *Replicator) recordConflict(op Op, local register, remoteWins bool) {
+	c := Conflict{
+		Key:          op.Key,
+		DetectedAt:   time.Now(),
+		LocalRegion:  local.region,
+		LocalTime:    time.Unix(0, local.time),
+		RemoteRegion: op.Region,
+		RemoteTime:   time.Unix(0, op.Time),
+		Winner:       local.region,
+	}
+	if remoteWins {
+		c.Winner = op.Region
+	}
+	log.Printf("Replication conflict on %q: %s and %s wrote concurrently, %s wins",
+		op.Key, c.LocalRegion, c.RemoteRegion, c.Winner)
+
+	r.conflictCount.Add(1)
+	r.mu.Lock()
+	r.conflicts = append(r.conflicts, c)
+	if len(r.conflicts) > maxConflicts {
+		r.conflicts = r.conflicts[len(r.conflicts)-maxConflicts:]
+	}
+	r.mu.Unlock()
+}
+
+// Report summarizes replication state for the conflict report endpoint.
+type Report struct {
+	Region     string       `json:"region"`
+	Applied    uint64       `json:"applied"`
+	Superseded uint64       `json:"superseded"`
+	Conflicts  uint64       `json:"conflicts"`
+	Peers      []PeerStatus `json:"peers"`
+	// Recent holds the latest conflicts, oldest first
+	Recent []Conflict `json:"recent"`
+}
+
+// PeerStatus describes the outgoing stream to one peer.
+type PeerStatus struct {
+	URL       string `json:"url"`
+	Queued    int    `json:"queued"`
+	Sent      uint64 `json:"sent"`
+	Dropped   uint64 `json:"dropped"`
+	Failures  uint64 `json:"failures"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// Report returns counters, per-peer queue state and recent conflicts.
+func (r *Replicator) Report() Report {
+	rep := Report{
+		Region:     r.region,
+		Applied:    r.applied.Load(),
+		Superseded: r.superseded.Load(),
+		Conflicts:  r.conflictCount.Load(),
+		Peers:      []PeerStatus{},
+	}
+	r.mu.Lock()
+	rep.Recent = append([]Conflict{}, r.conflicts...)
+	r.mu.Unlock()
+
+	for _, p := range r.peers {
+		status := PeerStatus{
+			URL:      p.url,
+			Queued:   len(p.queue),
+			Sent:     p.sent.Load(),
+			Dropped:  p.dropped.Load(),
+			Failures: p.failures.Load(),
+		}
+		if err, ok := p.lastErr.Load().(string); ok {
+			status.LastError = err
+		}
+		rep.Peers = append(rep.Peers, status)
+	}
+	return rep
+}
+
+// peer is the outgoing stream to one remote deployment.
+type peer struct {
+	url   string
+	queue chan Op
+
+	sent     atomic.Uint64
+	dropped  atomic.Uint64
+	failures atomic.Uint64
+	lastErr  atomic.Value
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// send batches queued ops and posts them to the peer, retrying a failed
+// batch with backoff so ops to the same key are delivered in order.
+func (r *Replicator) send(p *peer) {
+	defer close(p.done)
+
+	for {
+		var batch []Op
+		select {
+		case <-p.stop:
+			return
+		case op := <-p.queue:
+			batch = append(batch, op)
+		}
+
+		flush := time.NewTimer(flushInterval)
+	collect:
+		for len(batch) < maxBatch {
+			select {
+			case op := <-p.queue:
+				batch = append(batch, op)
+			case <-flush.C:
+				break collect
+			case <-p.stop:
+				flush.Stop()
+				return
+			}
+		}
+		flush.Stop()
+
+		backoff := 100 * time.Millisecond
+		for {
+			err := r.post(p.url, batch)
+			if err == nil {
+				p.sent.Add(uint64(len(batch)))
+				break
+			}
+			p.failures.Add(1)
+			p.lastErr.Store(err.Error())
+
+			select {
+			case <-p.stop:
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, 5*time.Second)
+		}
+	}
+}
+
+func (r *Replicator) post(url string, ops []Op) error {
+	body, err := json.Marshal(Batch{Region: r.region, Ops: ops})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, url+"/replication/apply", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if r.apiKey != "" {
+		req.Header.Set("X-API-Key", r.apiKey)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("peer replied %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,264 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"kv-server/internal/cache"
+	"kv-server/internal/database"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultCacheKeysLimit = 1000
+
+type explainCache struct {
+	Shard          int        `json:"shard"`
+	Resident       bool       `json:"resident"`
+	ValueBytes     int        `json:"value_bytes,omitempty"`
+	InsertedAt     *time.Time `json:"inserted_at,omitempty"`
+	AgeMs          int64      `json:"age_ms,omitempty"`
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`
+	TTLRemainingMs int64      `json:"ttl_remaining_ms,omitempty"`
+}
+
+type explainDatabase struct {
+	Present    bool   `json:"present"`
+	ValueBytes int    `json:"value_bytes,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+type explainResponse struct {
+	Key      string          `json:"key"`
+	Cache    explainCache    `json:"cache"`
+	Database explainDatabase `json:"database"`
+	// Stale is set when the cached value no longer matches the database
+	Stale bool `json:"stale"`
+}
+
+type cacheEntryResponse struct {
+	Key        string     `json:"key"`
+	Shard      int        `json:"shard"`
+	ValueBytes int        `json:"value_bytes"`
+	InsertedAt time.Time  `json:"inserted_at"`
+	LastAccess *time.Time `json:"last_access,omitempty"`
+	Hits       uint64     `json:"hits"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	Version    uint64     `json:"version"`
+	Revision   uint64     `json:"revision,omitempty"`
+}
+
+// handleCacheEntry returns the cache metadata of a resident key, or 404 when
+// the key is not currently cached.
+func (s *KVServer) handleCacheEntry(w http.ResponseWriter, r *http.Request) {
+
+	key := strings.TrimPrefix(r.URL.Path, "/admin/cache/entries/")
+	if key == "" {
+		s.sendError(w, "key is required", http.StatusBadRequest)
+		return
+	}
+
+	info, ok := s.cache.Inspect(adminKey(r, key))
+	if !ok {
+		s.sendError(w, "key not cached", http.StatusNotFound)
+		return
+	}
+
+	resp := cacheEntryResponse{
+		Key:        key,
+		Shard:      info.Shard,
+		ValueBytes: len(info.Value),
+		InsertedAt: info.InsertedAt,
+		Hits:       info.Hits,
+		Version:    info.Version,
+		Revision:   info.Revision,
+	}
+	if !info.LastAccess.IsZero() {
+		resp.LastAccess = &info.LastAccess
+	}
+	if !info.ExpiresAt.IsZero() {
+		resp.ExpiresAt = &info.ExpiresAt
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+type cacheKeysResponse struct {
+	Keys  []string `json:"keys"`
+	Count int      `json:"count"`
+	// Truncated is set when more matching keys may exist beyond limit
+	Truncated bool `json:"truncated"`
+}
+
+// handleCacheKeys lists currently cached keys, optionally filtered by
+// ?prefix= and capped by ?limit= (default 1000). ?namespace= matches the
+// prefix in that namespace; keys of other namespaces are listed as
+// {namespace}/{key}.
+func (s *KVServer) handleCacheKeys(w http.ResponseWriter, r *http.Request) {
+
+	limit := defaultCacheKeysLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			s.sendError(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	// Ask for one extra key to detect truncation
+	keys := s.cache.Keys(adminKey(r, r.URL.Query().Get("prefix")), limit+1)
+	for i, key := range keys {
+		keys[i] = pathKey(key)
+	}
+	resp := cacheKeysResponse{Keys: keys}
+	if len(keys) > limit {
+		resp.Keys = keys[:limit]
+		resp.Truncated = true
+	}
+	if resp.Keys == nil {
+		resp.Keys = []string{}
+	}
+	sort.Strings(resp.Keys)
+	resp.Count = len(resp.Keys)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+type cacheFlushResponse struct {
+	Cleared int `json:"cleared"`
+	// Rehydrating is the number of hot keys queued to be reloaded
+	Rehydrating int64 `json:"rehydrating"`
+}
+
+// handleCacheFlush serves DELETE /admin/cache, which drops every cached
+// entry. With rehydration running, the hottest keys are reloaded in the
+// background at its rate.
+func (s *KVServer) handleCacheFlush(w http.ResponseWriter, r *http.Request) {
+
+	resp := cacheFlushResponse{Cleared: s.cache.Len()}
+	s.ClearCache()
+	if status := s.Rehydration(); status != nil {
+		resp.Rehydrating = status.Queued
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+type cacheShardsResponse struct {
+	Shards []cache.ShardStats `json:"shards"`
+	// Skew is the heaviest shard's weight over the mean; 1 is perfectly even
+	Skew      float64               `json:"skew"`
+	Rebalance cache.RebalanceStatus `json:"rebalance"`
+}
+
+// handleCacheShards serves GET /admin/cache/shards, the occupancy of every
+// cache shard, to spot a skewed one.
+func (s *KVServer) handleCacheShards(w http.ResponseWriter, r *http.Request) {
+
+	resp := cacheShardsResponse{Shards: s.cache.Shards(), Rebalance: s.cache.Rebalancing()}
+	var total, heaviest int64
+	for _, shard := range resp.Shards {
+		total += shard.Weight
+		heaviest = max(heaviest, shard.Weight)
+	}
+	if total > 0 {
+		resp.Skew = float64(heaviest) * float64(len(resp.Shards)) / float64(total)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleCacheRebalance serves POST /admin/cache/rebalance, which evens out
+// the shards online; progress is reported by /admin/cache/shards.
+func (s *KVServer) handleCacheRebalance(w http.ResponseWriter, r *http.Request) {
+	if err := s.cache.Rebalance(); err != nil {
+		s.sendError(w, "a rebalance is already running", http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(s.cache.Rebalancing())
+}
+
+// handleExplain reports where a key currently lives and whether the cached
+// copy agrees with the database, to debug clients seeing stale values. The
+// key is looked up in ?namespace=.
+func (s *KVServer) handleExplain(w http.ResponseWriter, r *http.Request) {
+
+	key := strings.TrimPrefix(r.URL.Path, "/admin/explain/")
+	if key == "" {
+		s.sendError(w, "key is required", http.StatusBadRequest)
+		return
+	}
+
+	resp := explainResponse{Key: key}
+	now := time.Now()
+	key = adminKey(r, key)
+
+	info, cached := s.cache.Inspect(key)
+	resp.Cache.Shard = info.Shard
+	if cached {
+		resp.Cache.Resident = true
+		resp.Cache.ValueBytes = len(info.Value)
+		resp.Cache.InsertedAt = &info.InsertedAt
+		resp.Cache.AgeMs = now.Sub(info.InsertedAt).Milliseconds()
+		if !info.ExpiresAt.IsZero() {
+			resp.Cache.ExpiresAt = &info.ExpiresAt
+			resp.Cache.TTLRemainingMs = info.ExpiresAt.Sub(now).Milliseconds()
+		}
+	}
+
+	// Bypass the cache to see what the database holds right now
+	value, err := s.db.Read(requestCtx(w), key)
+	if err != nil {
+		resp.Database.Error = err.Error()
+	} else {
+		resp.Database.Present = true
+		resp.Database.ValueBytes = len(value)
+	}
+
+	// A failed lookup (as opposed to a missing key) says nothing about staleness
+	missing := errors.Is(err, database.ErrNotFound)
+	resp.Stale = cached && (missing || (err == nil && value != info.Value))
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleIndexAdvice serves GET /admin/db/index-advice, a report of the
+// kv_store workload with recommended indexes, and POST
+// /admin/db/index-advice/{name}, which creates a recommended index.
+func (s *KVServer) handleIndexAdvice(w http.ResponseWriter, r *http.Request) {
+	advisor, ok := s.db.(database.IndexAdvisor)
+	if !ok {
+		s.sendError(w, "index advice not supported by this backend", http.StatusNotImplemented)
+		return
+	}
+
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/db/index-advice"), "/")
+	switch {
+	case name == "" && r.Method == http.MethodGet:
+		report, err := advisor.IndexAdvice()
+		if err != nil {
+			s.sendError(w, "database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(report)
+	case name != "" && r.Method == http.MethodPost:
+		if err := advisor.CreateAdvisedIndex(name); err != nil {
+			s.sendError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.sendSuccess(w, "", http.StatusCreated)
+	default:
+		s.sendError(w, "index name is required", http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"kv-server/internal/database"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// hotPathAllocs is the allocation budget of a cache-hit GET /kv/{key}
+// inside the handler: routing, header writes and encoding allocate nothing.
+const hotPathAllocs = 0
+
+// writerAllocs are the allocations of a fresh discardWriter: the writer,
+// its header map and the map's first group, which holds the handler's
+// headers. A handler setting more headers, or replacing their values, goes
+// over the budget.
+const writerAllocs = 3
+
+// discardWriter is a ResponseWriter that allocates nothing per request, so
+// measured allocations belong to the handler alone.
+type discardWriter struct {
+	header http.Header
+	status int
+}
+
+func (d *discardWriter) Header() http.Header         { return d.header }
+func (d *discardWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (d *discardWriter) WriteHeader(status int)      { d.status = status }
+
+// hotPathCases are cache-hit GETs, with and without the encoded response
+// cache, warmed up so that cache holds the response.
+func hotPathCases(valueSize int) map[string]*KVServer {
+	cases := make(map[string]*KVServer)
+	for _, encoded := range []bool{false, true} {
+		srv := NewKVServer(1000, database.NewMemoryDB(database.Faults{}))
+		name := "cache hit"
+		if encoded {
+			srv.SetResponseCache(1000, 0)
+			name = "cache hit, encoded"
+		}
+		srv.Cache().Put("bench", strings.Repeat("A", valueSize))
+		srv.ServeHTTP(&discardWriter{header: make(http.Header)}, httptest.NewRequest(http.MethodGet, "/kv/bench", nil))
+		cases[name] = srv
+	}
+	return cases
+}
+
+func TestHotPathAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("the race detector allocates")
+	}
+	for name, srv := range hotPathCases(10 << 10) {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/kv/bench", nil)
+			var w *discardWriter
+			allocs := testing.AllocsPerRun(1000, func() {
+				w = &discardWriter{header: make(http.Header)}
+				srv.ServeHTTP(w, req)
+			})
+			if w.status != http.StatusOK {
+				t.Fatalf("status %d, want 200", w.status)
+			}
+			if allocs > hotPathAllocs+writerAllocs {
+				t.Errorf("%.1f allocs per request with a fresh writer, budget is %d", allocs, hotPathAllocs+writerAllocs)
+			}
+		})
+	}
+}
+
+func BenchmarkHotPath(b *testing.B) {
+	for name, srv := range hotPathCases(10 << 10) {
+		b.Run(name, func(b *testing.B) {
+			req := httptest.NewRequest(http.MethodGet, "/kv/bench", nil)
+			w := &discardWriter{header: make(http.Header)}
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				srv.ServeHTTP(w, req)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"kv-server/internal/database"
+	"kv-server/internal/watch"
+	"net/http"
+	"strings"
+)
+
+// DefaultMaxAppendBytes bounds the values appends build unless
+// SetMaxAppendBytes changes it.
+const DefaultMaxAppendBytes = 1 << 20
+
+// SetMaxAppendBytes bounds the values POST /kv/{key}/append builds; an
+// append that would grow one past n bytes gets 409. Other writes are only
+// bounded by the request body limit.
+func (s *KVServer) SetMaxAppendBytes(n int) {
+	s.maxAppend = n
+}
+
+// appendTarget splits a POST path of the form {key}/append.
+func appendTarget(path string) (string, bool) {
+	return strings.CutSuffix(path, "/append")
+}
+
+// handleAppend serves POST /kv/{key}/append, which adds to the end of the
+// key's value in one database statement, so concurrent appends are all
+// kept. Like PUT, the body is {"value": ...}, or with any other
+// Content-Type the bytes to append. A missing key is created; an existing
+// one keeps its expiry and content type. The reply carries the new version.
+func (s *KVServer) handleAppend(w http.ResponseWriter, r *http.Request, key string) {
+	if key == "" {
+		s.sendError(w, "key is required", http.StatusBadRequest)
+		return
+	}
+	appender, ok := s.db.(database.Appender)
+	if !ok {
+		s.sendError(w, "append not supported by this backend", http.StatusNotImplemented)
+		return
+	}
+	if !s.checkQuarantine(w, key) || !s.checkUnschematized(w, key) {
+		return
+	}
+
+	var data string
+	contentType, raw := rawContentType(r)
+	if raw {
+		body, ok := s.readBody(w, r)
+		if !ok {
+			return
+		}
+		data = string(body)
+	} else {
+		req, ok := s.decodeRequest(w, r)
+		if !ok {
+			return
+		}
+		if req.Key != "" && req.Key != displayKey(key) {
+			s.sendError(w, "key in body does not match path", http.StatusBadRequest)
+			return
+		}
+		if req.TTLSeconds != 0 {
+			s.sendError(w, "ttl_seconds cannot be set on append", http.StatusBadRequest)
+			return
+		}
+		data = req.Value
+	}
+	if !s.checkAppendQuota(w, key, len(data)) {
+		return
+	}
+
+	revision, err := s.appendValue(requestCtx(w), appender, key, data, contentType)
+	switch {
+	case errors.Is(err, database.ErrTooLarge):
+		s.sendError(w, fmt.Sprintf("value would grow past %d bytes", s.maxAppend), http.StatusConflict)
+	case err != nil:
+		s.sendError(w, "database error", http.StatusInternalServerError)
+	default:
+		s.sendVersioned(w, "", revision, http.StatusOK)
+	}
+}
+
+// appendValue appends data in the database, then caches the whole value.
+// The database write runs under ctx.
+func (s *KVServer) appendValue(ctx context.Context, appender database.Appender, key, data, contentType string) (uint64, error) {
+	if s.repl != nil {
+		defer s.repl.Lock(key)()
+	}
+	rec, err := appender.Append(ctx, key, data, contentType, s.maxAppend)
+	s.noteResult(key, err)
+	if err != nil {
+		if !errors.Is(err, database.ErrTooLarge) {
+			s.writeStats.failed.Add(1)
+		}
+		return 0, err
+	}
+	s.writeStats.recordCommit(1)
+
+	if s.repl != nil {
+		s.repl.Local(key, rec.Value, false)
+	}
+
+	s.cacheWritten(ctx, key, recordVersion(rec))
+	s.chargeQuota(key, len(data))
+	s.publish(watch.Put, key, rec.Value, rec.Revision)
+	s.touch(key)
+
+	s.writeStats.acked.Add(1)
+	return rec.Revision, nil
+}
@@ -0,0 +1,354 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"kv-server/internal/database"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// auditQueue bounds the audit records waiting to be written; requests
+	// wait for room rather than go unrecorded.
+	auditQueue = 4096
+	// auditBatch bounds the records written at once.
+	auditBatch = 256
+)
+
+type auditLog struct {
+	records chan database.AuditRecord
+	done    chan struct{}
+}
+
+// StartAudit writes an audit record to sink for every POST, PUT and DELETE
+// request, on the fast port too, and every memcached write, whatever its
+// outcome. One goroutine writes the records in batches. A failed batch is
+// logged and counted as audit_failed. The returned function writes what is
+// queued and stops; it may be called more than once. Call it before
+// serving.
+func (s *KVServer) StartAudit(sink database.Auditor) (stop func()) {
+	a := &auditLog{records: make(chan database.AuditRecord, auditQueue), done: make(chan struct{})}
+	s.audit = a
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		batch := make([]database.AuditRecord, 0, auditBatch)
+		for {
+			select {
+			case rec := <-a.records:
+				batch = a.fill(append(batch[:0], rec))
+				s.writeAudit(sink, batch)
+			case <-a.done:
+				for batch = a.fill(batch[:0]); len(batch) > 0; batch = a.fill(batch[:0]) {
+					s.writeAudit(sink, batch)
+				}
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(a.done)
+			<-stopped
+		})
+	}
+}
+
+// fill adds the queued records to batch, up to auditBatch.
+func (a *auditLog) fill(batch []database.AuditRecord) []database.AuditRecord {
+	for len(batch) < auditBatch {
+		select {
+		case rec := <-a.records:
+			batch = append(batch, rec)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
+func (a *auditLog) record(rec database.AuditRecord) {
+	select {
+	case a.records <- rec:
+	case <-a.done:
+	}
+}
+
+func (s *KVServer) writeAudit(sink database.Auditor, batch []database.AuditRecord) {
+	if err := sink.AppendAudit(context.Background(), batch); err != nil {
+		s.stats.auditFailed.Add(uint64(len(batch)))
+		log.Printf("Writing %d audit records failed: %v", len(batch), err)
+	}
+}
+
+// audited reports whether requests with method are audited.
+func audited(method string) bool {
+	return method == http.MethodPost || method == http.MethodPut || method == http.MethodDelete
+}
+
+// auditHTTP records a request served by the standard listener, which
+// started at start.
+func (s *KVServer) auditHTTP(sw *statusWriter, r *http.Request, body *countingBody, start time.Time) {
+	op, key := s.auditTarget(r.Method, r.URL.Path)
+	if sw.auditKey != "" {
+		key = sw.auditKey
+	}
+	s.audit.record(database.AuditRecord{
+		Time:      start,
+		APIKey:    apiKeyID(s.credential(apiKeyOf(r), authorizationOf(r))),
+		Operation: op,
+		Key:       key,
+		ValueSize: body.n,
+		Status:    sw.status,
+		RequestID: sw.requestID(),
+	})
+}
+
+// auditFast records a request served by the fast path.
+func (s *KVServer) auditFast(req *fastRequest, status int, start time.Time) {
+	path, _, _ := strings.Cut(req.path, "?")
+	op, key := s.auditTarget(req.method, path)
+	if req.auditKey != "" {
+		key = req.auditKey
+	}
+	s.audit.record(database.AuditRecord{
+		Time:      start,
+		APIKey:    apiKeyID(s.credential(req.apiKey, req.authorization)),
+		Operation: op,
+		Key:       key,
+		ValueSize: int64(len(req.body)),
+		Status:    status,
+		RequestID: req.requestID(),
+	})
+}
+
+// auditMemcached records a memcached write, given its arguments as
+// memcachedWrite takes them and its reply. The reply stands in for a
+// status: 200 for success, 404 and 409 for misses and conflicts, 400 and
+// 500 for client and server errors.
+func (s *KVServer) auditMemcached(req *mcRequest, cmd string, args []string, ns, reply string, start time.Time) {
+	var key string
+	var size int
+	if len(args) > 0 {
+		key = pathKey(database.QualifyKey(ns, args[0]))
+	}
+	if cmd == "set" || cmd == "add" || cmd == "cas" {
+		size = len(args[len(args)-1])
+	}
+	status := http.StatusOK
+	switch {
+	case reply == "NOT_FOUND":
+		status = http.StatusNotFound
+	case reply == "EXISTS" || reply == "NOT_STORED":
+		status = http.StatusConflict
+	case strings.HasPrefix(reply, "CLIENT_ERROR"):
+		status = http.StatusBadRequest
+	case strings.HasPrefix(reply, "SERVER_ERROR"):
+		status = http.StatusInternalServerError
+	}
+	s.audit.record(database.AuditRecord{
+		Time:      start,
+		Operation: "memcached " + cmd,
+		Key:       key,
+		ValueSize: int64(size),
+		Status:    status,
+		RequestID: req.requestID(),
+	})
+}
+
+// auditTarget names the operation a request performs and the key its path
+// names, if any. /kv operations are named as kvRoute knows them; creates
+// and batches carry their keys in the body. Other routes are named by
+// method and path.
+func (s *KVServer) auditTarget(method, path string) (op, key string) {
+	if path != "/kv" && !strings.HasPrefix(path, "/kv/") {
+		return method + " " + path, ""
+	}
+	rest := strings.TrimPrefix(strings.TrimPrefix(path, "/kv"), "/")
+	var ns string
+	if s.namespaces {
+		var ok bool
+		if ns, rest, ok = splitNamespace(path); !ok {
+			return method + " " + path, ""
+		}
+	}
+	kind, _ := kvRoute(method, rest)
+	switch kind {
+	case opNone:
+		return method + " " + path, ""
+	case opIncr, opDecr:
+		rest, _, _ = incrTarget(rest)
+	case opAppend:
+		rest, _ = appendTarget(rest)
+	case opRestore:
+		rest, _ = restoreTarget(rest)
+	case opWrite, opDelete:
+	default:
+		rest = ""
+	}
+	return kind.String(), pathKey(qualify(ns, rest))
+}
+
+// noteAuditKey names the key a request carried in its body, for the audit
+// log.
+func (s *KVServer) noteAuditKey(w http.ResponseWriter, key string) {
+	if sw, ok := w.(*statusWriter); ok && s.audit != nil {
+		sw.auditKey = pathKey(key)
+	}
+}
+
+// apiKeyID identifies an API key or bearer token without revealing it: the
+// first 16 hex digits of its SHA-256 hash.
+func apiKeyID(key string) string {
+	if key == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// countingBody counts the bytes read from a request body.
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+// auditRotated is the suffix format of rotated audit files, which sorts by
+// age.
+const auditRotated = "20060102T150405.000000000Z"
+
+// AuditFile is an audit log kept as JSON lines in a file. A file that
+// would grow past its limit is renamed with the time as a suffix, e.g.
+// audit.log.20260105T140243.000000000Z, and a new one started.
+type AuditFile struct {
+	path     string
+	maxBytes int64
+	keep     int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+var _ database.Auditor = (*AuditFile)(nil)
+
+// OpenAuditFile appends to the audit file at path, rotating it at maxBytes
+// and keeping the newest keep rotated files. Zero maxBytes never rotates,
+// and zero keep keeps every file.
+func OpenAuditFile(path string, maxBytes int64, keep int) (*AuditFile, error) {
+	a := &AuditFile{path: path, maxBytes: maxBytes, keep: keep}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *AuditFile) open() error {
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.f, a.size = f, info.Size()
+	return nil
+}
+
+// AppendAudit writes records and syncs the file, so the records survive a
+// crash once it returns.
+func (a *AuditFile) AppendAudit(ctx context.Context, records []database.AuditRecord) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for i := range records {
+		if err := enc.Encode(&records[i]); err != nil {
+			return err
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.maxBytes > 0 && a.size > 0 && a.size+int64(buf.Len()) > a.maxBytes {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := a.f.Write(buf.Bytes())
+	a.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return a.f.Sync()
+}
+
+// rotate renames the file and starts a new one. The caller holds a.mu.
+func (a *AuditFile) rotate() error {
+	if err := a.f.Close(); err != nil {
+		return err
+	}
+	err := os.Rename(a.path, a.path+"."+time.Now().UTC().Format(auditRotated))
+	// Keep appending to the old file if it could not be renamed
+	if openErr := a.open(); openErr != nil {
+		return openErr
+	}
+	if err != nil {
+		return err
+	}
+	a.prune()
+	return nil
+}
+
+// prune removes the oldest rotated files beyond keep.
+func (a *AuditFile) prune() {
+	if a.keep <= 0 {
+		return
+	}
+	matches, err := filepath.Glob(a.path + ".*")
+	if err != nil {
+		return
+	}
+	var rotated []string
+	for _, name := range matches {
+		if _, err := time.Parse(auditRotated, strings.TrimPrefix(name, a.path+".")); err == nil {
+			rotated = append(rotated, name)
+		}
+	}
+	if len(rotated) <= a.keep {
+		return
+	}
+	sort.Strings(rotated)
+	for _, name := range rotated[:len(rotated)-a.keep] {
+		if err := os.Remove(name); err != nil {
+			log.Printf("Removing old audit file %s failed: %v", name, err)
+		}
+	}
+}
+
+// Close closes the file.
+func (a *AuditFile) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.f.Close()
+}
@@ -0,0 +1,294 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"kv-server/internal/database"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// apiKeyHeader carries the client's API key.
+const apiKeyHeader = "X-API-Key"
+
+// apiKeyOf returns the API key r carries. Browsers cannot set headers on a
+// WebSocket handshake, so /ws also takes it from ?api_key=; the access log
+// leaves queries out.
+func apiKeyOf(r *http.Request) string {
+	if key := r.Header.Get(apiKeyHeader); key != "" || r.URL.Path != "/ws" {
+		return key
+	}
+	return r.URL.Query().Get("api_key")
+}
+
+const errUnauthorized = "missing or invalid API key"
+
+// permission is a set of what a client may do.
+type permission uint8
+
+const (
+	// GET and HEAD on /kv, multi-gets, and watches
+	permRead permission = 1 << iota
+	// Every other /kv request, and transactions
+	permWrite
+	// Every other route: admin, replication, locks and uploads
+	permAdmin
+
+	permAll = permRead | permWrite | permAdmin
+)
+
+var permissionNames = [...]string{"read", "write", "admin"}
+
+func (p permission) String() string {
+	var names []string
+	for i, name := range permissionNames {
+		if p&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// apiKeys maps the SHA-256 hashes of the accepted keys, those given at
+// startup and those last loaded from the database, to the namespace each
+// is scoped to, empty for none.
+type apiKeys struct {
+	mu     sync.RWMutex
+	static map[[sha256.Size]byte]string
+	stored map[[sha256.Size]byte]string
+}
+
+// SetAPIKeys turns on authentication: every request except the health
+// probes must carry one of keys, or one loaded by StartAPIKeyReload, in
+// X-API-Key, and gets 401 otherwise. keys maps each key to the namespace it
+// is scoped to; a tenant key scoped to a namespace only reaches
+// /kv/{namespace}/ and its own watch streams, and gets 403 elsewhere. An
+// empty namespace reaches everything. Call it before serving.
+func (s *KVServer) SetAPIKeys(keys map[string]string) {
+	static := make(map[[sha256.Size]byte]string, len(keys))
+	for key, ns := range keys {
+		static[sha256.Sum256([]byte(key))] = ns
+	}
+	s.auth = &apiKeys{static: static}
+}
+
+// StartAPIKeyReload loads the API keys held in the database now and then
+// every interval, so keys can be added and revoked without a restart. It
+// requires SetAPIKeys. The returned function stops the reloads.
+func (s *KVServer) StartAPIKeyReload(src database.APIKeyStore, interval time.Duration) (stop func(), err error) {
+	if err := s.auth.reload(src); err != nil {
+		return nil, err
+	}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				// Keep the last good set while the database is unreachable
+				if err := s.auth.reload(src); err != nil {
+					log.Printf("Reloading API keys failed: %v", err)
+				}
+			}
+		}
+	}()
+	return func() { close(done) }, nil
+}
+
+func (a *apiKeys) reload(src database.APIKeyStore) error {
+	keys, err := src.APIKeys()
+	if err != nil {
+		return err
+	}
+	stored := make(map[[sha256.Size]byte]string, len(keys))
+	for _, key := range keys {
+		var sum [sha256.Size]byte
+		if n, err := hex.Decode(sum[:], []byte(key.Hash)); err != nil || n != len(sum) {
+			log.Printf("Ignoring malformed API key hash %q", key.Hash)
+			continue
+		}
+		stored[sum] = key.Namespace
+	}
+	a.mu.Lock()
+	a.stored = stored
+	a.mu.Unlock()
+	return nil
+}
+
+// count returns the number of accepted keys.
+func (a *apiKeys) count() int {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return len(a.static) + len(a.stored)
+}
+
+// lookup reports whether key is accepted and the namespace it is scoped
+// to. Comparing hashes rather than keys keeps lookups from leaking how much
+// of a guess was right. With authentication off every request is accepted
+// unscoped.
+func (a *apiKeys) lookup(key string) (scope string, ok bool) {
+	if a == nil {
+		return "", true
+	}
+	if key == "" {
+		return "", false
+	}
+	sum := sha256.Sum256([]byte(key))
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if scope, ok = a.static[sum]; ok {
+		return scope, true
+	}
+	scope, ok = a.stored[sum]
+	return scope, ok
+}
+
+// authExempt reports whether path is served without an API key: the health
+// probes, which orchestrators call unauthenticated.
+func authExempt(path string) bool {
+	return path == "/healthz" || path == "/readyz"
+}
+
+// authenticate returns the namespace a request is scoped to and what it
+// may do, given its API key and Authorization header, or ok false if it
+// carries neither a valid key nor a valid bearer token. Unscoped API keys
+// may do everything; tenant keys may read and write.
+func (s *KVServer) authenticate(ctx context.Context, apiKey, authorization string) (scope string, perms permission, ok bool) {
+	if s.tokens != nil && authorization != "" {
+		if token, bearer := bearerToken(authorization); bearer {
+			return s.tokens.verify(ctx, token)
+		}
+	}
+	if scope, ok = s.auth.lookup(apiKey); !ok {
+		return "", 0, false
+	}
+	if scope != "" {
+		return scope, permRead | permWrite, true
+	}
+	return "", permAll, true
+}
+
+// credential returns the API key or bearer token authenticate goes by,
+// which tells clients apart.
+func (s *KVServer) credential(apiKey, authorization string) string {
+	if s.tokens != nil {
+		if token, bearer := bearerToken(authorization); bearer {
+			return token
+		}
+	}
+	return apiKey
+}
+
+// permissionFor returns the permission a request for method and path
+// needs: none for the descriptions of the API, read or write for the data
+// routes, and admin for the rest.
+func (s *KVServer) permissionFor(method, path string) permission {
+	switch {
+	case path == "/kv" || strings.HasPrefix(path, "/kv/"):
+		rest := strings.TrimPrefix(strings.TrimPrefix(path, "/kv"), "/")
+		if s.namespaces {
+			// An invalid namespace gets 400 from handleKV
+			_, rest, _ = splitNamespace(path)
+		}
+		op, _ := kvRoute(method, rest)
+		return opPermission(op)
+	case path == "/watch" || strings.HasPrefix(path, "/watch/") || path == "/ws":
+		return permRead
+	case path == "/txn" || strings.HasPrefix(path, "/txn/"):
+		return permWrite
+	case path == "/capabilities" || path == "/openapi.json":
+		return 0
+	}
+	return permAdmin
+}
+
+// opPermission returns the permission a /kv operation needs.
+func opPermission(op kvOp) permission {
+	switch op {
+	case opNone, opList, opMultiGet, opRange, opCount, opHistory, opRead, opHead:
+		return permRead
+	}
+	return permWrite
+}
+
+// scopeKey is the request context key of a tenant key's namespace.
+type scopeKey struct{}
+
+// checkAuth answers 401 for a request without a valid API key or bearer
+// token, and 403 for one outside the routes its credentials may use, and
+// returns false. Otherwise it returns the request to serve, carrying a
+// scoped credential's namespace for scopeOf.
+func (s *KVServer) checkAuth(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	if s.auth == nil || authExempt(r.URL.Path) {
+		return r, true
+	}
+	authorization := authorizationOf(r)
+	scope, perms, ok := s.authenticate(r.Context(), apiKeyOf(r), authorization)
+	if !ok {
+		s.sendError(w, s.unauthorized(authorization), http.StatusUnauthorized)
+		return r, false
+	}
+	need := s.permissionFor(r.Method, r.URL.Path)
+	// Scoped credentials reach only the data routes, which check the
+	// namespace, and the descriptions of the API
+	if scope != "" && need&permAdmin != 0 {
+		s.sendError(w, errForbiddenScope, http.StatusForbidden)
+		return r, false
+	}
+	if perms&need != need {
+		s.sendError(w, forbiddenPermission(need), http.StatusForbidden)
+		return r, false
+	}
+	if scope == "" {
+		return r, true
+	}
+	return r.WithContext(context.WithValue(r.Context(), scopeKey{}, scope)), true
+}
+
+const (
+	errForbiddenScope = "API key is not valid for this namespace"
+	errInvalidToken   = "invalid or expired bearer token"
+)
+
+// unauthorized is the error of a request whose credentials did not
+// authenticate, given its Authorization header.
+func (s *KVServer) unauthorized(authorization string) string {
+	if _, bearer := bearerToken(authorization); bearer && s.tokens != nil {
+		return errInvalidToken
+	}
+	return errUnauthorized
+}
+
+// forbiddenPermission is the error of a request its credentials do not
+// permit.
+func forbiddenPermission(need permission) string {
+	return "credentials lack the " + need.String() + " permission"
+}
+
+// scopeOf returns the namespace the request's API key is scoped to, empty
+// if it is not.
+func scopeOf(r *http.Request) string {
+	scope, _ := r.Context().Value(scopeKey{}).(string)
+	return scope
+}
+
+// inScope reports whether a request scoped to scope may use namespace ns.
+func inScope(scope, ns string) bool {
+	return scope == "" || scope == ns
+}
+
+// APIKeyCount returns the number of accepted API keys.
+func (s *KVServer) APIKeyCount() int {
+	if s.auth == nil {
+		return 0
+	}
+	return s.auth.count()
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"kv-server/internal/cache"
+	"kv-server/internal/database"
+	"kv-server/internal/watch"
+	"log"
+	"net/http"
+	"time"
+)
+
+// maxBatchItems bounds a single POST /kv/batch.
+const maxBatchItems = 10000
+
+// BatchItemResult reports the outcome for one item of a batch, in request
+// order.
+type BatchItemResult struct {
+	Key     string `json:"key"`
+	Success bool   `json:"success"`
+	// Version is set on the item that was written; earlier items for the
+	// same key were superseded within the batch
+	Version uint64 `json:"version,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// BatchResponse is the body of a POST /kv/batch reply.
+type BatchResponse struct {
+	Success bool              `json:"success"`
+	Written int               `json:"written"`
+	Error   string            `json:"error,omitempty"`
+	Results []BatchItemResult `json:"results"`
+}
+
+// handleBatch writes an array of {key,value} pairs in one database
+// transaction. Invalid items are rejected individually; the valid ones
+// commit together or not at all. It replies 201 when every item was written,
+// 207 when some were rejected and 400 when none were valid. Items are
+// written to namespace ns.
+func (s *KVServer) handleBatch(w http.ResponseWriter, r *http.Request, ns string) {
+	if reqErr := checkContentType(r); reqErr != nil {
+		s.sendRequestError(w, reqErr)
+		return
+	}
+
+	body, ok := s.readBody(w, r)
+	if !ok {
+		return
+	}
+
+	var items []Request
+	if reqErr := decodeJSON(body, &items); reqErr != nil {
+		s.sendRequestError(w, reqErr)
+		return
+	}
+	if len(items) == 0 {
+		s.sendError(w, "batch is empty", http.StatusBadRequest)
+		return
+	}
+	if len(items) > maxBatchItems {
+		s.sendError(w, fmt.Sprintf("batch exceeds %d items", maxBatchItems), http.StatusBadRequest)
+		return
+	}
+
+	resp := BatchResponse{Results: make([]BatchItemResult, len(items))}
+
+	// A later item for the same key wins, as if written one by one
+	last := make(map[string]int, len(items))
+	tally := quotaTally{s: s}
+	expiries := make([]time.Time, len(items))
+	for i, item := range items {
+		resp.Results[i].Key = item.Key
+		if item.Key == "" {
+			resp.Results[i].Error = "key is required"
+			continue
+		}
+		expiresAt, ok := item.expiry()
+		if !ok {
+			resp.Results[i].Error = errInvalidTTL
+			continue
+		}
+		expiries[i] = expiresAt
+		items[i].Key = database.QualifyKey(ns, item.Key)
+		if reqErr := s.schemaError(items[i].Key, item.Value); reqErr != nil {
+			resp.Results[i].Error = reqErr.msg
+			continue
+		}
+		if status, msg := tally.add(requestCtx(w), items[i].Key, len(item.Value), false); status != 0 {
+			resp.Results[i].Error = msg
+			continue
+		}
+		last[items[i].Key] = i
+	}
+	pairs := make([]database.KeyValue, 0, len(last))
+	for i, item := range items {
+		if resp.Results[i].Error == "" && last[item.Key] == i {
+			pairs = append(pairs, database.KeyValue{Key: item.Key, Value: item.Value, ExpiresAt: expiries[i]})
+		}
+	}
+
+	if len(pairs) == 0 {
+		s.stats.countStatus(http.StatusBadRequest)
+		resp.Error = "no valid items"
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	if err := s.writeBatch(requestCtx(w), pairs); err != nil {
+		log.Printf("Batch write of %d keys failed: %v", len(pairs), err)
+		for i := range resp.Results {
+			if resp.Results[i].Error == "" {
+				resp.Results[i].Error = "database error"
+			}
+		}
+		s.stats.countStatus(http.StatusInternalServerError)
+		resp.Error = "database error"
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	for _, kv := range pairs {
+		resp.Results[last[kv.Key]].Version = kv.Revision
+	}
+
+	status := http.StatusCreated
+	for i := range resp.Results {
+		if resp.Results[i].Error == "" {
+			resp.Results[i].Success = true
+			resp.Written++
+		}
+	}
+	if resp.Written < len(items) {
+		status = http.StatusMultiStatus
+	}
+	resp.Success = status == http.StatusCreated
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// writeBatch commits pairs in a single transaction, under ctx, then updates
+// the cache.
+func (s *KVServer) writeBatch(ctx context.Context, pairs []database.KeyValue) error {
+	if s.repl != nil {
+		keys := make([]string, len(pairs))
+		for i, kv := range pairs {
+			keys[i] = kv.Key
+		}
+		defer s.repl.Lock(keys...)()
+	}
+	if err := s.db.CreateBatch(ctx, pairs); err != nil {
+		s.writeStats.failed.Add(uint64(len(pairs)))
+		return err
+	}
+	s.writeStats.recordCommit(len(pairs))
+	if s.repl != nil {
+		for _, kv := range pairs {
+			s.repl.Local(kv.Key, kv.Value, false)
+		}
+	}
+
+	for _, kv := range pairs {
+		s.cacheWritten(ctx, kv.Key, cache.Versioned[string]{Value: kv.Value, Revision: kv.Revision, ExpiresAt: kv.ExpiresAt, ContentType: kv.ContentType})
+		s.chargeQuota(kv.Key, len(kv.Value))
+		s.publish(watch.Put, kv.Key, kv.Value, kv.Revision)
+		s.touch(kv.Key)
+	}
+
+	s.writeStats.acked.Add(uint64(len(pairs)))
+	return nil
+}
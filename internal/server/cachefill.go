@@ -0,0 +1,100 @@
+package server
+
+import (
+	"context"
+	"kv-server/internal/cache"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	cacheFillHeader     = "X-Cache-Fill"
+	errInvalidCacheFill = "X-Cache-Fill must be fill or skip, cache_fill a boolean"
+)
+
+// cacheFill reports whether a request may put what it reads or writes in
+// the cache: false for an X-Cache-Fill header of "skip" or ?cache_fill=false.
+// It returns ok false for a value that is neither.
+func cacheFill(header, rawQuery string) (fill, ok bool) {
+	switch {
+	case header == "", strings.EqualFold(header, "fill"):
+		fill = true
+	case strings.EqualFold(header, "skip"):
+	default:
+		return false, false
+	}
+
+	if rawQuery == "" || !strings.Contains(rawQuery, "cache_fill=") {
+		return fill, true
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return false, false
+	}
+	values, present := query["cache_fill"]
+	if !present {
+		return fill, true
+	}
+	allowed, err := strconv.ParseBool(values[0])
+	if err != nil {
+		return false, false
+	}
+	return fill && allowed, true
+}
+
+// noteCacheFill marks the request answered by w as one that must not fill
+// the cache if it asks so. It answers 400 and returns false for an invalid
+// request.
+func (s *KVServer) noteCacheFill(w http.ResponseWriter, r *http.Request) bool {
+	fill, ok := cacheFill(r.Header.Get(cacheFillHeader), r.URL.RawQuery)
+	if !ok {
+		s.sendError(w, errInvalidCacheFill, http.StatusBadRequest)
+		return false
+	}
+	if sw, isSW := w.(*statusWriter); isSW && !fill {
+		sw.ctx.skipCache = true
+	}
+	return true
+}
+
+// skipsCache reports whether the request with ctx asked not to fill the
+// cache.
+func skipsCache(ctx context.Context) bool {
+	c, ok := ctx.(*requestContext)
+	return ok && c.skipCache
+}
+
+// readUncached serves a read that must not fill the cache: from the cache
+// on a hit, else straight from the database, leaving the cache and the
+// key's recency as they are so a one-off scan does not evict the hot set.
+func (s *KVServer) readUncached(ctx context.Context, key string) (cache.Versioned[string], error) {
+	if v, ok := s.cache.GetVersioned(key); ok {
+		return v, nil
+	}
+	if s.Level() >= CacheOnly {
+		return cache.Versioned[string]{}, errCacheOnly
+	}
+	s.stats.fillSkipped.Add(1)
+	rec, err := s.db.ReadRecord(ctx, key)
+	s.noteResult(key, err)
+	if err != nil {
+		return cache.Versioned[string]{}, err
+	}
+	return recordVersion(rec), nil
+}
+
+// cacheWritten updates the cache after a write of key committed: with the
+// new value, or for a request that must not fill the cache by dropping the
+// old one, so a large one-off value does not take the place of hot ones.
+func (s *KVServer) cacheWritten(ctx context.Context, key string, v cache.Versioned[string]) {
+	s.forgetEncoded(key)
+	if skipsCache(ctx) {
+		s.stats.fillSkipped.Add(1)
+		s.cache.Delete(key)
+		return
+	}
+	s.cache.PutVersioned(key, v)
+	s.writeStats.cacheWrites.Add(1)
+}
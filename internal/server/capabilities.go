@@ -0,0 +1,135 @@
+package server
+
+import (
+	"encoding/json"
+	"kv-server/internal/database"
+	"net/http"
+)
+
+// APIVersion is the version of the HTTP API. It changes only when a change
+// would break existing clients; additions show up in /capabilities
+// instead.
+const APIVersion = 1
+
+// Capabilities describes what this server supports, so clients can adapt
+// instead of assuming.
+type Capabilities struct {
+	APIVersion int `json:"api_version"`
+	// Protocols lists the HTTP versions the connection the request came
+	// in on can use
+	Protocols  []string         `json:"protocols"`
+	Operations []Operation      `json:"operations"`
+	Limits     CapabilityLimits `json:"limits"`
+	Features   Features         `json:"features"`
+}
+
+// Operation is one request the API serves.
+type Operation struct {
+	Method      string `json:"method"`
+	Path        string `json:"path"`
+	Description string `json:"description"`
+}
+
+// CapabilityLimits are the bounds requests must stay within. A zero
+// request timeout or rate means none.
+type CapabilityLimits struct {
+	MaxBodyBytes       int64   `json:"max_body_bytes"`
+	MaxUploadBytes     int64   `json:"max_upload_bytes"`
+	MaxAppendBytes     int     `json:"max_append_bytes"`
+	MaxBatchItems      int     `json:"max_batch_items"`
+	MaxMultiGetKeys    int     `json:"max_multi_get_keys"`
+	MaxListLimit       int     `json:"max_list_limit"`
+	MaxTTLSeconds      int64   `json:"max_ttl_seconds"`
+	MaxRequestIDLength int     `json:"max_request_id_length"`
+	RequestTimeoutMS   int64   `json:"request_timeout_ms"`
+	RateLimit          float64 `json:"rate_limit"`
+	RateLimitBurst     int     `json:"rate_limit_burst,omitempty"`
+}
+
+// Features reports the optional features that are on, and those the
+// storage backend provides.
+type Features struct {
+	Auth        bool `json:"auth"`
+	Namespaces  bool `json:"namespaces"`
+	Compression bool `json:"compression"`
+	// CompressMinBytes is the smallest response body gzipped
+	CompressMinBytes int  `json:"compress_min_bytes,omitempty"`
+	History          bool `json:"history"`
+	Fencing          bool `json:"fencing"`
+	Snapshots        bool `json:"snapshots"`
+	Locks            bool `json:"locks"`
+	WatchResume      bool `json:"watch_resume"`
+	Replication      bool `json:"replication"`
+	// SoftDelete is set when deleted keys can be restored
+	SoftDelete bool `json:"soft_delete"`
+}
+
+// SetUnencryptedHTTP2 records that the HTTP server also accepts HTTP/2
+// without TLS (h2c), so /capabilities offers it on plain connections. Call
+// it before serving.
+func (s *KVServer) SetUnencryptedHTTP2(on bool) {
+	s.h2c = on
+}
+
+// handleCapabilities serves GET /capabilities.
+func (s *KVServer) handleCapabilities(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(s.capabilities(r))
+}
+
+func (s *KVServer) capabilities(r *http.Request) Capabilities {
+	protocols := []string{"HTTP/1.1"}
+	if r.TLS != nil || s.h2c {
+		protocols = append(protocols, "HTTP/2")
+	}
+
+	_, history := s.db.(database.HistoryReader)
+	_, fencing := s.db.(database.Fencer)
+	_, snapshots := s.db.(database.Snapshotter)
+	_, locks := s.db.(database.Locker)
+	c := Capabilities{
+		APIVersion: APIVersion,
+		Protocols:  protocols,
+		Operations: s.operations(),
+		Limits: CapabilityLimits{
+			MaxBodyBytes:       s.maxBody,
+			MaxUploadBytes:     s.uploadMaxBytes(),
+			MaxAppendBytes:     s.maxAppend,
+			MaxBatchItems:      maxBatchItems,
+			MaxMultiGetKeys:    maxMultiGetKeys,
+			MaxListLimit:       maxListLimit,
+			MaxTTLSeconds:      maxTTLSeconds,
+			MaxRequestIDLength: maxRequestIDLen,
+			RequestTimeoutMS:   s.requestTimeout.Milliseconds(),
+		},
+		Features: Features{
+			Auth:             s.auth != nil,
+			Namespaces:       s.namespaces,
+			Compression:      s.compressMin > 0,
+			CompressMinBytes: s.compressMin,
+			History:          history,
+			Fencing:          fencing,
+			Snapshots:        snapshots,
+			Locks:            locks,
+			WatchResume:      s.watch.Resumable(),
+			Replication:      s.repl != nil,
+			SoftDelete:       s.softDelete != nil,
+		},
+	}
+	if s.limiter != nil {
+		c.Limits.RateLimit = s.limiter.rate
+		c.Limits.RateLimitBurst = int(s.limiter.burst)
+	}
+	return c
+}
+
+// operations lists the data operations, with paths for the namespace
+// setting.
+func (s *KVServer) operations() []Operation {
+	var ops []Operation
+	for _, e := range s.endpoints() {
+		if e.listed {
+			ops = append(ops, e.Operation)
+		}
+	}
+	return ops
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultCompressMinBytes is the smallest response body gzipped unless
+// SetCompression changes it; below it gzip's framing eats most of the
+// saving.
+const DefaultCompressMinBytes = 1 << 10
+
+// Shared header values, assigned directly to avoid allocating.
+var (
+	encodingGzip       = []string{"gzip"}
+	varyAcceptEncoding = []string{"Accept-Encoding"}
+)
+
+var gzipWriters = sync.Pool{New: func() any {
+	zw, _ := gzip.NewWriterLevel(nil, gzip.BestSpeed)
+	return zw
+}}
+
+// compressionStats counts compressed bodies and the bytes compression
+// saved, by direction.
+type compressionStats struct {
+	responses     atomic.Uint64
+	responseSaved atomic.Int64
+	requests      atomic.Uint64
+	requestSaved  atomic.Int64
+}
+
+// SetCompression gzips response bodies of at least minBytes with a
+// compressible Content-Type (JSON, XML and text) for clients that accept
+// gzip, and accepts gzip request bodies, whose limit from SetMaxBodyBytes
+// then applies to the decompressed bytes. Every response advertises this
+// in an Accept-Encoding header, so clients know they may compress what
+// they send. Zero turns both off. Call it before serving.
+func (s *KVServer) SetCompression(minBytes int) {
+	s.compressMin = minBytes
+}
+
+// negotiateCompression sets up compression of the response to r and
+// unwraps a gzip request body. It replies 415 and returns false for any
+// other request encoding.
+func (s *KVServer) negotiateCompression(sw *statusWriter, r *http.Request) bool {
+	sw.Header()["Accept-Encoding"] = encodingGzip
+	sw.compressMin = s.compressMin
+	sw.acceptsGzip = acceptsGzip(r.Header["Accept-Encoding"])
+
+	encoding := r.Header["Content-Encoding"]
+	if len(encoding) == 0 || strings.EqualFold(encoding[0], "identity") {
+		return true
+	}
+	if len(encoding) > 1 || !strings.EqualFold(encoding[0], "gzip") {
+		s.sendError(sw, "unsupported Content-Encoding; only gzip is accepted", http.StatusUnsupportedMediaType)
+		return false
+	}
+	wire := &countingReader{r: r.Body}
+	zr, err := gzip.NewReader(wire)
+	if err != nil {
+		s.sendError(sw, "invalid gzip body", http.StatusBadRequest)
+		return false
+	}
+	r.Body = &gzipBody{Reader: zr, body: r.Body, wire: wire, stats: &s.compression}
+	return true
+}
+
+// acceptsGzip reports whether Accept-Encoding values allow gzip: they name
+// gzip or *, and not with q=0.
+func acceptsGzip(values []string) bool {
+	for _, v := range values {
+		for v != "" {
+			var part string
+			part, v, _ = strings.Cut(v, ",")
+			coding, params, _ := strings.Cut(part, ";")
+			coding = strings.TrimSpace(coding)
+			if !strings.EqualFold(coding, "gzip") && coding != "*" {
+				continue
+			}
+			q, ok := strings.CutPrefix(strings.TrimSpace(params), "q=")
+			return !ok || strings.Trim(q, "0.") != ""
+		}
+	}
+	return false
+}
+
+// compressible reports whether a response with header h is worth gzipping:
+// it is not already encoded or a byte range, and its media type is text,
+// JSON or XML. Event streams are left alone so each event is flushed as it
+// is written.
+func compressible(h http.Header) bool {
+	if len(h["Content-Encoding"]) > 0 || len(h["Content-Range"]) > 0 || len(h["Content-Type"]) == 0 {
+		return false
+	}
+	ct := h["Content-Type"][0]
+	if ct == contentTypeJSON[0] {
+		return true
+	}
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil || mt == "text/event-stream" {
+		return false
+	}
+	return strings.HasPrefix(mt, "text/") || mt == "application/json" || mt == "application/xml" ||
+		mt == "application/javascript" || strings.HasSuffix(mt, "+json") || strings.HasSuffix(mt, "+xml")
+}
+
+// startBody runs at the first write of a response held back by
+// negotiateCompression. It decides whether to gzip the body, whose first
+// write is size bytes, then sends the header.
+func (sw *statusWriter) startBody(size int) {
+	min := sw.compressMin
+	sw.compressMin = 0
+	h := sw.Header()
+	if size >= min && compressible(h) {
+		// Keep a Vary: Origin set for CORS
+		switch vary := h["Vary"]; {
+		case len(vary) == 0:
+			h["Vary"] = varyAcceptEncoding
+		case !slices.Contains(vary, varyAcceptEncoding[0]):
+			h["Vary"] = append(vary[:len(vary):len(vary)], varyAcceptEncoding[0])
+		}
+		if sw.acceptsGzip {
+			h["Content-Encoding"] = encodingGzip
+			delete(h, "Content-Length")
+			sw.wire = countingWriter{w: sw.ResponseWriter}
+			sw.gz = gzipWriters.Get().(*gzip.Writer)
+			sw.gz.Reset(&sw.wire)
+		}
+	}
+	sw.ResponseWriter.WriteHeader(sw.status)
+}
+
+// finishBody sends a header still held back and ends a gzipped body,
+// counting it in stats. The bytes reported afterwards are those sent.
+func (sw *statusWriter) finishBody(stats *compressionStats) {
+	if sw.compressMin > 0 {
+		sw.compressMin = 0
+		if sw.wroteHeader {
+			sw.ResponseWriter.WriteHeader(sw.status)
+		}
+		return
+	}
+	if sw.gz == nil {
+		return
+	}
+	sw.gz.Close()
+	gzipWriters.Put(sw.gz)
+	sw.gz = nil
+	stats.responses.Add(1)
+	stats.responseSaved.Add(sw.bytes - sw.wire.n)
+	sw.bytes = sw.wire.n
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// gzipBody is a request body decompressed as it is read.
+type gzipBody struct {
+	*gzip.Reader
+	body  io.ReadCloser
+	wire  *countingReader
+	stats *compressionStats
+	n     int64
+}
+
+func (g *gzipBody) Read(b []byte) (int, error) {
+	n, err := g.Reader.Read(b)
+	g.n += int64(n)
+	return n, err
+}
+
+func (g *gzipBody) Close() error {
+	if g.stats != nil {
+		g.stats.requests.Add(1)
+		g.stats.requestSaved.Add(g.n - g.wire.n)
+		g.stats = nil
+	}
+	return g.body.Close()
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"context"
+	"kv-server/internal/cache"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	consistencyHeader     = "X-Consistency"
+	errInvalidConsistency = "X-Consistency must be strong or eventual, consistent a boolean"
+)
+
+// strongConsistency reports whether a read asks to skip the cache, through
+// an X-Consistency header of "strong" or ?consistent=true. It returns
+// ok false for a value that is neither.
+func strongConsistency(header, rawQuery string) (strong, ok bool) {
+	switch {
+	case header == "", strings.EqualFold(header, "eventual"):
+	case strings.EqualFold(header, "strong"):
+		strong = true
+	default:
+		return false, false
+	}
+
+	if rawQuery == "" || !strings.Contains(rawQuery, "consistent=") {
+		return strong, true
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return false, false
+	}
+	values, present := query["consistent"]
+	if !present {
+		return strong, true
+	}
+	consistent, err := strconv.ParseBool(values[0])
+	if err != nil {
+		return false, false
+	}
+	return strong || consistent, true
+}
+
+// readStrong reads key straight from the database, so it sees every write
+// acknowledged before it, whichever instance sharing the database took it.
+// The cache is left as it is: a concurrent write could otherwise be
+// overwritten there by the older value. Like a miss, it fails with
+// errCacheOnly from the CacheOnly rung down.
+func (s *KVServer) readStrong(ctx context.Context, key string) (cache.Versioned[string], error) {
+	if s.Level() >= CacheOnly {
+		return cache.Versioned[string]{}, errCacheOnly
+	}
+	s.stats.strongReads.Add(1)
+	rec, err := s.db.ReadRecord(ctx, key)
+	s.noteResult(key, err)
+	if err != nil {
+		return cache.Versioned[string]{}, err
+	}
+	return recordVersion(rec), nil
+}
+
+// readConsistent is readVersioned, or readStrong if strong is set.
+func (s *KVServer) readConsistent(ctx context.Context, key string, strong bool) (cache.Versioned[string], error) {
+	if strong {
+		return s.readStrong(ctx, key)
+	}
+	return s.readVersioned(ctx, key)
+}
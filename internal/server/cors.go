@@ -0,0 +1,119 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// DefaultCORSMethods are the methods browsers may use cross-origin
+	// unless SetCORS is given others.
+	DefaultCORSMethods = []string{"GET", "HEAD", "PUT", "POST", "DELETE"}
+
+	// DefaultCORSHeaders are the request headers browsers may send
+	// cross-origin unless SetCORS is given others.
+	DefaultCORSHeaders = []string{
+		"Content-Type", "Content-Encoding", apiKeyHeader, "Authorization", requestIDHeader, "If-Match", "If-None-Match",
+		"If-Range", "Range", consistencyHeader, cacheFillHeader, fencingTokenHeader,
+	}
+)
+
+// corsExposed are the response headers scripts may read cross-origin
+// beyond the safelisted ones.
+var corsExposed = []string{strings.Join([]string{
+	"ETag", requestIDHeader, "Retry-After", "Content-Range", "Accept-Ranges", "Location",
+}, ", ")}
+
+var (
+	anyOrigin  = []string{"*"}
+	varyOrigin = []string{"Origin"}
+)
+
+// corsPolicy is the CORS configuration, with its headers prepared so
+// answering does not allocate.
+type corsPolicy struct {
+	anyOrigin bool
+	origins   map[string]bool
+	methods   []string
+	headers   []string
+	maxAge    []string
+}
+
+// SetCORS lets browser scripts from origins call the API: "*" allows any
+// origin. Preflight requests are answered allowing methods and headers,
+// DefaultCORSMethods and DefaultCORSHeaders if empty, and may be cached by
+// the browser for maxAge. No origins turns CORS off, so browsers refuse
+// cross-origin calls. Call it before serving.
+func (s *KVServer) SetCORS(origins, methods, headers []string, maxAge time.Duration) {
+	if len(origins) == 0 {
+		s.cors = nil
+		return
+	}
+	if len(methods) == 0 {
+		methods = DefaultCORSMethods
+	}
+	if len(headers) == 0 {
+		headers = DefaultCORSHeaders
+	}
+	p := &corsPolicy{
+		origins: make(map[string]bool),
+		methods: []string{strings.Join(methods, ", ")},
+		headers: []string{strings.Join(headers, ", ")},
+	}
+	for _, origin := range origins {
+		if origin == "*" {
+			p.anyOrigin = true
+		}
+		// Browsers send an origin without a trailing slash
+		p.origins[strings.TrimSuffix(origin, "/")] = true
+	}
+	if maxAge > 0 {
+		p.maxAge = []string{strconv.Itoa(int(maxAge.Seconds()))}
+	}
+	s.cors = p
+}
+
+// handleCORS adds the CORS headers for a request from an allowed origin.
+// It answers a preflight request itself, with 204, and returns true;
+// preflights carry no API key, so they must not reach authentication.
+// A preflight from an origin that is not allowed gets no CORS headers, and
+// the browser then refuses the real request.
+func (s *KVServer) handleCORS(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header["Origin"]
+	if len(origin) == 0 {
+		return false
+	}
+	preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+	h := w.Header()
+	allowed := true
+	if s.cors.anyOrigin {
+		h["Access-Control-Allow-Origin"] = anyOrigin
+	} else {
+		// The answer depends on the origin, so caches must key on it
+		h["Vary"] = varyOrigin
+		allowed = s.cors.origins[origin[0]]
+		if allowed {
+			h["Access-Control-Allow-Origin"] = origin
+		}
+	}
+	if allowed {
+		if preflight {
+			h["Access-Control-Allow-Methods"] = s.cors.methods
+			h["Access-Control-Allow-Headers"] = s.cors.headers
+			if s.cors.maxAge != nil {
+				h["Access-Control-Max-Age"] = s.cors.maxAge
+			}
+		} else {
+			h["Access-Control-Expose-Headers"] = corsExposed
+		}
+	}
+	if !preflight {
+		return false
+	}
+	delete(h, "Content-Type")
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
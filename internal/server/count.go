@@ -0,0 +1,57 @@
+package server
+
+import (
+	"encoding/json"
+	"kv-server/internal/database"
+	"log"
+	"net/http"
+)
+
+// CountResponse is the reply to GET /kv/count.
+type CountResponse struct {
+	Success     bool  `json:"success"`
+	Count       int64 `json:"count"`
+	Approximate bool  `json:"approximate,omitempty"`
+}
+
+// handleCount serves GET /kv/count?prefix=, the number of live keys in
+// namespace ns starting with prefix. With ?approximate=true and no prefix
+// it answers from table statistics instead of counting, falling back to a
+// count while the table has none. Estimates cover every namespace, so they
+// are refused while namespaces are on.
+func (s *KVServer) handleCount(w http.ResponseWriter, r *http.Request, ns string) {
+	counter, ok := s.db.(database.Counter)
+	if !ok {
+		s.sendError(w, "counting not supported by this backend", http.StatusNotImplemented)
+		return
+	}
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+
+	if query.Get("approximate") == "true" {
+		if prefix != "" || s.namespaces {
+			s.sendError(w, "approximate counts cover every key; they take no prefix and need namespaces off", http.StatusBadRequest)
+			return
+		}
+		n, found, err := counter.EstimateKeys(requestCtx(w))
+		if err != nil {
+			log.Printf("Estimating keys failed: %v", err)
+			s.sendError(w, "database error", http.StatusInternalServerError)
+			return
+		}
+		if found {
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(CountResponse{Success: true, Count: n, Approximate: true})
+			return
+		}
+	}
+
+	n, err := counter.CountPrefix(requestCtx(w), database.QualifyKey(ns, prefix))
+	if err != nil {
+		log.Printf("Counting keys failed: %v", err)
+		s.sendError(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(CountResponse{Success: true, Count: n})
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// DefaultMaxBodyBytes bounds request bodies unless SetMaxBodyBytes changes
+// it.
+const DefaultMaxBodyBytes = 16 << 20
+
+// SetMaxBodyBytes bounds the request bodies the server reads; larger ones
+// get 413. It applies to the fast path as well.
+func (s *KVServer) SetMaxBodyBytes(n int64) {
+	s.maxBody = n
+}
+
+// readBody reads the request body, replying with a 413 and returning false
+// if it is over the limit, or a 400 if it cannot be read.
+func (s *KVServer) readBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	defer r.Body.Close()
+	if r.ContentLength > s.maxBody {
+		s.sendBodyTooLarge(w)
+		return nil, false
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, s.maxBody))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			s.sendBodyTooLarge(w)
+		} else {
+			s.sendError(w, "failed to read body", http.StatusBadRequest)
+		}
+		return nil, false
+	}
+	return body, true
+}
+
+func (s *KVServer) sendBodyTooLarge(w http.ResponseWriter) {
+	s.sendError(w, bodyTooLarge(s.maxBody), http.StatusRequestEntityTooLarge)
+}
+
+func bodyTooLarge(limit int64) string {
+	return fmt.Sprintf("request body larger than %d bytes", limit)
+}
+
+// ErrorDetail pinpoints what was wrong with a request body.
+type ErrorDetail struct {
+	Field    string `json:"field,omitempty"`
+	Keyword  string `json:"keyword,omitempty"`
+	Offset   int64  `json:"offset,omitempty"`
+	Line     int    `json:"line,omitempty"`
+	Column   int    `json:"column,omitempty"`
+	Expected string `json:"expected,omitempty"`
+	Got      string `json:"got,omitempty"`
+}
+
+// requestError is a client error with an optional precise location.
+type requestError struct {
+	msg    string
+	detail *ErrorDetail
+}
+
+func (e *requestError) Error() string {
+	return e.msg
+}
+
+// checkContentType rejects requests carrying several Content-Type headers
+// that disagree. Repeated identical headers (a common proxy artifact) are
+// accepted, as is a missing header.
+func checkContentType(r *http.Request) *requestError {
+	values := r.Header.Values("Content-Type")
+	if len(values) < 2 {
+		return nil
+	}
+	first, _, err := mime.ParseMediaType(values[0])
+	if err != nil {
+		return &requestError{msg: "invalid Content-Type header"}
+	}
+	for _, v := range values[1:] {
+		mt, _, err := mime.ParseMediaType(v)
+		if err != nil || mt != first {
+			return &requestError{msg: "conflicting Content-Type headers"}
+		}
+	}
+	return nil
+}
+
+// decodeJSON decodes exactly one JSON value from body into v, translating
+// decoder errors into messages that name the offending field or position.
+// Fields v does not have are rejected, as /openapi.json says, so a
+// misspelt field is not silently ignored.
+func decodeJSON(body []byte, v any) *requestError {
+	return decodeJSONStrict(body, v, true)
+}
+
+// decodePeerJSON is decodeJSON for bodies from peer regions, which may run
+// a newer version: fields v does not have are ignored.
+func decodePeerJSON(body []byte, v any) *requestError {
+	return decodeJSONStrict(body, v, false)
+}
+
+func decodeJSONStrict(body []byte, v any, strict bool) *requestError {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	if strict {
+		dec.DisallowUnknownFields()
+	}
+	if err := dec.Decode(v); err != nil {
+		return describeJSONError(body, err)
+	}
+
+	// Reject trailing garbage such as a second object
+	var extra json.RawMessage
+	if err := dec.Decode(&extra); err != io.EOF {
+		offset := dec.InputOffset()
+		line, col := position(body, offset)
+		return &requestError{
+			msg:    "unexpected data after JSON value",
+			detail: &ErrorDetail{Offset: offset, Line: line, Column: col},
+		}
+	}
+	return nil
+}
+
+func describeJSONError(body []byte, err error) *requestError {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+
+	switch {
+	case errors.Is(err, io.EOF):
+		return &requestError{msg: "request body is empty"}
+
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		offset := int64(len(body))
+		line, col := position(body, offset)
+		return &requestError{
+			msg:    "unexpected end of JSON input",
+			detail: &ErrorDetail{Offset: offset, Line: line, Column: col},
+		}
+
+	case errors.As(err, &syntaxErr):
+		line, col := position(body, syntaxErr.Offset)
+		return &requestError{
+			msg:    fmt.Sprintf("malformed JSON at line %d, column %d: %s", line, col, syntaxErr.Error()),
+			detail: &ErrorDetail{Offset: syntaxErr.Offset, Line: line, Column: col},
+		}
+
+	case errors.As(err, &typeErr):
+		line, col := position(body, typeErr.Offset)
+		field := typeErr.Field
+		if field == "" {
+			return &requestError{
+				msg:    fmt.Sprintf("request body must be a JSON %s, got %s", jsonKind(typeErr.Type), typeErr.Value),
+				detail: &ErrorDetail{Offset: typeErr.Offset, Line: line, Column: col, Got: typeErr.Value},
+			}
+		}
+		return &requestError{
+			msg: fmt.Sprintf("field %q must be a %s, got %s", field, jsonKind(typeErr.Type), typeErr.Value),
+			detail: &ErrorDetail{
+				Field:    field,
+				Offset:   typeErr.Offset,
+				Line:     line,
+				Column:   col,
+				Expected: jsonKind(typeErr.Type),
+				Got:      typeErr.Value,
+			},
+		}
+	}
+
+	// The decoder has no error type for unknown fields
+	if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		field, _ = strconv.Unquote(field)
+		return &requestError{
+			msg:    fmt.Sprintf("unknown field %q", field),
+			detail: &ErrorDetail{Field: field},
+		}
+	}
+	return &requestError{msg: "invalid json: " + err.Error()}
+}
+
+// jsonKind names a Go type the way a JSON client would think of it.
+func jsonKind(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Struct, reflect.Map:
+		return "object"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "number"
+	}
+	return t.String()
+}
+
+// position converts a byte offset into a 1-based line and column.
+func position(body []byte, offset int64) (line, col int) {
+	if offset > int64(len(body)) {
+		offset = int64(len(body))
+	}
+	line, col = 1, 1
+	for _, b := range body[:offset] {
+		if b == '\n' {
+			line++
+			col = 1
+		} else {
+			col++
+		}
+	}
+	return line, col
+}
@@ -0,0 +1,276 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Level is a rung of the degradation ladder. Each rung keeps the
+// restrictions of the ones above it:
+//
+//	Healthy      everything is served
+//	Shedding     scans (listings, range reads, counts, multi-gets,
+//	             batches, history reads) get 503 and refresh-ahead pauses,
+//	             keeping capacity for single-key traffic
+//	CacheOnly    single-key reads are served from the cache only; a miss
+//	             gets 503 instead of a database read
+//	ReadOnly     writes get 503 and the expiry sweeper pauses
+//	Unavailable  every /kv request gets 503 and /readyz fails, so load
+//	             balancers route around the instance
+//
+// Admin, health and watch routes are served on every rung, so operators
+// can see what is going on.
+type Level int32
+
+const (
+	Healthy Level = iota
+	Shedding
+	CacheOnly
+	ReadOnly
+	Unavailable
+)
+
+var levelNames = [...]string{"healthy", "shedding", "cache-only", "read-only", "unavailable"}
+
+func (l Level) String() string {
+	if l < 0 || int(l) >= len(levelNames) {
+		return "unknown"
+	}
+	return levelNames[l]
+}
+
+func (l Level) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+// requestClass groups /kv requests by what a rung turns away.
+type requestClass int
+
+const (
+	classRead requestClass = iota
+	classScan
+	classWrite
+)
+
+func (l Level) allows(c requestClass) bool {
+	switch c {
+	case classScan:
+		return l < Shedding
+	case classWrite:
+		return l < ReadOnly
+	}
+	return l < Unavailable
+}
+
+// errCacheOnly fails a read that missed the cache while reads may not go
+// to the database.
+var errCacheOnly = errors.New("degraded: cache-only reads")
+
+// DegradationConfig sets the thresholds that move the server down the
+// ladder. A zero threshold never triggers its rung.
+type DegradationConfig struct {
+	// ShedInFlight is the number of /kv requests in flight at which the
+	// server starts shedding.
+	ShedInFlight int64
+	// DBWaits is the number of waits for a pooled database connection per
+	// evaluation at which reads go cache-only.
+	DBWaits int64
+	// UnavailableAfter is how long the database may be down, during which
+	// the server is read-only, before it becomes unavailable.
+	UnavailableAfter time.Duration
+	// RecoverAfter is how long conditions must stay better before the
+	// server climbs back one rung. Degrading is immediate.
+	RecoverAfter time.Duration
+}
+
+// ladder is the server's current rung and the signals that set it.
+type ladder struct {
+	level       atomic.Int32
+	inFlight    atomic.Int64
+	transitions atomic.Uint64
+
+	mu      sync.Mutex
+	running bool
+	since   time.Time
+	reasons []string
+	better  time.Time // when conditions first allowed a higher rung
+	dbWaits int64     // pool wait count at the last evaluation
+	sampled bool
+}
+
+// DegradationStatus reports the current rung and why the server is on it.
+type DegradationStatus struct {
+	Level       Level     `json:"level"`
+	Since       time.Time `json:"since"`
+	Reasons     []string  `json:"reasons,omitempty"`
+	Transitions uint64    `json:"transitions"`
+	InFlight    int64     `json:"in_flight"`
+}
+
+// Level returns the server's current rung.
+func (s *KVServer) Level() Level {
+	return Level(s.ladder.level.Load())
+}
+
+// degradationRunning reports whether StartDegradation was called.
+func (s *KVServer) degradationRunning() bool {
+	s.ladder.mu.Lock()
+	defer s.ladder.mu.Unlock()
+	return s.ladder.running
+}
+
+// Degradation returns the current rung with its reasons.
+func (s *KVServer) Degradation() DegradationStatus {
+	s.ladder.mu.Lock()
+	defer s.ladder.mu.Unlock()
+	return DegradationStatus{
+		Level:       s.Level(),
+		Since:       s.ladder.since,
+		Reasons:     append([]string(nil), s.ladder.reasons...),
+		Transitions: s.ladder.transitions.Load(),
+		InFlight:    s.ladder.inFlight.Load(),
+	}
+}
+
+// StartDegradation evaluates the ladder every interval from the in-flight
+// request count and, with a health monitor attached, database health and
+// connection pool waits. Without it the server stays Healthy. The returned
+// function stops the evaluations.
+func (s *KVServer) StartDegradation(cfg DegradationConfig, interval time.Duration) (stop func()) {
+	s.ladder.mu.Lock()
+	s.ladder.running = true
+	s.ladder.since = time.Now()
+	s.ladder.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				s.evaluateDegradation(cfg)
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// evaluateDegradation moves the server to the rung its signals call for,
+// climbing back only one rung per RecoverAfter.
+func (s *KVServer) evaluateDegradation(cfg DegradationConfig) {
+	l := &s.ladder
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	target, reasons := s.degradationTarget(cfg)
+
+	now := time.Now()
+	current := s.Level()
+	switch {
+	case target > current:
+		l.better = time.Time{}
+	case target < current:
+		if l.better.IsZero() {
+			l.better = now
+		}
+		if now.Sub(l.better) < cfg.RecoverAfter {
+			return
+		}
+		target = current - 1
+		l.better = now
+	default:
+		l.better = time.Time{}
+		l.reasons = reasons
+		return
+	}
+
+	l.level.Store(int32(target))
+	l.transitions.Add(1)
+	l.since = now
+	l.reasons = reasons
+	if len(reasons) == 0 {
+		log.Printf("Degradation level %s -> %s", current, target)
+		return
+	}
+	log.Printf("Degradation level %s -> %s (%s)", current, target, strings.Join(reasons, "; "))
+}
+
+// degradationTarget returns the rung the current signals call for. The
+// caller holds s.ladder.mu.
+func (s *KVServer) degradationTarget(cfg DegradationConfig) (Level, []string) {
+	target := Healthy
+	var reasons []string
+	raise := func(l Level, reason string) {
+		target = max(target, l)
+		reasons = append(reasons, reason)
+	}
+
+	if n := s.ladder.inFlight.Load(); cfg.ShedInFlight > 0 && n >= cfg.ShedInFlight {
+		raise(Shedding, "in-flight requests at "+strconv.FormatInt(n, 10))
+	}
+
+	if s.health != nil {
+		status := s.health.Status()
+		waits := status.WaitCount - s.ladder.dbWaits
+		if !s.ladder.sampled {
+			waits = 0
+		}
+		s.ladder.dbWaits, s.ladder.sampled = status.WaitCount, true
+		if cfg.DBWaits > 0 && waits >= cfg.DBWaits {
+			raise(CacheOnly, "database pool waits at "+strconv.FormatInt(waits, 10))
+		}
+		if !status.Healthy {
+			down := time.Since(status.Since)
+			if cfg.UnavailableAfter > 0 && down >= cfg.UnavailableAfter {
+				raise(Unavailable, "database down for "+down.Round(time.Second).String())
+			} else {
+				raise(ReadOnly, "database down")
+			}
+		}
+	}
+	return target, reasons
+}
+
+// admit answers 503 with a Retry-After for a request the current rung
+// turns away and returns false; it returns true if the request may go
+// ahead.
+func (s *KVServer) admit(w http.ResponseWriter, c requestClass) bool {
+	if level := s.Level(); !level.allows(c) {
+		s.sendDegraded(w, level)
+		return false
+	}
+	return true
+}
+
+func (s *KVServer) sendDegraded(w http.ResponseWriter, level Level) {
+	w.Header().Set("Retry-After", "1")
+	s.sendError(w, "degraded: "+level.String(), http.StatusServiceUnavailable)
+}
+
+// kvClass classifies a /kv request by method and path below the namespace;
+// root is set for the path naming the namespace (or /kv) itself.
+func kvClass(method, path string, root bool, rawQuery string) requestClass {
+	switch method {
+	case http.MethodGet, http.MethodHead:
+		if root || path == "multi" || path == "range" || path == "count" || strings.Contains(rawQuery, "at_revision=") || strings.Contains(rawQuery, "at_time=") ||
+			strings.Contains(rawQuery, "version=") || strings.HasSuffix(path, "/history") {
+			return classScan
+		}
+		return classRead
+	case http.MethodPost:
+		if path == "multi" || path == "batch" {
+			return classScan
+		}
+	}
+	return classWrite
+}
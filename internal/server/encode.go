@@ -0,0 +1,116 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"unicode/utf8"
+)
+
+// Hot-path allocation budget: a cache-hit GET /kv/{key} allocates nothing in
+// the handler itself (routing, headers and response encoding included); the
+// only allocations left are net/http's own per-request ones. The budget is
+// checked by TestHotPathAllocs in alloc_test.go.
+
+// contentTypeJSON is shared by every response; assigning it directly avoids
+// the canonicalization and slice allocation of Header().Set.
+var contentTypeJSON = []string{"application/json"}
+
+var bufferPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, 0, 4096)
+		return &b
+	},
+}
+
+// writeResponse encodes a Response without reflection, using a pooled buffer.
+// The output matches json.Encoder's, trailing newline included.
+func writeResponse(w http.ResponseWriter, status int, success bool, value string, version uint64, errMsg, requestID string) {
+	bp := bufferPool.Get().(*[]byte)
+	buf := appendResponse((*bp)[:0], success, value, version, errMsg, requestID)
+
+	w.WriteHeader(status)
+	w.Write(buf)
+
+	*bp = buf
+	bufferPool.Put(bp)
+}
+
+// appendResponse appends the JSON encoding of
+// Response{success, value, version, errMsg, requestID}.
+func appendResponse(dst []byte, success bool, value string, version uint64, errMsg, requestID string) []byte {
+	if success {
+		dst = append(dst, `{"success":true`...)
+	} else {
+		dst = append(dst, `{"success":false`...)
+	}
+	if value != "" {
+		dst = append(dst, `,"value":`...)
+		dst = appendJSONString(dst, value)
+	}
+	if version != 0 {
+		dst = append(dst, `,"version":`...)
+		dst = strconv.AppendUint(dst, version, 10)
+	}
+	if errMsg != "" {
+		dst = append(dst, `,"error":`...)
+		dst = appendJSONString(dst, errMsg)
+	}
+	if requestID != "" {
+		dst = append(dst, `,"request_id":`...)
+		dst = appendJSONString(dst, requestID)
+	}
+	return append(dst, "}\n"...)
+}
+
+const hexDigits = "0123456789abcdef"
+
+// appendJSONString appends s as a quoted JSON string, escaping exactly like
+// encoding/json (HTML-safe, invalid UTF-8 replaced by U+FFFD).
+func appendJSONString(dst []byte, s string) []byte {
+	dst = append(dst, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		if b := s[i]; b < utf8.RuneSelf {
+			if b >= 0x20 && b != '"' && b != '\\' && b != '<' && b != '>' && b != '&' {
+				i++
+				continue
+			}
+			dst = append(dst, s[start:i]...)
+			switch b {
+			case '"', '\\':
+				dst = append(dst, '\\', b)
+			case '\n':
+				dst = append(dst, '\\', 'n')
+			case '\r':
+				dst = append(dst, '\\', 'r')
+			case '\t':
+				dst = append(dst, '\\', 't')
+			default:
+				dst = append(dst, '\\', 'u', '0', '0', hexDigits[b>>4], hexDigits[b&0xF])
+			}
+			i++
+			start = i
+			continue
+		}
+
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			dst = append(dst, s[start:i]...)
+			dst = append(dst, "\ufffd"...)
+			i += size
+			start = i
+			continue
+		}
+		if r == '\u2028' || r == '\u2029' {
+			dst = append(dst, s[start:i]...)
+			dst = append(dst, '\\', 'u', '2', '0', '2', hexDigits[r&0xF])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	dst = append(dst, s[start:]...)
+	return append(dst, '"')
+}
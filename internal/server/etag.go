@@ -0,0 +1,88 @@
+package server
+
+import (
+	"kv-server/internal/cache"
+	"kv-server/internal/fasthash"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// A value's ETag is its revision, quoted, so it can be sent back in
+// If-Match as it is. A value cached without a revision gets a weak tag made
+// from its CRC-32C instead, which If-None-Match still matches but If-Match
+// does not take.
+const etagSlots = 4096
+
+// etagTable interns ETags so serving them does not allocate while a hot
+// key keeps its revision. It is direct-mapped; a collision only costs an
+// allocation.
+type etagTable [etagSlots]atomic.Pointer[etag]
+
+type etag struct {
+	n    uint64
+	weak bool
+	// tag is the header value; header holds it for assigning to a
+	// header map directly
+	tag    string
+	header []string
+}
+
+var etags etagTable
+
+// valueETag returns the ETag of v.
+func valueETag(v cache.Versioned[string]) *etag {
+	if v.Revision != 0 {
+		return etags.get(v.Revision, false)
+	}
+	return etags.get(uint64(fasthash.Checksum(v.Value)), true)
+}
+
+func (t *etagTable) get(n uint64, weak bool) *etag {
+	slot := &t[n%etagSlots]
+	if e := slot.Load(); e != nil && e.n == n && e.weak == weak {
+		return e
+	}
+	var tag string
+	if weak {
+		tag = `W/"crc32c-` + strconv.FormatUint(n, 16) + `"`
+	} else {
+		tag = `"` + strconv.FormatUint(n, 10) + `"`
+	}
+	e := &etag{n: n, weak: weak, tag: tag, header: []string{tag}}
+	slot.Store(e)
+	return e
+}
+
+// matchesNoneOf reports whether an If-None-Match value is "*" or lists the
+// tag. Comparison is weak, as RFC 9110 has it for If-None-Match.
+func (e *etag) matchesNoneOf(header string) bool {
+	for header != "" {
+		var tag string
+		tag, header, _ = strings.Cut(header, ",")
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || weakTag(tag) == weakTag(e.tag) {
+			return true
+		}
+	}
+	return false
+}
+
+func weakTag(tag string) string {
+	return strings.TrimPrefix(tag, "W/")
+}
+
+// notModified sets the ETag of v and, if r's If-None-Match matches it,
+// answers 304 and returns true.
+func (s *KVServer) notModified(w http.ResponseWriter, r *http.Request, v cache.Versioned[string]) bool {
+	e := valueETag(v)
+	w.Header()["Etag"] = e.header
+	inm := r.Header["If-None-Match"]
+	if len(inm) == 0 || !e.matchesNoneOf(strings.Join(inm, ",")) {
+		return false
+	}
+	s.stats.notModified.Add(1)
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
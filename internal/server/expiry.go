@@ -0,0 +1,62 @@
+package server
+
+import (
+	"context"
+	"kv-server/internal/watch"
+	"log"
+	"time"
+)
+
+// expirySweepBatch bounds the rows one sweep statement deletes.
+const expirySweepBatch = 1000
+
+// StartExpirySweeper deletes keys past their ttl_seconds from the database
+// every interval. Reads already treat them as missing; sweeping reclaims the
+// rows and tells watchers with an "expire" event. It also deletes the rows
+// of expired lock leases. Outside the maintenance
+// windows a sweep deletes one batch, or none. With soft delete on, it
+// purges old tombstones too, and with -history-versions old versions. The
+// returned function stops the sweeper.
+func (s *KVServer) StartExpirySweeper(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				pace := s.maintenancePace()
+				if s.Level() >= ReadOnly || s.readOnly.on.Load() || pace == pacePaused {
+					continue
+				}
+				s.sweepExpired(pace)
+				s.purgeExpiredLocks()
+				s.purgeTombstones(pace)
+				s.pruneHistory(pace)
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+func (s *KVServer) sweepExpired(pace maintenancePace) {
+	for {
+		keys, err := s.db.DeleteExpired(context.Background(), expirySweepBatch)
+		if err != nil {
+			log.Printf("Expiry sweep failed: %v", err)
+			return
+		}
+		for _, key := range keys {
+			s.cache.Delete(key)
+			s.forgetEncoded(key)
+			s.publish(watch.Expire, key, "", 0)
+		}
+		s.stats.expired.Add(uint64(len(keys)))
+		if len(keys) < expirySweepBatch || pace == paceThrottled {
+			return
+		}
+	}
+}
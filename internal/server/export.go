@@ -0,0 +1,75 @@
+package server
+
+import (
+	"encoding/json"
+	"kv-server/internal/database"
+	"log"
+	"net/http"
+	"time"
+)
+
+// exportRecord is one line of an export: a key with what restoring it
+// needs besides its value.
+type exportRecord struct {
+	Namespace   string     `json:"namespace,omitempty"`
+	Key         string     `json:"key"`
+	Value       string     `json:"value"`
+	ContentType string     `json:"content_type,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+}
+
+// handleExport serves GET /admin/export, streaming every live key as one
+// exportRecord per line, in namespace and key order. ?prefix= limits it to
+// keys starting with the prefix, and ?namespace= to one namespace; with
+// namespaces on, an export without ?namespace= spans them all.
+//
+// The export runs for as long as it takes, past the write and request
+// timeouts, until the client goes away. Errors after the first line can
+// only be signalled by cutting the stream short, so the response then
+// ends without its final chunk.
+func (s *KVServer) handleExport(w http.ResponseWriter, r *http.Request) {
+	exporter, ok := s.db.(database.Exporter)
+	if !ok {
+		s.sendError(w, "export not supported by this backend", http.StatusNotImplemented)
+		return
+	}
+
+	query := r.URL.Query()
+	scope := database.ExportScope{
+		Prefix:        database.QualifyKey(query.Get("namespace"), query.Get("prefix")),
+		AllNamespaces: s.namespaces && !query.Has("namespace"),
+	}
+
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "application/x-ndjson")
+
+	enc := json.NewEncoder(w)
+	exported := 0
+	err := exporter.Export(streamContext(w, r), scope, func(kv database.KeyValue) error {
+		if exported == 0 {
+			w.WriteHeader(http.StatusOK)
+		}
+		exported++
+		return enc.Encode(newExportRecord(kv))
+	})
+	switch {
+	case err == nil && exported == 0:
+		w.WriteHeader(http.StatusOK)
+	case err != nil && exported == 0:
+		log.Printf("Export of %q failed: %v", scope.Prefix, err)
+		w.Header()["Content-Type"] = contentTypeJSON
+		s.sendError(w, "database error", http.StatusInternalServerError)
+	case err != nil:
+		log.Printf("Export of %q failed after %d keys: %v", scope.Prefix, exported, err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func newExportRecord(kv database.KeyValue) exportRecord {
+	ns, key := database.SplitKey(kv.Key)
+	rec := exportRecord{Namespace: ns, Key: key, Value: kv.Value, ContentType: kv.ContentType}
+	if !kv.ExpiresAt.IsZero() {
+		rec.ExpiresAt = &kv.ExpiresAt
+	}
+	return rec
+}
@@ -0,0 +1,534 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"kv-server/internal/database"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const fastIdleTimeout = 90 * time.Second
+
+var (
+	errFastBadRequest = errors.New("malformed request")
+	errFastTooLarge   = errors.New("request body too large")
+)
+
+// fastRequest is the subset of an HTTP/1.1 request the fast path understands.
+type fastRequest struct {
+	method      string
+	path        string
+	ifMatch     string
+	ifNoneMatch string
+	consistency string
+	cacheFill   string
+	fence       string
+	contentType string
+	accept      string
+	apiKey      string
+	// The Authorization header, for bearer tokens
+	authorization string
+	remoteAddr    string
+	body          []byte
+	keepAlive     bool
+	// The body has a Content-Encoding other than identity
+	encoded bool
+
+	// The client's X-Request-ID, or one made on first use; empty until then
+	id  string
+	ctx requestContext
+
+	// The Allow header of a 405
+	allow string
+	// The ETag of a 200 or 304 read
+	etag string
+	// The key a create carried in its body, for the audit log
+	auditKey string
+}
+
+// requestID returns the request's ID, making one if the client sent none.
+func (req *fastRequest) requestID() string {
+	if req.id == "" {
+		req.id = newRequestID()
+	}
+	return req.id
+}
+
+// ServeFast serves the /kv hot routes (GET, PUT and DELETE /kv/{key}, POST /kv)
+// on ln with a minimal HTTP/1.1 implementation that skips net/http's
+// per-request machinery. It supports keep-alive and Content-Length bodies
+// only; everything else (admin, health, chunked bodies) belongs on the
+// standard listener.
+func (s *KVServer) ServeFast(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go s.serveFastConn(conn)
+	}
+}
+
+func (s *KVServer) serveFastConn(conn net.Conn) {
+	defer conn.Close()
+
+	br := bufio.NewReaderSize(conn, 8<<10)
+	bw := bufio.NewWriterSize(conn, 8<<10)
+	out := make([]byte, 0, 4096)
+	remoteAddr := conn.RemoteAddr().String()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(fastIdleTimeout))
+
+		req, err := readFastRequest(br, s.maxBody)
+		if err != nil {
+			switch {
+			case errors.Is(err, errFastBadRequest):
+				id := newRequestID()
+				writeFastResponse(bw, 400, errorBody(out, "bad request", id), false, "", "", id)
+				bw.Flush()
+			case errors.Is(err, errFastTooLarge):
+				// The body is not read, so the connection cannot be reused
+				id := newRequestID()
+				writeFastResponse(bw, 413, errorBody(out, bodyTooLarge(s.maxBody), id), false, "", "", id)
+				bw.Flush()
+			}
+			return
+		}
+
+		req.remoteAddr = remoteAddr
+		start := time.Now()
+		req.ctx.reset(context.Background(), s.requestTimeout, start)
+		status, body := s.dispatchFast(req, out)
+		if status >= 400 && req.ctx.timedOut() {
+			s.stats.timedOut.Add(1)
+			status, body = 504, errorBody(body[:0], errRequestTimeout, req.requestID())
+		}
+		req.ctx.finish()
+		s.metrics.observe(req.method, status, time.Since(start))
+		if s.accessLog != nil {
+			s.logFast(req, status, len(body), start)
+		}
+		if s.audit != nil && audited(req.method) {
+			s.auditFast(req, status, start)
+		}
+		header := ""
+		switch status {
+		case 405:
+			header = "Allow: " + req.allow
+		case 429:
+			header = "Retry-After: " + s.limiter.retryAfter
+		case 503:
+			header = "Retry-After: 1"
+		}
+		writeFastResponse(bw, status, body, req.keepAlive, header, req.etag, req.id)
+		out = body[:0]
+
+		// Only flush once no pipelined request is waiting
+		if br.Buffered() == 0 {
+			if err := bw.Flush(); err != nil {
+				return
+			}
+		}
+		if !req.keepAlive {
+			bw.Flush()
+			return
+		}
+	}
+}
+
+// dispatchFast returns the status and the response body, appended to out.
+func (s *KVServer) dispatchFast(req *fastRequest, out []byte) (int, []byte) {
+	path, query, _ := strings.Cut(req.path, "?")
+	ctx := &req.ctx
+	scope, perms, ok := s.authenticate(ctx, req.apiKey, req.authorization)
+	if !ok {
+		return 401, errorBody(out, s.unauthorized(req.authorization), req.requestID())
+	}
+	if s.limiter != nil && !s.limiter.allow(s.rateLimitClient(s.credential(req.apiKey, req.authorization), req.remoteAddr)) {
+		s.stats.rateLimited.Add(1)
+		return 429, errorBody(out, errRateLimited, req.requestID())
+	}
+	if s.shedder != nil {
+		if !s.enterLoad() {
+			return 503, errorBody(out, errOverloaded, req.requestID())
+		}
+		defer s.shedder.leave()
+	}
+	if s.workers != nil {
+		if !s.workers.acquire() {
+			return 503, errorBody(out, errOverloaded, req.requestID())
+		}
+		defer s.workers.release()
+	}
+	s.stats.requests.Add(1)
+	defer s.stats.observe(time.Now())
+	s.ladder.inFlight.Add(1)
+	defer s.ladder.inFlight.Add(-1)
+
+	// Namespaced paths are served as /kv/{key} within the namespace
+	var ns string
+	if s.namespaces && strings.HasPrefix(path, "/kv") {
+		var rest string
+		var ok bool
+		if ns, rest, ok = splitNamespace(path); !ok {
+			return 400, errorBody(out, errInvalidNamespace, req.requestID())
+		}
+		path = "/kv/" + rest
+	}
+	if !inScope(scope, ns) {
+		return 403, errorBody(out, errForbiddenScope, req.requestID())
+	}
+
+	if path != "/kv" && !strings.HasPrefix(path, "/kv/") {
+		return 404, errorBody(out, "not found", req.requestID())
+	}
+	rest := strings.TrimPrefix(strings.TrimPrefix(path, "/kv"), "/")
+	op, allow := kvRoute(req.method, rest)
+	if op == opNone {
+		req.allow = allow
+		return 405, errorBody(out, errMethodNotAllowed, req.requestID())
+	}
+	need := opPermission(op)
+	if perms&need != need {
+		return 403, errorBody(out, forbiddenPermission(need), req.requestID())
+	}
+
+	if level := s.Level(); level != Healthy {
+		if !level.allows(kvClass(req.method, rest, rest == "", query)) {
+			return 503, errorBody(out, "degraded: "+level.String(), req.requestID())
+		}
+	}
+	if need == permWrite && !s.writable() {
+		return 503, errorBody(out, errReadOnly, req.requestID())
+	}
+
+	if req.encoded {
+		return 415, errorBody(out, "compressed bodies are not served on the fast path", req.requestID())
+	}
+	fill, ok := cacheFill(req.cacheFill, query)
+	if !ok {
+		return 400, errorBody(out, errInvalidCacheFill, req.requestID())
+	}
+	ctx.skipCache = !fill
+
+	switch op {
+	case opCreate:
+		var r Request
+		if reqErr := decodeJSON(req.body, &r); reqErr != nil {
+			return 400, errorBody(out, reqErr.msg, req.requestID())
+		}
+		if r.Key == "" {
+			return 400, errorBody(out, "key is required", req.requestID())
+		}
+		key := database.QualifyKey(ns, r.Key)
+		if s.audit != nil {
+			req.auditKey = pathKey(key)
+		}
+		if _, blocked := s.quarantine.blocked(key); blocked {
+			return 503, errorBody(out, "key quarantined", req.requestID())
+		}
+		expiresAt, ok := r.expiry()
+		if !ok {
+			return 400, errorBody(out, errInvalidTTL, req.requestID())
+		}
+		if reqErr := s.schemaError(key, r.Value); reqErr != nil {
+			return 422, errorBody(out, reqErr.msg, req.requestID())
+		}
+		if status, msg := s.quotaError(ctx, key, len(r.Value)); status != 0 {
+			return status, errorBody(out, msg, req.requestID())
+		}
+		revision, err := s.create(ctx, key, r.Value, "", expiresAt)
+		if err != nil {
+			if errors.Is(err, database.ErrExists) {
+				return 409, errorBody(out, "key already exists", req.requestID())
+			}
+			return 500, errorBody(out, "database error", req.requestID())
+		}
+		return 201, successBody(out, "", revision)
+
+	case opRead, opWrite, opDelete:
+		name, err := url.PathUnescape(rest)
+		if err != nil || name == "" {
+			return 400, errorBody(out, "key is required", req.requestID())
+		}
+		key := database.QualifyKey(ns, name)
+		if _, blocked := s.quarantine.blocked(key); blocked {
+			return 503, errorBody(out, "key quarantined", req.requestID())
+		}
+		switch op {
+		case opRead:
+			if strings.Contains(query, "at_revision=") || strings.Contains(query, "at_time=") || strings.Contains(query, "version=") {
+				return 400, errorBody(out, "time-travel reads are not served on the fast path", req.requestID())
+			}
+			strong, ok := strongConsistency(req.consistency, query)
+			if !ok {
+				return 400, errorBody(out, errInvalidConsistency, req.requestID())
+			}
+			v, err := s.readConsistent(ctx, key, strong)
+			if errors.Is(err, errCacheOnly) {
+				return 503, errorBody(out, "degraded: "+s.Level().String(), req.requestID())
+			}
+			if err != nil {
+				return 404, errorBody(out, "key not found", req.requestID())
+			}
+			e := valueETag(v)
+			req.etag = e.tag
+			if req.ifNoneMatch != "" && e.matchesNoneOf(req.ifNoneMatch) {
+				s.stats.notModified.Add(1)
+				return 304, out[:0]
+			}
+			if acceptsRaw(req.accept, v.ContentType) {
+				req.etag = ""
+				return 406, errorBody(out, "raw values are not served on the fast path", req.requestID())
+			}
+			// out is reused for the next response, so copy the shared body
+			if body := s.encodedSuccess(key, v); body != nil {
+				return 200, append(out[:0], body...)
+			}
+			return 200, successBody(out, v.Value, v.Revision)
+		case opWrite:
+			if isRawType(req.contentType) {
+				return 415, errorBody(out, "raw values are not served on the fast path", req.requestID())
+			}
+			var r Request
+			if reqErr := decodeJSON(req.body, &r); reqErr != nil {
+				return 400, errorBody(out, reqErr.msg, req.requestID())
+			}
+			if r.Key != "" && r.Key != name {
+				return 400, errorBody(out, "key in body does not match path", req.requestID())
+			}
+			expiresAt, ok := r.expiry()
+			if !ok {
+				return 400, errorBody(out, errInvalidTTL, req.requestID())
+			}
+			if reqErr := s.schemaError(key, r.Value); reqErr != nil {
+				return 422, errorBody(out, reqErr.msg, req.requestID())
+			}
+			if status, msg := s.quotaError(ctx, key, len(r.Value)); status != 0 {
+				return status, errorBody(out, msg, req.requestID())
+			}
+			var revision uint64
+			switch {
+			case req.ifMatch != "" && req.fence != "":
+				return 400, errorBody(out, "If-Match and "+fencingTokenHeader+" cannot be combined", req.requestID())
+			case req.ifMatch != "":
+				expected, perr := parseVersion(req.ifMatch)
+				if perr != nil {
+					return 400, errorBody(out, "invalid If-Match version", req.requestID())
+				}
+				revision, err = s.update(ctx, key, r.Value, "", expiresAt, expected)
+			case req.fence != "":
+				token, perr := parseFencingToken(req.fence)
+				if perr != nil {
+					return 400, errorBody(out, "invalid "+fencingTokenHeader, req.requestID())
+				}
+				revision, err = s.fenced(ctx, key, r.Value, "", expiresAt, token)
+			default:
+				revision, err = s.write(ctx, key, r.Value, "", expiresAt)
+			}
+			if err != nil {
+				status, msg := updateError(err)
+				return status, errorBody(out, msg, req.requestID())
+			}
+			return 200, successBody(out, "", revision)
+		default:
+			if err := s.remove(ctx, key); err != nil {
+				return 404, errorBody(out, "key not found", req.requestID())
+			}
+			return 200, successBody(out, "", 0)
+		}
+	}
+
+	// Lists, counters, HEAD and the multi-key operations need the
+	// standard port
+	return 501, errorBody(out, "not served on the fast path", req.requestID())
+}
+
+// readFastRequest parses one request. io.EOF means the peer closed cleanly.
+func readFastRequest(br *bufio.Reader, maxBody int64) (*fastRequest, error) {
+	line, err := readLine(br)
+	if err != nil {
+		return nil, err
+	}
+
+	method, rest, ok1 := strings.Cut(line, " ")
+	path, proto, ok2 := strings.Cut(rest, " ")
+	if !ok1 || !ok2 || !strings.HasPrefix(proto, "HTTP/1.") {
+		return nil, errFastBadRequest
+	}
+
+	req := &fastRequest{method: method, path: path, keepAlive: proto == "HTTP/1.1"}
+	req.ctx = requestContext{Context: context.Background(), ids: req}
+	contentLength := 0
+
+	for {
+		line, err := readLine(br)
+		if err != nil {
+			return nil, err
+		}
+		if line == "" {
+			break
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, errFastBadRequest
+		}
+		value = strings.TrimSpace(value)
+
+		switch {
+		case strings.EqualFold(name, "Content-Length"):
+			contentLength, err = strconv.Atoi(value)
+			if err != nil || contentLength < 0 {
+				return nil, errFastBadRequest
+			}
+			if int64(contentLength) > maxBody {
+				return nil, errFastTooLarge
+			}
+		case strings.EqualFold(name, "Transfer-Encoding"):
+			// Chunked bodies are not supported on the fast path
+			return nil, errFastBadRequest
+		case strings.EqualFold(name, "If-Match"):
+			req.ifMatch = value
+		case strings.EqualFold(name, "If-None-Match"):
+			req.ifNoneMatch = value
+		case strings.EqualFold(name, consistencyHeader):
+			req.consistency = value
+		case strings.EqualFold(name, cacheFillHeader):
+			req.cacheFill = value
+		case strings.EqualFold(name, fencingTokenHeader):
+			req.fence = value
+		case strings.EqualFold(name, "Content-Encoding"):
+			req.encoded = !strings.EqualFold(value, "identity")
+		case strings.EqualFold(name, "Content-Type"):
+			req.contentType = value
+		case strings.EqualFold(name, "Accept"):
+			req.accept = value
+		case strings.EqualFold(name, apiKeyHeader):
+			req.apiKey = value
+		case strings.EqualFold(name, "Authorization"):
+			req.authorization = value
+		case strings.EqualFold(name, requestIDHeader):
+			if validRequestID(value) {
+				req.id = value
+			}
+		case strings.EqualFold(name, "Connection"):
+			if strings.EqualFold(value, "close") {
+				req.keepAlive = false
+			} else if strings.EqualFold(value, "keep-alive") {
+				req.keepAlive = true
+			}
+		}
+	}
+
+	if contentLength > 0 {
+		req.body = make([]byte, contentLength)
+		if _, err := io.ReadFull(br, req.body); err != nil {
+			return nil, err
+		}
+	}
+	return req, nil
+}
+
+func readLine(br *bufio.Reader) (string, error) {
+	line, err := br.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return "", errFastBadRequest
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+// writeFastResponse writes a response with body. header is an extra header
+// line such as "Retry-After: 1"; an empty header or requestID is left out.
+func writeFastResponse(bw *bufio.Writer, status int, body []byte, keepAlive bool, header, etag, requestID string) {
+	bw.WriteString("HTTP/1.1 ")
+	bw.WriteString(strconv.Itoa(status))
+	bw.WriteByte(' ')
+	bw.WriteString(statusText(status))
+	// A 304 has no body to describe
+	if status != 304 {
+		bw.WriteString("\r\nContent-Type: application/json\r\nContent-Length: ")
+		bw.WriteString(strconv.Itoa(len(body)))
+	}
+	if etag != "" {
+		bw.WriteString("\r\nETag: ")
+		bw.WriteString(etag)
+	}
+	if header != "" {
+		bw.WriteString("\r\n")
+		bw.WriteString(header)
+	}
+	if requestID != "" {
+		bw.WriteString("\r\nX-Request-ID: ")
+		bw.WriteString(requestID)
+	}
+	if !keepAlive {
+		bw.WriteString("\r\nConnection: close")
+	}
+	bw.WriteString("\r\n\r\n")
+	bw.Write(body)
+}
+
+func statusText(status int) string {
+	switch status {
+	case 200:
+		return "OK"
+	case 201:
+		return "Created"
+	case 304:
+		return "Not Modified"
+	case 400:
+		return "Bad Request"
+	case 401:
+		return "Unauthorized"
+	case 403:
+		return "Forbidden"
+	case 404:
+		return "Not Found"
+	case 405:
+		return "Method Not Allowed"
+	case 406:
+		return "Not Acceptable"
+	case 409:
+		return "Conflict"
+	case 412:
+		return "Precondition Failed"
+	case 413:
+		return "Request Entity Too Large"
+	case 415:
+		return "Unsupported Media Type"
+	case 422:
+		return "Unprocessable Entity"
+	case 429:
+		return "Too Many Requests"
+	case 501:
+		return "Not Implemented"
+	case 503:
+		return "Service Unavailable"
+	case 504:
+		return "Gateway Timeout"
+	}
+	return "Internal Server Error"
+}
+
+func successBody(out []byte, value string, version uint64) []byte {
+	return appendResponse(out[:0], true, value, version, "", "")
+}
+
+func errorBody(out []byte, errMsg, requestID string) []byte {
+	return appendResponse(out[:0], false, "", 0, errMsg, requestID)
+}
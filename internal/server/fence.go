@@ -0,0 +1,35 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"kv-server/internal/database"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fencingTokenHeader carries the fencing token of a writer that holds a
+// lock, on PUT /kv/{key}.
+const fencingTokenHeader = "X-Fencing-Token"
+
+var errFencingUnsupported = errors.New("fencing tokens not supported by this backend")
+
+// fenced is write for a writer holding fencing token: it fails with
+// database.ErrStaleToken if a write of key has carried a higher token, so a
+// writer whose lock expired and passed to another cannot overwrite it.
+func (s *KVServer) fenced(ctx context.Context, key, value, contentType string, expiresAt time.Time, token uint64) (uint64, error) {
+	fencer, ok := s.db.(database.Fencer)
+	if !ok {
+		return 0, errFencingUnsupported
+	}
+	return s.store(ctx, key, value, contentType, expiresAt, func(ctx context.Context, key, value, contentType string, expiresAt time.Time) (uint64, error) {
+		return fencer.CreateFenced(ctx, key, value, contentType, expiresAt, token)
+	})
+}
+
+// parseFencingToken parses an X-Fencing-Token value, which must fit in a
+// BIGINT column.
+func parseFencingToken(h string) (uint64, error) {
+	return strconv.ParseUint(strings.TrimSpace(h), 10, 63)
+}
@@ -1,65 +1,373 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
-	"io"
+	"errors"
 	"kv-server/internal/cache"
 	"kv-server/internal/database"
+	"kv-server/internal/replication"
+	"kv-server/internal/watch"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
 type KVServer struct {
-	cache *cache.ShardedCache
-	db    *database.PostgresDB
+	cache  *cache.ShardedCache
+	db     database.Store
+	health *database.HealthMonitor
+	repl   *replication.Replicator
+	routes router
+	stats  serverStats
+
+	// When the server was made, for its uptime
+	started time.Time
+
+	writeStats writeStats
+	snapshots  snapshotRegistry
+	uploads    uploadRegistry
+
+	// Encoded GET responses of hot keys; nil when disabled
+	encoded *cache.Cache[string, encodedResponse]
+
+	// Keys turned away after repeated failures; nil when disabled
+	quarantine *quarantine
+
+	// Tombstone store and retention; nil when deletes are outright
+	softDelete *softDelete
+
+	// Versions of each key kept in the store's history; 0 keeps all
+	historyVersions int
+
+	// Bounds the values appends build
+	maxAppend int
+
+	// JSON Schemas values must match, by namespace
+	schemas valueSchemas
+
+	// Usage of namespaces with a quota; nil when there are none
+	quotas *quotas
+
+	watch *watch.Hub
+
+	// Route /kv/{namespace}/{key} rather than /kv/{key}
+	namespaces bool
+
+	// Plain HTTP connections may speak HTTP/2
+	h2c bool
+
+	// Accepted API keys; nil when authentication is off
+	auth *apiKeys
+	// Bearer token verification; nil unless StartJWT was called
+	tokens *tokenAuth
+
+	// The operator's switch turning writes away
+	readOnly readOnlyMode
+
+	// Origins browsers may call from; nil when CORS is off
+	cors *corsPolicy
+
+	openapi openAPIDoc
+
+	// Per-client token buckets; nil when rate limiting is off
+	limiter *rateLimiter
+
+	// Bounds the requests processed at once; nil when unbounded
+	workers *workerPool
+	shedder *loadShedder
+	audit   *auditLog
+
+	// Largest request body read; larger ones get 413
+	maxBody int64
+
+	// Bounds each request's database calls; zero for no bound
+	requestTimeout time.Duration
+
+	// Samples hourly statistics; nil when stats history is off
+	statsHistory *statsRecorder
+
+	metrics requestMetrics
+
+	// Structured access log; nil when off
+	accessLog *accessLog
+
+	// Smallest response body gzipped; zero disables compression
+	compressMin int
+	compression compressionStats
+
+	ladder ladder
+
+	// Reloads hot keys after ClearCache; nil when disabled
+	rehydrate atomic.Pointer[rehydrator]
+
+	// Windows confining background maintenance; nil when unconfined
+	maintenance *maintenanceSchedule
+
+	// Bounds the key count of evicting namespaces; nil when there are none
+	trimmer atomic.Pointer[namespaceTrimmer]
 }
 
 type Request struct {
 	Key   string `json:"key"`
 	Value string `json:"value"`
+	// TTLSeconds expires the key that many seconds after the write; zero
+	// keeps it until deleted
+	TTLSeconds int64 `json:"ttl_seconds,omitempty"`
 }
 
+// maxTTLSeconds bounds ttl_seconds to ten years, well within time.Duration.
+const maxTTLSeconds = 10 * 365 * 24 * 60 * 60
+
+// expiry returns when a write of req expires, zero for never. It reports
+// false if ttl_seconds is out of range.
+func (req Request) expiry() (time.Time, bool) {
+	if req.TTLSeconds < 0 || req.TTLSeconds > maxTTLSeconds {
+		return time.Time{}, false
+	}
+	if req.TTLSeconds == 0 {
+		return time.Time{}, true
+	}
+	return time.Now().Add(time.Duration(req.TTLSeconds) * time.Second), true
+}
+
+const errInvalidTTL = "ttl_seconds must be between 0 and 315360000"
+
 type Response struct {
-	Success bool   `json:"success"`
-	Value   string `json:"value,omitempty"`
-	Error   string `json:"error,omitempty"`
+	Success bool         `json:"success"`
+	Value   string       `json:"value,omitempty"`
+	Version uint64       `json:"version,omitempty"`
+	Error   string       `json:"error,omitempty"`
+	Detail  *ErrorDetail `json:"detail,omitempty"`
+	// RequestID identifies the request in the server's logs; only errors
+	// carry it
+	RequestID string `json:"request_id,omitempty"`
 }
 
-func NewKVServer(cacheSize int, db *database.PostgresDB) *KVServer {
-	return &KVServer{
-		cache: cache.NewShardedCache(cacheSize),
+func NewKVServer(cacheSize int, db database.Store, cacheOpts ...cache.Option) *KVServer {
+	s := &KVServer{
+		cache: cache.NewShardedCache(cacheSize, cacheOpts...),
 		db:    db,
+		watch: watch.NewHub(watch.DefaultBuffer, watch.DefaultHistory),
+
+		started:        time.Now(),
+		maxBody:        DefaultMaxBodyBytes,
+		maxAppend:      DefaultMaxAppendBytes,
+		requestTimeout: DefaultRequestTimeout,
+		compressMin:    DefaultCompressMinBytes,
 	}
+
+	// /kv and everything below it is routed by handleKV
+	s.routes.handle("GET /healthz", s.handleHealthz)
+	s.routes.handle("HEAD /healthz", s.handleHealthz)
+	s.routes.handle("GET /readyz", s.handleReadyz)
+	s.routes.handle("HEAD /readyz", s.handleReadyz)
+	s.routes.handle("GET /capabilities", s.handleCapabilities)
+	s.routes.handle("GET /openapi.json", s.handleOpenAPI)
+	s.routes.handle("GET /admin/explain/", s.handleExplain)
+	s.routes.handle("GET /admin/cache/entries/", s.handleCacheEntry)
+	s.routes.handle("GET /admin/cache/keys", s.handleCacheKeys)
+	s.routes.handle("DELETE /admin/cache", s.handleCacheFlush)
+	s.routes.handle("GET /admin/cache/shards", s.handleCacheShards)
+	s.routes.handle("POST /admin/cache/rebalance", s.handleCacheRebalance)
+	s.routes.handle("GET /admin/snapshots", s.handleSnapshots)
+	s.routes.handle("POST /admin/snapshots", s.handleSnapshots)
+	s.routes.handle("GET /admin/snapshots/", s.handleSnapshots)
+	s.routes.handle("DELETE /admin/snapshots/", s.handleSnapshots)
+	s.routes.handle("GET /admin/export", s.handleExport)
+	s.routes.handle("POST /admin/import", s.handleImport)
+	s.routes.handle("GET /admin/replication", s.handleReplicationReport)
+	s.routes.handle("GET /admin/db/index-advice", s.handleIndexAdvice)
+	s.routes.handle("POST /admin/db/index-advice/", s.handleIndexAdvice)
+	s.routes.handle("GET /admin/quarantine", s.handleQuarantine)
+	s.routes.handle("DELETE /admin/quarantine/", s.handleQuarantine)
+	s.routes.handle("GET /admin/schemas", s.handleSchemas)
+	s.routes.handle("PUT /admin/schemas", s.handleSchemas)
+	s.routes.handle("DELETE /admin/schemas", s.handleSchemas)
+	s.routes.handle("GET /admin/quotas", s.handleQuotas)
+	s.routes.handle("GET /admin/read-only", s.handleReadOnly)
+	s.routes.handle("PUT /admin/read-only", s.handleReadOnly)
+	s.routes.handle("GET /admin/watch", s.handleWatchStats)
+	s.routes.handle("GET /admin/stats", s.handleStats)
+	s.routes.handle("GET /admin/stats/history", s.handleStatsHistory)
+	s.routes.handle("POST /replication/apply", s.handleReplicationApply)
+	s.routes.handle("POST /locks/", s.handleLocks)
+	s.routes.handle("GET /locks/", s.handleLocks)
+	s.routes.handle("DELETE /locks/", s.handleLocks)
+	s.routes.handle("POST /txn", s.handleTxn)
+	s.routes.handle("POST /txn/", s.handleTxn)
+	s.routes.handle("POST /uploads", s.handleUploads)
+	s.routes.handle("GET /uploads/", s.handleUploads)
+	s.routes.handle("PUT /uploads/", s.handleUploads)
+	s.routes.handle("POST /uploads/", s.handleUploads)
+	s.routes.handle("DELETE /uploads/", s.handleUploads)
+	s.routes.handle("GET /watch", s.handleWatch)
+	s.routes.handle("GET /watch/", s.handleWatch)
+	s.routes.handle("POST /watch/", s.handleWatch)
+	s.routes.handle("DELETE /watch/", s.handleWatch)
+	s.routes.handle("GET /ws", s.handleWebSocket)
+
+	return s
+}
+
+// SetHealthMonitor makes /readyz follow the monitor's view of the database.
+func (s *KVServer) SetHealthMonitor(m *database.HealthMonitor) {
+	s.health = m
 }
 
 func (s *KVServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
+	sw := wrapWriter(w, r)
+	defer sw.release()
+	var start time.Time
+	if s.requestTimeout > 0 {
+		start = time.Now()
+	}
+	sw.ctx.reset(r.Context(), s.requestTimeout, start)
+	if s.accessLog != nil {
+		s.serveLogged(sw, r)
+		return
+	}
+	s.serve(sw, r)
+}
 
-	path := strings.TrimPrefix(r.URL.Path, "/kv/")
+func (s *KVServer) serve(sw *statusWriter, r *http.Request) {
+	sw.Header()["Content-Type"] = contentTypeJSON
+	if s.audit != nil && audited(r.Method) {
+		// Made up front so the response carries the ID the record does
+		sw.requestID()
+		body := &countingBody{ReadCloser: r.Body}
+		r.Body = body
+		defer s.auditHTTP(sw, r, body, time.Now())
+	}
+	if s.cors != nil && s.handleCORS(sw, r) {
+		return
+	}
+	r, ok := s.checkAuth(sw, r)
+	if !ok {
+		return
+	}
+	if !s.checkRateLimit(sw, r) {
+		return
+	}
+	if s.shedder != nil && !workerExempt(r.URL.Path) {
+		if !s.shedLoad(sw) {
+			return
+		}
+		defer s.shedder.leave()
+	}
+	if s.workers != nil && !workerExempt(r.URL.Path) {
+		if !s.acquireWorker(sw) {
+			return
+		}
+		defer s.workers.release()
+	}
+	if s.compressMin > 0 {
+		defer sw.finishBody(&s.compression)
+		if !s.negotiateCompression(sw, r) {
+			return
+		}
+	}
 
-	switch r.Method {
-	case http.MethodPost:
-		s.handleCreate(w, r)
-	case http.MethodGet:
-		s.handleRead(w, r, path)
-	case http.MethodDelete:
-		s.handleDelete(w, r, path)
-	default:
-		s.sendError(w, "method not allowed", http.StatusMethodNotAllowed)
+	if path := r.URL.Path; path == "/kv" || strings.HasPrefix(path, "/kv/") {
+		s.serveMeasured(sw, r)
+		return
 	}
+	s.route(sw, r)
 }
 
-func (s *KVServer) handleCreate(w http.ResponseWriter, r *http.Request) {
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		s.sendError(w, "failed to read body", http.StatusBadRequest)
+func (s *KVServer) handleKV(w http.ResponseWriter, r *http.Request) {
+	s.stats.requests.Add(1)
+	defer s.stats.observe(time.Now())
+	s.ladder.inFlight.Add(1)
+	defer s.ladder.inFlight.Add(-1)
+
+	// The namespace takes the place of /kv for everything below it
+	path := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/kv"), "/")
+	var ns string
+	if s.namespaces {
+		var ok bool
+		if ns, path, ok = splitNamespace(r.URL.Path); !ok {
+			s.sendError(w, errInvalidNamespace, http.StatusBadRequest)
+			return
+		}
+	}
+	if !inScope(scopeOf(r), ns) {
+		s.sendError(w, errForbiddenScope, http.StatusForbidden)
+		return
+	}
+	op, allow := kvRoute(r.Method, path)
+	if op == opNone {
+		s.methodNotAllowed(w, allow)
+		return
+	}
+	if !s.admit(w, kvClass(r.Method, path, path == "", r.URL.RawQuery)) {
+		return
+	}
+	if opPermission(op) == permWrite && !s.checkWritable(w) {
+		return
+	}
+	if !s.noteCacheFill(w, r) {
 		return
 	}
-	defer r.Body.Close()
 
-	var req Request
-	if err := json.Unmarshal(body, &req); err != nil {
-		s.sendError(w, "invalid json", http.StatusBadRequest)
+	switch op {
+	case opList:
+		s.stats.reads.Add(1)
+		s.handleList(w, r, ns)
+	case opMultiGet:
+		s.stats.reads.Add(1)
+		s.handleMultiGet(w, r, ns)
+	case opRange:
+		s.stats.reads.Add(1)
+		s.handleRange(w, r, ns)
+	case opCount:
+		s.stats.reads.Add(1)
+		s.handleCount(w, r, ns)
+	case opCreate:
+		s.stats.writes.Add(1)
+		s.handleCreate(w, r, ns)
+	case opBatch:
+		s.stats.writes.Add(1)
+		s.handleBatch(w, r, ns)
+	case opIncr, opDecr:
+		s.stats.writes.Add(1)
+		key, _, _ := incrTarget(path)
+		s.handleIncr(w, r, qualify(ns, key), op == opDecr)
+	case opAppend:
+		s.stats.writes.Add(1)
+		key, _ := appendTarget(path)
+		s.handleAppend(w, r, qualify(ns, key))
+	case opRestore:
+		s.stats.writes.Add(1)
+		key, _ := restoreTarget(path)
+		s.handleRestore(w, r, qualify(ns, key))
+	case opHistory:
+		s.stats.reads.Add(1)
+		key, _ := historyTarget(path)
+		s.handleHistory(w, r, qualify(ns, key))
+	case opRead:
+		s.stats.reads.Add(1)
+		s.handleRead(w, r, qualify(ns, path))
+	case opHead:
+		s.stats.reads.Add(1)
+		s.handleHead(w, r, qualify(ns, path))
+	case opWrite:
+		s.stats.writes.Add(1)
+		s.handleUpdate(w, r, qualify(ns, path))
+	case opDelete:
+		s.stats.deletes.Add(1)
+		s.handleDelete(w, r, qualify(ns, path))
+	}
+}
+
+// handleCreate serves POST /kv, which only creates: an existing key is a
+// 409. ?upsert=true restores the old overwrite-silently behaviour. The key
+// is created in namespace ns.
+func (s *KVServer) handleCreate(w http.ResponseWriter, r *http.Request, ns string) {
+	req, ok := s.decodeRequest(w, r)
+	if !ok {
 		return
 	}
 
@@ -67,17 +375,165 @@ func (s *KVServer) handleCreate(w http.ResponseWriter, r *http.Request) {
 		s.sendError(w, "key is required", http.StatusBadRequest)
 		return
 	}
+	key := database.QualifyKey(ns, req.Key)
+	s.noteAuditKey(w, key)
+	if !s.checkQuarantine(w, key) || !s.checkSchema(w, key, req.Value) || !s.checkQuota(w, key, len(req.Value)) {
+		return
+	}
+	expiresAt, ok := req.expiry()
+	if !ok {
+		s.sendError(w, errInvalidTTL, http.StatusBadRequest)
+		return
+	}
 
-	// Store in database first
-	if err := s.db.Create(req.Key, req.Value); err != nil {
+	write := s.create
+	if r.URL.Query().Get("upsert") == "true" {
+		write = s.write
+	}
+	revision, err := write(requestCtx(w), key, req.Value, "", expiresAt)
+	if err != nil {
+		if errors.Is(err, database.ErrExists) {
+			s.sendError(w, "key already exists", http.StatusConflict)
+			return
+		}
 		s.sendError(w, "database error", http.StatusInternalServerError)
 		return
 	}
 
-	// Then update cache
-	s.cache.Put(req.Key, req.Value)
+	s.sendVersioned(w, "", revision, http.StatusCreated)
+}
+
+// handleUpdate serves PUT /kv/{key} with a {"value": ...} body, creating or
+// overwriting the key. A key in the body must match the path. With any
+// other Content-Type the body is the value itself, stored as raw bytes
+// along with that Content-Type, and ?ttl_seconds= sets the expiry; an
+// X-Value-CRC32C header makes the write fail with 422 unless the body
+// matches it.
+//
+// With an If-Match: <version> header the write is a compare-and-swap: it
+// only succeeds while the key is still at that version, and fails with 412
+// otherwise, so read-modify-write clients never lose a concurrent update.
+func (s *KVServer) handleUpdate(w http.ResponseWriter, r *http.Request, key string) {
+	if key == "" || key == "/kv" {
+		s.sendError(w, "key is required", http.StatusBadRequest)
+		return
+	}
+	if !s.checkQuarantine(w, key) {
+		return
+	}
+
+	var value string
+	var expiresAt time.Time
+	contentType, raw := rawContentType(r)
+	if raw {
+		body, ok := s.readBody(w, r)
+		if !ok {
+			return
+		}
+		value = string(body)
+		if !s.checkValueChecksum(w, r, value) {
+			return
+		}
+		if expiresAt, ok = rawExpiry(r); !ok {
+			s.sendError(w, errInvalidTTL, http.StatusBadRequest)
+			return
+		}
+	} else {
+		req, ok := s.decodeRequest(w, r)
+		if !ok {
+			return
+		}
+		if req.Key != "" && req.Key != displayKey(key) {
+			s.sendError(w, "key in body does not match path", http.StatusBadRequest)
+			return
+		}
+		value = req.Value
+		if expiresAt, ok = req.expiry(); !ok {
+			s.sendError(w, errInvalidTTL, http.StatusBadRequest)
+			return
+		}
+	}
+	if !s.checkSchema(w, key, value) || !s.checkQuota(w, key, len(value)) {
+		return
+	}
 
-	s.sendSuccess(w, "", http.StatusCreated)
+	var revision uint64
+	var err error
+	ifMatch, fence := r.Header.Get("If-Match"), r.Header.Get(fencingTokenHeader)
+	switch {
+	case ifMatch != "" && fence != "":
+		s.sendError(w, "If-Match and "+fencingTokenHeader+" cannot be combined", http.StatusBadRequest)
+		return
+	case ifMatch != "":
+		expected, perr := parseVersion(ifMatch)
+		if perr != nil {
+			s.sendError(w, "invalid If-Match version", http.StatusBadRequest)
+			return
+		}
+		revision, err = s.update(requestCtx(w), key, value, contentType, expiresAt, expected)
+	case fence != "":
+		token, perr := parseFencingToken(fence)
+		if perr != nil {
+			s.sendError(w, "invalid "+fencingTokenHeader, http.StatusBadRequest)
+			return
+		}
+		revision, err = s.fenced(requestCtx(w), key, value, contentType, expiresAt, token)
+	default:
+		revision, err = s.write(requestCtx(w), key, value, contentType, expiresAt)
+	}
+	if err != nil {
+		status, msg := updateError(err)
+		s.sendError(w, msg, status)
+		return
+	}
+
+	s.sendVersioned(w, "", revision, http.StatusOK)
+}
+
+// parseVersion parses an If-Match value: a version number, optionally
+// quoted like an entity tag.
+func parseVersion(h string) (uint64, error) {
+	h = strings.TrimSpace(h)
+	if len(h) >= 2 && h[0] == '"' && h[len(h)-1] == '"' {
+		h = h[1 : len(h)-1]
+	}
+	return strconv.ParseUint(h, 10, 64)
+}
+
+// updateError maps a failed PUT to its status code and message.
+func updateError(err error) (int, string) {
+	switch {
+	case errors.Is(err, database.ErrRevisionMismatch):
+		return http.StatusPreconditionFailed, "version mismatch"
+	case errors.Is(err, database.ErrNotFound):
+		return http.StatusPreconditionFailed, "key not found"
+	case errors.Is(err, database.ErrStaleToken):
+		return http.StatusConflict, "stale fencing token"
+	case errors.Is(err, errFencingUnsupported):
+		return http.StatusNotImplemented, errFencingUnsupported.Error()
+	}
+	return http.StatusInternalServerError, "database error"
+}
+
+// decodeRequest reads and decodes a Request body, replying with a 400 and
+// returning false if it is malformed.
+func (s *KVServer) decodeRequest(w http.ResponseWriter, r *http.Request) (Request, bool) {
+	var req Request
+	if reqErr := checkContentType(r); reqErr != nil {
+		s.sendRequestError(w, reqErr)
+		return req, false
+	}
+
+	body, ok := s.readBody(w, r)
+	if !ok {
+		return req, false
+	}
+
+	if reqErr := decodeJSON(body, &req); reqErr != nil {
+		s.sendRequestError(w, reqErr)
+		return req, false
+	}
+	return req, true
 }
 
 func (s *KVServer) handleRead(w http.ResponseWriter, r *http.Request, key string) {
@@ -85,24 +541,41 @@ func (s *KVServer) handleRead(w http.ResponseWriter, r *http.Request, key string
 		s.sendError(w, "key is required", http.StatusBadRequest)
 		return
 	}
-
-	// Check cache first
-	if value, ok := s.cache.Get(key); ok {
-		s.sendSuccess(w, value, http.StatusOK)
+	if !s.checkQuarantine(w, key) {
+		return
+	}
+	if r.URL.RawQuery != "" && s.handleReadAt(w, r, key) {
+		return
+	}
+	strong, ok := strongConsistency(r.Header.Get(consistencyHeader), r.URL.RawQuery)
+	if !ok {
+		s.sendError(w, errInvalidConsistency, http.StatusBadRequest)
 		return
 	}
 
-	// Cache miss - read from database
-	value, err := s.db.Read(key)
+	v, err := s.readConsistent(requestCtx(w), key, strong)
+	if errors.Is(err, errCacheOnly) {
+		s.sendDegraded(w, s.Level())
+		return
+	}
 	if err != nil {
 		s.sendError(w, "key not found", http.StatusNotFound)
 		return
 	}
 
-	// Add to cache
-	s.cache.Put(key, value)
-
-	s.sendSuccess(w, value, http.StatusOK)
+	if s.notModified(w, r, v) {
+		return
+	}
+	if wantsRaw(r, v.ContentType) {
+		s.sendRaw(w, r, v)
+		return
+	}
+	if body := s.encodedSuccess(key, v); body != nil {
+		w.WriteHeader(http.StatusOK)
+		w.Write(body)
+		return
+	}
+	s.sendVersioned(w, v.Value, v.Revision, http.StatusOK)
 }
 
 func (s *KVServer) handleDelete(w http.ResponseWriter, r *http.Request, key string) {
@@ -110,35 +583,201 @@ func (s *KVServer) handleDelete(w http.ResponseWriter, r *http.Request, key stri
 		s.sendError(w, "key is required", http.StatusBadRequest)
 		return
 	}
+	if !s.checkQuarantine(w, key) {
+		return
+	}
 
-	// Delete from database
-	if err := s.db.Delete(key); err != nil {
+	if err := s.remove(requestCtx(w), key); err != nil {
 		s.sendError(w, "key not found", http.StatusNotFound)
 		return
 	}
 
-	// Delete from cache if exists
+	s.sendSuccess(w, "", http.StatusOK)
+}
+
+// read checks the cache first, reading through to the database on a miss.
+// The database read runs under ctx.
+func (s *KVServer) read(ctx context.Context, key string) (string, error) {
+	v, err := s.readVersioned(ctx, key)
+	return v.Value, err
+}
+
+// readVersioned is read that also reports the value's revision and, on a
+// hit, the cache entry's version. From the CacheOnly rung down a miss fails
+// with errCacheOnly.
+func (s *KVServer) readVersioned(ctx context.Context, key string) (cache.Versioned[string], error) {
+	if skipsCache(ctx) {
+		return s.readUncached(ctx, key)
+	}
+	v, err := s.cache.GetOrLoadVersioned(key, func() (cache.Versioned[string], error) {
+		if s.Level() >= CacheOnly {
+			return cache.Versioned[string]{}, errCacheOnly
+		}
+		ctx, cancel := loadContext(ctx)
+		defer cancel()
+		rec, err := s.db.ReadRecord(ctx, key)
+		s.noteResult(key, err)
+		return recordVersion(rec), err
+	})
+	if err == nil {
+		s.touch(key)
+	}
+	return v, err
+}
+
+// recordVersion converts a database record for the cache.
+func recordVersion(rec database.Record) cache.Versioned[string] {
+	return cache.Versioned[string]{Value: rec.Value, Revision: rec.Revision, ExpiresAt: rec.ExpiresAt, ContentType: rec.ContentType}
+}
+
+// write upserts in the database first, then updates the cache. It returns
+// the key's new revision. A zero expiresAt keeps the key until deleted; an
+// empty contentType marks a value written through the JSON API. The
+// database write runs under ctx.
+func (s *KVServer) write(ctx context.Context, key, value, contentType string, expiresAt time.Time) (uint64, error) {
+	return s.store(ctx, key, value, contentType, expiresAt, s.db.Create)
+}
+
+// create is write for a key that must not exist yet; it fails with
+// database.ErrExists otherwise.
+func (s *KVServer) create(ctx context.Context, key, value, contentType string, expiresAt time.Time) (uint64, error) {
+	return s.store(ctx, key, value, contentType, expiresAt, s.db.Insert)
+}
+
+// update is write for a key that must still be at revision; it fails with
+// database.ErrRevisionMismatch otherwise.
+func (s *KVServer) update(ctx context.Context, key, value, contentType string, expiresAt time.Time, revision uint64) (uint64, error) {
+	return s.store(ctx, key, value, contentType, expiresAt, func(ctx context.Context, key, value, contentType string, expiresAt time.Time) (uint64, error) {
+		return s.db.Update(ctx, key, value, contentType, expiresAt, revision)
+	})
+}
+
+func (s *KVServer) store(ctx context.Context, key, value, contentType string, expiresAt time.Time,
+	dbWrite func(ctx context.Context, key, value, contentType string, expiresAt time.Time) (uint64, error)) (uint64, error) {
+	if s.repl != nil {
+		defer s.repl.Lock(key)()
+	}
+	revision, err := dbWrite(ctx, key, value, contentType, expiresAt)
+	s.noteResult(key, err)
+	if err != nil {
+		// A failed precondition is the client's answer, not a failed write
+		if !errors.Is(err, database.ErrExists) && !errors.Is(err, database.ErrRevisionMismatch) &&
+			!errors.Is(err, database.ErrNotFound) && !errors.Is(err, database.ErrStaleToken) {
+			s.writeStats.failed.Add(1)
+		}
+		return 0, err
+	}
+	s.writeStats.recordCommit(1)
+	if s.repl != nil {
+		s.repl.Local(key, value, false)
+	}
+
+	s.cacheWritten(ctx, key, cache.Versioned[string]{Value: value, Revision: revision, ExpiresAt: expiresAt, ContentType: contentType})
+	s.chargeQuota(key, len(value))
+	s.publish(watch.Put, key, value, revision)
+	s.touch(key)
+
+	s.writeStats.acked.Add(1)
+	return revision, nil
+}
+
+// remove deletes from the database, then from the cache if present.
+func (s *KVServer) remove(ctx context.Context, key string) error {
+	if s.repl != nil {
+		defer s.repl.Lock(key)()
+	}
+	err := s.deleteRow(ctx, key)
+	s.noteResult(key, err)
+	if err != nil {
+		if !errors.Is(err, database.ErrNotFound) {
+			s.writeStats.failed.Add(1)
+		}
+		return err
+	}
+	s.writeStats.recordCommit(1)
+	if s.repl != nil {
+		s.repl.Local(key, "", true)
+	}
+
 	s.cache.Delete(key)
+	s.forgetEncoded(key)
+	s.writeStats.cacheWrites.Add(1)
+	s.publish(watch.Delete, key, "", 0)
 
-	s.sendSuccess(w, "", http.StatusOK)
+	s.writeStats.acked.Add(1)
+	return nil
 }
 
 func (s *KVServer) sendSuccess(w http.ResponseWriter, value string, status int) {
-	w.WriteHeader(status)
-	json.NewEncoder(w).Encode(Response{
-		Success: true,
-		Value:   value,
-	})
+	writeResponse(w, status, true, value, 0, "", "")
+}
+
+// sendVersioned is sendSuccess reporting the key's version.
+func (s *KVServer) sendVersioned(w http.ResponseWriter, value string, version uint64, status int) {
+	writeResponse(w, status, true, value, version, "", "")
 }
 
 func (s *KVServer) sendError(w http.ResponseWriter, errMsg string, status int) {
+	// Whatever failed, the request ran out of time
+	if sw, ok := w.(*statusWriter); ok && sw.ctx.timedOut() {
+		s.stats.timedOut.Add(1)
+		errMsg, status = errRequestTimeout, http.StatusGatewayTimeout
+	}
+	s.stats.countStatus(status)
+	writeResponse(w, status, false, "", 0, errMsg, requestIDOf(w))
+}
+
+// sendRequestError reports a malformed request as a 400 with details.
+func (s *KVServer) sendRequestError(w http.ResponseWriter, reqErr *requestError) {
+	s.sendErrorDetail(w, reqErr, http.StatusBadRequest)
+}
+
+// sendErrorDetail reports reqErr, with its details, under status.
+func (s *KVServer) sendErrorDetail(w http.ResponseWriter, reqErr *requestError, status int) {
+	s.stats.countStatus(status)
 	w.WriteHeader(status)
 	json.NewEncoder(w).Encode(Response{
-		Success: false,
-		Error:   errMsg,
+		Success:   false,
+		Error:     reqErr.msg,
+		Detail:    reqErr.detail,
+		RequestID: requestIDOf(w),
 	})
 }
 
+// Cache exposes the server's cache, e.g. for warming it or benchmarking.
+func (s *KVServer) Cache() *cache.ShardedCache {
+	return s.cache
+}
+
+// InvalidateCached evicts a key changed elsewhere (e.g. by another instance).
+func (s *KVServer) InvalidateCached(key string) {
+	s.cache.Delete(key)
+	s.forgetEncoded(key)
+}
+
+// ClearCache drops every cached entry. With rehydration running, the
+// hottest keys are queued to be reloaded.
+func (s *KVServer) ClearCache() {
+	var hot []string
+	rh := s.rehydrate.Load()
+	if rh != nil {
+		hot = s.cache.HotKeys(rh.top)
+	}
+	s.cache.Clear()
+	if s.encoded != nil {
+		s.encoded.Clear()
+	}
+	if rh != nil {
+		rh.queue(hot)
+	}
+}
+
 func (s *KVServer) GetCacheStats() (hits, misses uint64) {
 	return s.cache.GetStats()
 }
+
+// GetCacheMemory returns the cache's resident entry count and approximate
+// memory usage in bytes.
+func (s *KVServer) GetCacheMemory() (entries int, bytes int64) {
+	return s.cache.Len(), s.cache.MemoryUsage()
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// handleHead serves HEAD /kv/{key}: 200 or 404 with the value's length in
+// X-Value-Length and its version in X-Version, so clients can probe for a
+// large value without transferring it. Like a GET it carries an ETag and
+// honors If-None-Match. A HEAD asking for the raw value also gets the
+// headers a raw GET would.
+func (s *KVServer) handleHead(w http.ResponseWriter, r *http.Request, key string) {
+	if key == "" {
+		s.sendError(w, "key is required", http.StatusBadRequest)
+		return
+	}
+	if !s.checkQuarantine(w, key) {
+		return
+	}
+
+	strong, ok := strongConsistency(r.Header.Get(consistencyHeader), r.URL.RawQuery)
+	if !ok {
+		s.sendError(w, errInvalidConsistency, http.StatusBadRequest)
+		return
+	}
+
+	v, err := s.readConsistent(requestCtx(w), key, strong)
+	if errors.Is(err, errCacheOnly) {
+		s.sendDegraded(w, s.Level())
+		return
+	}
+	if err != nil {
+		s.sendError(w, "key not found", http.StatusNotFound)
+		return
+	}
+
+	if s.notModified(w, r, v) {
+		return
+	}
+	if wantsRaw(r, v.ContentType) {
+		setRawHeaders(w, v)
+	}
+	h := w.Header()
+	h.Set("X-Value-Length", strconv.Itoa(len(v.Value)))
+	if v.Revision != 0 {
+		h.Set("X-Version", strconv.FormatUint(v.Revision, 10))
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"encoding/json"
+	"kv-server/internal/database"
+	"net/http"
+)
+
+type readinessResponse struct {
+	Ready       bool                   `json:"ready"`
+	Degradation *DegradationStatus     `json:"degradation,omitempty"`
+	Database    *database.HealthStatus `json:"database,omitempty"`
+}
+
+// handleHealthz is a liveness probe: the process is up and serving.
+func (s *KVServer) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	s.sendSuccess(w, "", http.StatusOK)
+}
+
+// handleReadyz reports whether the server can currently serve traffic.
+// With the degradation ladder running that is any rung but Unavailable, so
+// an instance stays in rotation serving cached reads while the database is
+// briefly down. Otherwise it follows database availability when a health
+// monitor is attached.
+func (s *KVServer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	resp := readinessResponse{Ready: true}
+	if s.health != nil {
+		status := s.health.Status()
+		resp.Ready = status.Healthy
+		resp.Database = &status
+	}
+	if s.degradationRunning() {
+		status := s.Degradation()
+		resp.Ready = status.Level < Unavailable
+		resp.Degradation = &status
+	}
+
+	status := http.StatusOK
+	if !resp.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
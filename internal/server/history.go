@@ -0,0 +1,107 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"kv-server/internal/database"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultHistoryLimit is how many versions GET /kv/{key}/history returns
+// without ?limit=.
+const defaultHistoryLimit = 100
+
+// HistoryResponse lists a key's versions, newest first.
+type HistoryResponse struct {
+	Success  bool             `json:"success"`
+	Key      string           `json:"key"`
+	Versions []HistoryVersion `json:"versions"`
+}
+
+// HistoryVersion is one write or delete of a key.
+type HistoryVersion struct {
+	Version   uint64    `json:"version"`
+	Value     string    `json:"value,omitempty"`
+	Deleted   bool      `json:"deleted,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// SetHistoryVersions bounds the history kept of each key to its newest
+// keep versions, deletes included; the expiry sweeper drops older ones.
+// Zero keeps them all. Call it before serving.
+func (s *KVServer) SetHistoryVersions(keep int) {
+	s.historyVersions = keep
+}
+
+// historyTarget splits a GET path of the form {key}/history.
+func historyTarget(path string) (string, bool) {
+	return strings.CutSuffix(path, "/history")
+}
+
+// handleHistory serves GET /kv/{key}/history?limit=N, the key's versions,
+// newest first, from the store's history. Like reads at a revision, it
+// always goes to the database.
+func (s *KVServer) handleHistory(w http.ResponseWriter, r *http.Request, key string) {
+	if key == "" {
+		s.sendError(w, "key is required", http.StatusBadRequest)
+		return
+	}
+	history, ok := s.db.(database.HistoryReader)
+	if !ok {
+		s.sendError(w, "history not supported by this backend", http.StatusNotImplemented)
+		return
+	}
+
+	limit := defaultHistoryLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxListLimit {
+			s.sendError(w, fmt.Sprintf("limit must be between 1 and %d", maxListLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	versions, err := history.History(key, limit)
+	s.noteResult(key, err)
+	if err != nil {
+		s.sendError(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	if len(versions) == 0 {
+		s.sendError(w, "key not found", http.StatusNotFound)
+		return
+	}
+
+	resp := HistoryResponse{Success: true, Key: displayKey(key), Versions: make([]HistoryVersion, len(versions))}
+	for i, v := range versions {
+		resp.Versions[i] = HistoryVersion{Version: v.Revision, Value: v.Value, Deleted: v.Deleted, UpdatedAt: v.UpdatedAt}
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// pruneHistory drops the versions beyond -history-versions, if set and
+// the store can. Like the expiry sweep, a throttled prune drops one batch.
+func (s *KVServer) pruneHistory(pace maintenancePace) {
+	pruner, ok := s.db.(database.HistoryPruner)
+	if s.historyVersions <= 0 || !ok {
+		return
+	}
+	for {
+		n, err := pruner.PruneHistory(context.Background(), s.historyVersions, expirySweepBatch)
+		if err != nil {
+			log.Printf("History prune failed: %v", err)
+			return
+		}
+		s.stats.pruned.Add(uint64(n))
+		if n < expirySweepBatch || pace == paceThrottled {
+			return
+		}
+	}
+}
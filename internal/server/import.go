@@ -0,0 +1,245 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kv-server/internal/database"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// defaultImportBatch is how many keys an import writes per transaction
+	// unless ?batch= says otherwise.
+	defaultImportBatch = 1000
+
+	// maxImportErrors bounds the rejected lines an import reports.
+	maxImportErrors = 100
+)
+
+// ImportProgress reports how far an import has got. One is streamed after
+// every batch, and a last one with Done set when the import ends.
+type ImportProgress struct {
+	Done   bool `json:"done"`
+	DryRun bool `json:"dry_run,omitempty"`
+	// Lines is how many lines have been read and, unless the import
+	// failed, fully handled: a failed batch's lines are not counted, so a
+	// retry can resume after Lines
+	Lines int `json:"lines"`
+	// Imported counts the keys written, or that would have been in a dry
+	// run; a key given twice in a batch counts once
+	Imported int `json:"imported"`
+	Rejected int `json:"rejected"`
+	// Expired counts records skipped because their expiry has passed
+	Expired int `json:"expired"`
+	// Error says what stopped the import early
+	Error string `json:"error,omitempty"`
+	// Errors lists the first rejected lines, on the last report only
+	Errors []ImportLineError `json:"errors,omitempty"`
+}
+
+// ImportLineError says why a line of an import was rejected.
+type ImportLineError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// importBatch is the batch an import is building. A key given twice keeps
+// its first place and its last value, as if the lines were written one by
+// one.
+type importBatch struct {
+	pairs []database.KeyValue
+	index map[string]int
+	lines int
+}
+
+func (b *importBatch) add(kv database.KeyValue) {
+	if i, ok := b.index[kv.Key]; ok {
+		b.pairs[i] = kv
+		return
+	}
+	b.index[kv.Key] = len(b.pairs)
+	b.pairs = append(b.pairs, kv)
+}
+
+func (b *importBatch) reset() {
+	b.pairs = b.pairs[:0]
+	clear(b.index)
+	b.lines = 0
+}
+
+// handleImport serves POST /admin/import, the counterpart of
+// /admin/export: it reads records in the export's format, one per line, and
+// writes them in transactions of ?batch= keys. A record without a
+// namespace goes into ?namespace=, or the default namespace. ?dry_run=true
+// checks every line but writes nothing.
+//
+// Progress is streamed back as one ImportProgress per line, so the
+// response is 200 even when the import fails part way; its last line says
+// how it ended. Blank lines are skipped. Invalid lines are rejected one by
+// one without stopping the import, while a database error or a line longer
+// than the body limit stops it.
+func (s *KVServer) handleImport(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	dryRun := false
+	if v := query.Get("dry_run"); v != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(v); err != nil {
+			s.sendError(w, "dry_run must be a boolean", http.StatusBadRequest)
+			return
+		}
+	}
+	size := defaultImportBatch
+	if v := query.Get("batch"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxBatchItems {
+			s.sendError(w, fmt.Sprintf("batch must be between 1 and %d", maxBatchItems), http.StatusBadRequest)
+			return
+		}
+		size = n
+	}
+	defaultNS := query.Get("namespace")
+	if defaultNS != "" && (!s.namespaces || !validNamespace(defaultNS)) {
+		s.sendError(w, errInvalidNamespace, http.StatusBadRequest)
+		return
+	}
+
+	// An import takes as long as its body does to arrive and be written
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+	defer r.Body.Close()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	report := func(p ImportProgress) {
+		enc.Encode(p)
+		rc.Flush()
+	}
+
+	ctx := streamContext(w, r)
+	progress := ImportProgress{DryRun: dryRun}
+	batch := importBatch{index: make(map[string]int)}
+	// A dry run writes nothing, so its tally covers the whole import
+	tally := quotaTally{s: s}
+	commit := func() bool {
+		if len(batch.pairs) > 0 && !dryRun {
+			if !s.Level().allows(classWrite) {
+				progress.Error = "degraded: " + s.Level().String()
+				return false
+			}
+			if !s.writable() {
+				progress.Error = errReadOnly
+				return false
+			}
+			if err := s.writeBatch(ctx, batch.pairs); err != nil {
+				log.Printf("Import batch of %d keys failed after line %d: %v", len(batch.pairs), progress.Lines, err)
+				progress.Error = "database error"
+				return false
+			}
+			tally.reset()
+		}
+		progress.Lines += batch.lines
+		progress.Imported += len(batch.pairs)
+		batch.reset()
+		return true
+	}
+
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(make([]byte, 64<<10), int(s.maxBody))
+	now := time.Now()
+scan:
+	for scanner.Scan() {
+		batch.lines++
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		line := progress.Lines + batch.lines
+		kv, expired, msg := s.importRecord(scanner.Bytes(), defaultNS, now)
+		switch {
+		case msg != "":
+			progress.Rejected++
+			if len(progress.Errors) < maxImportErrors {
+				progress.Errors = append(progress.Errors, ImportLineError{Line: line, Error: msg})
+			}
+		case expired:
+			progress.Expired++
+		default:
+			status, msg := tally.add(ctx, kv.Key, len(kv.Value), false)
+			if status == http.StatusInternalServerError {
+				progress.Error = msg
+				break scan
+			}
+			if status != 0 {
+				progress.Rejected++
+				if len(progress.Errors) < maxImportErrors {
+					progress.Errors = append(progress.Errors, ImportLineError{Line: line, Error: msg})
+				}
+				break
+			}
+			batch.add(kv)
+		}
+
+		if len(batch.pairs) >= size {
+			if !commit() {
+				break
+			}
+			report(ImportProgress{DryRun: dryRun, Lines: progress.Lines, Imported: progress.Imported, Rejected: progress.Rejected, Expired: progress.Expired})
+		}
+	}
+	if progress.Error == "" {
+		if err := scanner.Err(); err != nil {
+			if errors.Is(err, bufio.ErrTooLong) {
+				progress.Error = fmt.Sprintf("line %d is longer than %d bytes", progress.Lines+batch.lines+1, s.maxBody)
+			} else {
+				progress.Error = "failed to read body"
+			}
+		} else {
+			commit()
+		}
+	}
+
+	progress.Done = true
+	if progress.Error != "" {
+		log.Printf("Import stopped after line %d: %s", progress.Lines, progress.Error)
+	}
+	report(progress)
+}
+
+// importRecord parses one line of an import into the pair to write. It
+// reports expired for a record whose expiry has passed by now, or why the
+// line is invalid.
+func (s *KVServer) importRecord(line []byte, defaultNS string, now time.Time) (kv database.KeyValue, expired bool, msg string) {
+	var rec exportRecord
+	if reqErr := decodeJSON(line, &rec); reqErr != nil {
+		return kv, false, reqErr.msg
+	}
+	if rec.Key == "" {
+		return kv, false, "key is required"
+	}
+	ns := rec.Namespace
+	if ns == "" {
+		ns = defaultNS
+	}
+	if ns != "" && (!s.namespaces || !validNamespace(ns)) {
+		return kv, false, errInvalidNamespace
+	}
+
+	kv = database.KeyValue{Key: database.QualifyKey(ns, rec.Key), Value: rec.Value, ContentType: rec.ContentType}
+	if reqErr := s.schemaError(kv.Key, kv.Value); reqErr != nil {
+		return kv, false, reqErr.msg
+	}
+	if rec.ExpiresAt != nil {
+		if !rec.ExpiresAt.After(now) {
+			return kv, true, ""
+		}
+		kv.ExpiresAt = *rec.ExpiresAt
+	}
+	return kv, false, ""
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"kv-server/internal/database"
+	"kv-server/internal/watch"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// handleIncr serves POST /kv/{key}/incr and /kv/{key}/decr with an optional
+// ?delta= (default 1). The key's value must be an integer; a missing key
+// counts from 0. The reply carries the new value and version.
+func (s *KVServer) handleIncr(w http.ResponseWriter, r *http.Request, key string, negate bool) {
+	if key == "" {
+		s.sendError(w, "key is required", http.StatusBadRequest)
+		return
+	}
+	if !s.checkQuarantine(w, key) || !s.checkUnschematized(w, key) {
+		return
+	}
+
+	delta := int64(1)
+	if v := r.URL.Query().Get("delta"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			s.sendError(w, "delta must be an integer", http.StatusBadRequest)
+			return
+		}
+		delta = n
+	}
+	if negate {
+		if delta == math.MinInt64 {
+			s.sendError(w, "delta out of range", http.StatusBadRequest)
+			return
+		}
+		delta = -delta
+	}
+	if !s.checkQuota(w, key, 0) {
+		return
+	}
+
+	value, revision, err := s.increment(requestCtx(w), key, delta)
+	switch {
+	case errors.Is(err, database.ErrNotInteger):
+		s.sendError(w, "value is not an integer", http.StatusConflict)
+	case errors.Is(err, database.ErrOverflow):
+		s.sendError(w, "increment overflows a 64-bit integer", http.StatusConflict)
+	case err != nil:
+		s.sendError(w, "database error", http.StatusInternalServerError)
+	default:
+		s.sendVersioned(w, value, revision, http.StatusOK)
+	}
+}
+
+// incrTarget splits a POST path of the form {key}/incr or {key}/decr.
+func incrTarget(path string) (key string, negate, ok bool) {
+	if key, ok := strings.CutSuffix(path, "/incr"); ok {
+		return key, false, true
+	}
+	if key, ok := strings.CutSuffix(path, "/decr"); ok {
+		return key, true, true
+	}
+	return "", false, false
+}
+
+// increment adds delta in the database, which does the arithmetic so
+// concurrent increments never lose an update, then caches the result. The
+// database write runs under ctx.
+func (s *KVServer) increment(ctx context.Context, key string, delta int64) (string, uint64, error) {
+	if s.repl != nil {
+		defer s.repl.Lock(key)()
+	}
+	rec, err := s.db.Increment(ctx, key, delta)
+	s.noteResult(key, err)
+	if err != nil {
+		if !errors.Is(err, database.ErrNotInteger) && !errors.Is(err, database.ErrOverflow) {
+			s.writeStats.failed.Add(1)
+		}
+		return "", 0, err
+	}
+	s.writeStats.recordCommit(1)
+
+	if s.repl != nil {
+		s.repl.Local(key, rec.Value, false)
+	}
+
+	s.cacheWritten(ctx, key, recordVersion(rec))
+	s.chargeQuota(key, len(rec.Value))
+	s.publish(watch.Put, key, rec.Value, rec.Revision)
+	s.touch(key)
+
+	s.writeStats.acked.Add(1)
+	return rec.Value, rec.Revision, nil
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"kv-server/internal/jwt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JWTConfig sets how bearer tokens are verified and what they grant.
+type JWTConfig struct {
+	// Secret verifies HS256 tokens; empty refuses them
+	Secret []byte
+	// JWKSURL is the identity provider's JSON Web Key Set, which verifies
+	// RS256 tokens; empty refuses them
+	JWKSURL string
+	// Issuer and Audience, if set, must match the iss and aud claims
+	Issuer   string
+	Audience string
+	// NamespaceClaim names the claim holding the namespace a token is
+	// scoped to, "*" for all. Empty leaves every token unscoped.
+	NamespaceClaim string
+	// PermissionsClaim names the claim listing what a token may do: read,
+	// write and admin. Empty grants every token all three.
+	PermissionsClaim string
+}
+
+// maxVerifiedTokens bounds the tokens remembered as verified; the memory
+// is cleared when it fills.
+const maxVerifiedTokens = 10000
+
+// tokenAuth verifies bearer tokens and remembers those that passed until
+// they expire, so RS256 signatures are checked once per token rather than
+// once per request.
+type tokenAuth struct {
+	verifier         jwt.Verifier
+	namespaceClaim   string
+	permissionsClaim string
+
+	// now is time.Now, and moved forward by tests
+	now func() time.Time
+
+	mu       sync.Mutex
+	verified map[[sha256.Size]byte]tokenGrant
+}
+
+// tokenGrant is what a verified token grants, until expires.
+type tokenGrant struct {
+	scope   string
+	perms   permission
+	expires time.Time
+}
+
+// StartJWT accepts bearer tokens in the Authorization header alongside API
+// keys. Tokens are verified against cfg and grant what their claims say.
+// With a JWKS URL the key set is fetched now, then every refresh interval
+// and whenever a token names a key it lacks, at most once a minute. It
+// requires SetAPIKeys. The returned function stops the refreshes.
+func (s *KVServer) StartJWT(cfg JWTConfig, refresh time.Duration) (stop func(), err error) {
+	if len(cfg.Secret) == 0 && cfg.JWKSURL == "" {
+		return nil, errors.New("a JWT secret or JWKS URL is required")
+	}
+	t := &tokenAuth{
+		verifier:         jwt.Verifier{Issuer: cfg.Issuer, Audience: cfg.Audience},
+		namespaceClaim:   cfg.NamespaceClaim,
+		permissionsClaim: cfg.PermissionsClaim,
+		now:              time.Now,
+		verified:         make(map[[sha256.Size]byte]tokenGrant),
+	}
+	if len(cfg.Secret) > 0 {
+		t.verifier.Secret = cfg.Secret
+	}
+	if cfg.JWKSURL == "" {
+		s.tokens = t
+		return func() {}, nil
+	}
+
+	keys := jwt.NewKeySet(cfg.JWKSURL)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := keys.Refresh(ctx); err != nil {
+		return nil, err
+	}
+	if keys.Len() == 0 {
+		log.Printf("Warning: the key set at %s has no RSA signing keys", cfg.JWKSURL)
+	}
+	t.verifier.Keys = keys
+	s.tokens = t
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(refresh)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				// Keep the last keys while the identity provider is unreachable
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				if err := keys.Refresh(ctx); err != nil {
+					log.Printf("Refreshing the JWT key set failed: %v", err)
+				}
+				cancel()
+			}
+		}
+	}()
+	return func() { close(done) }, nil
+}
+
+// verify returns what token grants, or ok false if it does not verify.
+func (t *tokenAuth) verify(ctx context.Context, token string) (scope string, perms permission, ok bool) {
+	sum := sha256.Sum256([]byte(token))
+	now := t.now()
+	t.mu.Lock()
+	g, found := t.verified[sum]
+	t.mu.Unlock()
+	if found && now.Before(g.expires) {
+		return g.scope, g.perms, true
+	}
+
+	claims, err := t.verifier.Verify(ctx, token, now)
+	if err != nil {
+		return "", 0, false
+	}
+	g = t.grant(claims)
+
+	t.mu.Lock()
+	if len(t.verified) >= maxVerifiedTokens {
+		clear(t.verified)
+	}
+	t.verified[sum] = g
+	t.mu.Unlock()
+	return g.scope, g.perms, true
+}
+
+// grant maps a verified token's claims to its scope and permissions. A
+// token naming no namespace while they are claimed is granted nothing.
+func (t *tokenAuth) grant(claims jwt.Claims) tokenGrant {
+	g := tokenGrant{perms: permAll}
+	exp, _ := claims["exp"].(float64)
+	g.expires = time.Unix(int64(exp), 0).Add(jwt.ClockSkew)
+
+	if t.namespaceClaim != "" {
+		switch ns := claims.String(t.namespaceClaim); {
+		case ns == "*":
+		case validNamespace(ns):
+			g.scope = ns
+		default:
+			g.perms = 0
+			return g
+		}
+	}
+	if t.permissionsClaim != "" {
+		g.perms = 0
+		for _, name := range claims.Strings(t.permissionsClaim) {
+			switch name {
+			case "read":
+				g.perms |= permRead
+			case "write":
+				g.perms |= permWrite
+			case "admin":
+				g.perms |= permAdmin
+			}
+		}
+	}
+	return g
+}
+
+// bearerToken returns the token of an Authorization header using the
+// Bearer scheme.
+func bearerToken(authorization string) (string, bool) {
+	scheme, token, ok := strings.Cut(authorization, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// authorizationOf returns the Authorization r carries. Like the API key,
+// /ws also takes a bearer token from ?access_token=.
+func authorizationOf(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); auth != "" || r.URL.Path != "/ws" {
+		return auth
+	}
+	if token := r.URL.Query().Get("access_token"); token != "" {
+		return "Bearer " + token
+	}
+	return ""
+}
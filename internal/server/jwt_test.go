@@ -0,0 +1,147 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"kv-server/internal/database"
+	"kv-server/internal/jwt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testJWTSecret = []byte("test-secret")
+
+// signToken returns an HS256 token carrying claims, signed with
+// testJWTSecret.
+func signToken(t *testing.T, claims map[string]any) string {
+	t.Helper()
+	enc := func(v any) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := enc(map[string]any{"alg": "HS256"}) + "." + enc(claims)
+	mac := hmac.New(sha256.New, testJWTSecret)
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func newJWTServer(t *testing.T) *KVServer {
+	t.Helper()
+	srv := NewKVServer(1000, database.NewMemoryDB(database.Faults{}))
+	srv.SetNamespaces(true)
+	srv.SetAPIKeys(map[string]string{"admin-key": ""})
+	stop, err := srv.StartJWT(JWTConfig{Secret: testJWTSecret, NamespaceClaim: "ns", PermissionsClaim: "perms"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(stop)
+	return srv
+}
+
+func TestTokenStaysInItsNamespace(t *testing.T) {
+	srv := newJWTServer(t)
+	token := signToken(t, map[string]any{
+		"exp":   float64(time.Now().Add(time.Hour).Unix()),
+		"ns":    "ta",
+		"perms": []string{"read", "write"},
+	})
+	// do sends a request with the credential in header
+	do := func(method, path, header, credential, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(header, credential)
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		return w
+	}
+	if w := do(http.MethodPut, "/kv/tb/k", apiKeyHeader, "admin-key", `{"value":"theirs"}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT /kv/tb/k with the admin key: status %d: %s", w.Code, w.Body)
+	}
+
+	tests := []struct {
+		method, path, body string
+		want               int
+	}{
+		{http.MethodPut, "/kv/ta/k", `{"value":"mine"}`, http.StatusOK},
+		{http.MethodGet, "/kv/ta/k", "", http.StatusOK},
+		{http.MethodGet, "/kv/tb/k", "", http.StatusForbidden},
+		{http.MethodHead, "/kv/tb/k", "", http.StatusForbidden},
+		{http.MethodPut, "/kv/tb/k", `{"value":"mine"}`, http.StatusForbidden},
+		{http.MethodDelete, "/kv/tb/k", "", http.StatusForbidden},
+		{http.MethodPost, "/kv/tb", `{"key":"k2","value":"mine"}`, http.StatusForbidden},
+		{http.MethodPost, "/kv/tb/batch", `[{"key":"k","value":"mine"}]`, http.StatusForbidden},
+		{http.MethodPost, "/kv/tb/multi", `{"keys":["k"]}`, http.StatusForbidden},
+		{http.MethodPost, "/kv/tb/k/append", `{"value":"mine"}`, http.StatusForbidden},
+		{http.MethodGet, "/kv/tb", "", http.StatusForbidden},
+		{http.MethodPost, "/txn/tb", `{"ops":[{"op":"put","key":"k","value":"mine"}]}`, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			if w := do(tt.method, tt.path, "Authorization", "Bearer "+token, tt.body); w.Code != tt.want {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+
+	// tb's key is as the admin key wrote it
+	w := do(http.MethodGet, "/kv/tb/k", apiKeyHeader, "admin-key", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"theirs"`) {
+		t.Errorf("GET /kv/tb/k after the token's writes: status %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestVerifiedTokensExpire(t *testing.T) {
+	srv := newJWTServer(t)
+	now := time.Now()
+	srv.tokens.now = func() time.Time { return now }
+	exp := now.Add(time.Minute)
+	token := signToken(t, map[string]any{"exp": float64(exp.Unix()), "ns": "ta", "perms": []string{"read"}})
+
+	if _, _, ok := srv.tokens.verify(context.Background(), token); !ok {
+		t.Fatal("a valid token did not verify")
+	}
+	// Remembered until exp plus the clock skew, and not after
+	now = exp.Add(jwt.ClockSkew - time.Second)
+	if _, _, ok := srv.tokens.verify(context.Background(), token); !ok {
+		t.Fatal("a token within the clock skew of its exp did not verify")
+	}
+	now = exp.Add(jwt.ClockSkew)
+	if _, _, ok := srv.tokens.verify(context.Background(), token); ok {
+		t.Fatal("an expired token verified from the cache")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/ta/k", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("GET with an expired token: status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestVerifiedTokensAreBounded(t *testing.T) {
+	srv := newJWTServer(t)
+	exp := float64(time.Now().Add(time.Hour).Unix())
+	for i := 0; i < maxVerifiedTokens+10; i++ {
+		token := signToken(t, map[string]any{"exp": exp, "ns": fmt.Sprintf("t%d", i)})
+		if _, _, ok := srv.tokens.verify(context.Background(), token); !ok {
+			t.Fatalf("token %d did not verify", i)
+		}
+		srv.tokens.mu.Lock()
+		n := len(srv.tokens.verified)
+		srv.tokens.mu.Unlock()
+		if n > maxVerifiedTokens {
+			t.Fatalf("%d tokens remembered after %d verified, want at most %d", n, i+1, maxVerifiedTokens)
+		}
+	}
+}
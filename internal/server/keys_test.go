@@ -0,0 +1,104 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"kv-server/internal/database"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// randomKey produces keys with characters that need care in URLs.
+func randomKey(rng *rand.Rand) string {
+	const alphabet = "abcXYZ019-_.~ %/?#&=+:;@!$'()*,\"<>\\é世"
+	runes := []rune(alphabet)
+	var b strings.Builder
+	for n := 1 + rng.Intn(12); n > 0; n-- {
+		b.WriteRune(runes[rng.Intn(len(runes))])
+	}
+	return b.String()
+}
+
+// checkKeyRoundTrip writes value to key through its escaped URL path and
+// reads it back, from the cache and then from the database.
+func checkKeyRoundTrip(t *testing.T, srv *KVServer, key, value string) {
+	body, _ := json.Marshal(Request{Value: value})
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/kv/"+url.PathEscape(key), bytes.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("PUT %q: status %d: %s", key, w.Code, w.Body)
+	}
+
+	for _, source := range []string{"cache", "database"} {
+		w = httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/kv/"+url.PathEscape(key), nil))
+		var resp Response
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("GET %q from the %s: undecodable response %q", key, source, w.Body)
+		}
+		if w.Code != http.StatusOK || resp.Value != value {
+			t.Fatalf("GET %q from the %s: status %d, value %q, want %q", key, source, w.Code, resp.Value, value)
+		}
+		srv.Cache().Delete(key)
+	}
+}
+
+func TestKeyRoundTrip(t *testing.T) {
+	srv := NewKVServer(1000, database.NewMemoryDB(database.Faults{}))
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		// A leading slash would collapse into the route prefix
+		key := strings.TrimLeft(randomKey(rng), "/")
+		if key == "" {
+			continue
+		}
+		checkKeyRoundTrip(t, srv, key, fmt.Sprintf("value-%d", i))
+	}
+}
+
+func FuzzKeyRoundTrip(f *testing.F) {
+	for _, key := range []string{"a", "with space", "a/b/c", "100%", "q?x=1#frag", "é世", "..", "a%2Fb"} {
+		f.Add(key)
+	}
+	srv := NewKVServer(1000, database.NewMemoryDB(database.Faults{}))
+	f.Fuzz(func(t *testing.T, key string) {
+		key = strings.TrimLeft(key, "/")
+		// Keys named like other resources, such as "range" or "a/history",
+		// are not readable as keys
+		if key == "" || !utf8.ValidString(key) {
+			t.Skip()
+		}
+		if op, _ := kvRoute(http.MethodGet, key); op != opRead {
+			t.Skip()
+		}
+		if op, _ := kvRoute(http.MethodPut, key); op != opWrite {
+			t.Skip()
+		}
+		checkKeyRoundTrip(t, srv, key, "v")
+	})
+}
+
+// FuzzRequestBody requires a well formed JSON answer that is not 5xx, and
+// no panic, for any body posted to /kv.
+func FuzzRequestBody(f *testing.F) {
+	for _, body := range []string{`{"key":"a","value":"b"}`, `{"key":"kéy","value":"x\ny"}`, `{}`, `[]`, `""`} {
+		f.Add([]byte(body))
+	}
+	srv := NewKVServer(1000, database.NewMemoryDB(database.Faults{}))
+	f.Fuzz(func(t *testing.T, body []byte) {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/kv", bytes.NewReader(body)))
+		if w.Code >= 500 {
+			t.Fatalf("body %q: status %d", body, w.Code)
+		}
+		if !json.Valid(w.Body.Bytes()) {
+			t.Fatalf("body %q: invalid JSON response %q", body, w.Body)
+		}
+	})
+}
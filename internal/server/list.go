@@ -0,0 +1,87 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"kv-server/internal/database"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// ListItem is one key, with its value when requested.
+type ListItem struct {
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+}
+
+// ListResponse is one page of GET /kv. Items is only set when values were
+// requested. NextCursor is empty on the last page.
+type ListResponse struct {
+	Success    bool       `json:"success"`
+	Keys       []string   `json:"keys"`
+	Items      []ListItem `json:"items,omitempty"`
+	NextCursor string     `json:"next_cursor,omitempty"`
+}
+
+// handleList serves GET /kv?prefix=&limit=&cursor=&values=true, listing keys
+// from the database in key order. The cursor is opaque to clients; it
+// encodes the last key of the previous page. Only keys in namespace ns are
+// listed.
+func (s *KVServer) handleList(w http.ResponseWriter, r *http.Request, ns string) {
+	query := r.URL.Query()
+
+	limit := defaultListLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxListLimit {
+			s.sendError(w, fmt.Sprintf("limit must be between 1 and %d", maxListLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	var after string
+	if cursor := query.Get("cursor"); cursor != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil {
+			s.sendError(w, "invalid cursor", http.StatusBadRequest)
+			return
+		}
+		after = database.QualifyKey(ns, string(decoded))
+	}
+	withValues := query.Get("values") == "true"
+
+	// Ask for one extra key to learn whether another page exists
+	items, err := s.db.List(requestCtx(w), database.QualifyKey(ns, query.Get("prefix")), after, limit+1, withValues)
+	if err != nil {
+		log.Printf("Listing keys failed: %v", err)
+		s.sendError(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	resp := ListResponse{Success: true}
+	if len(items) > limit {
+		items = items[:limit]
+		resp.NextCursor = base64.RawURLEncoding.EncodeToString([]byte(displayKey(items[limit-1].Key)))
+	}
+	resp.Keys = make([]string, len(items))
+	for i, kv := range items {
+		resp.Keys[i] = displayKey(kv.Key)
+	}
+	if withValues {
+		resp.Items = make([]ListItem, len(items))
+		for i, kv := range items {
+			resp.Items[i] = ListItem{Key: displayKey(kv.Key), Value: kv.Value}
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"kv-server/internal/database"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultLockTTL is the lease of a lock acquired without ttl_seconds.
+	DefaultLockTTL = 30 * time.Second
+
+	// maxLockTTL bounds a lease, so a holder that dies without releasing
+	// cannot keep a lock for long.
+	maxLockTTL = 24 * time.Hour
+
+	// maxLockNameLen matches the width of the name column.
+	maxLockNameLen = 255
+)
+
+// LockRequest is the optional body of POST /locks/{name}. With a token it
+// renews the lease the token holds instead of acquiring.
+type LockRequest struct {
+	Owner      string `json:"owner,omitempty"`
+	TTLSeconds int64  `json:"ttl_seconds,omitempty"`
+	Token      uint64 `json:"token,omitempty"`
+}
+
+// LockResponse describes a lease: the caller's, or on 409 the holder's.
+type LockResponse struct {
+	Success   bool      `json:"success"`
+	Name      string    `json:"name"`
+	Owner     string    `json:"owner,omitempty"`
+	Token     uint64    `json:"token,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// handleLocks serves the lock API:
+//
+//	POST   /locks/{name}           acquire the lock, or renew the lease of
+//	                               the body's token
+//	GET    /locks/{name}           show the current holder
+//	DELETE /locks/{name}?token=N   release the lock N holds
+//
+// A lease expires on its own after its TTL, freeing the lock. The token is
+// a fencing token to send as X-Fencing-Token on writes the holder makes.
+func (s *KVServer) handleLocks(w http.ResponseWriter, r *http.Request) {
+	locker, ok := s.db.(database.Locker)
+	if !ok {
+		s.sendError(w, "locks not supported by this backend", http.StatusNotImplemented)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/locks/")
+	if name == "" || len(name) > maxLockNameLen {
+		s.sendError(w, "lock name must be 1-255 bytes", http.StatusBadRequest)
+		return
+	}
+
+	class := classWrite
+	if r.Method == http.MethodGet {
+		class = classRead
+	}
+	if !s.admit(w, class) || (class == classWrite && !s.checkWritable(w)) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		s.acquireLock(w, r, locker, name)
+	case http.MethodGet:
+		lock, err := locker.Holder(requestCtx(w), name)
+		if errors.Is(err, database.ErrNotFound) {
+			s.sendError(w, "lock is free", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			s.sendError(w, "database error", http.StatusInternalServerError)
+			return
+		}
+		s.sendLock(w, lock, http.StatusOK, "")
+	case http.MethodDelete:
+		s.releaseLock(w, r, locker, name)
+	}
+}
+
+func (s *KVServer) acquireLock(w http.ResponseWriter, r *http.Request, locker database.Locker, name string) {
+	var req LockRequest
+	if r.ContentLength != 0 {
+		body, ok := s.readBody(w, r)
+		if !ok {
+			return
+		}
+		if len(body) > 0 {
+			if reqErr := decodeJSON(body, &req); reqErr != nil {
+				s.sendRequestError(w, reqErr)
+				return
+			}
+		}
+	}
+	ttl := DefaultLockTTL
+	if req.TTLSeconds != 0 {
+		ttl = time.Duration(req.TTLSeconds) * time.Second
+		if req.TTLSeconds < 0 || ttl > maxLockTTL {
+			s.sendError(w, "ttl_seconds must be between 1 and "+strconv.Itoa(int(maxLockTTL/time.Second)), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if req.Token != 0 {
+		lock, err := locker.Renew(requestCtx(w), name, req.Token, ttl)
+		if errors.Is(err, database.ErrLockNotHeld) {
+			s.sendError(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Printf("Renewing lock %q failed: %v", name, err)
+			s.sendError(w, "database error", http.StatusInternalServerError)
+			return
+		}
+		s.sendLock(w, lock, http.StatusOK, "")
+		return
+	}
+
+	lock, err := locker.Acquire(requestCtx(w), name, req.Owner, ttl)
+	if errors.Is(err, database.ErrLockHeld) {
+		if wait := time.Until(lock.ExpiresAt); wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		}
+		s.stats.countStatus(http.StatusConflict)
+		lock.Name = name
+		s.sendLock(w, lock, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("Acquiring lock %q failed: %v", name, err)
+		s.sendError(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	s.sendLock(w, lock, http.StatusCreated, "")
+}
+
+func (s *KVServer) releaseLock(w http.ResponseWriter, r *http.Request, locker database.Locker, name string) {
+	raw := r.URL.Query().Get("token")
+	if raw == "" {
+		raw = r.Header.Get(fencingTokenHeader)
+	}
+	token, err := parseFencingToken(raw)
+	if err != nil {
+		s.sendError(w, "token is required", http.StatusBadRequest)
+		return
+	}
+	err = locker.Release(requestCtx(w), name, token)
+	if errors.Is(err, database.ErrLockNotHeld) {
+		s.sendError(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Releasing lock %q failed: %v", name, err)
+		s.sendError(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	s.sendSuccess(w, "", http.StatusOK)
+}
+
+// sendLock replies with a lease; success is false for an error message.
+func (s *KVServer) sendLock(w http.ResponseWriter, lock database.Lock, status int, errMsg string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(LockResponse{
+		Success:   errMsg == "",
+		Name:      lock.Name,
+		Owner:     lock.Owner,
+		Token:     lock.Token,
+		ExpiresAt: lock.ExpiresAt,
+		Error:     errMsg,
+	})
+}
+
+// purgeExpiredLocks deletes the rows of expired leases, if the store has
+// locks.
+func (s *KVServer) purgeExpiredLocks() {
+	locker, ok := s.db.(database.Locker)
+	if !ok {
+		return
+	}
+	if _, err := locker.DeleteExpiredLocks(context.Background()); err != nil {
+		log.Printf("Deleting expired locks failed: %v", err)
+	}
+}
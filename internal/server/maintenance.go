@@ -0,0 +1,173 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// MaintenanceWindow is a daily span of time, from Start to End past
+// midnight, in which background maintenance runs at full speed. A window
+// whose End is before its Start spans midnight.
+type MaintenanceWindow struct {
+	Start, End time.Duration
+}
+
+// MaintenancePolicy is what background maintenance does outside every
+// window.
+type MaintenancePolicy int
+
+const (
+	// MaintenanceThrottle runs a single batch per job run, so backlogs
+	// drain slowly rather than in bursts.
+	MaintenanceThrottle MaintenancePolicy = iota
+	// MaintenancePause runs nothing.
+	MaintenancePause
+)
+
+func (p MaintenancePolicy) String() string {
+	if p == MaintenancePause {
+		return "pause"
+	}
+	return "throttle"
+}
+
+// ParseMaintenancePolicy parses "throttle" or "pause".
+func ParseMaintenancePolicy(s string) (MaintenancePolicy, error) {
+	switch s {
+	case "throttle":
+		return MaintenanceThrottle, nil
+	case "pause":
+		return MaintenancePause, nil
+	}
+	return 0, fmt.Errorf("unknown maintenance policy %q, expected throttle or pause", s)
+}
+
+// ParseMaintenanceWindows parses a spec like "02:00-05:00,22:30-23:30" into
+// daily windows.
+func ParseMaintenanceWindows(spec string) ([]MaintenanceWindow, error) {
+	if strings.TrimSpace(spec) == "" {
+		return nil, nil
+	}
+
+	var windows []MaintenanceWindow
+	for _, item := range strings.Split(spec, ",") {
+		from, to, ok := strings.Cut(strings.TrimSpace(item), "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid maintenance window %q, expected HH:MM-HH:MM", item)
+		}
+		start, err := parseTimeOfDay(from)
+		if err != nil {
+			return nil, fmt.Errorf("invalid maintenance window %q: %v", item, err)
+		}
+		end, err := parseTimeOfDay(to)
+		if err != nil {
+			return nil, fmt.Errorf("invalid maintenance window %q: %v", item, err)
+		}
+		if start == end {
+			return nil, fmt.Errorf("maintenance window %q is empty", item)
+		}
+		windows = append(windows, MaintenanceWindow{Start: start, End: end})
+	}
+	return windows, nil
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a time of day", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// contains reports whether the time of day d falls in the window.
+func (w MaintenanceWindow) contains(d time.Duration) bool {
+	if w.Start < w.End {
+		return d >= w.Start && d < w.End
+	}
+	return d >= w.Start || d < w.End
+}
+
+// maintenanceSchedule confines heavy background jobs (expiry sweeps,
+// namespace trims, stats key counts and pruning) to daily windows.
+type maintenanceSchedule struct {
+	windows []MaintenanceWindow
+	loc     *time.Location
+	outside MaintenancePolicy
+}
+
+// maintenancePace is how much work a background job may do in one run.
+type maintenancePace int
+
+const (
+	paceFull maintenancePace = iota
+	paceThrottled
+	pacePaused
+)
+
+// SetMaintenanceWindows confines background maintenance to windows, read as
+// times of day in loc: expiry sweeps, namespace trims, and the stats
+// history's key counts and pruning. Outside them jobs are throttled to a
+// single batch per run or paused, as outside says. No windows lifts the
+// restriction. Call it before starting the jobs.
+func (s *KVServer) SetMaintenanceWindows(windows []MaintenanceWindow, loc *time.Location, outside MaintenancePolicy) {
+	if len(windows) == 0 {
+		s.maintenance = nil
+		return
+	}
+	s.maintenance = &maintenanceSchedule{windows: windows, loc: loc, outside: outside}
+}
+
+// inWindow reports whether t falls in one of the windows.
+func (m *maintenanceSchedule) inWindow(t time.Time) bool {
+	hour, minute, second := t.In(m.loc).Clock()
+	d := time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute + time.Duration(second)*time.Second
+	for _, w := range m.windows {
+		if w.contains(d) {
+			return true
+		}
+	}
+	return false
+}
+
+// maintenancePace returns how much work background maintenance may do now.
+func (s *KVServer) maintenancePace() maintenancePace {
+	m := s.maintenance
+	if m == nil || m.inWindow(time.Now()) {
+		return paceFull
+	}
+	if m.outside == MaintenancePause {
+		return pacePaused
+	}
+	return paceThrottled
+}
+
+// MaintenanceStatus reports the maintenance schedule for /debug/vars.
+type MaintenanceStatus struct {
+	Windows  []string `json:"windows"`
+	Location string   `json:"location"`
+	InWindow bool     `json:"in_window"`
+	Outside  string   `json:"outside"`
+}
+
+// Maintenance returns the maintenance schedule's status, or nil without
+// one.
+func (s *KVServer) Maintenance() *MaintenanceStatus {
+	m := s.maintenance
+	if m == nil {
+		return nil
+	}
+	st := &MaintenanceStatus{
+		Location: m.loc.String(),
+		InWindow: m.inWindow(time.Now()),
+		Outside:  m.outside.String(),
+	}
+	for _, w := range m.windows {
+		st.Windows = append(st.Windows, formatTimeOfDay(w.Start)+"-"+formatTimeOfDay(w.End))
+	}
+	return st
+}
+
+func formatTimeOfDay(d time.Duration) string {
+	return fmt.Sprintf("%02d:%02d", int(d/time.Hour), int(d%time.Hour/time.Minute))
+}
@@ -0,0 +1,472 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"kv-server/internal/database"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// memcachedMaxKey is memcached's own limit on key length.
+	memcachedMaxKey = 250
+
+	// memcachedRelativeExpiry is the largest exptime memcached reads as
+	// seconds from now rather than as a Unix time: 30 days.
+	memcachedRelativeExpiry = 30 * 24 * 60 * 60
+
+	// memcachedFlagsType is the content type a value stored with non-zero
+	// flags gets, carrying them for the next get; a value with flags 0 is
+	// stored like one written through the JSON API.
+	memcachedFlagsType = "application/x-memcached; flags="
+)
+
+// mcRequest is one command on a memcached connection.
+type mcRequest struct {
+	// One made on first use; empty until then
+	id  string
+	ctx requestContext
+}
+
+func (req *mcRequest) requestID() string {
+	if req.id == "" {
+		req.id = newRequestID()
+	}
+	return req.id
+}
+
+// ServeMemcached serves the memcached text protocol on ln, so applications
+// written against memcached can keep their client and get durable storage
+// behind the cache. It speaks get, gets, set, add, cas, delete, incr, decr,
+// version and quit, on keys in namespace ns, which must be "" unless
+// namespaces are on. The protocol has no authentication: every connection
+// is trusted with ns.
+func (s *KVServer) ServeMemcached(ln net.Listener, ns string) error {
+	if err := s.CheckMemcachedNamespace(ns); err != nil {
+		return err
+	}
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go s.serveMemcachedConn(conn, ns)
+	}
+}
+
+func (s *KVServer) serveMemcachedConn(conn net.Conn, ns string) {
+	defer conn.Close()
+
+	br := bufio.NewReaderSize(conn, 8<<10)
+	bw := bufio.NewWriterSize(conn, 8<<10)
+	remoteAddr := conn.RemoteAddr().String()
+	req := &mcRequest{}
+	req.ctx = requestContext{Context: context.Background(), ids: req}
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(fastIdleTimeout))
+		line, err := readLine(br)
+		if errors.Is(err, errFastBadRequest) {
+			bw.WriteString("CLIENT_ERROR line too long\r\n")
+			bw.Flush()
+			return
+		}
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			bw.WriteString("ERROR\r\n")
+			bw.Flush()
+			continue
+		}
+		if fields[0] == "quit" {
+			return
+		}
+
+		req.id = ""
+		req.ctx.reset(context.Background(), s.requestTimeout, time.Now())
+		ok := s.memcachedCommand(req, br, bw, fields, ns, remoteAddr)
+		req.ctx.finish()
+		if !ok {
+			bw.Flush()
+			return
+		}
+
+		// Only flush once no pipelined command is waiting
+		if br.Buffered() == 0 {
+			if err := bw.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// memcachedCommand runs one command and writes its reply. It returns false
+// if the connection cannot go on, because a data block could not be read.
+func (s *KVServer) memcachedCommand(req *mcRequest, br *bufio.Reader, bw *bufio.Writer, fields []string, ns, remoteAddr string) bool {
+	cmd, args := fields[0], fields[1:]
+	noreply := false
+	if cmd != "get" && cmd != "gets" && len(args) > 0 && args[len(args)-1] == "noreply" {
+		noreply, args = true, args[:len(args)-1]
+	}
+
+	var class requestClass
+	switch cmd {
+	case "get", "gets":
+		class = classRead
+	case "set", "add", "cas":
+		// The data block follows, however the command is answered
+		data, ok, reply := readMemcachedData(br, args, cmd == "cas", s.maxBody)
+		if !ok {
+			writeMemcached(bw, reply, false)
+			return false
+		}
+		if reply != "" {
+			writeMemcached(bw, reply, noreply)
+			return true
+		}
+		args = append(args, data)
+		class = classWrite
+	case "delete", "incr", "decr":
+		class = classWrite
+	case "version":
+		bw.WriteString("VERSION kv-server " + strconv.Itoa(APIVersion) + "\r\n")
+		return true
+	default:
+		bw.WriteString("ERROR\r\n")
+		return true
+	}
+
+	if s.limiter != nil && !s.limiter.allow(s.rateLimitClient("", remoteAddr)) {
+		s.stats.rateLimited.Add(1)
+		writeMemcached(bw, "SERVER_ERROR "+errRateLimited, false)
+		return true
+	}
+	if s.shedder != nil {
+		if !s.enterLoad() {
+			writeMemcached(bw, "SERVER_ERROR "+errOverloaded, false)
+			return true
+		}
+		defer s.shedder.leave()
+	}
+	if s.workers != nil {
+		if !s.workers.acquire() {
+			writeMemcached(bw, "SERVER_ERROR "+errOverloaded, false)
+			return true
+		}
+		defer s.workers.release()
+	}
+	s.stats.requests.Add(1)
+	defer s.stats.observe(time.Now())
+	s.ladder.inFlight.Add(1)
+	defer s.ladder.inFlight.Add(-1)
+
+	if level := s.Level(); !level.allows(class) {
+		writeMemcached(bw, "SERVER_ERROR degraded: "+level.String(), false)
+		return true
+	}
+	if class != classRead && !s.writable() {
+		writeMemcached(bw, "SERVER_ERROR "+errReadOnly, false)
+		return true
+	}
+	if class == classRead {
+		s.memcachedGet(req, bw, args, ns, cmd == "gets")
+		return true
+	}
+	s.stats.writes.Add(1)
+	start := time.Now()
+	reply := s.memcachedWrite(req, cmd, args, ns)
+	if s.audit != nil {
+		s.auditMemcached(req, cmd, args, ns, reply, start)
+	}
+	writeMemcached(bw, reply, noreply)
+	return true
+}
+
+// memcachedGet answers get and gets, which also sends each value's
+// revision as its cas unique. Missing keys are left out of the reply.
+func (s *KVServer) memcachedGet(req *mcRequest, bw *bufio.Writer, keys []string, ns string, cas bool) {
+	if len(keys) == 0 {
+		bw.WriteString("ERROR\r\n")
+		return
+	}
+	for _, name := range keys {
+		if !validMemcachedKey(name) {
+			bw.WriteString("CLIENT_ERROR bad command line format\r\n")
+			return
+		}
+	}
+	for _, name := range keys {
+		key := database.QualifyKey(ns, name)
+		if _, blocked := s.quarantine.blocked(key); blocked {
+			continue
+		}
+		v, err := s.readVersioned(&req.ctx, key)
+		if errors.Is(err, database.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			// Values already written stand; the client sees the error
+			// where it expected END
+			fmt.Fprintf(bw, "SERVER_ERROR %s\r\n", memcachedError(err))
+			return
+		}
+		fmt.Fprintf(bw, "VALUE %s %d %d", name, memcachedFlags(v.ContentType), len(v.Value))
+		if cas {
+			fmt.Fprintf(bw, " %d", v.Revision)
+		}
+		bw.WriteString("\r\n")
+		bw.WriteString(v.Value)
+		bw.WriteString("\r\n")
+	}
+	bw.WriteString("END\r\n")
+}
+
+// CheckMemcachedNamespace returns an error if ServeMemcached cannot serve
+// keys in ns, so a bad namespace is caught before anything is served.
+func (s *KVServer) CheckMemcachedNamespace(ns string) error {
+	switch {
+	case s.namespaces && ns == "":
+		return errors.New("a namespace is required with namespaces on")
+	case !s.namespaces && ns != "":
+		return errors.New("a namespace needs namespaces on")
+	case !s.addressable(ns):
+		return errors.New(errInvalidNamespace)
+	}
+	return nil
+}
+
+// memcachedWrite runs a set, add, cas, delete, incr or decr, whose data
+// block, if any, is the last of args, and returns the reply.
+func (s *KVServer) memcachedWrite(req *mcRequest, cmd string, args []string, ns string) string {
+	if len(args) == 0 || !validMemcachedKey(args[0]) {
+		return "CLIENT_ERROR bad command line format"
+	}
+	key := database.QualifyKey(ns, args[0])
+	if _, blocked := s.quarantine.blocked(key); blocked {
+		return "SERVER_ERROR key quarantined"
+	}
+	ctx := &req.ctx
+
+	switch cmd {
+	case "delete":
+		// "delete <key> 0" is the old form, with a hold time of zero
+		if len(args) > 2 || len(args) == 2 && args[1] != "0" {
+			return "CLIENT_ERROR bad command line format"
+		}
+		err := s.remove(ctx, key)
+		if errors.Is(err, database.ErrNotFound) {
+			return "NOT_FOUND"
+		}
+		if err != nil {
+			return "SERVER_ERROR " + memcachedError(err)
+		}
+		return "DELETED"
+
+	case "incr", "decr":
+		if len(args) != 2 {
+			return "CLIENT_ERROR bad command line format"
+		}
+		delta, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			return "CLIENT_ERROR invalid numeric delta argument"
+		}
+		if s.schemas.lookup(ns) != nil {
+			s.stats.schemaRejected.Add(1)
+			return "CLIENT_ERROR " + errSchemaUnchecked
+		}
+		value, err := s.memcachedIncr(ctx, key, delta, cmd == "decr")
+		switch {
+		case errors.Is(err, database.ErrNotFound):
+			return "NOT_FOUND"
+		case errors.Is(err, database.ErrNotInteger):
+			return "CLIENT_ERROR cannot increment or decrement non-numeric value"
+		case err != nil:
+			return "SERVER_ERROR " + memcachedError(err)
+		}
+		return value
+	}
+
+	// set, add and cas: key, flags, exptime, bytes, [cas unique,] data
+	flags, err := strconv.ParseUint(args[1], 10, 32)
+	if err != nil {
+		return "CLIENT_ERROR bad command line format"
+	}
+	exptime, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		return "CLIENT_ERROR bad command line format"
+	}
+	expiresAt := memcachedExpiry(exptime, time.Now())
+	contentType := ""
+	if flags != 0 {
+		contentType = memcachedFlagsType + strconv.FormatUint(flags, 10)
+	}
+	value := args[len(args)-1]
+	if reqErr := s.schemaError(key, value); reqErr != nil {
+		return "CLIENT_ERROR " + reqErr.msg
+	}
+	if status, msg := s.quotaError(ctx, key, len(value)); status != 0 {
+		return "SERVER_ERROR " + msg
+	}
+
+	switch cmd {
+	case "set":
+		_, err = s.write(ctx, key, value, contentType, expiresAt)
+	case "add":
+		_, err = s.create(ctx, key, value, contentType, expiresAt)
+	case "cas":
+		var revision uint64
+		if revision, err = strconv.ParseUint(args[4], 10, 64); err != nil {
+			return "CLIENT_ERROR bad command line format"
+		}
+		_, err = s.update(ctx, key, value, contentType, expiresAt, revision)
+	}
+	switch {
+	case errors.Is(err, database.ErrExists):
+		return "NOT_STORED"
+	case errors.Is(err, database.ErrRevisionMismatch):
+		return "EXISTS"
+	case errors.Is(err, database.ErrNotFound):
+		return "NOT_FOUND"
+	case err != nil:
+		return "SERVER_ERROR " + memcachedError(err)
+	}
+	return "STORED"
+}
+
+// memcachedIncr adds delta to key's value, or subtracts it if decr, as
+// memcached does: the value is an unsigned 64-bit integer that incr wraps
+// and decr stops at 0, and a missing key is ErrNotFound rather than
+// created. The store's counters are signed, so it reads the value and
+// writes it back if the revision still holds, trying again if not.
+func (s *KVServer) memcachedIncr(ctx context.Context, key string, delta uint64, decr bool) (string, error) {
+	for {
+		rec, err := s.db.ReadRecord(ctx, key)
+		if err != nil {
+			return "", err
+		}
+		n, err := strconv.ParseUint(rec.Value, 10, 64)
+		if err != nil {
+			return "", database.ErrNotInteger
+		}
+		switch {
+		case !decr:
+			n += delta
+		case delta > n:
+			n = 0
+		default:
+			n -= delta
+		}
+		value := strconv.FormatUint(n, 10)
+		_, err = s.update(ctx, key, value, rec.ContentType, rec.ExpiresAt, rec.Revision)
+		if errors.Is(err, database.ErrRevisionMismatch) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return value, nil
+	}
+}
+
+// readMemcachedData reads the data block of a storage command, given its
+// arguments after the command name and before any noreply. It returns a reply instead if the
+// command line is malformed; ok is false if the block could not be read
+// past, and the connection must be closed.
+func readMemcachedData(br *bufio.Reader, args []string, cas bool, maxBody int64) (data string, ok bool, reply string) {
+	n := 4
+	if cas {
+		n = 5
+	}
+	if len(args) != n {
+		return "", true, "ERROR"
+	}
+	size, err := strconv.ParseInt(args[3], 10, 64)
+	if err != nil || size < 0 {
+		return "", false, "CLIENT_ERROR bad data chunk"
+	}
+	if size > maxBody {
+		// Skip the block so the connection stays usable
+		if _, err := io.CopyN(io.Discard, br, size+2); err != nil {
+			return "", false, ""
+		}
+		return "", true, "SERVER_ERROR object too large for cache"
+	}
+	buf := make([]byte, size+2)
+	if _, err := io.ReadFull(br, buf); err != nil {
+		return "", false, ""
+	}
+	if buf[size] != '\r' || buf[size+1] != '\n' {
+		return "", false, "CLIENT_ERROR bad data chunk"
+	}
+	return string(buf[:size]), true, ""
+}
+
+// writeMemcached writes a one-line reply, unless the client asked for none.
+func writeMemcached(bw *bufio.Writer, reply string, noreply bool) {
+	if reply == "" || noreply {
+		return
+	}
+	bw.WriteString(reply)
+	bw.WriteString("\r\n")
+}
+
+// memcachedError is the message of a SERVER_ERROR for err.
+func memcachedError(err error) string {
+	if errors.Is(err, errCacheOnly) {
+		return err.Error()
+	}
+	return "database error"
+}
+
+// memcachedExpiry converts an exptime to an expiry: 0 never expires, up to
+// 30 days is seconds from now, anything larger a Unix time, and a negative
+// one has already passed.
+func memcachedExpiry(exptime int64, now time.Time) time.Time {
+	switch {
+	case exptime == 0:
+		return time.Time{}
+	case exptime < 0:
+		return now.Add(-time.Second)
+	case exptime <= memcachedRelativeExpiry:
+		return now.Add(time.Duration(exptime) * time.Second)
+	}
+	return time.Unix(exptime, 0)
+}
+
+// memcachedFlags returns the flags a value was stored with, 0 for a value
+// not stored through memcached.
+func memcachedFlags(contentType string) uint32 {
+	raw, ok := strings.CutPrefix(contentType, memcachedFlagsType)
+	if !ok {
+		return 0
+	}
+	flags, _ := strconv.ParseUint(raw, 10, 32)
+	return uint32(flags)
+}
+
+// validMemcachedKey reports whether name is a key memcached would accept:
+// at most 250 bytes with no control characters or spaces.
+func validMemcachedKey(name string) bool {
+	if name == "" || len(name) > memcachedMaxKey {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if name[i] <= ' ' || name[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
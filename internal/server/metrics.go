@@ -0,0 +1,347 @@
+package server
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// metricMethods are the methods requests are counted by; anything else
+// counts as "other".
+var metricMethods = [...]string{"GET", "HEAD", "PUT", "POST", "DELETE", "other"}
+
+// latencyBuckets are the upper bounds, in seconds, of the request latency
+// histogram.
+var latencyBuckets = [...]float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// requestMetrics counts /kv requests by method and status, with a latency
+// histogram per method. Every field is an atomic, so recording a request
+// takes no lock and allocates nothing.
+type requestMetrics struct {
+	// Indexed by method, then status - 100
+	counts  [len(metricMethods)][500]atomic.Uint64
+	latency [len(metricMethods)]latencyHistogram
+}
+
+type latencyHistogram struct {
+	// buckets[i] counts requests no slower than latencyBuckets[i] and
+	// slower than the bucket before; the last counts the rest
+	buckets [len(latencyBuckets) + 1]atomic.Uint64
+	sum     atomic.Int64
+}
+
+func methodIndex(method string) int {
+	for i, m := range metricMethods[:len(metricMethods)-1] {
+		if method == m {
+			return i
+		}
+	}
+	return len(metricMethods) - 1
+}
+
+func (m *requestMetrics) observe(method string, status int, d time.Duration) {
+	i := methodIndex(method)
+	if status >= 100 && status < 600 {
+		m.counts[i][status-100].Add(1)
+	}
+
+	h := &m.latency[i]
+	seconds := d.Seconds()
+	b := len(latencyBuckets)
+	for j, le := range latencyBuckets {
+		if seconds <= le {
+			b = j
+			break
+		}
+	}
+	h.buckets[b].Add(1)
+	h.sum.Add(int64(d))
+}
+
+// LatencySummary is the request count, mean and estimated quantiles, in
+// seconds, of a latency histogram.
+type LatencySummary struct {
+	Count uint64  `json:"count"`
+	Mean  float64 `json:"mean_seconds"`
+	P50   float64 `json:"p50_seconds"`
+	P95   float64 `json:"p95_seconds"`
+	P99   float64 `json:"p99_seconds"`
+}
+
+// summary reads the histogram's buckets once and summarizes them; an empty
+// histogram is all zeros.
+func (h *latencyHistogram) summary() LatencySummary {
+	var counts [len(latencyBuckets) + 1]uint64
+	var total uint64
+	for i := range h.buckets {
+		counts[i] = h.buckets[i].Load()
+		total += counts[i]
+	}
+	if total == 0 {
+		return LatencySummary{}
+	}
+	return LatencySummary{
+		Count: total,
+		Mean:  time.Duration(h.sum.Load()).Seconds() / float64(total),
+		P50:   bucketQuantile(&counts, total, 0.5),
+		P95:   bucketQuantile(&counts, total, 0.95),
+		P99:   bucketQuantile(&counts, total, 0.99),
+	}
+}
+
+// bucketQuantile estimates the q-quantile of total requests counted in
+// counts the way Prometheus's histogram_quantile does: by interpolating
+// linearly within the bucket it falls in. One in the last bucket, which
+// has no upper bound, is reported as the highest bound.
+func bucketQuantile(counts *[len(latencyBuckets) + 1]uint64, total uint64, q float64) float64 {
+	rank := q * float64(total)
+	var below uint64
+	for i, n := range counts {
+		if n > 0 && float64(below+n) >= rank {
+			if i == len(latencyBuckets) {
+				break
+			}
+			lower := 0.0
+			if i > 0 {
+				lower = latencyBuckets[i-1]
+			}
+			return lower + (latencyBuckets[i]-lower)*(rank-float64(below))/float64(n)
+		}
+		below += n
+	}
+	return latencyBuckets[len(latencyBuckets)-1]
+}
+
+// statusWriter wraps every request's ResponseWriter. It records the status
+// a handler answers with and the bytes it writes, and holds the request's
+// ID and database context. They are pooled so wrapping a request allocates
+// nothing.
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+
+	// The client's X-Request-ID, or one made on first use; empty until then
+	id  string
+	ctx requestContext
+
+	// The key a request carried in its body, for the audit log
+	auditKey string
+
+	// Set by negotiateCompression: while compressMin is non-zero the
+	// header is held back for startBody. gz is the gzipped body, written
+	// through wire.
+	compressMin int
+	acceptsGzip bool
+	gz          *gzip.Writer
+	wire        countingWriter
+}
+
+var statusWriters = sync.Pool{New: func() any {
+	sw := new(statusWriter)
+	sw.ctx = requestContext{Context: context.Background(), ids: sw}
+	return sw
+}}
+
+// wrapWriter wraps w for r, echoing a valid X-Request-ID from r.
+func wrapWriter(w http.ResponseWriter, r *http.Request) *statusWriter {
+	sw := statusWriters.Get().(*statusWriter)
+	sw.ResponseWriter, sw.status, sw.bytes, sw.wroteHeader, sw.id = w, http.StatusOK, 0, false, ""
+	sw.compressMin, sw.acceptsGzip, sw.auditKey = 0, false, ""
+	if ids := r.Header[requestIDHeader]; len(ids) > 0 && validRequestID(ids[0]) {
+		sw.id = ids[0]
+		w.Header()[requestIDHeader] = ids[:1]
+	}
+	return sw
+}
+
+func (sw *statusWriter) release() {
+	sw.ctx.finish()
+	sw.ResponseWriter = nil
+	statusWriters.Put(sw)
+}
+
+// requestID returns the request's ID. Making one costs allocations, so a
+// request that neither fails, is logged nor reaches the database never
+// gets one; once made, it is sent back in X-Request-ID unless the header
+// is already written.
+func (sw *statusWriter) requestID() string {
+	if sw.id == "" {
+		sw.id = newRequestID()
+		if !sw.wroteHeader {
+			sw.Header()[requestIDHeader] = []string{sw.id}
+		}
+	}
+	return sw.id
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	sw.status = status
+	sw.wroteHeader = true
+	if sw.compressMin == 0 {
+		sw.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	sw.wroteHeader = true
+	if sw.compressMin > 0 {
+		sw.startBody(len(b))
+	}
+	var n int
+	var err error
+	if sw.gz != nil {
+		n, err = sw.gz.Write(b)
+	} else {
+		n, err = sw.ResponseWriter.Write(b)
+	}
+	sw.bytes += int64(n)
+	return n, err
+}
+
+// Flush lets watch streams through the wrapper.
+func (sw *statusWriter) Flush() {
+	if sw.compressMin > 0 {
+		sw.startBody(0)
+	}
+	if sw.gz != nil {
+		sw.gz.Flush()
+	}
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// serveMeasured serves a /kv request with handleKV, counting it by method
+// and status.
+func (s *KVServer) serveMeasured(sw *statusWriter, r *http.Request) {
+	start := time.Now()
+	s.handleKV(sw, r)
+	s.metrics.observe(r.Method, sw.status, time.Since(start))
+}
+
+// MetricsHandler serves the server's metrics in the Prometheus text
+// exposition format: /kv requests by method and status with their latency
+// and its estimated p50, p95 and p99,
+// cache hits, misses and evictions, bytes saved by compression, and, with a
+// health monitor attached, the database connection pool.
+func (s *KVServer) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		bw := bufio.NewWriter(w)
+		s.writeMetrics(bw)
+		bw.Flush()
+	})
+}
+
+func (s *KVServer) writeMetrics(w *bufio.Writer) {
+	header(w, "kv_requests_total", "counter", "Requests to /kv by method and status.")
+	for i, method := range metricMethods {
+		for j := range s.metrics.counts[i] {
+			if n := s.metrics.counts[i][j].Load(); n > 0 {
+				w.WriteString(`kv_requests_total{method="` + method + `",status="` + strconv.Itoa(j+100) + `"} `)
+				writeUint(w, n)
+			}
+		}
+	}
+
+	header(w, "kv_request_duration_seconds", "histogram", "Latency of /kv requests by method.")
+	for i, method := range metricMethods {
+		h := &s.metrics.latency[i]
+		var cumulative uint64
+		for j := range h.buckets {
+			cumulative += h.buckets[j].Load()
+			le := "+Inf"
+			if j < len(latencyBuckets) {
+				le = strconv.FormatFloat(latencyBuckets[j], 'g', -1, 64)
+			}
+			w.WriteString(`kv_request_duration_seconds_bucket{method="` + method + `",le="` + le + `"} `)
+			writeUint(w, cumulative)
+		}
+		w.WriteString(`kv_request_duration_seconds_sum{method="` + method + `"} `)
+		writeFloat(w, time.Duration(h.sum.Load()).Seconds())
+		w.WriteString(`kv_request_duration_seconds_count{method="` + method + `"} `)
+		writeUint(w, cumulative)
+	}
+
+	header(w, "kv_request_duration_quantile_seconds", "gauge", "Latency quantiles of /kv requests by method, estimated from the histogram.")
+	for i, method := range metricMethods {
+		sum := s.metrics.latency[i].summary()
+		if sum.Count == 0 {
+			continue
+		}
+		for _, q := range [...]struct {
+			label string
+			value float64
+		}{{"0.5", sum.P50}, {"0.95", sum.P95}, {"0.99", sum.P99}} {
+			w.WriteString(`kv_request_duration_quantile_seconds{method="` + method + `",quantile="` + q.label + `"} `)
+			writeFloat(w, q.value)
+		}
+	}
+
+	hits, misses := s.cache.GetStats()
+	metric(w, "kv_cache_hits_total", "counter", "Cache lookups that hit.", float64(hits))
+	metric(w, "kv_cache_misses_total", "counter", "Cache lookups that missed.", float64(misses))
+	metric(w, "kv_cache_evictions_total", "counter", "Cache entries evicted for capacity.", float64(s.cache.Evictions()))
+	metric(w, "kv_cache_entries", "gauge", "Entries in the cache.", float64(s.cache.Len()))
+	metric(w, "kv_cache_bytes", "gauge", "Weight of the cached values in bytes.", float64(s.cache.Weight()))
+	metric(w, "kv_degradation_level", "gauge", "Rung of the degradation ladder, 0 for healthy.", float64(s.Level()))
+
+	c := &s.compression
+	header(w, "kv_compressed_bodies_total", "counter", "Gzipped request and response bodies.")
+	w.WriteString(`kv_compressed_bodies_total{direction="request"} `)
+	writeUint(w, c.requests.Load())
+	w.WriteString(`kv_compressed_bodies_total{direction="response"} `)
+	writeUint(w, c.responses.Load())
+	header(w, "kv_compression_saved_bytes_total", "counter", "Bytes gzip kept off the wire, net of any bodies it grew.")
+	w.WriteString(`kv_compression_saved_bytes_total{direction="request"} `)
+	writeFloat(w, float64(c.requestSaved.Load()))
+	w.WriteString(`kv_compression_saved_bytes_total{direction="response"} `)
+	writeFloat(w, float64(c.responseSaved.Load()))
+
+	if s.health == nil {
+		return
+	}
+	status := s.health.Status()
+	up := 0.0
+	if status.Healthy {
+		up = 1
+	}
+	metric(w, "kv_db_up", "gauge", "Whether the last database ping succeeded.", up)
+	metric(w, "kv_db_connections_open", "gauge", "Open database connections.", float64(status.OpenConnections))
+	metric(w, "kv_db_connections_in_use", "gauge", "Database connections in use.", float64(status.InUse))
+	metric(w, "kv_db_connections_idle", "gauge", "Idle database connections.", float64(status.Idle))
+	metric(w, "kv_db_connections_max_open", "gauge", "Maximum open database connections.", float64(status.MaxOpen))
+	metric(w, "kv_db_waits_total", "counter", "Waits for a pooled database connection.", float64(status.WaitCount))
+	metric(w, "kv_db_wait_seconds_total", "counter", "Time spent waiting for a pooled database connection.", status.WaitDuration.Seconds())
+}
+
+func header(w *bufio.Writer, name, kind, help string) {
+	w.WriteString("# HELP " + name + " " + help + "\n# TYPE " + name + " " + kind + "\n")
+}
+
+func metric(w *bufio.Writer, name, kind, help string, value float64) {
+	header(w, name, kind, help)
+	w.WriteString(name + " ")
+	writeFloat(w, value)
+}
+
+func writeUint(w *bufio.Writer, n uint64) {
+	w.WriteString(strconv.FormatUint(n, 10))
+	w.WriteByte('\n')
+}
+
+func writeFloat(w *bufio.Writer, f float64) {
+	w.WriteString(strconv.FormatFloat(f, 'g', -1, 64))
+	w.WriteByte('\n')
+}
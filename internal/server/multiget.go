@@ -0,0 +1,138 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"kv-server/internal/database"
+	"log"
+	"net/http"
+)
+
+// maxMultiGetKeys bounds a single /kv/multi request.
+const maxMultiGetKeys = 1000
+
+// multiGetRequest is the body of POST /kv/multi.
+type multiGetRequest struct {
+	Keys []string `json:"keys"`
+}
+
+// MultiGetResponse maps found keys to values and lists the keys that do not
+// exist.
+type MultiGetResponse struct {
+	Success bool              `json:"success"`
+	Values  map[string]string `json:"values"`
+	Missing []string          `json:"missing"`
+}
+
+// handleMultiGet serves GET /kv/multi?key=a&key=b and POST /kv/multi with
+// {"keys": [...]}. Keys are looked up in the cache first and all misses are
+// read from the database in a single query. Keys are looked up in namespace
+// ns.
+func (s *KVServer) handleMultiGet(w http.ResponseWriter, r *http.Request, ns string) {
+	var keys []string
+	if r.Method == http.MethodPost {
+		if reqErr := checkContentType(r); reqErr != nil {
+			s.sendRequestError(w, reqErr)
+			return
+		}
+		body, ok := s.readBody(w, r)
+		if !ok {
+			return
+		}
+
+		var req multiGetRequest
+		if reqErr := decodeJSON(body, &req); reqErr != nil {
+			s.sendRequestError(w, reqErr)
+			return
+		}
+		keys = req.Keys
+	} else {
+		keys = r.URL.Query()["key"]
+	}
+
+	if len(keys) == 0 {
+		s.sendError(w, "at least one key is required", http.StatusBadRequest)
+		return
+	}
+	if len(keys) > maxMultiGetKeys {
+		s.sendError(w, fmt.Sprintf("at most %d keys per request", maxMultiGetKeys), http.StatusBadRequest)
+		return
+	}
+	for _, key := range keys {
+		if key == "" {
+			s.sendError(w, "key is required", http.StatusBadRequest)
+			return
+		}
+	}
+
+	qualified := make([]string, len(keys))
+	for i, key := range keys {
+		qualified[i] = database.QualifyKey(ns, key)
+	}
+	values, missing, err := s.readMany(requestCtx(w), qualified)
+	if err != nil {
+		log.Printf("Multi-get of %d keys failed: %v", len(keys), err)
+		s.sendError(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	if ns != "" {
+		found := make(map[string]string, len(values))
+		for key, value := range values {
+			found[displayKey(key)] = value
+		}
+		values = found
+		for i, key := range missing {
+			missing[i] = displayKey(key)
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(MultiGetResponse{Success: true, Values: values, Missing: missing})
+}
+
+// readMany returns the values of keys that exist and the (deduplicated)
+// keys that do not, filling the cache with what it reads from the database
+// under ctx.
+func (s *KVServer) readMany(ctx context.Context, keys []string) (map[string]string, []string, error) {
+	values := make(map[string]string, len(keys))
+	var misses []string
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		if value, ok := s.cache.Get(key); ok {
+			values[key] = value
+			s.touch(key)
+		} else {
+			misses = append(misses, key)
+		}
+	}
+
+	missing := []string{}
+	if len(misses) == 0 {
+		return values, missing, nil
+	}
+
+	loaded, err := s.db.ReadBatch(ctx, misses)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, key := range misses {
+		value, ok := loaded[key]
+		if !ok {
+			missing = append(missing, key)
+			continue
+		}
+		values[key] = value
+		if skipsCache(ctx) {
+			s.stats.fillSkipped.Add(1)
+			continue
+		}
+		s.cache.Put(key, value)
+		s.touch(key)
+	}
+	return values, missing, nil
+}
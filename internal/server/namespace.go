@@ -0,0 +1,95 @@
+package server
+
+import (
+	"kv-server/internal/database"
+	"net/http"
+	"strings"
+)
+
+// maxNamespaceLen matches the width of the namespace column.
+const maxNamespaceLen = 64
+
+const errInvalidNamespace = "invalid namespace"
+
+// SetNamespaces switches the /kv routes to /kv/{namespace}/{key}, so several
+// applications can share one deployment without their keys colliding.
+// Namespaces are isolated in the database, cache and watch streams. Keys
+// written before namespaces were enabled stay in the default namespace,
+// which is not addressable while they are on.
+func (s *KVServer) SetNamespaces(enabled bool) {
+	s.namespaces = enabled
+}
+
+// validNamespace reports whether ns is 1-64 letters, digits, '_', '.' or
+// '-', starting with a letter or digit.
+func validNamespace(ns string) bool {
+	if ns == "" || len(ns) > maxNamespaceLen {
+		return false
+	}
+	for i := 0; i < len(ns); i++ {
+		c := ns[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case i > 0 && (c == '_' || c == '.' || c == '-'):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// splitNamespace splits a /kv/{namespace}/{rest} path. rest is empty for
+// /kv/{namespace} itself. It reports false if the namespace is missing or
+// invalid.
+func splitNamespace(path string) (ns, rest string, ok bool) {
+	path, found := strings.CutPrefix(path, "/kv/")
+	if !found {
+		return "", "", false
+	}
+	ns, rest, _ = strings.Cut(path, "/")
+	return ns, rest, validNamespace(ns)
+}
+
+// checkNamespace rejects a namespace named outside the path, e.g. by a watch
+// subscription, that the /kv routes could not address.
+func (s *KVServer) checkNamespace(w http.ResponseWriter, ns string) bool {
+	if !s.addressable(ns) {
+		s.sendError(w, errInvalidNamespace, http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// addressable reports whether the /kv routes can address namespace ns.
+func (s *KVServer) addressable(ns string) bool {
+	return (ns == "") != s.namespaces && (ns == "" || validNamespace(ns))
+}
+
+// qualify returns the Store key of key in namespace ns, leaving an empty key
+// empty so handlers still reject it.
+func qualify(ns, key string) string {
+	if key == "" {
+		return ""
+	}
+	return database.QualifyKey(ns, key)
+}
+
+// displayKey returns key as clients address it: without its namespace.
+func displayKey(key string) string {
+	_, key = database.SplitKey(key)
+	return key
+}
+
+// pathKey returns key as it appears in a /kv path, {namespace}/{key} for
+// keys outside the default namespace, for listings that span namespaces.
+func pathKey(key string) string {
+	if ns, name := database.SplitKey(key); ns != "" {
+		return ns + "/" + name
+	}
+	return key
+}
+
+// adminKey qualifies a key named by an admin route with ?namespace=.
+func adminKey(r *http.Request, key string) string {
+	return qualify(r.URL.Query().Get("namespace"), key)
+}
@@ -0,0 +1,486 @@
+package server
+
+import (
+	"encoding"
+	"encoding/json"
+	"kv-server/internal/cache"
+	"kv-server/internal/database"
+	"kv-server/internal/replication"
+	"kv-server/internal/watch"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const (
+	contentTypeNDJSON = "application/x-ndjson"
+	contentTypeSSE    = "text/event-stream"
+)
+
+// endpoint is one operation of the HTTP API, as the OpenAPI document
+// describes it.
+type endpoint struct {
+	Operation
+	params []param
+	// body and resp are values of the types the request body decodes into
+	// and the reply encodes, nil for none; bodyType and respType are their
+	// content types, JSON if empty
+	body     any
+	bodyType string
+	status   int
+	resp     any
+	respType string
+	// raw endpoints also take or serve the value itself, in any content
+	// type but JSON
+	raw bool
+	// listed endpoints are the data operations /capabilities lists
+	listed bool
+}
+
+// param is a query parameter or header of an endpoint; path parameters
+// come from the path.
+type param struct {
+	name, in, typ, desc string
+}
+
+func queryParam(name, typ, desc string) param  { return param{name, "query", typ, desc} }
+func headerParam(name, typ, desc string) param { return param{name, "header", typ, desc} }
+
+var namespaceParam = queryParam("namespace", "string", "Namespace of the keys")
+
+// endpoints lists every operation the API serves, with paths for the
+// namespace setting.
+func (s *KVServer) endpoints() []endpoint {
+	kv, txn := "/kv", "/txn"
+	if s.namespaces {
+		kv, txn = "/kv/{namespace}", "/txn/{namespace}"
+	}
+	return []endpoint{
+		{
+			Operation: Operation{"GET", kv + "/{key}", "Read a value; Accept selects the raw bytes, at_revision or at_time a past value, version an exact one, X-Consistency: strong skips the cache"},
+			params: []param{
+				queryParam("at_revision", "integer", "Read the value as of this revision"),
+				queryParam("at_time", "string", "Read the value as of this RFC 3339 time"),
+				queryParam("version", "integer", "Read the value this version of the key wrote"),
+				headerParam("If-None-Match", "string", "Reply 304 if the value's ETag matches"),
+				headerParam(consistencyHeader, "string", "strong reads the database, skipping the cache"),
+				headerParam(cacheFillHeader, "string", "skip leaves a value read from the database out of the cache"),
+			},
+			status: http.StatusOK, resp: Response{}, raw: true, listed: true,
+		},
+		{Operation: Operation{"HEAD", kv + "/{key}", "Read a value's metadata"}, status: http.StatusOK, listed: true},
+		{
+			Operation: Operation{"PUT", kv + "/{key}", "Write a value; If-Match makes it conditional, X-Fencing-Token fences it"},
+			params: []param{
+				queryParam("ttl_seconds", "integer", "Expiry of a raw value"),
+				headerParam("If-Match", "string", "Write only if the value's ETag matches"),
+				headerParam(fencingTokenHeader, "integer", "Fencing token of the lock guarding the key"),
+				headerParam(valueChecksumHeader, "string", "CRC-32C of a raw value, as 8 hex digits"),
+				headerParam(cacheFillHeader, "string", "skip drops the key from the cache instead of caching the value"),
+			},
+			body: Request{}, status: http.StatusOK, resp: Response{}, raw: true, listed: true,
+		},
+		{Operation: Operation{"DELETE", kv + "/{key}", "Delete a key"}, status: http.StatusOK, resp: Response{}, listed: true},
+		{
+			Operation: Operation{"POST", kv, "Create a key that must not exist yet"},
+			params:    []param{queryParam("upsert", "boolean", "true overwrites an existing key instead of failing with 409")},
+			body:      Request{}, status: http.StatusCreated, resp: Response{}, listed: true,
+		},
+		{
+			Operation: Operation{"GET", kv, "List keys by prefix, a page at a time"},
+			params: []param{
+				queryParam("prefix", "string", "List only keys starting with this"),
+				queryParam("limit", "integer", "Keys per page"),
+				queryParam("cursor", "string", "Cursor of the next page, from the previous one"),
+				queryParam("values", "boolean", "Include the values"),
+			},
+			status: http.StatusOK, resp: ListResponse{}, listed: true,
+		},
+		{Operation: Operation{"POST", kv + "/batch", "Write many keys in one transaction"}, body: []Request{}, status: http.StatusCreated, resp: BatchResponse{}, listed: true},
+		{Operation: Operation{"POST", txn, "Write several keys atomically if compares on their versions or values hold"}, body: TxnRequest{}, status: http.StatusOK, resp: TxnResponse{}, listed: true},
+		{
+			Operation: Operation{"GET", kv + "/multi", "Read the keys listed in the query"},
+			params:    []param{queryParam("key", "string", "A key to read; repeat it for more")},
+			status:    http.StatusOK, resp: MultiGetResponse{}, listed: true,
+		},
+		{Operation: Operation{"POST", kv + "/multi", "Read the keys listed in the body"}, body: multiGetRequest{}, status: http.StatusOK, resp: MultiGetResponse{}, listed: true},
+		{
+			Operation: Operation{"GET", kv + "/range", "Read the keys from start up to end in key order"},
+			params: []param{
+				queryParam("start", "string", "First key of the range, inclusive; the first key if not given"),
+				queryParam("end", "string", "Key the range stops before; the last key if not given"),
+				queryParam("limit", "integer", "Most keys to return, 100 if not given"),
+				queryParam("keys_only", "boolean", "Leave the values out"),
+			},
+			status: http.StatusOK, resp: RangeResponse{}, listed: true,
+		},
+		{
+			Operation: Operation{"GET", kv + "/count", "Count the keys starting with a prefix"},
+			params: []param{
+				queryParam("prefix", "string", "Count only keys starting with this"),
+				queryParam("approximate", "boolean", "Estimate the number of all keys from table statistics"),
+			},
+			status: http.StatusOK, resp: CountResponse{}, listed: true,
+		},
+		{
+			Operation: Operation{"POST", kv + "/{key}/incr", "Increment a counter"},
+			params:    []param{queryParam("delta", "integer", "Amount to add, 1 if not given")},
+			status:    http.StatusOK, resp: Response{}, listed: true,
+		},
+		{
+			Operation: Operation{"POST", kv + "/{key}/decr", "Decrement a counter"},
+			params:    []param{queryParam("delta", "integer", "Amount to subtract, 1 if not given")},
+			status:    http.StatusOK, resp: Response{}, listed: true,
+		},
+		{
+			Operation: Operation{"POST", kv + "/{key}/append", "Append to a value, creating the key if missing"},
+			body:      Request{}, status: http.StatusOK, resp: Response{}, raw: true, listed: true,
+		},
+		{
+			Operation: Operation{"GET", kv + "/{key}/history", "List a key's versions, newest first"},
+			params:    []param{queryParam("limit", "integer", "Most versions to list, 100 if not given")},
+			status:    http.StatusOK, resp: HistoryResponse{}, listed: true,
+		},
+		{Operation: Operation{"POST", kv + "/{key}/restore", "Undo a key's delete, with soft delete on"}, status: http.StatusOK, resp: Response{}, listed: true},
+		{
+			Operation: Operation{"GET", "/watch", "Stream changes to keys as server-sent events"},
+			params: []param{
+				queryParam("key", "string", "A key to watch; repeat it for more"),
+				queryParam("prefix", "string", "A prefix to watch; repeat it for more"),
+				queryParam("type", "string", "An event type to watch; repeat it for more"),
+				namespaceParam,
+				queryParam("queue", "integer", "Events the stream may fall behind by"),
+				queryParam("policy", "string", "What to do when the queue is full: disconnect or drop"),
+				queryParam("resume", "integer", "Resume after the event with this id"),
+			},
+			status: http.StatusOK, respType: contentTypeSSE, listed: true,
+		},
+		{Operation: Operation{"GET", "/ws", "Watch keys over a WebSocket, subscribing and unsubscribing with JSON messages"}, status: http.StatusSwitchingProtocols, listed: true},
+		{Operation: Operation{"POST", "/locks/{name}", "Acquire a lock for a lease, returning a fencing token, or renew the lease"}, body: LockRequest{}, status: http.StatusCreated, resp: LockResponse{}, listed: true},
+		{Operation: Operation{"GET", "/locks/{name}", "Show a lock's holder"}, status: http.StatusOK, resp: LockResponse{}, listed: true},
+		{
+			Operation: Operation{"DELETE", "/locks/{name}", "Release a lock"},
+			params:    []param{queryParam("token", "integer", "Fencing token of the lease")},
+			status:    http.StatusOK, resp: Response{}, listed: true,
+		},
+		{Operation: Operation{"POST", "/uploads", "Start a multi-part upload of a large value"}, body: uploadRequest{}, status: http.StatusCreated, resp: upload{}, listed: true},
+		{Operation: Operation{"GET", "/capabilities", "Describe this server"}, status: http.StatusOK, resp: Capabilities{}, listed: true},
+		{Operation: Operation{"GET", "/openapi.json", "Describe the API as an OpenAPI document"}, status: http.StatusOK, resp: map[string]any{}, listed: true},
+
+		{Operation: Operation{"GET", "/watch/{stream}", "Show a watch stream's queue and lag"}, status: http.StatusOK, resp: watch.StreamStats{}},
+		{Operation: Operation{"GET", "/watch/{stream}/subscriptions", "List a watch stream's subscriptions"}, status: http.StatusOK, resp: []watch.Subscription{}},
+		{Operation: Operation{"POST", "/watch/{stream}/subscriptions", "Add a subscription to a watch stream"}, body: watch.Subscription{}, status: http.StatusCreated, resp: watch.Subscription{}},
+		{Operation: Operation{"DELETE", "/watch/{stream}/subscriptions/{id}", "Remove a subscription from a watch stream"}, status: http.StatusOK, resp: Response{}},
+		{
+			Operation: Operation{"PUT", "/uploads/{id}", "Append a part to an upload"},
+			params:    []param{queryParam("offset", "integer", "Where the part starts; it must be the upload's size")},
+			body:      []byte{}, bodyType: contentTypeOctetStream, status: http.StatusOK, resp: upload{},
+		},
+		{Operation: Operation{"GET", "/uploads/{id}", "Show an upload's size so far"}, status: http.StatusOK, resp: upload{}},
+		{Operation: Operation{"POST", "/uploads/{id}/commit", "Verify an upload's SHA-256 and write its key"}, body: commitRequest{}, status: http.StatusOK, resp: Response{}},
+		{Operation: Operation{"DELETE", "/uploads/{id}", "Abort an upload"}, status: http.StatusOK, resp: Response{}},
+		{Operation: Operation{"GET", "/healthz", "Report that the process is up"}, status: http.StatusOK, resp: Response{}},
+		{Operation: Operation{"GET", "/readyz", "Report whether the server can serve traffic"}, status: http.StatusOK, resp: readinessResponse{}},
+
+		{Operation: Operation{"GET", "/admin/explain/{key}", "Show where a key lives and whether the cache is stale"}, params: []param{namespaceParam}, status: http.StatusOK, resp: explainResponse{}},
+		{Operation: Operation{"GET", "/admin/cache/entries/{key}", "Show the cache metadata of a key"}, params: []param{namespaceParam}, status: http.StatusOK, resp: cacheEntryResponse{}},
+		{
+			Operation: Operation{"GET", "/admin/cache/keys", "List cached keys"},
+			params:    []param{queryParam("prefix", "string", "List only keys starting with this"), queryParam("limit", "integer", "Most keys to list"), namespaceParam},
+			status:    http.StatusOK, resp: cacheKeysResponse{},
+		},
+		{Operation: Operation{"DELETE", "/admin/cache", "Drop every cached entry"}, status: http.StatusOK, resp: cacheFlushResponse{}},
+		{Operation: Operation{"GET", "/admin/cache/shards", "Show the occupancy of every cache shard"}, status: http.StatusOK, resp: cacheShardsResponse{}},
+		{Operation: Operation{"POST", "/admin/cache/rebalance", "Even out the cache shards"}, status: http.StatusAccepted, resp: cache.RebalanceStatus{}},
+		{
+			Operation: Operation{"POST", "/admin/snapshots", "Take a snapshot of keys under a prefix"},
+			params:    []param{queryParam("prefix", "string", "Snapshot only keys starting with this"), namespaceParam},
+			status:    http.StatusCreated, resp: openSnapshot{},
+		},
+		{Operation: Operation{"GET", "/admin/snapshots", "List open snapshots"}, status: http.StatusOK, resp: []openSnapshot{}},
+		{Operation: Operation{"GET", "/admin/snapshots/{id}/kv/{key}", "Read a key as of a snapshot"}, status: http.StatusOK, resp: Response{}},
+		{Operation: Operation{"GET", "/admin/snapshots/{id}/export", "Stream a snapshot's keys as NDJSON"}, status: http.StatusOK, resp: exportRecord{}, respType: contentTypeNDJSON},
+		{Operation: Operation{"DELETE", "/admin/snapshots/{id}", "Release a snapshot"}, status: http.StatusOK, resp: Response{}},
+		{
+			Operation: Operation{"GET", "/admin/export", "Stream every live key as NDJSON"},
+			params:    []param{queryParam("prefix", "string", "Export only keys starting with this"), namespaceParam},
+			status:    http.StatusOK, resp: exportRecord{}, respType: contentTypeNDJSON,
+		},
+		{
+			Operation: Operation{"POST", "/admin/import", "Write keys from an export, streaming progress"},
+			params: []param{
+				queryParam("batch", "integer", "Keys per transaction"),
+				queryParam("namespace", "string", "Namespace of records without one"),
+				queryParam("dry_run", "boolean", "Check every line but write nothing"),
+			},
+			body: exportRecord{}, bodyType: contentTypeNDJSON, status: http.StatusOK, resp: ImportProgress{}, respType: contentTypeNDJSON,
+		},
+		{Operation: Operation{"GET", "/admin/replication", "Show replication counters, peer queues and recent conflicts"}, status: http.StatusOK, resp: replication.Report{}},
+		{Operation: Operation{"POST", "/replication/apply", "Apply a batch of writes from a peer region"}, body: replication.Batch{}, status: http.StatusOK, resp: Response{}},
+		{Operation: Operation{"GET", "/admin/db/index-advice", "Report the workload with recommended indexes"}, status: http.StatusOK, resp: database.IndexReport{}},
+		{Operation: Operation{"POST", "/admin/db/index-advice/{name}", "Create a recommended index"}, status: http.StatusCreated, resp: Response{}},
+		{Operation: Operation{"GET", "/admin/quarantine", "List quarantined keys"}, status: http.StatusOK, resp: quarantineResponse{}},
+		{Operation: Operation{"DELETE", "/admin/quarantine/{key}", "Release a quarantined key early"}, params: []param{namespaceParam}, status: http.StatusOK, resp: Response{}},
+		{Operation: Operation{"GET", "/admin/schemas", "List the JSON Schemas values must match, by namespace"}, status: http.StatusOK, resp: schemasResponse{}},
+		{Operation: Operation{"PUT", "/admin/schemas", "Register the JSON Schema a namespace's values must match"}, params: []param{namespaceParam}, body: map[string]any{}, status: http.StatusOK, resp: Response{}},
+		{Operation: Operation{"DELETE", "/admin/schemas", "Drop a namespace's JSON Schema"}, params: []param{namespaceParam}, status: http.StatusOK, resp: Response{}},
+		{Operation: Operation{"GET", "/admin/quotas", "List namespace quotas with each namespace's usage"}, status: http.StatusOK, resp: quotasResponse{}},
+		{Operation: Operation{"GET", "/admin/read-only", "Report whether read-only mode is on"}, status: http.StatusOK, resp: readOnlyResponse{}},
+		{Operation: Operation{"PUT", "/admin/read-only", "Switch read-only mode on or off"}, body: readOnlyRequest{}, status: http.StatusOK, resp: readOnlyResponse{}},
+		{Operation: Operation{"GET", "/admin/watch", "Show event counts and every open watch stream"}, status: http.StatusOK, resp: watch.HubStats{}},
+		{Operation: Operation{"GET", "/admin/stats", "Show the server's figures"}, status: http.StatusOK, resp: StatsResponse{}},
+		{
+			Operation: Operation{"GET", "/admin/stats/history", "Show hourly statistics"},
+			params:    []param{queryParam("hours", "integer", "Hours to show, 24 if not given")},
+			status:    http.StatusOK, resp: statsHistoryResponse{},
+		},
+	}
+}
+
+// handleOpenAPI serves GET /openapi.json, an OpenAPI 3 description of the
+// API for generating clients. Request bodies are described by the types
+// they decode into, so the document and the server's validation agree.
+func (s *KVServer) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	s.openapi.once.Do(func() {
+		s.openapi.doc, _ = json.Marshal(s.openAPIDocument())
+	})
+	w.WriteHeader(http.StatusOK)
+	w.Write(s.openapi.doc)
+}
+
+// openAPIDoc is the OpenAPI document, built on first request since it
+// depends on settings made before serving.
+type openAPIDoc struct {
+	once sync.Once
+	doc  []byte
+}
+
+func (s *KVServer) openAPIDocument() map[string]any {
+	schemas := &schemaSet{names: make(map[reflect.Type]string), defs: make(map[string]any)}
+	errorReply := map[string]any{
+		"description": "Error",
+		"content":     jsonContent(schemas.of(reflect.TypeOf(Response{}))),
+	}
+
+	paths := make(map[string]map[string]any)
+	for _, e := range s.endpoints() {
+		op := map[string]any{
+			"summary":     e.Description,
+			"operationId": operationID(e.Method, e.Path),
+		}
+		var params []any
+		for _, name := range pathParams(e.Path) {
+			params = append(params, map[string]any{
+				"name": name, "in": "path", "required": true, "schema": map[string]any{"type": "string"},
+			})
+		}
+		for _, p := range e.params {
+			params = append(params, map[string]any{
+				"name": p.name, "in": p.in, "description": p.desc, "schema": map[string]any{"type": p.typ},
+			})
+		}
+		if params != nil {
+			op["parameters"] = params
+		}
+
+		if e.body != nil {
+			content := content(schemas, e.bodyType, e.body)
+			if e.raw {
+				content["*/*"] = map[string]any{"schema": map[string]any{"type": "string", "format": "binary"}}
+			}
+			op["requestBody"] = map[string]any{"required": true, "content": content}
+		}
+		ok := map[string]any{"description": http.StatusText(e.status)}
+		switch {
+		case e.respType == contentTypeSSE:
+			ok["content"] = map[string]any{contentTypeSSE: map[string]any{"schema": map[string]any{"type": "string"}}}
+		case e.resp != nil:
+			content := content(schemas, e.respType, e.resp)
+			if e.raw {
+				content["*/*"] = map[string]any{"schema": map[string]any{"type": "string", "format": "binary"}}
+			}
+			ok["content"] = content
+		}
+		op["responses"] = map[string]any{strconv.Itoa(e.status): ok, "default": errorReply}
+
+		if paths[e.Path] == nil {
+			paths[e.Path] = make(map[string]any)
+		}
+		paths[e.Path][strings.ToLower(e.Method)] = op
+	}
+
+	components := map[string]any{"schemas": schemas.defs}
+	doc := map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "kv-server",
+			"version": strconv.Itoa(APIVersion),
+		},
+		"paths":      paths,
+		"components": components,
+	}
+	if s.auth != nil {
+		schemes := map[string]any{
+			"apiKey": map[string]any{"type": "apiKey", "in": "header", "name": apiKeyHeader},
+		}
+		security := []any{map[string]any{"apiKey": []string{}}}
+		if s.tokens != nil {
+			schemes["bearer"] = map[string]any{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"}
+			security = append(security, map[string]any{"bearer": []string{}})
+		}
+		components["securitySchemes"] = schemes
+		doc["security"] = security
+	}
+	return doc
+}
+
+// content describes a body of v's type in contentType, JSON if empty.
+func content(schemas *schemaSet, contentType string, v any) map[string]any {
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	return map[string]any{contentType: map[string]any{"schema": schemas.of(reflect.TypeOf(v))}}
+}
+
+func jsonContent(schema map[string]any) map[string]any {
+	return map[string]any{"application/json": map[string]any{"schema": schema}}
+}
+
+// pathParams returns the names of the {parameters} in path.
+func pathParams(path string) []string {
+	var names []string
+	for _, seg := range strings.Split(path, "/") {
+		if strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}") {
+			names = append(names, seg[1:len(seg)-1])
+		}
+	}
+	return names
+}
+
+// operationID names an operation for generated clients, as in
+// "getKvKeyIncr" for GET /kv/{key}/incr.
+func operationID(method, path string) string {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(method))
+	upper := true
+	for _, c := range path {
+		switch {
+		case unicode.IsLetter(c) || unicode.IsDigit(c):
+			if upper {
+				c = unicode.ToUpper(c)
+			}
+			b.WriteRune(c)
+			upper = false
+		default:
+			upper = true
+		}
+	}
+	return b.String()
+}
+
+var (
+	timeType        = reflect.TypeOf(time.Time{})
+	rawMessageType  = reflect.TypeOf(json.RawMessage{})
+	textMarshalType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// schemaSet builds the JSON schemas of Go types as encoding/json encodes
+// them. Structs become components, referred to by name.
+type schemaSet struct {
+	names map[reflect.Type]string
+	defs  map[string]any
+}
+
+func (ss *schemaSet) of(t reflect.Type) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t == rawMessageType:
+		return map[string]any{}
+	case t.Implements(textMarshalType):
+		return map[string]any{"type": "string"}
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		return map[string]any{"$ref": "#/components/schemas/" + ss.define(t)}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": ss.of(t.Elem())}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+		return map[string]any{"type": "array", "items": ss.of(t.Elem())}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer", "format": "int64", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	}
+	// Interfaces hold any JSON value
+	return map[string]any{}
+}
+
+// define adds the schema of struct type t to the components, once, and
+// returns its name. Unknown properties are not allowed: request bodies
+// with them are rejected.
+func (ss *schemaSet) define(t reflect.Type) string {
+	if name, ok := ss.names[t]; ok {
+		return name
+	}
+	name := exportedName(t.Name())
+	if _, taken := ss.defs[name]; taken || name == "" {
+		pkg := t.PkgPath()
+		name = exportedName(pkg[strings.LastIndex(pkg, "/")+1:]) + name
+	}
+	ss.names[t] = name
+	ss.defs[name] = nil // reserve the name while fields refer back to t
+
+	props := make(map[string]any)
+	ss.properties(t, props)
+	ss.defs[name] = map[string]any{"type": "object", "properties": props, "additionalProperties": false}
+	return name
+}
+
+// properties adds the JSON properties of struct type t's fields to props,
+// those of embedded structs included.
+func (ss *schemaSet) properties(t reflect.Type, props map[string]any) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			ss.properties(f.Type, props)
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = ss.of(f.Type)
+	}
+}
+
+func exportedName(name string) string {
+	if name == "" {
+		return ""
+	}
+	return strings.ToUpper(name[:1]) + name[1:]
+}
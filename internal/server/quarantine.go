@@ -0,0 +1,245 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"kv-server/internal/database"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultQuarantineThreshold is how many database failures of one key
+	// within the window quarantine it.
+	DefaultQuarantineThreshold = 5
+	DefaultQuarantineWindow    = time.Minute
+	DefaultQuarantineDuration  = 5 * time.Minute
+
+	// maxSuspectKeys bounds the keys tracked at once, so an outage failing
+	// every key cannot grow the map without limit.
+	maxSuspectKeys = 10000
+)
+
+// poisonKey is the failure record of one key.
+type poisonKey struct {
+	Namespace        string    `json:"namespace,omitempty"`
+	Key              string    `json:"key"`
+	Failures         int       `json:"failures"`
+	FirstFailure     time.Time `json:"first_failure"`
+	LastError        string    `json:"last_error"`
+	QuarantinedUntil time.Time `json:"quarantined_until"`
+}
+
+func (p *poisonKey) quarantined() bool {
+	return !p.QuarantinedUntil.IsZero()
+}
+
+// quarantine turns away requests for keys whose database operations keep
+// failing (a value too large for a column, a row the driver cannot decode),
+// so one poison key does not eat the retry capacity of every client.
+type quarantine struct {
+	threshold int
+	window    time.Duration
+	duration  time.Duration
+
+	// tracked mirrors len(keys), letting the hot path skip the lock while
+	// no key is failing
+	tracked  atomic.Int64
+	rejected atomic.Uint64
+
+	mu   sync.Mutex
+	keys map[string]*poisonKey
+}
+
+// SetQuarantine quarantines a key for duration once its database operations
+// fail threshold times within window. Requests for it then get 503 until it
+// is released. Zero threshold disables quarantine.
+func (s *KVServer) SetQuarantine(threshold int, window, duration time.Duration) {
+	if threshold <= 0 {
+		s.quarantine = nil
+		return
+	}
+	s.quarantine = &quarantine{
+		threshold: threshold,
+		window:    window,
+		duration:  duration,
+		keys:      make(map[string]*poisonKey),
+	}
+}
+
+// blocked reports whether key is quarantined and for how much longer.
+func (q *quarantine) blocked(key string) (time.Duration, bool) {
+	if q == nil || q.tracked.Load() == 0 {
+		return 0, false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	p := q.keys[key]
+	if p == nil || !p.quarantined() {
+		return 0, false
+	}
+	remaining := time.Until(p.QuarantinedUntil)
+	if remaining <= 0 {
+		// Served its time; the next failure starts a fresh count
+		q.forget(key)
+		return 0, false
+	}
+	q.rejected.Add(1)
+	return remaining, true
+}
+
+// fail records a database failure of key, quarantining it at the threshold.
+func (q *quarantine) fail(key string, err error) {
+	now := time.Now()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	p := q.keys[key]
+	if p != nil && !p.quarantined() && now.Sub(p.FirstFailure) > q.window {
+		q.forget(key)
+		p = nil
+	}
+	if p == nil {
+		if len(q.keys) >= maxSuspectKeys {
+			return
+		}
+		p = &poisonKey{Key: key, FirstFailure: now}
+		q.keys[key] = p
+		q.tracked.Add(1)
+	}
+	p.Failures++
+	p.LastError = err.Error()
+	if p.Failures >= q.threshold && !p.quarantined() {
+		p.QuarantinedUntil = now.Add(q.duration)
+		log.Printf("Quarantined key %q for %s after %d failures: %v", key, q.duration, p.Failures, err)
+	}
+}
+
+// succeed clears the failure count of a key that is not quarantined.
+func (q *quarantine) succeed(key string) {
+	if q.tracked.Load() == 0 {
+		return
+	}
+	q.mu.Lock()
+	if p := q.keys[key]; p != nil && !p.quarantined() {
+		q.forget(key)
+	}
+	q.mu.Unlock()
+}
+
+// forget drops key's record. The caller holds q.mu.
+func (q *quarantine) forget(key string) {
+	delete(q.keys, key)
+	q.tracked.Add(-1)
+}
+
+// release lifts key's quarantine early, reporting whether it was quarantined.
+func (q *quarantine) release(key string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	p := q.keys[key]
+	if p == nil || !p.quarantined() {
+		return false
+	}
+	q.forget(key)
+	return true
+}
+
+// list returns the currently quarantined keys in key order.
+func (q *quarantine) list() []poisonKey {
+	now := time.Now()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	keys := []poisonKey{}
+	for key, p := range q.keys {
+		if !p.quarantined() {
+			continue
+		}
+		if !now.Before(p.QuarantinedUntil) {
+			q.forget(key)
+			continue
+		}
+		keys = append(keys, *p)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Key < keys[j].Key })
+	for i := range keys {
+		keys[i].Namespace, keys[i].Key = database.SplitKey(keys[i].Key)
+	}
+	return keys
+}
+
+// noteResult feeds the outcome of a database operation on key to the
+// quarantine. Errors that answer the request (a missing key, a failed
+// precondition) show the key works, and failures while the database is
+// known to be down say nothing about the key.
+func (s *KVServer) noteResult(key string, err error) {
+	q := s.quarantine
+	if q == nil {
+		return
+	}
+	if err == nil || errors.Is(err, database.ErrNotFound) || errors.Is(err, database.ErrExists) ||
+		errors.Is(err, database.ErrRevisionMismatch) || errors.Is(err, database.ErrNotInteger) ||
+		errors.Is(err, database.ErrOverflow) || errors.Is(err, database.ErrStaleToken) {
+		q.succeed(key)
+		return
+	}
+	// A client that went away says nothing about the key
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	if s.health != nil && !s.health.Healthy() {
+		return
+	}
+	q.fail(key, err)
+}
+
+// checkQuarantine answers 503 with a Retry-After for a quarantined key and
+// returns false; it returns true if the request may go ahead.
+func (s *KVServer) checkQuarantine(w http.ResponseWriter, key string) bool {
+	remaining, blocked := s.quarantine.blocked(key)
+	if !blocked {
+		return true
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(remaining.Seconds())+1))
+	s.sendError(w, "key quarantined", http.StatusServiceUnavailable)
+	return false
+}
+
+type quarantineResponse struct {
+	Keys     []poisonKey `json:"keys"`
+	Rejected uint64      `json:"rejected"`
+}
+
+// handleQuarantine serves GET /admin/quarantine, listing quarantined keys,
+// and DELETE /admin/quarantine/{key}?namespace=, which releases one early.
+func (s *KVServer) handleQuarantine(w http.ResponseWriter, r *http.Request) {
+	q := s.quarantine
+	if q == nil {
+		s.sendError(w, "quarantine not enabled", http.StatusNotFound)
+		return
+	}
+
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/quarantine"), "/")
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(quarantineResponse{Keys: q.list(), Rejected: q.rejected.Load()})
+	case key != "" && r.Method == http.MethodDelete:
+		if !q.release(adminKey(r, key)) {
+			s.sendError(w, "key not quarantined", http.StatusNotFound)
+			return
+		}
+		s.sendSuccess(w, "", http.StatusOK)
+	default:
+		s.sendError(w, "key is required", http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,328 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kv-server/internal/database"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// quotaRemeasureAfter is how old a namespace's measurement must be before a
+// write that would take it over its quota measures it again.
+const quotaRemeasureAfter = time.Second
+
+// Quota bounds what a namespace may hold; zero leaves a bound off.
+type Quota struct {
+	MaxKeys  int64 `json:"max_keys,omitempty"`
+	MaxBytes int64 `json:"max_bytes,omitempty"`
+}
+
+// ParseQuotas parses a spec like "team-a=10000/1073741824,team-b=0/5000000"
+// into each namespace's maximum key count and value bytes, 0 for no bound.
+func ParseQuotas(spec string) (map[string]Quota, error) {
+	if strings.TrimSpace(spec) == "" {
+		return nil, nil
+	}
+
+	quotas := make(map[string]Quota)
+	for _, item := range strings.Split(spec, ",") {
+		ns, bounds, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok || !validNamespace(ns) {
+			return nil, fmt.Errorf("invalid quota %q, expected namespace=keys/bytes", item)
+		}
+		if _, dup := quotas[ns]; dup {
+			return nil, fmt.Errorf("duplicate quota %q", ns)
+		}
+		keys, bytes, ok := strings.Cut(bounds, "/")
+		maxKeys, err1 := strconv.ParseInt(keys, 10, 64)
+		maxBytes, err2 := strconv.ParseInt(bytes, 10, 64)
+		if !ok || err1 != nil || err2 != nil || maxKeys < 0 || maxBytes < 0 || maxKeys+maxBytes == 0 {
+			return nil, fmt.Errorf("invalid quota for namespace %q, expected keys/bytes with either above 0", ns)
+		}
+		quotas[ns] = Quota{MaxKeys: maxKeys, MaxBytes: maxBytes}
+	}
+	return quotas, nil
+}
+
+// namespaceUsage is what a namespace with a quota holds: as last measured
+// in the database, plus every write since. Overwrites count as new keys in
+// full until the next measurement, so usage errs high, and a write it would
+// turn away measures again first.
+type namespaceUsage struct {
+	quota Quota
+
+	keys       atomic.Int64
+	bytes      atomic.Int64
+	measuredAt atomic.Int64 // Unix nanoseconds
+	rejected   atomic.Uint64
+
+	// Held while measuring, so concurrent writes at the quota measure once
+	measuring sync.Mutex
+}
+
+type quotas struct {
+	store database.UsageReader
+	// Fixed once made, so read without a lock
+	byNS map[string]*namespaceUsage
+}
+
+// StartQuotas enforces a quota on each namespace in limits: a write that
+// would create a key past MaxKeys gets 403, and one that would take the
+// values past MaxBytes gets 413. Usage is measured now and then every
+// interval, and followed between measurements. Call it before serving. The
+// returned function stops the measurements.
+func (s *KVServer) StartQuotas(limits map[string]Quota, interval time.Duration) (stop func(), err error) {
+	store, ok := s.db.(database.UsageReader)
+	if !ok {
+		return nil, errors.New("store cannot measure namespaces")
+	}
+	q := &quotas{store: store, byNS: make(map[string]*namespaceUsage, len(limits))}
+	for ns, quota := range limits {
+		u := &namespaceUsage{quota: quota}
+		if err := q.measure(context.Background(), ns, u); err != nil {
+			return nil, err
+		}
+		q.byNS[ns] = u
+	}
+	s.quotas = q
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				for ns, u := range q.byNS {
+					// Keep the last figures while the database is unreachable
+					if err := q.measure(context.Background(), ns, u); err != nil {
+						log.Printf("Measuring namespace %q failed: %v", ns, err)
+					}
+				}
+			}
+		}
+	}()
+	return func() { close(done) }, nil
+}
+
+// measure replaces u's usage with the database's figures.
+func (q *quotas) measure(ctx context.Context, ns string, u *namespaceUsage) error {
+	u.measuring.Lock()
+	defer u.measuring.Unlock()
+	return q.measureHeld(ctx, ns, u)
+}
+
+// measureHeld is measure for a caller holding u.measuring.
+func (q *quotas) measureHeld(ctx context.Context, ns string, u *namespaceUsage) error {
+	keys, bytes, err := q.store.NamespaceUsage(ctx, ns)
+	if err != nil {
+		return err
+	}
+	u.keys.Store(keys)
+	u.bytes.Store(bytes)
+	u.measuredAt.Store(time.Now().UnixNano())
+	return nil
+}
+
+// lookup returns the usage of key's namespace, or nil if it has no quota.
+func (q *quotas) lookup(key string) *namespaceUsage {
+	if q == nil {
+		return nil
+	}
+	ns, _ := database.SplitKey(key)
+	return q.byNS[ns]
+}
+
+// exceeds reports whether adding keys keys and bytes bytes to what u
+// holds goes over its quota. A write that adds no key may go ahead however
+// many keys the namespace holds.
+func (u *namespaceUsage) exceeds(keys, bytes int64) (status int, msg string) {
+	if u.quota.MaxKeys > 0 && keys > 0 && u.keys.Load()+keys > u.quota.MaxKeys {
+		return http.StatusForbidden, fmt.Sprintf("namespace is at its quota of %d keys", u.quota.MaxKeys)
+	}
+	if u.quota.MaxBytes > 0 && u.bytes.Load()+bytes > u.quota.MaxBytes {
+		return http.StatusRequestEntityTooLarge, fmt.Sprintf("write would take the namespace past its quota of %d bytes", u.quota.MaxBytes)
+	}
+	return 0, ""
+}
+
+// quotaError checks a write of size bytes to key against the quota of its
+// namespace. It returns the status and error to answer with, or 0 if the
+// write may go ahead. Only a write that looks to go over the quota reads
+// the key and, if the figures are stale, measures the namespace again.
+func (s *KVServer) quotaError(ctx context.Context, key string, size int) (int, string) {
+	return s.checkUsage(ctx, key, size, false)
+}
+
+// checkUsage is quotaError for a write that replaces key's value, or that
+// adds size bytes to it if appending.
+func (s *KVServer) checkUsage(ctx context.Context, key string, size int, appending bool) (int, string) {
+	if s.quotas == nil {
+		return 0, ""
+	}
+	t := quotaTally{s: s}
+	return t.add(ctx, key, size, appending)
+}
+
+// quotaTally adds up the writes of one batch, transaction or import, so
+// that each is checked against its namespace's quota together with those
+// before it rather than against the usage from before the request.
+type quotaTally struct {
+	s *KVServer
+	// sizes is the value size of each key counted so far
+	sizes   map[string]int
+	pending map[*namespaceUsage]*usageDelta
+}
+
+// usageDelta is what a tally's writes add to a namespace.
+type usageDelta struct {
+	keys  int64
+	bytes int64
+}
+
+// add is checkUsage for one more write of the tally, counting it if it may
+// go ahead. A key the tally already counted is an overwrite; otherwise,
+// as for single writes, the key is only read when the write looks to go
+// over the quota.
+func (t *quotaTally) add(ctx context.Context, key string, size int, appending bool) (int, string) {
+	u := t.s.quotas.lookup(key)
+	if u == nil {
+		return 0, ""
+	}
+	if t.sizes == nil {
+		t.sizes = make(map[string]int)
+		t.pending = make(map[*namespaceUsage]*usageDelta)
+	}
+	d := t.pending[u]
+	if d == nil {
+		d = &usageDelta{}
+	}
+
+	keys, bytes := int64(1), int64(size)
+	prev, counted := t.sizes[key]
+	if counted {
+		keys = 0
+		if !appending {
+			bytes -= int64(prev)
+		}
+	} else if status, _ := u.exceeds(d.keys+keys, d.bytes+bytes); status != 0 {
+		if time.Since(time.Unix(0, u.measuredAt.Load())) > quotaRemeasureAfter && u.measuring.TryLock() {
+			ns, _ := database.SplitKey(key)
+			err := t.s.quotas.measureHeld(ctx, ns, u)
+			u.measuring.Unlock()
+			if err != nil {
+				log.Printf("Measuring namespace %q failed: %v", ns, err)
+			}
+		}
+		rec, err := t.s.db.ReadRecord(ctx, key)
+		if err != nil && !errors.Is(err, database.ErrNotFound) {
+			return http.StatusInternalServerError, "database error"
+		}
+		if err == nil {
+			keys = 0
+			if appending {
+				prev = len(rec.Value)
+			} else {
+				bytes -= int64(len(rec.Value))
+			}
+		}
+	}
+
+	if status, msg := u.exceeds(d.keys+keys, d.bytes+bytes); status != 0 {
+		u.rejected.Add(1)
+		return status, msg
+	}
+	d.keys += keys
+	d.bytes += bytes
+	t.pending[u] = d
+	if appending {
+		t.sizes[key] = prev + size
+	} else {
+		t.sizes[key] = size
+	}
+	return 0, ""
+}
+
+// reset forgets the counted writes, once they are committed and charged.
+func (t *quotaTally) reset() {
+	clear(t.sizes)
+	clear(t.pending)
+}
+
+// checkQuota answers a write of size bytes to key that would go over its
+// namespace's quota and returns false; it returns true if the write may go
+// ahead.
+func (s *KVServer) checkQuota(w http.ResponseWriter, key string, size int) bool {
+	status, msg := s.quotaError(requestCtx(w), key, size)
+	if status == 0 {
+		return true
+	}
+	s.sendError(w, msg, status)
+	return false
+}
+
+// checkAppendQuota is checkQuota for appending size bytes to key.
+func (s *KVServer) checkAppendQuota(w http.ResponseWriter, key string, size int) bool {
+	status, msg := s.checkUsage(requestCtx(w), key, size, true)
+	if status == 0 {
+		return true
+	}
+	s.sendError(w, msg, status)
+	return false
+}
+
+// chargeQuota adds a committed write of size bytes to key to its
+// namespace's usage.
+func (s *KVServer) chargeQuota(key string, size int) {
+	if u := s.quotas.lookup(key); u != nil {
+		u.keys.Add(1)
+		u.bytes.Add(int64(size))
+	}
+}
+
+// QuotaUsage is a namespace's quota and what it holds.
+type QuotaUsage struct {
+	Namespace  string    `json:"namespace"`
+	Quota      Quota     `json:"quota"`
+	Keys       int64     `json:"keys"`
+	Bytes      int64     `json:"bytes"`
+	MeasuredAt time.Time `json:"measured_at"`
+	Rejected   uint64    `json:"rejected"`
+}
+
+type quotasResponse struct {
+	Success bool         `json:"success"`
+	Quotas  []QuotaUsage `json:"quotas"`
+}
+
+// handleQuotas serves GET /admin/quotas, each namespace's quota and usage.
+func (s *KVServer) handleQuotas(w http.ResponseWriter, r *http.Request) {
+	resp := quotasResponse{Success: true, Quotas: []QuotaUsage{}}
+	if q := s.quotas; q != nil {
+		for ns, u := range q.byNS {
+			resp.Quotas = append(resp.Quotas, QuotaUsage{
+				Namespace:  ns,
+				Quota:      u.quota,
+				Keys:       u.keys.Load(),
+				Bytes:      u.bytes.Load(),
+				MeasuredAt: time.Unix(0, u.measuredAt.Load()).UTC(),
+				Rejected:   u.rejected.Load(),
+			})
+		}
+	}
+	sort.Slice(resp.Quotas, func(i, j int) bool { return resp.Quotas[i].Namespace < resp.Quotas[j].Namespace })
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"kv-server/internal/database"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// RangeResponse is one page of GET /kv/range. NextStart, the first key of
+// the next page, is empty on the last page.
+type RangeResponse struct {
+	Success   bool       `json:"success"`
+	Items     []ListItem `json:"items"`
+	NextStart string     `json:"next_start,omitempty"`
+}
+
+// handleRange serves GET /kv/range?start=&end=&limit=&keys_only=true: the
+// keys from start, inclusive, to end, exclusive, in key order, with their
+// values unless keys_only is set. Without end the range runs to the last
+// key. Only keys in namespace ns are read.
+func (s *KVServer) handleRange(w http.ResponseWriter, r *http.Request, ns string) {
+	ranger, ok := s.db.(database.RangeReader)
+	if !ok {
+		s.sendError(w, "range reads not supported by this backend", http.StatusNotImplemented)
+		return
+	}
+	query := r.URL.Query()
+
+	limit := defaultListLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxListLimit {
+			s.sendError(w, fmt.Sprintf("limit must be between 1 and %d", maxListLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	start, end := query.Get("start"), query.Get("end")
+	if end != "" && end <= start {
+		s.sendError(w, "end must sort after start", http.StatusBadRequest)
+		return
+	}
+	keysOnly := query.Get("keys_only") == "true"
+
+	// Ask for one extra key to learn where the next page starts
+	items, err := ranger.Range(requestCtx(w), database.QualifyKey(ns, start), database.QualifyKey(ns, end), limit+1, keysOnly)
+	if err != nil {
+		log.Printf("Range read failed: %v", err)
+		s.sendError(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	resp := RangeResponse{Success: true}
+	if len(items) > limit {
+		resp.NextStart = displayKey(items[limit].Key)
+		items = items[:limit]
+	}
+	resp.Items = make([]ListItem, len(items))
+	for i, kv := range items {
+		resp.Items[i] = ListItem{Key: displayKey(kv.Key), Value: kv.Value}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
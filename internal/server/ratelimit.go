@@ -0,0 +1,140 @@
+package server
+
+import (
+	"hash/maphash"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimitShards spreads clients over independently locked bucket maps.
+const rateLimitShards = 64
+
+const errRateLimited = "rate limit exceeded"
+
+// rateLimiter keeps a token bucket per client: an API key with
+// authentication on, the remote IP otherwise.
+type rateLimiter struct {
+	rate  float64 // tokens per second
+	burst float64
+	// retryAfter is the Retry-After header of a 429, in seconds: the
+	// longest an empty bucket waits for its next token
+	retryAfter string
+
+	seed   maphash.Seed
+	shards [rateLimitShards]rateShard
+}
+
+type rateShard struct {
+	mu      sync.Mutex
+	buckets map[string]tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// StartRateLimit limits every client to rps requests per second, with bursts
+// of up to burst requests. Requests over the limit get 429 with a
+// Retry-After header. The health probes are exempt. The returned function
+// stops the removal of idle clients' buckets.
+func (s *KVServer) StartRateLimit(rps float64, burst int) (stop func()) {
+	l := &rateLimiter{
+		rate:       rps,
+		burst:      float64(burst),
+		retryAfter: strconv.Itoa(int(math.Ceil(1 / rps))),
+		seed:       maphash.MakeSeed(),
+	}
+	for i := range l.shards {
+		l.shards[i].buckets = make(map[string]tokenBucket)
+	}
+	s.limiter = l
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				l.sweep()
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// allow takes a token from client's bucket, reporting false if it is empty.
+func (l *rateLimiter) allow(client string) bool {
+	shard := &l.shards[maphash.String(l.seed, client)%rateLimitShards]
+	now := time.Now()
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	b, ok := shard.buckets[client]
+	if !ok {
+		b.tokens = l.burst
+	} else {
+		b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	}
+	b.last = now
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	shard.buckets[client] = b
+	return allowed
+}
+
+// sweep drops the buckets of clients idle long enough to have refilled,
+// which are indistinguishable from new ones.
+func (l *rateLimiter) sweep() {
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	now := time.Now()
+	for i := range l.shards {
+		shard := &l.shards[i]
+		shard.mu.Lock()
+		for client, b := range shard.buckets {
+			if now.Sub(b.last) >= full {
+				delete(shard.buckets, client)
+			}
+		}
+		shard.mu.Unlock()
+	}
+}
+
+// checkRateLimit answers 429 for a request over its client's limit and
+// returns false; it returns true if the request may go ahead.
+func (s *KVServer) checkRateLimit(w http.ResponseWriter, r *http.Request) bool {
+	if s.limiter == nil || authExempt(r.URL.Path) {
+		return true
+	}
+	if s.limiter.allow(s.rateLimitClient(s.credential(apiKeyOf(r), authorizationOf(r)), r.RemoteAddr)) {
+		return true
+	}
+	s.stats.rateLimited.Add(1)
+	w.Header().Set("Retry-After", s.limiter.retryAfter)
+	s.sendError(w, errRateLimited, http.StatusTooManyRequests)
+	return false
+}
+
+// rateLimitClient names the client a request is counted against. Requests
+// reaching the limiter with authentication on carry a valid credential, an
+// API key or bearer token.
+func (s *KVServer) rateLimitClient(credential, remoteAddr string) string {
+	if s.auth != nil {
+		return credential
+	}
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return host
+	}
+	return remoteAddr
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"io"
+	"kv-server/internal/cache"
+	"kv-server/internal/fasthash"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// contentTypeOctetStream is served for raw values stored without a type.
+const contentTypeOctetStream = "application/octet-stream"
+
+// valueChecksumHeader carries a raw value's CRC-32C as 8 hex digits, on
+// raw reads and, optionally, raw writes.
+const valueChecksumHeader = "X-Value-CRC32C"
+
+// checkValueChecksum verifies a raw write's value against the checksum the
+// client sent, if any, replying with 400 or 422 and returning false when
+// it is malformed or does not match.
+func (s *KVServer) checkValueChecksum(w http.ResponseWriter, r *http.Request, value string) bool {
+	h := r.Header.Get(valueChecksumHeader)
+	if h == "" {
+		return true
+	}
+	want, err := strconv.ParseUint(strings.TrimSpace(h), 16, 32)
+	if err != nil {
+		s.sendError(w, "invalid "+valueChecksumHeader, http.StatusBadRequest)
+		return false
+	}
+	if got := fasthash.Checksum(value); uint32(want) != got {
+		s.sendError(w, "checksum mismatch: value has crc32c "+formatChecksum(got), http.StatusUnprocessableEntity)
+		return false
+	}
+	return true
+}
+
+func formatChecksum(c uint32) string {
+	var b [8]byte
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i] = hexDigits[c&0xF]
+		c >>= 4
+	}
+	return string(b[:])
+}
+
+// rawContentType reports whether a PUT body is the value itself rather than
+// a JSON request: any Content-Type other than application/json. Form
+// encoding also counts as JSON, since it is what curl -d sends by default.
+// It returns the header as sent, which is stored with the value.
+func rawContentType(r *http.Request) (string, bool) {
+	ct := r.Header.Get("Content-Type")
+	if !isRawType(ct) {
+		return "", false
+	}
+	return ct, true
+}
+
+func isRawType(ct string) bool {
+	if ct == "" {
+		return false
+	}
+	mt, _, err := mime.ParseMediaType(ct)
+	return err == nil && mt != "application/json" && mt != "application/x-www-form-urlencoded"
+}
+
+// rawExpiry is Request.expiry for raw writes, which take ?ttl_seconds=.
+func rawExpiry(r *http.Request) (time.Time, bool) {
+	ttl := r.URL.Query().Get("ttl_seconds")
+	if ttl == "" {
+		return time.Time{}, true
+	}
+	seconds, err := strconv.ParseInt(ttl, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return Request{TTLSeconds: seconds}.expiry()
+}
+
+// wantsRaw reports whether a GET asks for the value's bytes instead of the
+// JSON envelope: its Accept header names application/octet-stream or the
+// media type the value was stored with.
+func wantsRaw(r *http.Request, contentType string) bool {
+	return acceptsRaw(r.Header.Get("Accept"), contentType)
+}
+
+func acceptsRaw(accept, contentType string) bool {
+	if accept == "" {
+		return false
+	}
+	stored, _, _ := mime.ParseMediaType(contentType)
+	for _, part := range strings.Split(accept, ",") {
+		mt, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		if mt == contentTypeOctetStream || (stored != "" && mt == stored) {
+			return true
+		}
+	}
+	return false
+}
+
+// sendRaw writes v's bytes with its stored Content-Type, its version in
+// X-Version and the CRC-32C of the whole value in X-Value-CRC32C. A Range
+// header naming one byte range gets just those bytes with 206, so an
+// interrupted download can resume where it stopped.
+func (s *KVServer) sendRaw(w http.ResponseWriter, r *http.Request, v cache.Versioned[string]) {
+	setRawHeaders(w, v)
+	size := len(v.Value)
+	start, end, status := byteRange(r, size, valueETag(v))
+	switch status {
+	case http.StatusPartialContent:
+		h := w.Header()
+		h.Set("Content-Range", "bytes "+strconv.Itoa(start)+"-"+strconv.Itoa(end-1)+"/"+strconv.Itoa(size))
+		h.Set("Content-Length", strconv.Itoa(end-start))
+		w.WriteHeader(http.StatusPartialContent)
+		io.WriteString(w, v.Value[start:end])
+	case http.StatusRequestedRangeNotSatisfiable:
+		h := w.Header()
+		h.Set("Content-Range", "bytes */"+strconv.Itoa(size))
+		h.Del("Content-Length")
+		h["Content-Type"] = contentTypeJSON
+		s.sendError(w, "range not satisfiable", http.StatusRequestedRangeNotSatisfiable)
+	default:
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, v.Value)
+	}
+}
+
+// byteRange resolves r's Range header against a value of size bytes. It
+// returns 206 with the range [start, end), 416 if the range starts past the
+// value, or 200 if the whole value should be sent. A missing or malformed
+// header, several ranges, or an If-Range other than the value's current
+// strong ETag all get the whole value, as HTTP allows.
+func byteRange(r *http.Request, size int, e *etag) (start, end, status int) {
+	header := r.Header.Get("Range")
+	if header == "" {
+		return 0, size, http.StatusOK
+	}
+	if ifRange := r.Header.Get("If-Range"); ifRange != "" && (e.weak || ifRange != e.tag) {
+		return 0, size, http.StatusOK
+	}
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, size, http.StatusOK
+	}
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return 0, size, http.StatusOK
+	}
+
+	if first == "" {
+		// A suffix range: the last n bytes
+		n, err := strconv.Atoi(last)
+		if err != nil || n < 0 {
+			return 0, size, http.StatusOK
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, http.StatusRequestedRangeNotSatisfiable
+		}
+		return max(size-n, 0), size, http.StatusPartialContent
+	}
+
+	start, err := strconv.Atoi(first)
+	if err != nil || start < 0 {
+		return 0, size, http.StatusOK
+	}
+	end = size
+	if last != "" {
+		n, err := strconv.Atoi(last)
+		if err != nil || n < start {
+			return 0, size, http.StatusOK
+		}
+		end = min(n+1, size)
+	}
+	if start >= size {
+		return 0, 0, http.StatusRequestedRangeNotSatisfiable
+	}
+	return start, end, http.StatusPartialContent
+}
+
+func setRawHeaders(w http.ResponseWriter, v cache.Versioned[string]) {
+	h := w.Header()
+	if v.ContentType != "" {
+		h.Set("Content-Type", v.ContentType)
+	} else {
+		h.Set("Content-Type", contentTypeOctetStream)
+	}
+	h.Set("Content-Length", strconv.Itoa(len(v.Value)))
+	h.Set("Accept-Ranges", "bytes")
+	h.Set(valueChecksumHeader, formatChecksum(fasthash.Checksum(v.Value)))
+	if v.Revision != 0 {
+		h.Set("X-Version", strconv.FormatUint(v.Revision, 10))
+	}
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"errors"
+	"kv-server/internal/database"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// handleReadAt serves GET /kv/{key}?at_revision=N and ?at_time=<RFC 3339>,
+// resolving the key's value as of that revision or time from the store's
+// history, and ?version=V, the value version V wrote, which must be one of
+// the key's. The cache only holds current values, so these always go to
+// the database. It reports false, without replying, if the request asks
+// for none of them.
+func (s *KVServer) handleReadAt(w http.ResponseWriter, r *http.Request, key string) bool {
+	query := r.URL.Query()
+	atRevision, atTime, version := query.Get("at_revision"), query.Get("at_time"), query.Get("version")
+	if atRevision == "" && atTime == "" && version == "" {
+		return false
+	}
+
+	history, ok := s.db.(database.HistoryReader)
+	if !ok {
+		s.sendError(w, "history not supported by this backend", http.StatusNotImplemented)
+		return true
+	}
+	given := 0
+	for _, v := range []string{atRevision, atTime, version} {
+		if v != "" {
+			given++
+		}
+	}
+	if given > 1 {
+		s.sendError(w, "at_revision, at_time and version are mutually exclusive", http.StatusBadRequest)
+		return true
+	}
+
+	var value string
+	var revision uint64
+	var err error
+	switch {
+	case version != "":
+		n, perr := strconv.ParseUint(version, 10, 64)
+		if perr != nil {
+			s.sendError(w, "version must be a non-negative integer", http.StatusBadRequest)
+			return true
+		}
+		value, revision, err = history.ReadAtRevision(key, n)
+		if err == nil && revision != n {
+			// The key was not written at n, only earlier
+			err = database.ErrNotFound
+		}
+	case atRevision != "":
+		n, perr := strconv.ParseUint(atRevision, 10, 64)
+		if perr != nil {
+			s.sendError(w, "at_revision must be a non-negative integer", http.StatusBadRequest)
+			return true
+		}
+		value, revision, err = history.ReadAtRevision(key, n)
+	default:
+		at, perr := time.Parse(time.RFC3339Nano, atTime)
+		if perr != nil {
+			s.sendError(w, "at_time must be an RFC 3339 timestamp", http.StatusBadRequest)
+			return true
+		}
+		value, revision, err = history.ReadAtTime(key, at)
+	}
+
+	switch {
+	case errors.Is(err, database.ErrNotFound):
+		s.sendError(w, "key not found", http.StatusNotFound)
+	case err != nil:
+		s.sendError(w, "database error", http.StatusInternalServerError)
+	default:
+		s.sendVersioned(w, value, revision, http.StatusOK)
+	}
+	return true
+}
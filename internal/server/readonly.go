@@ -0,0 +1,118 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const errReadOnly = "read-only mode"
+
+// readOnlyMode is the operator's switch for turning writes away, as during
+// a migration or a database failover. Unlike the ReadOnly rung of the
+// degradation ladder, which keeps every read off the database too, it
+// leaves reads alone.
+type readOnlyMode struct {
+	on atomic.Bool
+
+	mu     sync.Mutex
+	since  time.Time
+	reason string
+}
+
+// ReadOnlyStatus reports whether read-only mode is on, since when and why.
+type ReadOnlyStatus struct {
+	ReadOnly bool      `json:"read_only"`
+	Since    time.Time `json:"since"`
+	Reason   string    `json:"reason,omitempty"`
+}
+
+// SetReadOnly switches read-only mode on or off. While it is on, every
+// mutation gets 503, from /kv, transactions, upload commits, locks,
+// imports, replication from peers and memcached, and the expiry sweeper
+// and namespace trimmer pause; reads are served as usual. It may be called
+// while serving.
+func (s *KVServer) SetReadOnly(on bool, reason string) {
+	m := &s.readOnly
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.on.Load() == on && (!on || reason == m.reason) {
+		return
+	}
+	if !on {
+		reason = ""
+	}
+	m.since, m.reason = time.Now(), reason
+	m.on.Store(on)
+	switch {
+	case !on:
+		log.Printf("Read-only mode off")
+	case reason != "":
+		log.Printf("Read-only mode on (%s)", reason)
+	default:
+		log.Printf("Read-only mode on")
+	}
+}
+
+// ReadOnly returns the state of read-only mode.
+func (s *KVServer) ReadOnly() ReadOnlyStatus {
+	m := &s.readOnly
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return ReadOnlyStatus{ReadOnly: m.on.Load(), Since: m.since, Reason: m.reason}
+}
+
+// writable reports whether mutations may go ahead, counting one turned
+// away if not.
+func (s *KVServer) writable() bool {
+	if !s.readOnly.on.Load() {
+		return true
+	}
+	s.stats.readOnlyRejected.Add(1)
+	return false
+}
+
+// checkWritable answers 503 with a Retry-After for a mutation while
+// read-only mode is on and returns false; it returns true if the mutation
+// may go ahead.
+func (s *KVServer) checkWritable(w http.ResponseWriter) bool {
+	if s.writable() {
+		return true
+	}
+	w.Header().Set("Retry-After", "1")
+	s.sendError(w, errReadOnly, http.StatusServiceUnavailable)
+	return false
+}
+
+type readOnlyRequest struct {
+	ReadOnly *bool  `json:"read_only"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+type readOnlyResponse struct {
+	Success bool `json:"success"`
+	ReadOnlyStatus
+}
+
+// handleReadOnly serves GET /admin/read-only, the state of read-only mode,
+// and PUT /admin/read-only, which switches it with a body like
+// {"read_only": true, "reason": "failover"}. The switch is per instance.
+func (s *KVServer) handleReadOnly(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		body, ok := s.readBody(w, r)
+		if !ok {
+			return
+		}
+		var req readOnlyRequest
+		if err := json.Unmarshal(body, &req); err != nil || req.ReadOnly == nil {
+			s.sendError(w, "body must be a JSON object with a boolean read_only", http.StatusBadRequest)
+			return
+		}
+		s.SetReadOnly(*req.ReadOnly, req.Reason)
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(readOnlyResponse{Success: true, ReadOnlyStatus: s.ReadOnly()})
+}
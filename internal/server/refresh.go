@@ -0,0 +1,54 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"kv-server/internal/database"
+	"log"
+	"time"
+)
+
+// StartRefreshAhead periodically reloads the top most frequently hit cache
+// entries that will expire within window, so popular keys are refreshed from
+// the database before they expire instead of taking a miss. The returned
+// function stops the refresher.
+func (s *KVServer) StartRefreshAhead(top int, window time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		// Scan twice per window so nothing slips through between scans
+		ticker := time.NewTicker(window / 2)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if s.Level() >= Shedding {
+					continue
+				}
+				s.refreshAhead(top, window)
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+func (s *KVServer) refreshAhead(top int, window time.Duration) {
+	refreshed := 0
+	for _, candidate := range s.cache.HotExpiring(window, top) {
+		rec, err := s.db.ReadRecord(context.Background(), candidate.Key)
+		if errors.Is(err, database.ErrNotFound) {
+			s.cache.Delete(candidate.Key)
+			continue
+		}
+		if err != nil {
+			log.Printf("Refresh-ahead of %q failed: %v", candidate.Key, err)
+			continue
+		}
+		if s.cache.Refresh(candidate.Key, recordVersion(rec), candidate.InsertedAt) {
+			refreshed++
+		}
+	}
+	s.stats.refreshAhead.Add(uint64(refreshed))
+}
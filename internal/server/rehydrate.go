@@ -0,0 +1,119 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"kv-server/internal/cache"
+	"kv-server/internal/database"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// rehydrator reloads the hottest keys after the cache is cleared, at a fixed
+// rate, so a flush does not turn every popular key into a simultaneous miss
+// against the database.
+type rehydrator struct {
+	top      int
+	interval time.Duration
+
+	// The keys hot at the last clear; a newer clear replaces a pending set
+	pending chan []string
+
+	queued     atomic.Int64
+	rehydrated atomic.Uint64
+}
+
+// RehydrationStatus reports the progress of rehydration.
+type RehydrationStatus struct {
+	Queued     int64  `json:"queued"`
+	Rehydrated uint64 `json:"rehydrated"`
+}
+
+// StartRehydration makes ClearCache remember the top most frequently hit keys
+// and reload them from the database at perSecond keys per second. Keys that
+// organic reads load first are skipped. Rehydration pauses while the server
+// is shedding. The returned function stops it.
+func (s *KVServer) StartRehydration(top int, perSecond float64) (stop func()) {
+	rh := &rehydrator{
+		top:      top,
+		interval: time.Duration(float64(time.Second) / perSecond),
+		pending:  make(chan []string, 1),
+	}
+	s.rehydrate.Store(rh)
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case keys := <-rh.pending:
+				s.rehydrateKeys(rh, keys, done)
+			}
+		}
+	}()
+	return func() {
+		s.rehydrate.Store(nil)
+		close(done)
+	}
+}
+
+// queue hands the keys hot before a clear to the rehydrator,
+// replacing any set it has not started.
+func (rh *rehydrator) queue(keys []string) {
+	select {
+	case <-rh.pending:
+	default:
+	}
+	rh.queued.Store(int64(len(keys)))
+	rh.pending <- keys
+}
+
+func (s *KVServer) rehydrateKeys(rh *rehydrator, keys []string, done <-chan struct{}) {
+	ticker := time.NewTicker(rh.interval)
+	defer ticker.Stop()
+
+	for len(keys) > 0 {
+		select {
+		case <-done:
+			return
+		case newer := <-rh.pending:
+			// The cache was cleared again; start over with what was hot then
+			keys = newer
+			continue
+		case <-ticker.C:
+		}
+		if s.Level() >= Shedding {
+			continue
+		}
+
+		key := keys[0]
+		keys = keys[1:]
+		rh.queued.Store(int64(len(keys)))
+
+		loaded, err := s.cache.Warm(key, func() (cache.Versioned[string], error) {
+			rec, err := s.db.ReadRecord(context.Background(), key)
+			s.noteResult(key, err)
+			return recordVersion(rec), err
+		})
+		if err != nil && !errors.Is(err, database.ErrNotFound) {
+			log.Printf("Rehydration of %q failed: %v", key, err)
+		}
+		if loaded {
+			rh.rehydrated.Add(1)
+		}
+	}
+}
+
+// Rehydration returns rehydration progress, or nil when it is not running.
+func (s *KVServer) Rehydration() *RehydrationStatus {
+	rh := s.rehydrate.Load()
+	if rh == nil {
+		return nil
+	}
+	return &RehydrationStatus{
+		Queued:     rh.queued.Load(),
+		Rehydrated: rh.rehydrated.Load(),
+	}
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"kv-server/internal/cache"
+	"kv-server/internal/database"
+	"kv-server/internal/replication"
+	"kv-server/internal/watch"
+	"log"
+	"net/http"
+	"time"
+)
+
+// SetReplicator enables experimental active-active replication: local writes
+// are shipped to the replicator's peers and POST /replication/apply accepts
+// theirs.
+func (s *KVServer) SetReplicator(r *replication.Replicator) {
+	s.repl = r
+}
+
+// handleReplicationApply receives a batch of writes from a peer region.
+func (s *KVServer) handleReplicationApply(w http.ResponseWriter, r *http.Request) {
+	if s.repl == nil {
+		s.sendError(w, "replication not enabled", http.StatusNotFound)
+		return
+	}
+
+	body, ok := s.readBody(w, r)
+	if !ok {
+		return
+	}
+
+	var batch replication.Batch
+	if reqErr := decodePeerJSON(body, &batch); reqErr != nil {
+		s.sendRequestError(w, reqErr)
+		return
+	}
+	if batch.Region == s.repl.Region() {
+		s.sendError(w, "batch originates from this region", http.StatusBadRequest)
+		return
+	}
+
+	// The peer retries the batch later
+	if !s.checkWritable(w) {
+		return
+	}
+
+	ctx := requestCtx(w)
+	if err := s.repl.Receive(batch.Ops, func(op replication.Op) error {
+		return s.applyReplicated(ctx, op)
+	}); err != nil {
+		log.Printf("Replication from %s failed: %v", batch.Region, err)
+		s.sendError(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	s.sendSuccess(w, "", http.StatusOK)
+}
+
+// applyReplicated writes a peer's op to the database and cache without
+// shipping it onwards, under ctx.
+func (s *KVServer) applyReplicated(ctx context.Context, op replication.Op) error {
+	if op.Deleted {
+		if err := s.deleteRow(ctx, op.Key); err != nil && !errors.Is(err, database.ErrNotFound) {
+			return err
+		}
+		s.cache.Delete(op.Key)
+		s.forgetEncoded(op.Key)
+		s.publish(watch.Delete, op.Key, "", 0)
+		return nil
+	}
+	revision, err := s.db.Create(ctx, op.Key, op.Value, "", time.Time{})
+	if err != nil {
+		return err
+	}
+	s.cache.PutVersioned(op.Key, cache.Versioned[string]{Value: op.Value, Revision: revision})
+	s.forgetEncoded(op.Key)
+	s.publish(watch.Put, op.Key, op.Value, revision)
+	return nil
+}
+
+// handleReplicationReport returns replication counters, peer queues and the
+// most recent conflicts.
+func (s *KVServer) handleReplicationReport(w http.ResponseWriter, r *http.Request) {
+	if s.repl == nil {
+		s.sendError(w, "replication not enabled", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(s.repl.Report())
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"kv-server/internal/database"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// requestIDHeader is X-Request-ID in canonical form, so it can index a
+// header map directly.
+const requestIDHeader = "X-Request-Id"
+
+// maxRequestIDLen bounds a client's X-Request-ID; a longer one is replaced.
+const maxRequestIDLen = 128
+
+// validRequestID reports whether a client's X-Request-ID can be echoed and
+// logged as is: 1 to maxRequestIDLen printable ASCII characters.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID returns a random ID of 16 hex digits.
+func newRequestID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// requestIDer hands out a request's ID, making one on first use.
+type requestIDer interface {
+	requestID() string
+}
+
+// requestContext is the context a request's database calls run under. It
+// is cancelled when the client goes away and, with a request timeout, once
+// the request has run that long. The deadline is only armed when the
+// database first asks for it, so requests served from the cache never pay
+// for a timer. It answers database.RequestIDKey with the request's ID,
+// which is likewise only made once the database asks for one.
+type requestContext struct {
+	context.Context // the request's own context
+	ids             requestIDer
+
+	timeout time.Duration
+	start   time.Time
+	once    sync.Once
+	timed   context.Context
+	cancel  context.CancelFunc
+
+	// The request asked not to fill the cache
+	skipCache bool
+}
+
+// reset readies c for a request that started at start, under parent.
+func (c *requestContext) reset(parent context.Context, timeout time.Duration, start time.Time) {
+	c.Context, c.timeout, c.start = parent, timeout, start
+}
+
+// finish releases the deadline's timer once the request is answered.
+func (c *requestContext) finish() {
+	if c.cancel != nil {
+		c.cancel()
+	}
+	c.once = sync.Once{}
+	c.timed, c.cancel = nil, nil
+	c.skipCache = false
+	c.Context = context.Background()
+}
+
+// ctx returns the context with the request's deadline, arming it on first
+// use.
+func (c *requestContext) ctx() context.Context {
+	if c.timeout <= 0 {
+		return c.Context
+	}
+	c.once.Do(func() {
+		c.timed, c.cancel = context.WithDeadline(c.Context, c.start.Add(c.timeout))
+	})
+	return c.timed
+}
+
+func (c *requestContext) Deadline() (time.Time, bool) { return c.ctx().Deadline() }
+func (c *requestContext) Done() <-chan struct{}       { return c.ctx().Done() }
+func (c *requestContext) Err() error                  { return c.ctx().Err() }
+
+func (c *requestContext) Value(key any) any {
+	if _, ok := key.(database.RequestIDKey); ok {
+		return c.ids.requestID()
+	}
+	return c.Context.Value(key)
+}
+
+// timedOut reports whether the request's deadline passed while it was
+// armed.
+func (c *requestContext) timedOut() bool {
+	return c.timed != nil && errors.Is(c.timed.Err(), context.DeadlineExceeded)
+}
+
+// requestCtx returns the context database calls made while answering w run
+// under: cancelled when the client goes away or the request times out.
+func requestCtx(w http.ResponseWriter) context.Context {
+	if sw, ok := w.(*statusWriter); ok {
+		return &sw.ctx
+	}
+	return context.Background()
+}
+
+// requestIDOf returns the ID of the request w answers, or "" outside
+// ServeHTTP.
+func requestIDOf(w http.ResponseWriter) string {
+	if sw, ok := w.(*statusWriter); ok {
+		return sw.requestID()
+	}
+	return ""
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"kv-server/internal/cache"
+)
+
+// encodedResponse is the complete JSON body of a successful GET, valid while
+// the cached value still has the version it was encoded from.
+type encodedResponse struct {
+	version uint64
+	body    []byte
+}
+
+// SetResponseCache keeps the encoded response bodies of up to entries hot
+// keys (bounded by maxBytes when positive), so repeated hits skip encoding.
+// Zero entries disables it.
+func (s *KVServer) SetResponseCache(entries int, maxBytes int64) {
+	if entries <= 0 {
+		s.encoded = nil
+		return
+	}
+	s.encoded = cache.New[string, encodedResponse](entries,
+		cache.WithWeigher(func(e encodedResponse) int { return len(e.body) }),
+		cache.WithMaxWeight(maxBytes),
+	)
+}
+
+// encodedSuccess returns the success body for a cache hit, encoding and
+// remembering it if needed. It returns nil when the response cache is off or
+// the value did not come from the cache (version 0). The returned slice is
+// shared and must not be modified.
+func (s *KVServer) encodedSuccess(key string, v cache.Versioned[string]) []byte {
+	if s.encoded == nil || v.Version == 0 {
+		return nil
+	}
+	if e, ok := s.encoded.Get(key); ok && e.version == v.Version {
+		return e.body
+	}
+	body := appendResponse(nil, true, v.Value, v.Revision, "", "")
+	s.encoded.Put(key, encodedResponse{version: v.Version, body: body})
+	return body
+}
+
+// forgetEncoded drops a key's encoded response alongside its value. Stale
+// bodies are never served anyway, since versions must match; this just
+// frees them early.
+func (s *KVServer) forgetEncoded(key string) {
+	if s.encoded != nil {
+		s.encoded.Delete(key)
+	}
+}
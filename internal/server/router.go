@@ -0,0 +1,239 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+const errMethodNotAllowed = "method not allowed"
+
+// router dispatches requests by path, then by method. A route's path
+// matches itself; one ending in "/" also matches every path below it, the
+// longest such path winning. A path without a route gets 404, and a method
+// its route lacks gets 405 with an Allow header, both with the usual JSON
+// body. Lookups do not allocate.
+type router struct {
+	exact    map[string]*route
+	prefixes []*route // longest path first
+}
+
+type route struct {
+	path     string
+	handlers map[string]http.HandlerFunc
+	// allow lists the methods with handlers, for the Allow header
+	allow string
+	// counts holds each method's responses, indexed by status - 100
+	counts map[string]*[500]atomic.Uint64
+}
+
+// handle adds h for a pattern like "GET /admin/cache/keys".
+func (rt *router) handle(pattern string, h http.HandlerFunc) {
+	method, path, ok := strings.Cut(pattern, " ")
+	if !ok || method == "" || !strings.HasPrefix(path, "/") {
+		panic("server: invalid route pattern " + pattern)
+	}
+	if rt.exact == nil {
+		rt.exact = make(map[string]*route)
+	}
+
+	r := rt.exact[path]
+	if r == nil {
+		r = &route{path: path, handlers: make(map[string]http.HandlerFunc), counts: make(map[string]*[500]atomic.Uint64)}
+		rt.exact[path] = r
+		if strings.HasSuffix(path, "/") {
+			rt.prefixes = append(rt.prefixes, r)
+			sort.Slice(rt.prefixes, func(i, j int) bool { return len(rt.prefixes[i].path) > len(rt.prefixes[j].path) })
+		}
+	}
+	if r.handlers[method] != nil {
+		panic("server: duplicate route " + pattern)
+	}
+	r.handlers[method] = h
+	r.counts[method] = new([500]atomic.Uint64)
+
+	methods := make([]string, 0, len(r.handlers))
+	for m := range r.handlers {
+		methods = append(methods, m)
+	}
+	sort.Strings(methods)
+	r.allow = strings.Join(methods, ", ")
+}
+
+// lookup returns the route for path, or nil if there is none.
+func (rt *router) lookup(path string) *route {
+	if r := rt.exact[path]; r != nil {
+		return r
+	}
+	for _, r := range rt.prefixes {
+		if strings.HasPrefix(path, r.path) {
+			return r
+		}
+	}
+	return nil
+}
+
+func (s *KVServer) route(w http.ResponseWriter, r *http.Request) {
+	rt := s.routes.lookup(r.URL.Path)
+	if rt == nil {
+		s.sendError(w, "not found", http.StatusNotFound)
+		return
+	}
+	h := rt.handlers[r.Method]
+	if h == nil {
+		s.methodNotAllowed(w, rt.allow)
+		return
+	}
+	h(w, r)
+	if sw, ok := w.(*statusWriter); ok && sw.status >= 100 && sw.status < 600 {
+		rt.counts[r.Method][sw.status-100].Add(1)
+	}
+}
+
+// statusCounts returns the responses of every route but /kv, which the
+// request metrics count, keyed by "METHOD path" and then by status.
+func (rt *router) statusCounts() map[string]map[string]uint64 {
+	out := make(map[string]map[string]uint64)
+	for path, r := range rt.exact {
+		for method, counts := range r.counts {
+			for i := range counts {
+				if n := counts[i].Load(); n > 0 {
+					endpoint := method + " " + path
+					if out[endpoint] == nil {
+						out[endpoint] = make(map[string]uint64)
+					}
+					out[endpoint][strconv.Itoa(i+100)] = n
+				}
+			}
+		}
+	}
+	return out
+}
+
+// methodNotAllowed answers 405 for a method the resource does not have,
+// listing those it has in allow.
+func (s *KVServer) methodNotAllowed(w http.ResponseWriter, allow string) {
+	w.Header().Set("Allow", allow)
+	s.sendError(w, errMethodNotAllowed, http.StatusMethodNotAllowed)
+}
+
+// kvOp is an operation on the /kv routes.
+type kvOp int
+
+const (
+	opNone kvOp = iota
+	opList
+	opCreate
+	opMultiGet
+	opRange
+	opCount
+	opBatch
+	opIncr
+	opDecr
+	opAppend
+	opRestore
+	opHistory
+	opRead
+	opHead
+	opWrite
+	opDelete
+)
+
+var kvOpNames = [...]string{"none", "list", "create", "multi-get", "range", "count", "batch", "incr", "decr", "append", "restore", "history", "read", "head", "write", "delete"}
+
+func (op kvOp) String() string {
+	return kvOpNames[op]
+}
+
+// Allow headers of the /kv resources
+const (
+	allowCollection = "GET, POST"
+	allowMultiGet   = "GET, POST"
+	allowKey        = "DELETE, GET, HEAD, PUT"
+	// A key named like a batch, counter, append or restore resource can
+	// still be read, written and deleted
+	allowKeyOrPost = "DELETE, GET, HEAD, POST, PUT"
+)
+
+// kvRoute resolves the operation method asks for on path, the part of a
+// /kv path below /kv or the namespace:
+//
+//	GET, POST                /kv                      list, create
+//	GET, POST                /kv/multi                read many keys
+//	GET                      /kv/range                read the keys between two
+//	GET                      /kv/count                count keys
+//	POST                     /kv/batch                write many keys
+//	POST                     /kv/{key}/incr, /decr    add to a counter
+//	POST                     /kv/{key}/append         add to the end of a value
+//	POST                     /kv/{key}/restore        undo a soft delete
+//	GET                      /kv/{key}/history        list a key's versions
+//	GET, HEAD, PUT, DELETE   /kv/{key}                read, write, delete
+//
+// For a method the resource does not have it returns opNone and the
+// methods it has.
+func kvRoute(method, path string) (kvOp, string) {
+	switch {
+	case path == "":
+		switch method {
+		case http.MethodGet:
+			return opList, ""
+		case http.MethodPost:
+			return opCreate, ""
+		}
+		return opNone, allowCollection
+	case path == "multi":
+		// "multi" is reserved for multi-get; it is not readable as a
+		// single key
+		if method == http.MethodGet || method == http.MethodPost {
+			return opMultiGet, ""
+		}
+		return opNone, allowMultiGet
+	}
+
+	switch method {
+	case http.MethodGet:
+		// Nor can keys named "range" or "count" or ending in
+		// "/history"; the versions of the latter are those of the key
+		// before it
+		switch path {
+		case "range":
+			return opRange, ""
+		case "count":
+			return opCount, ""
+		}
+		if _, ok := historyTarget(path); ok {
+			return opHistory, ""
+		}
+		return opRead, ""
+	case http.MethodHead:
+		return opHead, ""
+	case http.MethodPut:
+		return opWrite, ""
+	case http.MethodDelete:
+		return opDelete, ""
+	case http.MethodPost:
+		if path == "batch" {
+			return opBatch, ""
+		}
+		if _, negate, ok := incrTarget(path); ok {
+			if negate {
+				return opDecr, ""
+			}
+			return opIncr, ""
+		}
+		if _, ok := appendTarget(path); ok {
+			return opAppend, ""
+		}
+		if _, ok := restoreTarget(path); ok {
+			return opRestore, ""
+		}
+	}
+	_, _, incr := incrTarget(path)
+	_, appendOp := appendTarget(path)
+	if _, restore := restoreTarget(path); incr || appendOp || restore || path == "batch" {
+		return opNone, allowKeyOrPost
+	}
+	return opNone, allowKey
+}
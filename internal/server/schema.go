@@ -0,0 +1,246 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"kv-server/internal/database"
+	"kv-server/internal/jsonschema"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultSchemaReloadInterval is how often StartSchemaReload picks up
+// schemas registered through other instances.
+const DefaultSchemaReloadInterval = 30 * time.Second
+
+// valueSchemas holds the compiled schema of each namespace that has one.
+type valueSchemas struct {
+	// count mirrors len(byNS), letting writes skip the lock while no
+	// namespace has a schema
+	count atomic.Int64
+
+	mu   sync.RWMutex
+	byNS map[string]*jsonschema.Schema
+	text map[string]string
+}
+
+// lookup returns namespace ns's schema, or nil.
+func (v *valueSchemas) lookup(ns string) *jsonschema.Schema {
+	if v.count.Load() == 0 {
+		return nil
+	}
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.byNS[ns]
+}
+
+// replace swaps in the schemas in text, skipping any that do not compile.
+func (v *valueSchemas) replace(text map[string]string) {
+	byNS := make(map[string]*jsonschema.Schema, len(text))
+	for ns, schema := range text {
+		compiled, err := jsonschema.Compile([]byte(schema))
+		if err != nil {
+			log.Printf("Ignoring the schema of namespace %q: %v", ns, err)
+			continue
+		}
+		byNS[ns] = compiled
+	}
+	v.mu.Lock()
+	v.byNS, v.text = byNS, text
+	v.count.Store(int64(len(byNS)))
+	v.mu.Unlock()
+}
+
+func (v *valueSchemas) set(ns, schema string, compiled *jsonschema.Schema) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.byNS == nil {
+		v.byNS, v.text = make(map[string]*jsonschema.Schema), make(map[string]string)
+	}
+	v.byNS[ns], v.text[ns] = compiled, schema
+	v.count.Store(int64(len(v.byNS)))
+}
+
+func (v *valueSchemas) remove(ns string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	delete(v.byNS, ns)
+	delete(v.text, ns)
+	v.count.Store(int64(len(v.byNS)))
+}
+
+// StartSchemaReload loads the value schemas held in the database now and
+// then every interval, so schemas registered through another instance are
+// enforced here too. It is a no-op for stores without schemas. The returned
+// function stops the reloads.
+func (s *KVServer) StartSchemaReload(interval time.Duration) (stop func(), err error) {
+	src, ok := s.db.(database.SchemaStore)
+	if !ok {
+		return func() {}, nil
+	}
+	if err := s.reloadSchemas(src); err != nil {
+		return nil, err
+	}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				// Keep enforcing the last good set while the database is unreachable
+				if err := s.reloadSchemas(src); err != nil {
+					log.Printf("Reloading value schemas failed: %v", err)
+				}
+			}
+		}
+	}()
+	return func() { close(done) }, nil
+}
+
+func (s *KVServer) reloadSchemas(src database.SchemaStore) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.requestTimeout+time.Second)
+	defer cancel()
+	text, err := src.Schemas(ctx)
+	if err != nil {
+		return err
+	}
+	s.schemas.replace(text)
+	return nil
+}
+
+// schemaError checks value, about to be written to key, against the schema
+// of key's namespace. It returns nil if the namespace has none or the value
+// matches it, and counts the rejection otherwise.
+func (s *KVServer) schemaError(key, value string) *requestError {
+	if s.schemas.count.Load() == 0 {
+		return nil
+	}
+	ns, _ := database.SplitKey(key)
+	schema := s.schemas.lookup(ns)
+	if schema == nil {
+		return nil
+	}
+	err := schema.Validate([]byte(value))
+	if err == nil {
+		return nil
+	}
+	s.stats.schemaRejected.Add(1)
+	var verr *jsonschema.Error
+	if !errors.As(err, &verr) {
+		return &requestError{msg: "value does not match schema: value is not JSON: " + err.Error()}
+	}
+	return &requestError{
+		msg:    "value does not match schema: " + verr.Error(),
+		detail: &ErrorDetail{Field: verr.Path, Keyword: verr.Keyword, Expected: verr.Message, Got: verr.Got},
+	}
+}
+
+// checkSchema answers 422 with the details for a value that does not match
+// its namespace's schema and returns false; it returns true if the write
+// may go ahead.
+func (s *KVServer) checkSchema(w http.ResponseWriter, key, value string) bool {
+	if reqErr := s.schemaError(key, value); reqErr != nil {
+		s.sendErrorDetail(w, reqErr, http.StatusUnprocessableEntity)
+		return false
+	}
+	return true
+}
+
+const errSchemaUnchecked = "namespace has a value schema, which this operation cannot be checked against"
+
+// checkUnschematized answers 422 and returns false if key's namespace has a
+// schema, for writes like appends whose resulting value is only known once
+// written.
+func (s *KVServer) checkUnschematized(w http.ResponseWriter, key string) bool {
+	ns, _ := database.SplitKey(key)
+	if s.schemas.lookup(ns) == nil {
+		return true
+	}
+	s.stats.schemaRejected.Add(1)
+	s.sendError(w, errSchemaUnchecked, http.StatusUnprocessableEntity)
+	return false
+}
+
+// SchemaInfo is a namespace's registered schema.
+type SchemaInfo struct {
+	Namespace string          `json:"namespace"`
+	Schema    json.RawMessage `json:"schema"`
+}
+
+type schemasResponse struct {
+	Success bool         `json:"success"`
+	Schemas []SchemaInfo `json:"schemas"`
+}
+
+// handleSchemas serves GET /admin/schemas, which lists the schemas in
+// force, and PUT and DELETE /admin/schemas?namespace=, which register a
+// namespace's schema, the request body, and drop it. Without namespaces the
+// one schema has the empty namespace. A schema applies to the writes that
+// follow; stored values are not rechecked.
+func (s *KVServer) handleSchemas(w http.ResponseWriter, r *http.Request) {
+	store, ok := s.db.(database.SchemaStore)
+	if !ok {
+		s.sendError(w, "value schemas not supported by this backend", http.StatusNotImplemented)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		s.schemas.mu.RLock()
+		resp := schemasResponse{Success: true, Schemas: make([]SchemaInfo, 0, len(s.schemas.text))}
+		for ns, text := range s.schemas.text {
+			if s.schemas.byNS[ns] != nil {
+				resp.Schemas = append(resp.Schemas, SchemaInfo{Namespace: ns, Schema: json.RawMessage(text)})
+			}
+		}
+		s.schemas.mu.RUnlock()
+		sort.Slice(resp.Schemas, func(i, j int) bool { return resp.Schemas[i].Namespace < resp.Schemas[j].Namespace })
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	ns := r.URL.Query().Get("namespace")
+	if !s.checkNamespace(w, ns) {
+		return
+	}
+	if r.Method == http.MethodDelete {
+		if err := store.DeleteSchema(requestCtx(w), ns); err != nil {
+			if errors.Is(err, database.ErrNotFound) {
+				s.sendError(w, "namespace has no schema", http.StatusNotFound)
+				return
+			}
+			log.Printf("Deleting the schema of namespace %q failed: %v", ns, err)
+			s.sendError(w, "database error", http.StatusInternalServerError)
+			return
+		}
+		s.schemas.remove(ns)
+		s.sendSuccess(w, "", http.StatusOK)
+		return
+	}
+
+	body, ok := s.readBody(w, r)
+	if !ok {
+		return
+	}
+	compiled, err := jsonschema.Compile(body)
+	if err != nil {
+		s.sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := store.PutSchema(requestCtx(w), ns, string(body)); err != nil {
+		log.Printf("Storing the schema of namespace %q failed: %v", ns, err)
+		s.sendError(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	s.schemas.set(ns, string(body), compiled)
+	s.sendSuccess(w, "", http.StatusOK)
+}
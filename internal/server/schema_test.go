@@ -0,0 +1,98 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"kv-server/internal/database"
+	"kv-server/internal/jsonschema"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testSchema = `{"type":"object","required":["name"],"properties":{"name":{"type":"string"}}}`
+
+func newSchemaServer(t *testing.T) *KVServer {
+	t.Helper()
+	srv := NewKVServer(1000, database.NewMemoryDB(database.Faults{}))
+	srv.SetNamespaces(true)
+	compiled, err := jsonschema.Compile([]byte(testSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.schemas.set("people", testSchema, compiled)
+	return srv
+}
+
+// schemaCases are PUT bodies to the people namespace and the status each
+// gets.
+var schemaCases = []struct {
+	name string
+	body string
+	want int
+}{
+	{"conforming", `{"value":"{\"name\":\"ada\"}"}`, http.StatusOK},
+	{"missing property", `{"value":"{}"}`, http.StatusUnprocessableEntity},
+	{"wrong type", `{"value":"{\"name\":1}"}`, http.StatusUnprocessableEntity},
+	{"not JSON", `{"value":"ada"}`, http.StatusUnprocessableEntity},
+}
+
+func TestSchemaRejectsPut(t *testing.T) {
+	srv := newSchemaServer(t)
+	for _, tt := range schemaCases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPut, "/kv/people/p1", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			srv.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("PUT %s: status %d, want %d: %s", tt.body, w.Code, tt.want, w.Body)
+			}
+		})
+	}
+
+	// Other namespaces are unchecked
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/kv/other/p1", strings.NewReader(`{"value":"ada"}`)))
+	if w.Code != http.StatusOK {
+		t.Errorf("PUT to a namespace without a schema: status %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestSchemaRejectsPutOnFastPath(t *testing.T) {
+	srv := newSchemaServer(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go srv.ServeFast(ln)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+
+	for _, tt := range schemaCases {
+		t.Run(tt.name, func(t *testing.T) {
+			fmt.Fprintf(conn, "PUT /kv/people/p1 HTTP/1.1\r\nHost: test\r\nContent-Type: application/json\r\nContent-Length: %d\r\n\r\n%s", len(tt.body), tt.body)
+			resp, err := http.ReadResponse(br, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Errorf("PUT %s: status %d, want %d", tt.body, resp.StatusCode, tt.want)
+			}
+			if want := http.StatusText(tt.want); !strings.HasSuffix(resp.Status, want) {
+				t.Errorf("PUT %s: status line %q, want reason %q", tt.body, resp.Status, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// loadShedder turns requests away with 503 the moment the server is past
+// its thresholds, before they wait for a worker or reach the database, so
+// the requests it does admit keep their latency.
+type loadShedder struct {
+	maxInFlight int64
+	maxQueued   int64
+
+	// Requests admitted and not yet finished, queued ones included
+	inFlight atomic.Int64
+}
+
+// SetLoadShedding sheds requests arriving while maxInFlight are already
+// being served, or while maxQueued are waiting for a worker. Zero turns a
+// threshold off; the queue threshold needs SetWorkers. The health probes
+// and watch streams are exempt, as from the worker pool. Call it before
+// serving.
+func (s *KVServer) SetLoadShedding(maxInFlight, maxQueued int) {
+	if maxInFlight <= 0 && maxQueued <= 0 {
+		s.shedder = nil
+		return
+	}
+	s.shedder = &loadShedder{maxInFlight: int64(maxInFlight), maxQueued: int64(maxQueued)}
+}
+
+// enterLoad admits a request and reports true, or counts it as shed and
+// reports false. An admitted request calls s.shedder.leave when done.
+func (s *KVServer) enterLoad() bool {
+	ls := s.shedder
+	n := ls.inFlight.Add(1)
+	var queued int64
+	if s.workers != nil {
+		queued = s.workers.queued.Load()
+	}
+	if (ls.maxInFlight > 0 && n > ls.maxInFlight) || (ls.maxQueued > 0 && queued >= ls.maxQueued) {
+		ls.inFlight.Add(-1)
+		s.stats.shed.Add(1)
+		return false
+	}
+	return true
+}
+
+func (ls *loadShedder) leave() {
+	ls.inFlight.Add(-1)
+}
+
+// shedLoad answers 503 for a request the load shedder turns away and
+// returns false; otherwise the request is admitted, and the caller calls
+// s.shedder.leave when done.
+func (s *KVServer) shedLoad(w http.ResponseWriter) bool {
+	if s.enterLoad() {
+		return true
+	}
+	w.Header()["Retry-After"] = retryAfterOne
+	s.sendError(w, errOverloaded, http.StatusServiceUnavailable)
+	return false
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"kv-server/internal/database"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultSnapshotTTL is how long an unreleased snapshot stays open.
+	DefaultSnapshotTTL = 5 * time.Minute
+
+	// maxSnapshots bounds open snapshots, each of which may pin a database
+	// connection.
+	maxSnapshots = 8
+)
+
+// openSnapshot is a snapshot registered under an ID until released or expired.
+type openSnapshot struct {
+	ID        string    `json:"id"`
+	Namespace string    `json:"namespace,omitempty"`
+	Prefix    string    `json:"prefix"`
+	Entries   int       `json:"entries"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+
+	snap  database.Snapshot
+	timer *time.Timer
+}
+
+type snapshotRegistry struct {
+	mu    sync.Mutex
+	ttl   time.Duration
+	items map[string]*openSnapshot
+}
+
+// SetSnapshotTTL changes how long snapshots stay open if not released.
+func (s *KVServer) SetSnapshotTTL(ttl time.Duration) {
+	s.snapshots.mu.Lock()
+	s.snapshots.ttl = ttl
+	s.snapshots.mu.Unlock()
+}
+
+// handleSnapshots serves the snapshot API:
+//
+//	POST   /admin/snapshots?prefix=ns/   take a snapshot of keys under prefix,
+//	                                     in ?namespace= if given
+//	GET    /admin/snapshots              list open snapshots
+//	GET    /admin/snapshots/{id}/kv/{key} read a key as of the snapshot
+//	GET    /admin/snapshots/{id}/export  stream every key as NDJSON
+//	DELETE /admin/snapshots/{id}         release the snapshot
+func (s *KVServer) handleSnapshots(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/snapshots"), "/")
+	if rest == "" {
+		switch r.Method {
+		case http.MethodPost:
+			s.createSnapshot(w, r)
+		case http.MethodGet:
+			s.listSnapshots(w)
+		default:
+			s.methodNotAllowed(w, "GET, POST")
+		}
+		return
+	}
+
+	id, sub, _ := strings.Cut(rest, "/")
+	s.snapshots.mu.Lock()
+	snap := s.snapshots.items[id]
+	s.snapshots.mu.Unlock()
+	if snap == nil {
+		s.sendError(w, "snapshot not found", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case sub == "" && r.Method == http.MethodDelete:
+		s.releaseSnapshot(id)
+		s.sendSuccess(w, "", http.StatusOK)
+	case strings.HasPrefix(sub, "kv/") && r.Method == http.MethodGet:
+		s.readSnapshot(w, snap, strings.TrimPrefix(sub, "kv/"))
+	case sub == "export" && r.Method == http.MethodGet:
+		s.exportSnapshot(w, snap)
+	case sub == "":
+		s.methodNotAllowed(w, "DELETE")
+	case sub == "export" || strings.HasPrefix(sub, "kv/"):
+		s.methodNotAllowed(w, "GET")
+	default:
+		s.sendError(w, "not found", http.StatusNotFound)
+	}
+}
+
+func (s *KVServer) createSnapshot(w http.ResponseWriter, r *http.Request) {
+	snapshotter, ok := s.db.(database.Snapshotter)
+	if !ok {
+		s.sendError(w, "snapshots not supported by this backend", http.StatusNotImplemented)
+		return
+	}
+
+	s.snapshots.mu.Lock()
+	full := len(s.snapshots.items) >= maxSnapshots
+	s.snapshots.mu.Unlock()
+	if full {
+		s.sendError(w, "too many open snapshots", http.StatusTooManyRequests)
+		return
+	}
+
+	ns, prefix := r.URL.Query().Get("namespace"), r.URL.Query().Get("prefix")
+	snap, err := snapshotter.Snapshot(database.QualifyKey(ns, prefix))
+	if err != nil {
+		log.Printf("Snapshot of %q failed: %v", prefix, err)
+		s.sendError(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	var id [8]byte
+	rand.Read(id[:])
+	now := time.Now()
+	open := &openSnapshot{
+		ID:        hex.EncodeToString(id[:]),
+		Namespace: ns,
+		Prefix:    prefix,
+		Entries:   snap.Count(),
+		CreatedAt: now,
+		snap:      snap,
+	}
+
+	s.snapshots.mu.Lock()
+	if s.snapshots.items == nil {
+		s.snapshots.items = make(map[string]*openSnapshot)
+	}
+	ttl := s.snapshots.ttl
+	if ttl <= 0 {
+		ttl = DefaultSnapshotTTL
+	}
+	open.ExpiresAt = now.Add(ttl)
+	open.timer = time.AfterFunc(ttl, func() { s.releaseSnapshot(open.ID) })
+	s.snapshots.items[open.ID] = open
+	s.snapshots.mu.Unlock()
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(open)
+}
+
+func (s *KVServer) listSnapshots(w http.ResponseWriter) {
+	s.snapshots.mu.Lock()
+	list := make([]*openSnapshot, 0, len(s.snapshots.items))
+	for _, snap := range s.snapshots.items {
+		list = append(list, snap)
+	}
+	s.snapshots.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(list)
+}
+
+// releaseSnapshot closes and forgets a snapshot; unknown IDs are ignored.
+func (s *KVServer) releaseSnapshot(id string) {
+	s.snapshots.mu.Lock()
+	snap := s.snapshots.items[id]
+	delete(s.snapshots.items, id)
+	s.snapshots.mu.Unlock()
+
+	if snap == nil {
+		return
+	}
+	snap.timer.Stop()
+	if err := snap.snap.Close(); err != nil {
+		log.Printf("Closing snapshot %s failed: %v", id, err)
+	}
+}
+
+func (s *KVServer) readSnapshot(w http.ResponseWriter, snap *openSnapshot, key string) {
+	if key == "" {
+		s.sendError(w, "key is required", http.StatusBadRequest)
+		return
+	}
+	value, err := snap.snap.Read(database.QualifyKey(snap.Namespace, key))
+	if errors.Is(err, database.ErrNotFound) {
+		s.sendError(w, "key not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.sendError(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	s.sendSuccess(w, value, http.StatusOK)
+}
+
+// exportSnapshot streams the snapshot as one {"key","value"} object per line.
+// Errors after the first line can only be signalled by truncating the stream.
+func (s *KVServer) exportSnapshot(w http.ResponseWriter, snap *openSnapshot) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	enc := json.NewEncoder(w)
+	err := snap.snap.Scan(func(key, value string) error {
+		return enc.Encode(Request{Key: displayKey(key), Value: value})
+	})
+	if err != nil {
+		log.Printf("Export of snapshot %s failed: %v", snap.ID, err)
+	}
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"kv-server/internal/database"
+	"kv-server/internal/watch"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// softDelete is the soft-delete configuration.
+type softDelete struct {
+	store     database.SoftDeleter
+	retention time.Duration
+}
+
+// SetSoftDelete keeps deleted keys as tombstones for retention, during
+// which POST /kv/{key}/restore brings them back; the expiry sweeper purges
+// older ones. Zero deletes keys outright, as do stores that cannot keep
+// tombstones. Deletes in a transaction are always outright. Call it before
+// serving.
+func (s *KVServer) SetSoftDelete(retention time.Duration) {
+	store, ok := s.db.(database.SoftDeleter)
+	if retention <= 0 || !ok {
+		s.softDelete = nil
+		return
+	}
+	s.softDelete = &softDelete{store: store, retention: retention}
+}
+
+// deleteRow deletes key from the database, keeping a tombstone if soft
+// delete is on.
+func (s *KVServer) deleteRow(ctx context.Context, key string) error {
+	if s.softDelete != nil {
+		return s.softDelete.store.SoftDelete(ctx, key)
+	}
+	return s.db.Delete(ctx, key)
+}
+
+// restoreTarget splits a POST path of the form {key}/restore.
+func restoreTarget(path string) (string, bool) {
+	return strings.CutSuffix(path, "/restore")
+}
+
+// handleRestore serves POST /kv/{key}/restore, which undoes the key's last
+// delete if its tombstone has not been purged. The reply carries the
+// restored value and its new version; a key written since the delete is a
+// 409.
+func (s *KVServer) handleRestore(w http.ResponseWriter, r *http.Request, key string) {
+	if s.softDelete == nil {
+		s.sendError(w, "soft delete not enabled", http.StatusNotFound)
+		return
+	}
+	if key == "" {
+		s.sendError(w, "key is required", http.StatusBadRequest)
+		return
+	}
+	if !s.checkQuarantine(w, key) {
+		return
+	}
+
+	rec, err := s.restore(requestCtx(w), key)
+	switch {
+	case errors.Is(err, database.ErrNotFound):
+		s.sendError(w, "no deleted key to restore", http.StatusNotFound)
+	case errors.Is(err, database.ErrExists):
+		s.sendError(w, "key has been written since it was deleted", http.StatusConflict)
+	case err != nil:
+		s.sendError(w, "database error", http.StatusInternalServerError)
+	default:
+		s.sendVersioned(w, rec.Value, rec.Revision, http.StatusOK)
+	}
+}
+
+// restore writes key's tombstone back in the database, then caches it.
+// The database write runs under ctx.
+func (s *KVServer) restore(ctx context.Context, key string) (database.Record, error) {
+	if s.repl != nil {
+		defer s.repl.Lock(key)()
+	}
+	rec, err := s.softDelete.store.Restore(ctx, key)
+	s.noteResult(key, err)
+	if err != nil {
+		if !errors.Is(err, database.ErrNotFound) && !errors.Is(err, database.ErrExists) {
+			s.writeStats.failed.Add(1)
+		}
+		return database.Record{}, err
+	}
+	s.writeStats.recordCommit(1)
+	if s.repl != nil {
+		s.repl.Local(key, rec.Value, false)
+	}
+
+	s.cacheWritten(ctx, key, recordVersion(rec))
+	s.chargeQuota(key, len(rec.Value))
+	s.publish(watch.Put, key, rec.Value, rec.Revision)
+	s.touch(key)
+
+	s.writeStats.acked.Add(1)
+	return rec, nil
+}
+
+// purgeTombstones drops the tombstones older than the retention, if soft
+// delete is on. Like the expiry sweep, a throttled purge drops one batch.
+func (s *KVServer) purgeTombstones(pace maintenancePace) {
+	if s.softDelete == nil {
+		return
+	}
+	before := time.Now().Add(-s.softDelete.retention)
+	for {
+		n, err := s.softDelete.store.PurgeTombstones(context.Background(), before, expirySweepBatch)
+		if err != nil {
+			log.Printf("Tombstone purge failed: %v", err)
+			return
+		}
+		s.stats.purged.Add(uint64(n))
+		if n < expirySweepBatch || pace == paceThrottled {
+			return
+		}
+	}
+}
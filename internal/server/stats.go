@@ -0,0 +1,269 @@
+package server
+
+import (
+	"encoding/json"
+	"expvar"
+	"kv-server/internal/database"
+	"net/http"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// serverStats counts requests handled by the KV routes.
+type serverStats struct {
+	requests         atomic.Uint64
+	reads            atomic.Uint64
+	writes           atomic.Uint64
+	deletes          atomic.Uint64
+	clientErrors     atomic.Uint64
+	serverErrors     atomic.Uint64
+	refreshAhead     atomic.Uint64
+	expired          atomic.Uint64
+	purged           atomic.Uint64
+	pruned           atomic.Uint64
+	trimmed          atomic.Uint64
+	rateLimited      atomic.Uint64
+	shed             atomic.Uint64
+	auditFailed      atomic.Uint64
+	schemaRejected   atomic.Uint64
+	timedOut         atomic.Uint64
+	notModified      atomic.Uint64
+	strongReads      atomic.Uint64
+	fillSkipped      atomic.Uint64
+	readOnlyRejected atomic.Uint64
+
+	// Time spent serving requests, and the slowest since the last sample
+	latency    atomic.Int64
+	latencyMax atomic.Int64
+}
+
+// observe records the latency of a request that started at start.
+func (st *serverStats) observe(start time.Time) {
+	d := int64(time.Since(start))
+	st.latency.Add(d)
+	for {
+		m := st.latencyMax.Load()
+		if d <= m || st.latencyMax.CompareAndSwap(m, d) {
+			return
+		}
+	}
+}
+
+// writeStats reconciles the write path: every acknowledged write must be
+// backed by a committed database row, and rows per commit measures how well
+// writes are batched.
+type writeStats struct {
+	acked       atomic.Uint64
+	failed      atomic.Uint64
+	dbCommits   atomic.Uint64
+	dbRows      atomic.Uint64
+	cacheWrites atomic.Uint64
+}
+
+// recordCommit counts a committed database transaction touching rows rows.
+func (ws *writeStats) recordCommit(rows int) {
+	ws.dbCommits.Add(1)
+	ws.dbRows.Add(uint64(rows))
+}
+
+func (ws *writeStats) snapshot() map[string]any {
+	acked := ws.acked.Load()
+	commits := ws.dbCommits.Load()
+	rows := ws.dbRows.Load()
+
+	rowsPerCommit := float64(0)
+	if commits > 0 {
+		rowsPerCommit = float64(rows) / float64(commits)
+	}
+	return map[string]any{
+		"acked":           acked,
+		"failed":          ws.failed.Load(),
+		"db_commits":      commits,
+		"db_rows":         rows,
+		"cache_writes":    ws.cacheWrites.Load(),
+		"rows_per_commit": rowsPerCommit,
+		// Non-zero means a write was acknowledged without a DB row behind it
+		"unbacked_acks": saturatingSub(acked, rows),
+	}
+}
+
+func saturatingSub(a, b uint64) uint64 {
+	if a > b {
+		return a - b
+	}
+	return 0
+}
+
+func (st *serverStats) countStatus(status int) {
+	if status >= 500 {
+		st.serverErrors.Add(1)
+	} else if status >= 400 {
+		st.clientErrors.Add(1)
+	}
+}
+
+// counters returns the server counters published as kv_server.
+func (s *KVServer) counters() map[string]uint64 {
+	return map[string]uint64{
+		"requests":           s.stats.requests.Load(),
+		"reads":              s.stats.reads.Load(),
+		"writes":             s.stats.writes.Load(),
+		"deletes":            s.stats.deletes.Load(),
+		"client_errors":      s.stats.clientErrors.Load(),
+		"server_errors":      s.stats.serverErrors.Load(),
+		"refresh_ahead":      s.stats.refreshAhead.Load(),
+		"expired":            s.stats.expired.Load(),
+		"purged":             s.stats.purged.Load(),
+		"pruned":             s.stats.pruned.Load(),
+		"trimmed":            s.stats.trimmed.Load(),
+		"rate_limited":       s.stats.rateLimited.Load(),
+		"shed":               s.stats.shed.Load(),
+		"audit_failed":       s.stats.auditFailed.Load(),
+		"schema_rejected":    s.stats.schemaRejected.Load(),
+		"timed_out":          s.stats.timedOut.Load(),
+		"not_modified":       s.stats.notModified.Load(),
+		"strong_reads":       s.stats.strongReads.Load(),
+		"cache_fill_skipped": s.stats.fillSkipped.Load(),
+		"read_only_rejected": s.stats.readOnlyRejected.Load(),
+	}
+}
+
+// cacheStats returns the cache figures published as kv_cache.
+func (s *KVServer) cacheStats() map[string]any {
+	hits, misses := s.cache.GetStats()
+	return map[string]any{
+		"hits":        hits,
+		"misses":      misses,
+		"entries":     s.cache.Len(),
+		"bytes":       s.cache.Weight(),
+		"memory":      s.cache.MemoryUsage(),
+		"pinned":      s.cache.PinnedWeight(),
+		"partitions":  s.cache.Partitions(),
+		"rehydration": s.Rehydration(),
+	}
+}
+
+// StatsResponse is the reply to GET /admin/stats.
+type StatsResponse struct {
+	Started       time.Time `json:"started"`
+	UptimeSeconds float64   `json:"uptime_seconds"`
+	// Counters are the kv_server expvar counters
+	Counters map[string]uint64 `json:"counters"`
+	// Requests counts responses by endpoint, "GET /kv" for every key, and
+	// then by status
+	Requests map[string]map[string]uint64 `json:"requests"`
+	// Latency summarizes /kv latency by endpoint, "GET /kv" for every key,
+	// since the server started
+	Latency map[string]LatencySummary `json:"latency"`
+	Writes  map[string]any            `json:"writes"`
+	Cache   map[string]any            `json:"cache"`
+	// Database is the health monitor's view of the database and its
+	// connection pool, if one is attached
+	Database *database.HealthStatus `json:"database,omitempty"`
+	Runtime  RuntimeStats           `json:"runtime"`
+}
+
+// RuntimeStats reports the Go runtime: goroutines, memory and GC.
+type RuntimeStats struct {
+	GoVersion    string  `json:"go_version"`
+	GOMAXPROCS   int     `json:"gomaxprocs"`
+	Goroutines   int     `json:"goroutines"`
+	HeapAlloc    uint64  `json:"heap_alloc_bytes"`
+	HeapInuse    uint64  `json:"heap_inuse_bytes"`
+	HeapObjects  uint64  `json:"heap_objects"`
+	Sys          uint64  `json:"sys_bytes"`
+	TotalAlloc   uint64  `json:"total_alloc_bytes"`
+	NumGC        uint32  `json:"num_gc"`
+	PauseTotal   float64 `json:"gc_pause_total_seconds"`
+	LastPause    float64 `json:"gc_last_pause_seconds"`
+	GCCPUPercent float64 `json:"gc_cpu_percent"`
+}
+
+// handleStats serves GET /admin/stats: the server's figures in one JSON
+// document, for dashboards that do not speak Prometheus.
+func (s *KVServer) handleStats(w http.ResponseWriter, r *http.Request) {
+	resp := StatsResponse{
+		Started:       s.started,
+		UptimeSeconds: time.Since(s.started).Seconds(),
+		Counters:      s.counters(),
+		Requests:      s.routes.statusCounts(),
+		Latency:       make(map[string]LatencySummary),
+		Writes:        s.writeStats.snapshot(),
+		Cache:         s.cacheStats(),
+		Runtime:       runtimeStats(),
+	}
+	for i, method := range metricMethods {
+		for j := range s.metrics.counts[i] {
+			if n := s.metrics.counts[i][j].Load(); n > 0 {
+				endpoint := method + " /kv"
+				if resp.Requests[endpoint] == nil {
+					resp.Requests[endpoint] = make(map[string]uint64)
+				}
+				resp.Requests[endpoint][strconv.Itoa(j+100)] = n
+			}
+		}
+		if sum := s.metrics.latency[i].summary(); sum.Count > 0 {
+			resp.Latency[method+" /kv"] = sum
+		}
+	}
+	if s.health != nil {
+		status := s.health.Status()
+		resp.Database = &status
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func runtimeStats() RuntimeStats {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return RuntimeStats{
+		GoVersion:    runtime.Version(),
+		GOMAXPROCS:   runtime.GOMAXPROCS(0),
+		Goroutines:   runtime.NumGoroutine(),
+		HeapAlloc:    m.HeapAlloc,
+		HeapInuse:    m.HeapInuse,
+		HeapObjects:  m.HeapObjects,
+		Sys:          m.Sys,
+		TotalAlloc:   m.TotalAlloc,
+		NumGC:        m.NumGC,
+		PauseTotal:   time.Duration(m.PauseTotalNs).Seconds(),
+		LastPause:    time.Duration(m.PauseNs[(m.NumGC+255)%256]).Seconds(),
+		GCCPUPercent: m.GCCPUFraction * 100,
+	}
+}
+
+// PublishExpvars registers the server, write-path, cache and degradation
+// counters with expvar under "kv_server", "kv_writes", "kv_cache" and
+// "kv_degradation". It must be called at most once per process.
+func (s *KVServer) PublishExpvars() {
+	expvar.Publish("kv_server", expvar.Func(func() any {
+		return s.counters()
+	}))
+	expvar.Publish("kv_workers", expvar.Func(func() any {
+		p := s.workers
+		if p == nil {
+			return nil
+		}
+		return map[string]any{
+			"workers": cap(p.slots),
+			"busy":    len(p.slots),
+			"queued":  p.queued.Load(),
+			"shed":    p.shed.Load(),
+		}
+	}))
+	expvar.Publish("kv_degradation", expvar.Func(func() any {
+		return s.Degradation()
+	}))
+	expvar.Publish("kv_maintenance", expvar.Func(func() any {
+		return s.Maintenance()
+	}))
+	expvar.Publish("kv_writes", expvar.Func(func() any {
+		return s.writeStats.snapshot()
+	}))
+	expvar.Publish("kv_cache", expvar.Func(func() any {
+		return s.cacheStats()
+	}))
+}
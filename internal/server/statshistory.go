@@ -0,0 +1,179 @@
+package server
+
+import (
+	"encoding/json"
+	"kv-server/internal/database"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultStatsHistoryHours = 24
+	maxStatsHistoryHours     = 90 * 24
+)
+
+// statsRecorder turns the server's running counters into samples for the
+// hourly statistics table.
+type statsRecorder struct {
+	store     database.StatsStore
+	retention time.Duration
+
+	mu sync.Mutex
+	// Counter values at the previous sample
+	requests, hits, misses uint64
+	latency                int64
+	// The hours keys were last counted and old hours last pruned in
+	counted, pruned time.Time
+}
+
+// StartStatsHistory adds the requests, cache hits and misses, and latency
+// served since the previous sample to the current hour in store, every
+// interval. The number of keys is counted once an hour. Hours older than
+// retention are deleted. Both wait while maintenance is paused. The returned function records a last sample and
+// stops.
+func (s *KVServer) StartStatsHistory(store database.StatsStore, interval, retention time.Duration) (stop func()) {
+	rec := &statsRecorder{store: store, retention: retention}
+	rec.requests = s.stats.requests.Load()
+	rec.hits, rec.misses = s.cache.GetStats()
+	rec.latency = s.stats.latency.Load()
+	s.statsHistory = rec
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				s.recordStats(rec)
+				return
+			case <-ticker.C:
+				s.recordStats(rec)
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+func (s *KVServer) recordStats(rec *statsRecorder) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	hour := time.Now().UTC().Truncate(time.Hour)
+	requests := s.stats.requests.Load()
+	hits, misses := s.cache.GetStats()
+	latency := s.stats.latency.Load()
+	sample := database.StatsSample{
+		Hour:        hour,
+		Requests:    requests - rec.requests,
+		CacheHits:   hits - rec.hits,
+		CacheMisses: misses - rec.misses,
+		LatencySum:  time.Duration(latency - rec.latency),
+		LatencyMax:  time.Duration(s.stats.latencyMax.Swap(0)),
+		Keys:        -1,
+	}
+
+	paused := s.maintenancePace() == pacePaused
+	if !hour.Equal(rec.counted) && !paused {
+		keys, err := rec.store.CountKeys()
+		if err != nil {
+			log.Printf("Stats history failed to count keys: %v", err)
+		} else {
+			sample.Keys = keys
+		}
+	}
+
+	if err := rec.store.RecordStats(sample); err != nil {
+		// The counters are not advanced, so the next sample includes these
+		log.Printf("Stats history failed to record: %v", err)
+		return
+	}
+	rec.requests, rec.hits, rec.misses, rec.latency = requests, hits, misses, latency
+	if sample.Keys >= 0 {
+		rec.counted = hour
+	}
+
+	if !hour.Equal(rec.pruned) && rec.retention > 0 && !paused {
+		if err := rec.store.PruneStats(hour.Add(-rec.retention)); err != nil {
+			log.Printf("Stats history failed to prune: %v", err)
+			return
+		}
+		rec.pruned = hour
+	}
+}
+
+type statsHourResponse struct {
+	Hour         time.Time `json:"hour"`
+	Requests     uint64    `json:"requests"`
+	QPS          float64   `json:"qps"`
+	CacheHitRate float64   `json:"cache_hit_rate"`
+	LatencyAvgMs float64   `json:"latency_avg_ms"`
+	LatencyMaxMs float64   `json:"latency_max_ms"`
+	// Keys is omitted for hours in which keys were not counted
+	Keys *int64 `json:"keys,omitempty"`
+}
+
+type statsHistoryResponse struct {
+	Hours []statsHourResponse `json:"hours"`
+}
+
+// handleStatsHistory serves GET /admin/stats/history?hours=, the hourly
+// statistics of the last hours hours (default 24), oldest first. The
+// current hour is included so far.
+func (s *KVServer) handleStatsHistory(w http.ResponseWriter, r *http.Request) {
+	if s.statsHistory == nil {
+		s.sendError(w, "stats history is disabled", http.StatusNotFound)
+		return
+	}
+
+	hours := defaultStatsHistoryHours
+	if v := r.URL.Query().Get("hours"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxStatsHistoryHours {
+			s.sendError(w, "hours must be between 1 and "+strconv.Itoa(maxStatsHistoryHours), http.StatusBadRequest)
+			return
+		}
+		hours = n
+	}
+
+	since := time.Now().UTC().Truncate(time.Hour).Add(-time.Duration(hours-1) * time.Hour)
+	history, err := s.statsHistory.store.StatsHistory(since)
+	if err != nil {
+		s.sendError(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	resp := statsHistoryResponse{Hours: make([]statsHourResponse, 0, len(history))}
+	for _, h := range history {
+		// The current hour's rate is over the part of it gone by
+		span := min(time.Since(h.Hour), time.Hour)
+		hour := statsHourResponse{
+			Hour:         h.Hour,
+			Requests:     h.Requests,
+			QPS:          float64(h.Requests) / span.Seconds(),
+			LatencyMaxMs: float64(h.LatencyMax) / float64(time.Millisecond),
+		}
+		if lookups := h.CacheHits + h.CacheMisses; lookups > 0 {
+			hour.CacheHitRate = float64(h.CacheHits) / float64(lookups)
+		}
+		if h.Requests > 0 {
+			hour.LatencyAvgMs = float64(h.LatencySum) / float64(h.Requests) / float64(time.Millisecond)
+		}
+		if h.Keys >= 0 {
+			hour.Keys = &h.Keys
+		}
+		resp.Hours = append(resp.Hours, hour)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"context"
+	"kv-server/internal/database"
+	"net/http"
+	"time"
+)
+
+// DefaultRequestTimeout bounds a request's database calls unless
+// SetRequestTimeout changes it.
+const DefaultRequestTimeout = 10 * time.Second
+
+const errRequestTimeout = "request timed out"
+
+// SetRequestTimeout bounds the database calls each request makes: once a
+// request has run for d, its pending and later calls fail and it gets 504.
+// Calls are cancelled as well when the client disconnects. Zero leaves
+// only the disconnect. It applies to the fast path as well.
+func (s *KVServer) SetRequestTimeout(d time.Duration) {
+	s.requestTimeout = d
+}
+
+// loadContext is the context for a cache load started by the request with
+// ctx. Other requests may be waiting on the load, so it must not fail
+// because this one went away; it keeps the request's ID and deadline but
+// not its cancellation.
+func loadContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	detached := context.WithoutCancel(ctx)
+	if deadline, ok := ctx.Deadline(); ok {
+		return context.WithDeadline(detached, deadline)
+	}
+	return detached, func() {}
+}
+
+// streamContext is the context for the database calls of a request that
+// streams for as long as it takes, such as an export: it keeps the
+// request's ID and ends when the client goes away, but has no timeout.
+func streamContext(w http.ResponseWriter, r *http.Request) context.Context {
+	return database.WithRequestID(r.Context(), requestIDOf(w))
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"kv-server/internal/database"
+	"kv-server/internal/watch"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// trimBatch bounds the keys one trim statement deletes.
+	trimBatch = 1000
+	// maxPendingTouches bounds the reads and writes remembered between
+	// trims; beyond it recency is approximate until the next trim.
+	maxPendingTouches = 100000
+)
+
+// namespaceTrimmer bounds the key count of evicting namespaces. Reads and
+// writes in them are remembered and handed to the store before each trim,
+// so the keys trimmed are the least recently used ones.
+type namespaceTrimmer struct {
+	store  database.Trimmer
+	limits map[string]int
+
+	mu      sync.Mutex
+	touched map[string]time.Time
+}
+
+// ParseNamespaceLimits parses a spec like "thumbnails=10000,previews=500"
+// into each namespace's maximum key count.
+func ParseNamespaceLimits(spec string) (map[string]int, error) {
+	if strings.TrimSpace(spec) == "" {
+		return nil, nil
+	}
+
+	limits := make(map[string]int)
+	for _, item := range strings.Split(spec, ",") {
+		ns, count, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok || !validNamespace(ns) {
+			return nil, fmt.Errorf("invalid namespace limit %q, expected namespace=count", item)
+		}
+		if _, dup := limits[ns]; dup {
+			return nil, fmt.Errorf("duplicate namespace limit %q", ns)
+		}
+		n, err := strconv.Atoi(count)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid key count for namespace %q", ns)
+		}
+		limits[ns] = n
+	}
+	return limits, nil
+}
+
+// StartNamespaceTrimmer makes each namespace in limits an evicting one:
+// every interval, the least recently read or written keys beyond its limit
+// are deleted, and watchers get an "evict" event. A namespace may exceed its
+// limit between trims. The trimmer pauses while the server is read-only,
+// and outside the maintenance windows trims one batch per namespace, or
+// none. The returned function stops it.
+func (s *KVServer) StartNamespaceTrimmer(limits map[string]int, interval time.Duration) (stop func(), err error) {
+	store, ok := s.db.(database.Trimmer)
+	if !ok {
+		return nil, errors.New("store cannot trim namespaces")
+	}
+	t := &namespaceTrimmer{
+		store:   store,
+		limits:  limits,
+		touched: make(map[string]time.Time),
+	}
+	s.trimmer.Store(t)
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				pace := s.maintenancePace()
+				if s.Level() >= ReadOnly || s.readOnly.on.Load() || pace == pacePaused {
+					continue
+				}
+				s.trimNamespaces(t, pace)
+			}
+		}
+	}()
+	return func() {
+		s.trimmer.Store(nil)
+		close(done)
+	}, nil
+}
+
+// touch remembers a read or write of key if its namespace is an evicting
+// one.
+func (s *KVServer) touch(key string) {
+	t := s.trimmer.Load()
+	if t == nil {
+		return
+	}
+	if ns, _ := database.SplitKey(key); t.limits[ns] == 0 {
+		return
+	}
+	now := time.Now()
+	t.mu.Lock()
+	if _, ok := t.touched[key]; ok || len(t.touched) < maxPendingTouches {
+		t.touched[key] = now
+	}
+	t.mu.Unlock()
+}
+
+func (s *KVServer) trimNamespaces(t *namespaceTrimmer, pace maintenancePace) {
+	t.mu.Lock()
+	touched := t.touched
+	t.touched = make(map[string]time.Time)
+	t.mu.Unlock()
+
+	if len(touched) > 0 {
+		// Trimming without the latest recency could delete hot keys
+		if err := t.store.Touch(touched); err != nil {
+			log.Printf("Namespace trim failed to record recency: %v", err)
+			return
+		}
+	}
+
+	for ns, max := range t.limits {
+		for {
+			keys, err := t.store.TrimNamespace(ns, max, trimBatch)
+			if err != nil {
+				log.Printf("Trimming namespace %q failed: %v", ns, err)
+				break
+			}
+			for _, key := range keys {
+				s.cache.Delete(key)
+				s.forgetEncoded(key)
+				s.publish(watch.Evict, key, "", 0)
+			}
+			s.stats.trimmed.Add(uint64(len(keys)))
+			if len(keys) < trimBatch || pace == paceThrottled {
+				break
+			}
+		}
+	}
+}
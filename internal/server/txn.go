@@ -0,0 +1,258 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kv-server/internal/cache"
+	"kv-server/internal/database"
+	"kv-server/internal/watch"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxTxnItems bounds the compares, and separately the ops, of one
+// transaction: it is meant for a few keys, and holds their rows locked.
+const maxTxnItems = 100
+
+// TxnRequest is the body of POST /txn: compares that must all hold, and
+// the writes to apply if they do.
+type TxnRequest struct {
+	Compare []TxnCompare `json:"compare"`
+	Ops     []TxnOp      `json:"ops"`
+}
+
+// TxnCompare compares a key's version or value with an operand. Op is one
+// of "=", "!=", "<" and ">", "=" if empty.
+type TxnCompare struct {
+	Key     string `json:"key"`
+	Target  string `json:"target"`
+	Op      string `json:"op,omitempty"`
+	Version uint64 `json:"version,omitempty"`
+	Value   string `json:"value,omitempty"`
+}
+
+// TxnOp is a "put" or "delete" of a key.
+type TxnOp struct {
+	Op         string `json:"op"`
+	Key        string `json:"key"`
+	Value      string `json:"value,omitempty"`
+	TTLSeconds int64  `json:"ttl_seconds,omitempty"`
+}
+
+// TxnResponse is the reply to POST /txn.
+type TxnResponse struct {
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+	// FailedCompare is the index of the first compare that did not hold
+	FailedCompare *int `json:"failed_compare,omitempty"`
+	// Results has one entry per op, in order, with the version a put wrote
+	Results []TxnOpResult `json:"results,omitempty"`
+}
+
+// TxnOpResult reports one applied op.
+type TxnOpResult struct {
+	Key     string `json:"key"`
+	Version uint64 `json:"version,omitempty"`
+}
+
+var compareOps = map[string]database.CompareOp{
+	"":   database.CompareEqual,
+	"=":  database.CompareEqual,
+	"!=": database.CompareNotEqual,
+	"<":  database.CompareLess,
+	">":  database.CompareGreater,
+}
+
+// handleTxn serves POST /txn, or POST /txn/{namespace} with namespaces on:
+// if every compare holds, the ops are applied in order in one database
+// transaction, all or none, like etcd's Txn. It replies 200 with the
+// versions written, or 412 naming the first compare that failed.
+func (s *KVServer) handleTxn(w http.ResponseWriter, r *http.Request) {
+	s.stats.requests.Add(1)
+	defer s.stats.observe(time.Now())
+	s.ladder.inFlight.Add(1)
+	defer s.ladder.inFlight.Add(-1)
+
+	ns, ok := s.txnNamespace(r.URL.Path)
+	if !ok {
+		s.sendError(w, errInvalidNamespace, http.StatusBadRequest)
+		return
+	}
+	if !inScope(scopeOf(r), ns) {
+		s.sendError(w, errForbiddenScope, http.StatusForbidden)
+		return
+	}
+	if !s.admit(w, classWrite) || !s.checkWritable(w) {
+		return
+	}
+	s.stats.writes.Add(1)
+
+	transactor, ok := s.db.(database.Transactor)
+	if !ok {
+		s.sendError(w, "transactions not supported by this backend", http.StatusNotImplemented)
+		return
+	}
+	if reqErr := checkContentType(r); reqErr != nil {
+		s.sendRequestError(w, reqErr)
+		return
+	}
+	body, ok := s.readBody(w, r)
+	if !ok {
+		return
+	}
+	var req TxnRequest
+	if reqErr := decodeJSON(body, &req); reqErr != nil {
+		s.sendRequestError(w, reqErr)
+		return
+	}
+
+	compares, ops, msg := parseTxn(req, ns)
+	if msg != "" {
+		s.sendError(w, msg, http.StatusBadRequest)
+		return
+	}
+	tally := quotaTally{s: s}
+	for i, op := range ops {
+		if !s.checkQuarantine(w, op.Key) {
+			return
+		}
+		if op.Delete {
+			continue
+		}
+		if reqErr := s.schemaError(op.Key, op.Value); reqErr != nil {
+			reqErr.msg = fmt.Sprintf("ops[%d]: %s", i, reqErr.msg)
+			s.sendErrorDetail(w, reqErr, http.StatusUnprocessableEntity)
+			return
+		}
+		if status, msg := tally.add(requestCtx(w), op.Key, len(op.Value), false); status != 0 {
+			s.sendError(w, fmt.Sprintf("ops[%d]: %s", i, msg), status)
+			return
+		}
+	}
+
+	failed, err := s.txn(requestCtx(w), transactor, compares, ops)
+	if errors.Is(err, database.ErrCompareFailed) {
+		s.stats.countStatus(http.StatusPreconditionFailed)
+		w.WriteHeader(http.StatusPreconditionFailed)
+		json.NewEncoder(w).Encode(TxnResponse{Error: "compare failed", FailedCompare: &failed})
+		return
+	}
+	if err != nil {
+		log.Printf("Transaction of %d ops failed: %v", len(ops), err)
+		s.sendError(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	resp := TxnResponse{Success: true, Results: make([]TxnOpResult, len(ops))}
+	for i, op := range ops {
+		resp.Results[i] = TxnOpResult{Key: req.Ops[i].Key, Version: op.Revision}
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// txnNamespace returns the namespace of a /txn path.
+func (s *KVServer) txnNamespace(path string) (string, bool) {
+	rest := strings.TrimPrefix(strings.TrimPrefix(path, "/txn"), "/")
+	if !s.namespaces {
+		return "", rest == ""
+	}
+	return rest, validNamespace(rest)
+}
+
+// parseTxn validates a transaction and qualifies its keys with ns. It
+// returns why the transaction is invalid, if it is.
+func parseTxn(req TxnRequest, ns string) ([]database.Compare, []database.TxnOp, string) {
+	if len(req.Ops) == 0 {
+		return nil, nil, "ops is empty"
+	}
+	if len(req.Compare) > maxTxnItems || len(req.Ops) > maxTxnItems {
+		return nil, nil, fmt.Sprintf("a transaction is limited to %d compares and %d ops", maxTxnItems, maxTxnItems)
+	}
+
+	compares := make([]database.Compare, len(req.Compare))
+	for i, c := range req.Compare {
+		if c.Key == "" {
+			return nil, nil, fmt.Sprintf("compare[%d]: key is required", i)
+		}
+		op, ok := compareOps[c.Op]
+		if !ok {
+			return nil, nil, fmt.Sprintf("compare[%d]: op must be =, !=, < or >", i)
+		}
+		compares[i] = database.Compare{Key: database.QualifyKey(ns, c.Key), Op: op, Version: c.Version, Value: c.Value}
+		switch c.Target {
+		case "version":
+			compares[i].Target = database.CompareVersion
+		case "value":
+			compares[i].Target = database.CompareValue
+		default:
+			return nil, nil, fmt.Sprintf("compare[%d]: target must be version or value", i)
+		}
+	}
+
+	ops := make([]database.TxnOp, len(req.Ops))
+	for i, op := range req.Ops {
+		if op.Key == "" {
+			return nil, nil, fmt.Sprintf("ops[%d]: key is required", i)
+		}
+		ops[i].Key = database.QualifyKey(ns, op.Key)
+		switch op.Op {
+		case "put":
+			expiresAt, ok := Request{TTLSeconds: op.TTLSeconds}.expiry()
+			if !ok {
+				return nil, nil, fmt.Sprintf("ops[%d]: %s", i, errInvalidTTL)
+			}
+			ops[i].Value, ops[i].ExpiresAt = op.Value, expiresAt
+		case "delete":
+			ops[i].Delete = true
+		default:
+			return nil, nil, fmt.Sprintf("ops[%d]: op must be put or delete", i)
+		}
+	}
+	return compares, ops, ""
+}
+
+// txn applies a transaction under ctx, then updates the cache, watchers
+// and replication as the single-key writes do.
+func (s *KVServer) txn(ctx context.Context, transactor database.Transactor, compares []database.Compare, ops []database.TxnOp) (int, error) {
+	if s.repl != nil {
+		keys := make([]string, len(ops))
+		for i, op := range ops {
+			keys[i] = op.Key
+		}
+		defer s.repl.Lock(keys...)()
+	}
+	failed, err := transactor.Txn(ctx, compares, ops)
+	if err != nil {
+		if !errors.Is(err, database.ErrCompareFailed) {
+			s.writeStats.failed.Add(uint64(len(ops)))
+		}
+		return failed, err
+	}
+	s.writeStats.recordCommit(len(ops))
+
+	for _, op := range ops {
+		if s.repl != nil {
+			s.repl.Local(op.Key, op.Value, op.Delete)
+		}
+		if op.Delete {
+			s.cache.Delete(op.Key)
+			s.forgetEncoded(op.Key)
+			s.publish(watch.Delete, op.Key, "", 0)
+			continue
+		}
+		s.cache.PutVersioned(op.Key, cache.Versioned[string]{Value: op.Value, Revision: op.Revision, ExpiresAt: op.ExpiresAt})
+		s.chargeQuota(op.Key, len(op.Value))
+		s.forgetEncoded(op.Key)
+		s.publish(watch.Put, op.Key, op.Value, op.Revision)
+		s.touch(op.Key)
+	}
+	s.writeStats.cacheWrites.Add(uint64(len(ops)))
+
+	s.writeStats.acked.Add(uint64(len(ops)))
+	return 0, nil
+}
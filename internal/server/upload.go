@@ -0,0 +1,341 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"kv-server/internal/database"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultUploadTimeout is how long an upload may sit without a part
+	// before it is abandoned.
+	DefaultUploadTimeout = time.Hour
+
+	// DefaultMaxUploadBytes bounds the value an upload may assemble.
+	DefaultMaxUploadBytes = 256 << 20
+
+	// maxUploads bounds open uploads, each of which holds its parts in
+	// memory.
+	maxUploads = 16
+)
+
+// upload is a value being assembled from parts under an ID until committed,
+// aborted or abandoned.
+type upload struct {
+	ID          string    `json:"id"`
+	Namespace   string    `json:"namespace,omitempty"`
+	Key         string    `json:"key"`
+	ContentType string    `json:"content_type,omitempty"`
+	Size        int64     `json:"size"`
+	ExpiresAt   time.Time `json:"expires_at"`
+
+	// Guards the fields below and the ones above that change
+	mu        sync.Mutex
+	data      []byte
+	sum       hash.Hash
+	ttl       int64
+	timer     *time.Timer
+	finishing bool
+}
+
+type uploadRegistry struct {
+	mu       sync.Mutex
+	timeout  time.Duration
+	maxBytes int64
+	items    map[string]*upload
+}
+
+// SetUploadLimits bounds the size of a value assembled by an upload and how
+// long an upload may go without a part before it is dropped. Zero keeps the
+// default.
+func (s *KVServer) SetUploadLimits(maxBytes int64, timeout time.Duration) {
+	s.uploads.mu.Lock()
+	s.uploads.maxBytes = maxBytes
+	s.uploads.timeout = timeout
+	s.uploads.mu.Unlock()
+}
+
+type uploadRequest struct {
+	Key         string `json:"key"`
+	Namespace   string `json:"namespace"`
+	ContentType string `json:"content_type"`
+	TTLSeconds  int64  `json:"ttl_seconds"`
+}
+
+type commitRequest struct {
+	SHA256 string `json:"sha256"`
+}
+
+// handleUploads serves the multi-part upload API, which assembles values
+// larger than one request body:
+//
+//	POST   /uploads                 begin an upload of a key
+//	PUT    /uploads/{id}?offset=N   append the body, which must start at N
+//	                                if given
+//	GET    /uploads/{id}            report the upload's size so far
+//	POST   /uploads/{id}/commit     verify the SHA-256 and write the key
+//	DELETE /uploads/{id}            abort the upload
+func (s *KVServer) handleUploads(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/uploads"), "/")
+	if rest == "" {
+		if r.Method != http.MethodPost {
+			s.methodNotAllowed(w, "POST")
+			return
+		}
+		s.beginUpload(w, r)
+		return
+	}
+
+	id, sub, _ := strings.Cut(rest, "/")
+	s.uploads.mu.Lock()
+	up := s.uploads.items[id]
+	s.uploads.mu.Unlock()
+	if up == nil || !inScope(scopeOf(r), up.Namespace) {
+		s.sendError(w, "upload not found", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case sub == "" && r.Method == http.MethodPut:
+		s.appendUpload(w, r, up)
+	case sub == "" && r.Method == http.MethodGet:
+		up.mu.Lock()
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(up)
+		up.mu.Unlock()
+	case sub == "" && r.Method == http.MethodDelete:
+		s.dropUpload(up)
+		s.sendSuccess(w, "", http.StatusOK)
+	case sub == "commit" && r.Method == http.MethodPost:
+		s.commitUpload(w, r, up)
+	case sub == "":
+		s.methodNotAllowed(w, "DELETE, GET, PUT")
+	case sub == "commit":
+		s.methodNotAllowed(w, "POST")
+	default:
+		s.sendError(w, "not found", http.StatusNotFound)
+	}
+}
+
+func (s *KVServer) beginUpload(w http.ResponseWriter, r *http.Request) {
+	body, ok := s.readBody(w, r)
+	if !ok {
+		return
+	}
+	var req uploadRequest
+	if reqErr := decodeJSON(body, &req); reqErr != nil {
+		s.sendRequestError(w, reqErr)
+		return
+	}
+	if req.Key == "" {
+		s.sendError(w, "key is required", http.StatusBadRequest)
+		return
+	}
+	if scope := scopeOf(r); req.Namespace == "" {
+		req.Namespace = scope
+	} else if !inScope(scope, req.Namespace) {
+		s.sendError(w, errForbiddenScope, http.StatusForbidden)
+		return
+	}
+	if !s.checkNamespace(w, req.Namespace) {
+		return
+	}
+	if req.ContentType != "" && !isRawType(req.ContentType) {
+		s.sendError(w, "content_type must be a non-JSON media type", http.StatusBadRequest)
+		return
+	}
+	if _, ok := (Request{TTLSeconds: req.TTLSeconds}).expiry(); !ok {
+		s.sendError(w, errInvalidTTL, http.StatusBadRequest)
+		return
+	}
+
+	var id [8]byte
+	rand.Read(id[:])
+	up := &upload{
+		ID:          hex.EncodeToString(id[:]),
+		Namespace:   req.Namespace,
+		Key:         req.Key,
+		ContentType: req.ContentType,
+		sum:         sha256.New(),
+		ttl:         req.TTLSeconds,
+	}
+
+	s.uploads.mu.Lock()
+	if len(s.uploads.items) >= maxUploads {
+		s.uploads.mu.Unlock()
+		s.sendError(w, "too many open uploads", http.StatusTooManyRequests)
+		return
+	}
+	if s.uploads.items == nil {
+		s.uploads.items = make(map[string]*upload)
+	}
+	timeout := s.uploadTimeout()
+	up.ExpiresAt = time.Now().Add(timeout)
+	up.timer = time.AfterFunc(timeout, func() { s.dropUpload(up) })
+	s.uploads.items[up.ID] = up
+	s.uploads.mu.Unlock()
+
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(up)
+}
+
+// appendUpload adds the request body to the upload. A part retried after a
+// lost reply carries the same ?offset= and gets 409 with the current size,
+// so the client can tell it already landed.
+func (s *KVServer) appendUpload(w http.ResponseWriter, r *http.Request, up *upload) {
+	offset := int64(-1)
+	if v := r.URL.Query().Get("offset"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			s.sendError(w, "offset must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		offset = n
+	}
+	part, ok := s.readBody(w, r)
+	if !ok {
+		return
+	}
+
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	switch {
+	case up.finishing:
+		s.sendError(w, "upload not found", http.StatusNotFound)
+		return
+	case offset >= 0 && offset != up.Size:
+		s.sendError(w, fmt.Sprintf("offset %d does not match upload size %d", offset, up.Size), http.StatusConflict)
+		return
+	case up.Size+int64(len(part)) > s.uploadMaxBytes():
+		s.sendError(w, fmt.Sprintf("upload larger than %d bytes", s.uploadMaxBytes()), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	up.data = append(up.data, part...)
+	up.sum.Write(part)
+	up.Size += int64(len(part))
+	timeout := s.uploadTimeout()
+	up.ExpiresAt = time.Now().Add(timeout)
+	up.timer.Reset(timeout)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(up)
+}
+
+// commitUpload writes the assembled value if its SHA-256 matches the one
+// the client computed. A mismatch leaves the upload open so the client can
+// abort it or inspect its size.
+func (s *KVServer) commitUpload(w http.ResponseWriter, r *http.Request, up *upload) {
+	body, ok := s.readBody(w, r)
+	if !ok {
+		return
+	}
+	var req commitRequest
+	if reqErr := decodeJSON(body, &req); reqErr != nil {
+		s.sendRequestError(w, reqErr)
+		return
+	}
+	want, err := hex.DecodeString(req.SHA256)
+	if err != nil || len(want) != sha256.Size {
+		s.sendError(w, "sha256 must be 64 hex digits", http.StatusBadRequest)
+		return
+	}
+	if !s.admit(w, classWrite) || !s.checkWritable(w) {
+		return
+	}
+	key := database.QualifyKey(up.Namespace, up.Key)
+	if !s.checkQuarantine(w, key) {
+		return
+	}
+
+	up.mu.Lock()
+	if up.finishing {
+		up.mu.Unlock()
+		s.sendError(w, "upload not found", http.StatusNotFound)
+		return
+	}
+	if got := up.sum.Sum(nil); !bytes.Equal(got, want) {
+		up.mu.Unlock()
+		s.sendError(w, "checksum mismatch: upload has sha256 "+hex.EncodeToString(got), http.StatusUnprocessableEntity)
+		return
+	}
+	// Appends and a second commit now see the upload as gone
+	up.finishing = true
+	up.timer.Stop()
+	value := string(up.data)
+	up.mu.Unlock()
+	if reqErr := s.schemaError(key, value); reqErr != nil {
+		// The client may still abort the upload
+		up.mu.Lock()
+		up.finishing = false
+		up.timer.Reset(s.uploadTimeout())
+		up.mu.Unlock()
+		s.sendErrorDetail(w, reqErr, http.StatusUnprocessableEntity)
+		return
+	}
+	if status, msg := s.quotaError(requestCtx(w), key, len(value)); status != 0 {
+		up.mu.Lock()
+		up.finishing = false
+		up.timer.Reset(s.uploadTimeout())
+		up.mu.Unlock()
+		s.sendError(w, msg, status)
+		return
+	}
+
+	expiresAt, _ := Request{TTLSeconds: up.ttl}.expiry()
+	s.stats.writes.Add(1)
+	revision, err := s.write(requestCtx(w), key, value, up.ContentType, expiresAt)
+	if err != nil {
+		// Let the client retry the commit
+		up.mu.Lock()
+		up.finishing = false
+		up.timer.Reset(s.uploadTimeout())
+		up.mu.Unlock()
+		s.sendError(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	s.dropUpload(up)
+	s.sendVersioned(w, "", revision, http.StatusOK)
+}
+
+// dropUpload forgets an upload and frees its parts; it is a no-op for an
+// upload already dropped.
+func (s *KVServer) dropUpload(up *upload) {
+	s.uploads.mu.Lock()
+	if s.uploads.items[up.ID] == up {
+		delete(s.uploads.items, up.ID)
+	}
+	s.uploads.mu.Unlock()
+
+	up.mu.Lock()
+	up.finishing = true
+	up.timer.Stop()
+	up.data = nil
+	up.mu.Unlock()
+}
+
+func (s *KVServer) uploadTimeout() time.Duration {
+	if s.uploads.timeout > 0 {
+		return s.uploads.timeout
+	}
+	return DefaultUploadTimeout
+}
+
+func (s *KVServer) uploadMaxBytes() int64 {
+	if s.uploads.maxBytes > 0 {
+		return s.uploads.maxBytes
+	}
+	return DefaultMaxUploadBytes
+}
@@ -0,0 +1,284 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kv-server/internal/database"
+	"kv-server/internal/watch"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// watchHeartbeat is how often an idle stream gets a comment line, so
+// proxies do not time it out.
+const watchHeartbeat = 15 * time.Second
+
+var contentTypeEventStream = []string{"text/event-stream"}
+
+// SetWatchHistory keeps the last events watch events for resuming
+// streams; zero disables resume. It replaces the hub, so call it before
+// serving.
+func (s *KVServer) SetWatchHistory(events int) {
+	s.watch = watch.NewHub(watch.DefaultBuffer, events)
+}
+
+// publish reports a change to watchers. Versions let them order events,
+// which may arrive out of order for concurrent writes to the same key.
+func (s *KVServer) publish(typ watch.EventType, key, value string, version uint64) {
+	ns, key := database.SplitKey(key)
+	s.watch.Publish(watch.Event{Type: typ, Namespace: ns, Key: key, Value: value, Version: version, Time: time.Now()})
+}
+
+// handleWatch serves the watch API. One stream multiplexes any number of
+// key and prefix subscriptions, which can change while it stays open:
+//
+//	GET    /watch?key=k&prefix=p&type=t      open an SSE stream, with
+//	                                         &namespace=n when namespaced
+//	GET    /watch/{stream}                   its queue and lag
+//	GET    /watch/{stream}/subscriptions     list its subscriptions
+//	POST   /watch/{stream}/subscriptions     add {"key": ...} or {"prefix": ...},
+//	                                         optionally with "namespace", "types"
+//	                                         and "where"
+//	DELETE /watch/{stream}/subscriptions/{id} remove a subscription
+func (s *KVServer) handleWatch(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/watch"), "/")
+	if rest == "" {
+		if r.Method != http.MethodGet {
+			s.methodNotAllowed(w, "GET")
+			return
+		}
+		s.serveWatchStream(w, r)
+		return
+	}
+
+	// A tenant key only sees the streams it opened
+	id, sub, _ := strings.Cut(rest, "/")
+	st := s.watch.Stream(id)
+	if st == nil || !inScope(scopeOf(r), st.Owner) {
+		s.sendError(w, "stream not found", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case sub == "" && r.Method == http.MethodGet:
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(st.Stats())
+	case sub == "subscriptions" && r.Method == http.MethodGet:
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(st.Subscriptions())
+	case sub == "subscriptions" && r.Method == http.MethodPost:
+		body, ok := s.readBody(w, r)
+		if !ok {
+			return
+		}
+		var req watch.Subscription
+		if reqErr := decodeJSON(body, &req); reqErr != nil {
+			s.sendRequestError(w, reqErr)
+			return
+		}
+		if err := req.Validate(); err != nil {
+			s.sendError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if scope := scopeOf(r); req.Namespace == "" {
+			req.Namespace = scope
+		} else if !inScope(scope, req.Namespace) {
+			s.sendError(w, errForbiddenScope, http.StatusForbidden)
+			return
+		}
+		if !s.checkNamespace(w, req.Namespace) {
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(st.Subscribe(req))
+	case strings.HasPrefix(sub, "subscriptions/") && r.Method == http.MethodDelete:
+		subID, err := strconv.ParseUint(strings.TrimPrefix(sub, "subscriptions/"), 10, 64)
+		if err != nil || !st.Unsubscribe(subID) {
+			s.sendError(w, "subscription not found", http.StatusNotFound)
+			return
+		}
+		s.sendSuccess(w, "", http.StatusOK)
+	case sub == "":
+		s.methodNotAllowed(w, "GET")
+	case sub == "subscriptions":
+		s.methodNotAllowed(w, "GET, POST")
+	case strings.HasPrefix(sub, "subscriptions/"):
+		s.methodNotAllowed(w, "DELETE")
+	default:
+		s.sendError(w, "not found", http.StatusNotFound)
+	}
+}
+
+type watchDropped struct {
+	Dropped uint64 `json:"dropped"`
+}
+
+type watchHello struct {
+	Stream        string               `json:"stream"`
+	Subscriptions []watch.Subscription `json:"subscriptions"`
+}
+
+// serveWatchStream opens a stream with the ?key= and ?prefix= subscriptions
+// in the ?namespace= namespace, each limited to the ?type= event types if
+// any are given, and sends events
+// as SSE until the client goes away. The first event, "stream", carries the
+// stream ID used to change subscriptions.
+//
+// ?queue= sizes the stream's queue and ?policy= picks what happens when it
+// fills: "disconnect" (the default) closes the stream, "drop" discards
+// events and then sends a "dropped" event with their count.
+//
+// Every event's SSE id is a resume token. A client reconnecting with it in
+// Last-Event-ID (as EventSource does) or ?resume= first gets the events it
+// missed that match the new stream's subscriptions. When those are no longer
+// kept, a "compacted" event follows "stream" and the client must re-read
+// the keys it watches.
+func (s *KVServer) serveWatchStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		s.sendError(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	query := r.URL.Query()
+	var types []watch.EventType
+	for _, t := range query["type"] {
+		types = append(types, watch.EventType(t))
+	}
+	if err := (watch.Subscription{Types: types}).Validate(); err != nil {
+		s.sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts, ok := s.streamOptions(w, r)
+	if !ok {
+		return
+	}
+
+	// A tenant key watches its own namespace
+	ns := query.Get("namespace")
+	if ns == "" {
+		ns = opts.Owner
+	} else if !inScope(opts.Owner, ns) {
+		s.sendError(w, errForbiddenScope, http.StatusForbidden)
+		return
+	}
+	if (query.Has("key") || query.Has("prefix")) && !s.checkNamespace(w, ns) {
+		return
+	}
+
+	var subs []watch.Subscription
+	for _, key := range query["key"] {
+		subs = append(subs, watch.Subscription{Namespace: ns, Key: key, Types: types})
+	}
+	for _, prefix := range query["prefix"] {
+		subs = append(subs, watch.Subscription{Namespace: ns, Prefix: prefix, Types: types})
+	}
+
+	token := r.Header.Get("Last-Event-ID")
+	if resume := query.Get("resume"); resume != "" {
+		token = resume
+	}
+	var st *watch.Stream
+	var err error
+	if token != "" {
+		st, err = s.watch.Resume(token, opts, subs...)
+	} else {
+		st, err = s.watch.Open(opts, subs...)
+	}
+	if errors.Is(err, watch.ErrInvalidToken) {
+		s.sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if st == nil {
+		s.sendError(w, "failed to open stream", http.StatusInternalServerError)
+		return
+	}
+	defer st.Close()
+
+	// Streams outlive the server's write timeout
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	w.Header()["Content-Type"] = contentTypeEventStream
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	writeSSE(w, "stream", st.Start(), watchHello{Stream: st.ID, Subscriptions: st.Subscriptions()})
+	if errors.Is(err, watch.ErrCompacted) {
+		writeSSE(w, "compacted", "", Response{Error: err.Error()})
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(watchHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-st.Done():
+			if err := st.Err(); err != nil {
+				writeSSE(w, "error", "", Response{Error: err.Error()})
+				flusher.Flush()
+			}
+			return
+		case d := <-st.Events():
+			writeSSE(w, string(d.Type), d.Token, d)
+			// Drain what is already queued before flushing
+			for drained := false; !drained; {
+				select {
+				case d = <-st.Events():
+					writeSSE(w, string(d.Type), d.Token, d)
+				default:
+					drained = true
+				}
+			}
+			st.Sent(d)
+			if n := st.TakeDropped(); n > 0 {
+				writeSSE(w, "dropped", "", watchDropped{Dropped: n})
+			}
+			flusher.Flush()
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+// streamOptions reads the ?queue= and ?policy= of a request opening a
+// stream, answering 400 and returning false if they are invalid.
+func (s *KVServer) streamOptions(w http.ResponseWriter, r *http.Request) (watch.StreamOptions, bool) {
+	query := r.URL.Query()
+	opts := watch.StreamOptions{Policy: watch.Policy(query.Get("policy")), Owner: scopeOf(r)}
+	if q := query.Get("queue"); q != "" {
+		n, err := strconv.Atoi(q)
+		if err != nil || n <= 0 {
+			s.sendError(w, "invalid queue size", http.StatusBadRequest)
+			return opts, false
+		}
+		opts.Buffer = n
+	}
+	if err := opts.Validate(); err != nil {
+		s.sendError(w, err.Error(), http.StatusBadRequest)
+		return opts, false
+	}
+	return opts, true
+}
+
+// writeSSE writes one server-sent event with a JSON payload and, unless id
+// is empty, an SSE id.
+func writeSSE(w http.ResponseWriter, event, id string, payload any) {
+	data, _ := json.Marshal(payload)
+	if id != "" {
+		fmt.Fprintf(w, "id: %s\n", id)
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+}
+
+// handleWatchStats serves GET /admin/watch: event counts and the queue of
+// every open stream, most lagging first.
+func (s *KVServer) handleWatchStats(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(s.watch.Stats())
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const errOverloaded = "server busy"
+
+// workerPool bounds the requests processed at once. A request finding
+// every worker busy waits in a bounded queue for one to free up, and is
+// shed with 503 if the queue is full or its wait runs out.
+type workerPool struct {
+	slots   chan struct{}
+	queue   int64
+	maxWait time.Duration
+
+	queued atomic.Int64
+	shed   atomic.Uint64
+}
+
+// SetWorkers processes at most workers requests at once. Up to queue more
+// wait at most maxWait for a worker; the rest get 503 with a Retry-After
+// header. The health probes and watch streams, which would hold a worker
+// for as long as they stay open, are exempt. Zero workers means no bound.
+// Call it before serving.
+func (s *KVServer) SetWorkers(workers, queue int, maxWait time.Duration) {
+	if workers <= 0 {
+		s.workers = nil
+		return
+	}
+	s.workers = &workerPool{
+		slots:   make(chan struct{}, workers),
+		queue:   int64(queue),
+		maxWait: maxWait,
+	}
+}
+
+// acquire takes a worker, waiting in the queue if there is room, and
+// reports false if the request is to be shed.
+func (p *workerPool) acquire() bool {
+	select {
+	case p.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	if p.queued.Add(1) > p.queue || p.maxWait <= 0 {
+		p.queued.Add(-1)
+		p.shed.Add(1)
+		return false
+	}
+	defer p.queued.Add(-1)
+
+	timer := time.NewTimer(p.maxWait)
+	defer timer.Stop()
+	select {
+	case p.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		p.shed.Add(1)
+		return false
+	}
+}
+
+func (p *workerPool) release() {
+	<-p.slots
+}
+
+// workerExempt reports whether a request to path skips the worker pool.
+func workerExempt(path string) bool {
+	return authExempt(path) || path == "/watch" || strings.HasPrefix(path, "/watch/") || path == "/ws"
+}
+
+// acquireWorker answers 503 for a request shed by the worker pool and
+// returns false; otherwise the request has a worker, which the caller
+// gives back with s.workers.release.
+func (s *KVServer) acquireWorker(w http.ResponseWriter) bool {
+	if s.workers.acquire() {
+		return true
+	}
+	w.Header()["Retry-After"] = retryAfterOne
+	s.sendError(w, errOverloaded, http.StatusServiceUnavailable)
+	return false
+}
+
+// retryAfterOne is a one-second Retry-After, assigned directly to avoid
+// allocating.
+var retryAfterOne = []string{"1"}
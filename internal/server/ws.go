@@ -0,0 +1,374 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"kv-server/internal/watch"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// wsGUID is appended to the client's key to answer the WebSocket handshake
+// (RFC 6455).
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// wsWriteTimeout bounds the write of one frame, so a client that stops
+// reading does not hold its connection open for ever.
+const wsWriteTimeout = 10 * time.Second
+
+// WebSocket opcodes
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// WebSocket close codes
+const (
+	wsCloseProtocol    = 1002
+	wsCloseUnsupported = 1003
+	wsClosePolicy      = 1008
+	wsCloseTooBig      = 1009
+)
+
+var (
+	errWSProtocol = errors.New("malformed frame")
+	errWSTooBig   = errors.New("message too big")
+)
+
+// wsCommand is a message from a WebSocket client: "subscribe", with the
+// fields of a watch subscription, or "unsubscribe" with the subscription's
+// id. Ref, if set, is echoed in the reply so the client can match them up.
+type wsCommand struct {
+	Op  string          `json:"op"`
+	Ref json.RawMessage `json:"ref,omitempty"`
+	watch.Subscription
+}
+
+// wsMessage is a message to a WebSocket client. Type is "stream" first,
+// then "subscribed", "unsubscribed" or "error" in reply to a command, and
+// "event" or "dropped" as changes arrive.
+type wsMessage struct {
+	Type         string              `json:"type"`
+	Ref          json.RawMessage     `json:"ref,omitempty"`
+	Stream       string              `json:"stream,omitempty"`
+	Subscription *watch.Subscription `json:"subscription,omitempty"`
+	ID           uint64              `json:"id,omitempty"`
+	Event        *watch.Delivery     `json:"event,omitempty"`
+	Dropped      uint64              `json:"dropped,omitempty"`
+	Error        string              `json:"error,omitempty"`
+}
+
+// handleWebSocket serves GET /ws, a watch stream over a WebSocket for
+// browsers, which can then change what they watch on the connection they
+// watch on. The stream starts with no subscriptions; the client sends JSON
+// text messages
+//
+//	{"op": "subscribe", "prefix": "orders/", "types": ["put"], "ref": 1}
+//	{"op": "unsubscribe", "id": 3}
+//
+// taking the fields of POST /watch/{stream}/subscriptions, and gets a JSON
+// reply to each besides a "stream" message first and an "event" message
+// per change. ?queue= and ?policy= work as for /watch; a stream closed for
+// falling behind gets an "error" message and close code 1008.
+//
+// The server pings every watchHeartbeat and drops a client it has heard
+// nothing from, not even a pong, for two of them.
+func (s *KVServer) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	if !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") {
+		w.Header().Set("Upgrade", "websocket")
+		s.sendError(w, "websocket upgrade required", http.StatusUpgradeRequired)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		s.sendError(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if nonce, err := base64.StdEncoding.DecodeString(key); err != nil || len(nonce) != 16 {
+		s.sendError(w, "invalid Sec-WebSocket-Key", http.StatusBadRequest)
+		return
+	}
+	opts, ok := s.streamOptions(w, r)
+	if !ok {
+		return
+	}
+
+	st, _ := s.watch.Open(opts)
+	if st == nil {
+		s.sendError(w, "failed to open stream", http.StatusInternalServerError)
+		return
+	}
+	defer st.Close()
+
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		s.sendError(w, "websocket not supported", http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+	if sw, ok := w.(*statusWriter); ok {
+		sw.status = http.StatusSwitchingProtocols
+	}
+	// The server's timeouts were meant for the request, not the connection
+	conn.SetDeadline(time.Time{})
+
+	accept := sha1.Sum([]byte(key + wsGUID))
+	brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " +
+		base64.StdEncoding.EncodeToString(accept[:]) + "\r\n\r\n")
+	ws := &wsConn{conn: conn, bw: brw.Writer}
+	if ws.send(wsMessage{Type: "stream", Stream: st.ID}) != nil {
+		return
+	}
+
+	// Commands are read and answered on their own goroutine; the
+	// connection is closed, ending it, when this one returns
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		s.readWebSocket(ws, brw.Reader, st, scopeOf(r))
+	}()
+
+	ping := time.NewTicker(watchHeartbeat)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-readDone:
+			return
+		case <-st.Done():
+			if err := st.Err(); err != nil {
+				ws.send(wsMessage{Type: "error", Error: err.Error()})
+				ws.close(wsClosePolicy, "stream closed")
+			}
+			return
+		case d := <-st.Events():
+			if ws.send(wsMessage{Type: "event", Event: &d}) != nil {
+				return
+			}
+			st.Sent(d)
+			if n := st.TakeDropped(); n > 0 {
+				ws.send(wsMessage{Type: "dropped", Dropped: n})
+			}
+		case <-ping.C:
+			if ws.writeFrame(wsPing, nil) != nil {
+				return
+			}
+		}
+	}
+}
+
+// readWebSocket reads the client's messages and answers its commands on
+// st until the client closes the connection, breaks the protocol or goes
+// quiet.
+func (s *KVServer) readWebSocket(ws *wsConn, br *bufio.Reader, st *watch.Stream, scope string) {
+	var message []byte
+	fragmented := false
+	for {
+		ws.conn.SetReadDeadline(time.Now().Add(2 * watchHeartbeat))
+		fin, op, payload, err := readWSFrame(br, s.maxBody)
+		switch {
+		case errors.Is(err, errWSTooBig):
+			ws.close(wsCloseTooBig, err.Error())
+			return
+		case errors.Is(err, errWSProtocol):
+			ws.close(wsCloseProtocol, err.Error())
+			return
+		case err != nil:
+			return
+		}
+
+		switch op {
+		case wsPing:
+			ws.writeFrame(wsPong, payload)
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			// Echo the client's code, then hang up
+			ws.writeFrame(wsClose, payload[:min(len(payload), 2)])
+			return
+		case wsText:
+			if fragmented {
+				ws.close(wsCloseProtocol, "expected a continuation frame")
+				return
+			}
+			message = payload
+		case wsContinuation:
+			if !fragmented {
+				ws.close(wsCloseProtocol, "unexpected continuation frame")
+				return
+			}
+			if int64(len(message)+len(payload)) > s.maxBody {
+				ws.close(wsCloseTooBig, errWSTooBig.Error())
+				return
+			}
+			message = append(message, payload...)
+		case wsBinary:
+			ws.close(wsCloseUnsupported, "messages must be JSON text")
+			return
+		default:
+			ws.close(wsCloseProtocol, "unknown opcode")
+			return
+		}
+		if fragmented = !fin; fragmented {
+			continue
+		}
+		ws.send(s.wsReply(st, scope, message))
+	}
+}
+
+// wsReply carries out a client's command on st, as a key scoped to scope
+// may, and returns the reply.
+func (s *KVServer) wsReply(st *watch.Stream, scope string, message []byte) wsMessage {
+	var cmd wsCommand
+	if reqErr := decodeJSON(message, &cmd); reqErr != nil {
+		return wsMessage{Type: "error", Error: reqErr.msg}
+	}
+	reply := wsMessage{Type: "error", Ref: cmd.Ref}
+	switch cmd.Op {
+	case "subscribe":
+		sub := cmd.Subscription
+		if err := sub.Validate(); err != nil {
+			reply.Error = err.Error()
+			return reply
+		}
+		if sub.Namespace == "" {
+			sub.Namespace = scope
+		} else if !inScope(scope, sub.Namespace) {
+			reply.Error = errForbiddenScope
+			return reply
+		}
+		if !s.addressable(sub.Namespace) {
+			reply.Error = errInvalidNamespace
+			return reply
+		}
+		sub = st.Subscribe(sub)
+		reply.Type, reply.Subscription = "subscribed", &sub
+	case "unsubscribe":
+		if !st.Unsubscribe(cmd.ID) {
+			reply.Error = "subscription not found"
+			return reply
+		}
+		reply.Type, reply.ID = "unsubscribed", cmd.ID
+	default:
+		reply.Error = "op must be subscribe or unsubscribe"
+	}
+	return reply
+}
+
+// wsConn is the server's end of a WebSocket. Both the event loop and the
+// command reader write to it, so frames are written whole under mu.
+type wsConn struct {
+	conn net.Conn
+	mu   sync.Mutex
+	bw   *bufio.Writer
+}
+
+func (c *wsConn) send(msg wsMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return c.writeFrame(wsText, data)
+}
+
+// close sends a close frame; the caller then closes the connection.
+func (c *wsConn) close(code uint16, reason string) {
+	c.writeFrame(wsClose, append(binary.BigEndian.AppendUint16(nil, code), reason...))
+}
+
+// writeFrame writes one unfragmented, unmasked frame, as servers send them.
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+
+	c.bw.WriteByte(0x80 | op)
+	switch n := len(payload); {
+	case n < 126:
+		c.bw.WriteByte(byte(n))
+	case n <= 0xffff:
+		c.bw.WriteByte(126)
+		c.bw.Write(binary.BigEndian.AppendUint16(nil, uint16(n)))
+	default:
+		c.bw.WriteByte(127)
+		c.bw.Write(binary.BigEndian.AppendUint64(nil, uint64(n)))
+	}
+	c.bw.Write(payload)
+	return c.bw.Flush()
+}
+
+// readWSFrame reads one frame from a client and unmasks its payload.
+// Client frames must be masked, and carry at most limit bytes.
+func readWSFrame(br *bufio.Reader, limit int64) (fin bool, op byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(br, head[:]); err != nil {
+		return
+	}
+	fin, op = head[0]&0x80 != 0, head[0]&0x0f
+	if head[0]&0x70 != 0 || head[1]&0x80 == 0 {
+		// Reserved bits are for extensions, which are never negotiated
+		return fin, op, nil, errWSProtocol
+	}
+
+	n := uint64(head[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(br, ext[:]); err != nil {
+			return
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(br, ext[:]); err != nil {
+			return
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if op >= wsClose && (!fin || n > 125) {
+		return fin, op, nil, errWSProtocol
+	}
+	if n > uint64(limit) {
+		return fin, op, nil, errWSTooBig
+	}
+
+	var mask [4]byte
+	if _, err = io.ReadFull(br, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, n)
+	if _, err = io.ReadFull(br, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, op, payload, nil
+}
+
+// headerHasToken reports whether the comma-separated values of header name
+// include token, ignoring case.
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h[name] {
+		for _, part := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,166 @@
+package watch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Op is a predicate comparison.
+type Op string
+
+const (
+	Eq     Op = "eq"
+	Ne     Op = "ne"
+	Gt     Op = "gt"
+	Gte    Op = "gte"
+	Lt     Op = "lt"
+	Lte    Op = "lte"
+	Exists Op = "exists"
+)
+
+// Predicate tests one field of a JSON value. Path is a dot-separated list
+// of object keys; an empty path is the whole value. Gt, Gte, Lt and Lte
+// compare numbers with numbers and strings with strings, and are false for
+// anything else.
+type Predicate struct {
+	Path  string `json:"path"`
+	Op    Op     `json:"op"`
+	Value any    `json:"value,omitempty"`
+}
+
+func (p Predicate) validate() error {
+	switch p.Op {
+	case Eq, Ne, Gt, Gte, Lt, Lte:
+		if p.Value == nil {
+			return fmt.Errorf("predicate %q needs a value", p.Op)
+		}
+	case Exists:
+	default:
+		return fmt.Errorf("unknown predicate op %q", p.Op)
+	}
+	return nil
+}
+
+func (p Predicate) matches(doc any) bool {
+	field, ok := lookupPath(doc, p.Path)
+	if p.Op == Exists {
+		return ok
+	}
+	if !ok {
+		return p.Op == Ne
+	}
+	switch p.Op {
+	case Eq:
+		return reflect.DeepEqual(field, p.Value)
+	case Ne:
+		return !reflect.DeepEqual(field, p.Value)
+	}
+
+	c, ok := compare(field, p.Value)
+	if !ok {
+		return false
+	}
+	switch p.Op {
+	case Gt:
+		return c > 0
+	case Gte:
+		return c >= 0
+	case Lt:
+		return c < 0
+	default:
+		return c <= 0
+	}
+}
+
+func lookupPath(doc any, path string) (any, bool) {
+	if path == "" {
+		return doc, true
+	}
+	for _, name := range strings.Split(path, ".") {
+		obj, ok := doc.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if doc, ok = obj[name]; !ok {
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+func compare(a, b any) (int, bool) {
+	switch a := a.(type) {
+	case float64:
+		b, ok := b.(float64)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case a < b:
+			return -1, true
+		case a > b:
+			return 1, true
+		}
+		return 0, true
+	case string:
+		b, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(a, b), true
+	}
+	return 0, false
+}
+
+// Validate reports whether sub is well formed.
+func (sub Subscription) Validate() error {
+	if sub.Key != "" && sub.Prefix != "" {
+		return errors.New("key and prefix are mutually exclusive")
+	}
+	for _, t := range sub.Types {
+		switch t {
+		case Put, Delete, Expire, Evict:
+		default:
+			return fmt.Errorf("unknown event type %q", t)
+		}
+	}
+	for _, p := range sub.Where {
+		if err := p.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// candidate is an event being matched against subscriptions. The value is
+// decoded, and the token encoded, at most once per publish however many
+// streams it goes to.
+type candidate struct {
+	Event
+	seq uint64
+	hub *Hub
+
+	decoded bool
+	doc     any
+	valid   bool
+
+	tok string
+}
+
+func (c *candidate) token() string {
+	if c.tok == "" {
+		c.tok = c.hub.token(c.seq)
+	}
+	return c.tok
+}
+
+func (c *candidate) document() (any, bool) {
+	if !c.decoded {
+		c.decoded = true
+		c.valid = json.Unmarshal([]byte(c.Value), &c.doc) == nil
+	}
+	return c.doc, c.valid
+}
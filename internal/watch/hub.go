@@ -0,0 +1,483 @@
+// Package watch fans key change events out to watch streams. A stream is
+// one client connection carrying any number of subscriptions, each matching
+// a key or a key prefix, which can be added and removed while it is open.
+package watch
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultBuffer is how many undelivered events a stream may queue.
+	DefaultBuffer = 1024
+	// DefaultHistory is how many recent events a hub keeps for resuming.
+	DefaultHistory = 10000
+)
+
+// ErrSlowConsumer closes a stream whose queue filled up, so a client that
+// cannot keep up never blocks writers.
+var ErrSlowConsumer = errors.New("stream fell behind and was closed")
+
+// ErrCompacted is returned by Resume when events after the token are no
+// longer kept, or would not fit the stream's queue. The stream is still
+// opened, live from now on; the client must re-read the keys it watches.
+var ErrCompacted = errors.New("resume token too old; resync required")
+
+// ErrInvalidToken is returned by Resume for a malformed token.
+var ErrInvalidToken = errors.New("invalid resume token")
+
+// EventType is the kind of change an event reports.
+type EventType string
+
+const (
+	Put    EventType = "put"
+	Delete EventType = "delete"
+	// Expire is a delete by the expiry sweeper
+	Expire EventType = "expire"
+	// Evict is a delete by the trimming of an evicting namespace
+	Evict EventType = "evict"
+)
+
+// Event is one change to a key in a namespace, "" for the default one.
+type Event struct {
+	Type      EventType `json:"type"`
+	Namespace string    `json:"namespace,omitempty"`
+	Key       string    `json:"key"`
+	Value     string    `json:"value,omitempty"`
+	Version   uint64    `json:"version,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// Delivery is an event as sent on a stream, with the IDs of the stream's
+// subscriptions it matched. Token resumes a later stream after this event.
+type Delivery struct {
+	Event
+	Subscriptions []uint64 `json:"subscriptions"`
+	Token         string   `json:"-"`
+}
+
+// Subscription matches one key, or every key under a prefix, in its
+// namespace. An empty prefix subscribes to all keys of the namespace. Types,
+// if set, limits it to those event
+// types. Where, if set, limits put events to values that parse as JSON and
+// satisfy every predicate; delete and expire events carry no value and are
+// filtered by type only.
+type Subscription struct {
+	ID        uint64      `json:"id"`
+	Namespace string      `json:"namespace,omitempty"`
+	Key       string      `json:"key,omitempty"`
+	Prefix    string      `json:"prefix,omitempty"`
+	Types     []EventType `json:"types,omitempty"`
+	Where     []Predicate `json:"where,omitempty"`
+}
+
+func (sub Subscription) matches(c *candidate) bool {
+	if c.Namespace != sub.Namespace {
+		return false
+	}
+	if sub.Key != "" {
+		if c.Key != sub.Key {
+			return false
+		}
+	} else if !strings.HasPrefix(c.Key, sub.Prefix) {
+		return false
+	}
+
+	if len(sub.Types) > 0 && !slices.Contains(sub.Types, c.Type) {
+		return false
+	}
+	if len(sub.Where) == 0 || c.Type != Put {
+		return true
+	}
+	doc, ok := c.document()
+	if !ok {
+		return false
+	}
+	for _, p := range sub.Where {
+		if !p.matches(doc) {
+			return false
+		}
+	}
+	return true
+}
+
+// Hub routes published events to the open streams. It numbers events in
+// publish order and keeps the most recent ones, so a client that reconnects
+// with the token of the last event it saw gets the ones it missed.
+type Hub struct {
+	buffer int
+
+	// epoch tells tokens of this hub from those of a previous process,
+	// whose events are gone
+	epoch string
+
+	// keep is the size of the history ring, fixed at construction so it
+	// can be read without the lock
+	keep int
+
+	// open mirrors len(streams), letting Publish skip the lock when no one
+	// is watching and nothing is kept
+	open atomic.Int64
+
+	dropped      atomic.Uint64
+	disconnected atomic.Uint64
+
+	mu      sync.RWMutex
+	streams map[string]*Stream
+	seq     uint64
+
+	// history is a ring of the last len(history) events; next is the slot
+	// the next event goes in
+	history []recorded
+	next    int
+}
+
+// recorded is a kept event and its sequence number.
+type recorded struct {
+	seq uint64
+	ev  Event
+}
+
+// NewHub returns a hub whose streams queue up to buffer events and which
+// keeps the last history events for resuming. Zero history disables resume.
+func NewHub(buffer, history int) *Hub {
+	if buffer <= 0 {
+		buffer = DefaultBuffer
+	}
+	b := make([]byte, 4)
+	rand.Read(b)
+	h := &Hub{buffer: buffer, epoch: hex.EncodeToString(b), streams: make(map[string]*Stream)}
+	if history > 0 {
+		h.keep = history
+		h.history = make([]recorded, 0, history)
+	}
+	return h
+}
+
+// Open starts a stream with the given subscriptions.
+func (h *Hub) Open(opts StreamOptions, subs ...Subscription) (*Stream, error) {
+	st, err := h.newStream(opts, subs)
+	if err != nil {
+		return nil, err
+	}
+	h.mu.Lock()
+	h.register(st)
+	h.mu.Unlock()
+	return st, nil
+}
+
+// Resume is Open for a client that saw events up to token: the events
+// published since that match subs are queued on the stream first. If they
+// cannot all be replayed it returns the live stream with ErrCompacted.
+func (h *Hub) Resume(token string, opts StreamOptions, subs ...Subscription) (*Stream, error) {
+	epoch, seq, err := parseToken(token)
+	if err != nil {
+		return nil, err
+	}
+	st, err := h.newStream(opts, subs)
+	if err != nil {
+		return nil, err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	err = h.replay(st, epoch, seq)
+	h.register(st)
+	if err == nil {
+		// Until the replay is read, the stream is still at token
+		st.start = token
+	}
+	return st, err
+}
+
+// replay queues the kept events after seq on st. The caller holds h.mu, so
+// no event is published between the replay and st going live.
+func (h *Hub) replay(st *Stream, epoch string, seq uint64) error {
+	oldest := h.seq - uint64(len(h.history)) + 1
+	if epoch != h.epoch || seq > h.seq || seq+1 < oldest {
+		return ErrCompacted
+	}
+	n := len(h.history)
+	for i := 0; i < n; i++ {
+		rec := h.history[(h.next+i)%n]
+		if rec.seq <= seq {
+			continue
+		}
+		if !st.enqueue(&candidate{Event: rec.ev, seq: rec.seq, hub: h}) {
+			// Drop the partial replay rather than leave a gap
+			for len(st.events) > 0 {
+				<-st.events
+			}
+			st.delivered = 0
+			return ErrCompacted
+		}
+	}
+	return nil
+}
+
+func (h *Hub) newStream(opts StreamOptions, subs []Subscription) (*Stream, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	if opts.Buffer == 0 {
+		opts.Buffer = h.buffer
+	}
+	if opts.Policy == "" {
+		opts.Policy = Disconnect
+	}
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	st := &Stream{
+		ID:     hex.EncodeToString(b),
+		Owner:  opts.Owner,
+		hub:    h,
+		policy: opts.Policy,
+		subs:   make(map[uint64]Subscription),
+		events: make(chan Delivery, opts.Buffer),
+		done:   make(chan struct{}),
+	}
+	for _, sub := range subs {
+		st.Subscribe(sub)
+	}
+	return st, nil
+}
+
+// register makes st live. The caller holds h.mu.
+func (h *Hub) register(st *Stream) {
+	st.start = h.token(h.seq)
+	h.streams[st.ID] = st
+	h.open.Add(1)
+}
+
+// token encodes a position in the hub's event sequence.
+func (h *Hub) token(seq uint64) string {
+	return h.epoch + "-" + strconv.FormatUint(seq, 10)
+}
+
+func parseToken(token string) (string, uint64, error) {
+	epoch, seq, ok := strings.Cut(token, "-")
+	if !ok || epoch == "" {
+		return "", 0, ErrInvalidToken
+	}
+	n, err := strconv.ParseUint(seq, 10, 64)
+	if err != nil {
+		return "", 0, ErrInvalidToken
+	}
+	return epoch, n, nil
+}
+
+// remember keeps ev in the ring. The caller holds h.mu.
+func (h *Hub) remember(seq uint64, ev Event) {
+	rec := recorded{seq: seq, ev: ev}
+	if len(h.history) < cap(h.history) {
+		h.history = append(h.history, rec)
+		return
+	}
+	h.history[h.next] = rec
+	h.next = (h.next + 1) % len(h.history)
+}
+
+// Stream returns the open stream with the given ID, or nil.
+func (h *Hub) Stream(id string) *Stream {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.streams[id]
+}
+
+// Resumable reports whether the hub keeps events for resuming streams.
+func (h *Hub) Resumable() bool {
+	return h.keep > 0
+}
+
+// Streams returns the number of open streams.
+func (h *Hub) Streams() int {
+	return int(h.open.Load())
+}
+
+// Publish delivers ev to every stream with a matching subscription and
+// keeps it for resuming. It never blocks: a stream whose queue is full
+// drops the event or is closed, as its policy says, without affecting the
+// others.
+func (h *Hub) Publish(ev Event) {
+	if h.open.Load() == 0 && h.keep == 0 {
+		return
+	}
+
+	// Publishers are serialized, so sequence numbers follow delivery order
+	var overflowed []*Stream
+	h.mu.Lock()
+	h.seq++
+	c := &candidate{Event: ev, seq: h.seq, hub: h}
+	if h.keep > 0 {
+		h.remember(c.seq, ev)
+	}
+	for _, st := range h.streams {
+		if !st.deliver(c) {
+			overflowed = append(overflowed, st)
+		}
+	}
+	h.mu.Unlock()
+
+	for _, st := range overflowed {
+		st.close(ErrSlowConsumer)
+		h.disconnected.Add(1)
+	}
+}
+
+// Stream is one watch connection and its subscriptions.
+type Stream struct {
+	ID    string
+	Owner string
+
+	hub    *Hub
+	policy Policy
+	events chan Delivery
+	done   chan struct{}
+	start  string
+
+	mu     sync.Mutex
+	subs   map[uint64]Subscription
+	nextID uint64
+	closed bool
+	err    error
+
+	delivered uint64
+	dropped   uint64
+	reported  uint64
+	lastSent  time.Time
+}
+
+// Subscribe adds sub to the stream and returns it with its assigned ID.
+func (st *Stream) Subscribe(sub Subscription) Subscription {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.nextID++
+	sub.ID = st.nextID
+	st.subs[sub.ID] = sub
+	return sub
+}
+
+// Unsubscribe removes a subscription, reporting whether it existed.
+func (st *Stream) Unsubscribe(id uint64) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if _, ok := st.subs[id]; !ok {
+		return false
+	}
+	delete(st.subs, id)
+	return true
+}
+
+// Subscriptions returns the stream's subscriptions in ID order.
+func (st *Stream) Subscriptions() []Subscription {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	subs := make([]Subscription, 0, len(st.subs))
+	for _, sub := range st.subs {
+		subs = append(subs, sub)
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].ID < subs[j].ID })
+	return subs
+}
+
+// Start returns the token of the position the stream went live at, which
+// resumes a later stream from there if no event has been seen yet.
+func (st *Stream) Start() string {
+	return st.start
+}
+
+// Events returns the channel events are delivered on.
+func (st *Stream) Events() <-chan Delivery {
+	return st.events
+}
+
+// Done is closed once the stream is closed.
+func (st *Stream) Done() <-chan struct{} {
+	return st.done
+}
+
+// Err reports why the hub closed the stream, or nil.
+func (st *Stream) Err() error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.err
+}
+
+// Close removes the stream from its hub.
+func (st *Stream) Close() {
+	st.close(nil)
+}
+
+// deliver queues c if it matches a subscription, reporting false if the
+// queue was full and the stream must be disconnected.
+func (st *Stream) deliver(c *candidate) bool {
+	if st.enqueue(c) {
+		return true
+	}
+	if st.policy != Drop {
+		return false
+	}
+	st.mu.Lock()
+	st.dropped++
+	st.mu.Unlock()
+	st.hub.dropped.Add(1)
+	return true
+}
+
+// enqueue queues c if it matches a subscription, reporting false if the
+// queue was full.
+func (st *Stream) enqueue(c *candidate) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.closed {
+		return true
+	}
+
+	var ids []uint64
+	for id, sub := range st.subs {
+		if sub.matches(c) {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return true
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	select {
+	case st.events <- Delivery{Event: c.Event, Subscriptions: ids, Token: c.token()}:
+		st.delivered++
+		return true
+	default:
+		return false
+	}
+}
+
+func (st *Stream) close(err error) {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return
+	}
+	st.closed = true
+	st.err = err
+	close(st.done)
+	st.mu.Unlock()
+
+	st.hub.mu.Lock()
+	delete(st.hub.streams, st.ID)
+	st.hub.mu.Unlock()
+	st.hub.open.Add(-1)
+}
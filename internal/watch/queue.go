@@ -0,0 +1,128 @@
+package watch
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// MaxBuffer bounds the queue a stream may ask for.
+const MaxBuffer = 65536
+
+// Policy is what happens to a stream whose queue is full when an event
+// arrives.
+type Policy string
+
+const (
+	// Disconnect closes the stream with ErrSlowConsumer; the client can
+	// reconnect and resume.
+	Disconnect Policy = "disconnect"
+	// Drop discards the event for that stream alone and counts it, keeping
+	// the stream open.
+	Drop Policy = "drop"
+)
+
+// StreamOptions sizes a stream's queue and sets its overflow policy. Zero
+// values take the hub's buffer and Disconnect. Owner is opaque to the hub;
+// it tells callers who opened the stream.
+type StreamOptions struct {
+	Buffer int
+	Policy Policy
+	Owner  string
+}
+
+// Validate reports whether o is usable.
+func (o StreamOptions) Validate() error {
+	switch o.Policy {
+	case "", Disconnect, Drop:
+	default:
+		return fmt.Errorf("unknown queue policy %q", o.Policy)
+	}
+	if o.Buffer < 0 || o.Buffer > MaxBuffer {
+		return fmt.Errorf("queue size must be between 1 and %d", MaxBuffer)
+	}
+	return nil
+}
+
+// StreamStats reports how far a stream's consumer is behind. Queued is the
+// lag in events; LagSeconds is how old the last event the client was sent
+// is, while more are queued behind it.
+type StreamStats struct {
+	ID            string  `json:"id"`
+	Subscriptions int     `json:"subscriptions"`
+	Policy        Policy  `json:"policy"`
+	Capacity      int     `json:"capacity"`
+	Queued        int     `json:"queued"`
+	Delivered     uint64  `json:"delivered"`
+	Dropped       uint64  `json:"dropped"`
+	LagSeconds    float64 `json:"lag_seconds"`
+}
+
+// HubStats sums up a hub and its streams, most lagging first.
+type HubStats struct {
+	Published    uint64        `json:"published"`
+	Dropped      uint64        `json:"dropped"`
+	Disconnected uint64        `json:"disconnected"`
+	Streams      []StreamStats `json:"streams"`
+}
+
+// Stats reports on the hub and every open stream.
+func (h *Hub) Stats() HubStats {
+	h.mu.RLock()
+	streams := make([]*Stream, 0, len(h.streams))
+	for _, st := range h.streams {
+		streams = append(streams, st)
+	}
+	published := h.seq
+	h.mu.RUnlock()
+
+	stats := HubStats{
+		Published:    published,
+		Dropped:      h.dropped.Load(),
+		Disconnected: h.disconnected.Load(),
+		Streams:      make([]StreamStats, 0, len(streams)),
+	}
+	for _, st := range streams {
+		stats.Streams = append(stats.Streams, st.Stats())
+	}
+	sort.Slice(stats.Streams, func(i, j int) bool {
+		return stats.Streams[i].Queued > stats.Streams[j].Queued
+	})
+	return stats
+}
+
+// Stats reports on the stream's queue.
+func (st *Stream) Stats() StreamStats {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	stats := StreamStats{
+		ID:            st.ID,
+		Subscriptions: len(st.subs),
+		Policy:        st.policy,
+		Capacity:      cap(st.events),
+		Queued:        len(st.events),
+		Delivered:     st.delivered,
+		Dropped:       st.dropped,
+	}
+	if stats.Queued > 0 && !st.lastSent.IsZero() {
+		stats.LagSeconds = time.Since(st.lastSent).Seconds()
+	}
+	return stats
+}
+
+// Sent records that d was written to the client, for lag reporting.
+func (st *Stream) Sent(d Delivery) {
+	st.mu.Lock()
+	st.lastSent = d.Time
+	st.mu.Unlock()
+}
+
+// TakeDropped returns how many events the Drop policy discarded since the
+// last call.
+func (st *Stream) TakeDropped() uint64 {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	n := st.dropped - st.reported
+	st.reported = st.dropped
+	return n
+}